@@ -0,0 +1,626 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EMAIL_MAX_LENGTH      = 254
+	ACCOUNT_TOKEN_BYTES   = 32
+	RESET_TOKEN_LIFETIME  = time.Hour
+	RESET_TOKEN_RETENTION = 24 * time.Hour   // Used and expired tokens are purged after this
+	VERIFY_TOKEN_LIFETIME = 72 * time.Hour   // Saving the email again on the manage page sends a new link
+	DELETE_REAUTH_WINDOW  = 10 * time.Minute // Time a password-less account has to delete itself after signing in
+)
+
+// Returns the address if email is a plain address, without a display name
+func parseEmail(email string) (string, error) {
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email || len(email) > EMAIL_MAX_LENGTH {
+		return "", &InvalidInput{}
+	}
+	return address.Address, nil
+}
+
+// Generates the secret of a password reset or email verification link, only its hash is stored
+func newAccountToken() (string, error) {
+	secret := make([]byte, ACCOUNT_TOKEN_BYTES)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+func hashAccountToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// Changes the password of the session's user after checking the current one, the user's other sessions are signed out
+func (api *API) changePassword(session *Session, current string, password string) error {
+	if !session.signedIn || !session.hasScope(SCOPE_ACCOUNT) {
+		Info.Printf("Rejecting password change with SID(%v)\n", session.sid)
+		return &Unauthorized{}
+	}
+	if password == "" {
+		return &InvalidInput{}
+	}
+
+	var stored []byte
+	err := api.QueryRow("passwordHash_from_userId", []any{session.userId}, &stored)
+	if err == sql.ErrNoRows {
+		return &NoSuchUser{}
+	} else if err != nil {
+		Error.Println("Failed to get stored password hash", err)
+		return err
+	}
+
+	// Accounts created through single sign-on have no password to check, they set one with a reset
+	if ok, _ := verifyPassword(current, stored); !ok {
+		Info.Printf("Rejecting password change of UserID(%d), wrong current password\n", session.userId)
+		return &Unauthorized{}
+	}
+
+	err = api.setPassword(session.userId, password)
+	if err != nil {
+		return err
+	}
+
+	api.sessions.DestroyUser(session.userId, session.sid)
+	Info.Printf("UserID(%d) changed their password\n", session.userId)
+	return nil
+}
+
+// Stores the hash of the new password and drops the pending reset tokens of the user
+func (api *API) setPassword(userId int, password string) error {
+	password_hash, err := hashPassword(password)
+	if err != nil {
+		Error.Println("Failed to hash password", err)
+		return err
+	}
+
+	_, err = api.ExecRow("update_password_hash", password_hash, userId)
+	if err != nil {
+		return err
+	}
+
+	_, err = api.ExecRow("delete_password_resets_of_user", userId)
+	return err
+}
+
+// Sets the address password reset links are sent to and mails it a verification link, an empty email removes it.
+// Setting the current unverified email again sends a new link
+func (api *API) setEmail(session *Session, email string) error {
+	if !session.signedIn || !session.hasScope(SCOPE_ACCOUNT) {
+		Info.Printf("Rejecting email change with SID(%v)\n", session.sid)
+		return &Unauthorized{}
+	}
+
+	var address sql.NullString
+	if email != "" {
+		parsed, err := parseEmail(email)
+		if err != nil {
+			return err
+		}
+		address = sql.NullString{String: parsed, Valid: true}
+	}
+
+	var current sql.NullString
+	var verified bool
+	err := api.QueryRow("email_from_userId", []any{session.userId}, &current, &verified)
+	if err == sql.ErrNoRows {
+		return &NoSuchUser{}
+	} else if err != nil {
+		Error.Println("Failed to get email", err)
+		return err
+	}
+
+	if address != current {
+		_, err = api.ExecRow("update_email", address, session.userId)
+		if isDuplicateKey(err) {
+			Info.Printf("Rejecting email of UserID(%d), used by another account\n", session.userId)
+			return &Conflict{}
+		} else if err != nil {
+			Error.Println("Failed to change email", err)
+			return err
+		}
+		verified = false
+	}
+
+	if !address.Valid {
+		_, err = api.ExecRow("delete_email_verification", session.userId)
+		return err
+	}
+	if verified {
+		return nil
+	}
+	return api.sendVerification(session.userId, address.String)
+}
+
+// Mails a link verifying email to the user, which replaces the link sent before
+func (api *API) sendVerification(userId int, email string) error {
+	token, err := newAccountToken()
+	if err != nil {
+		Error.Println("Failed to generate verification token", err)
+		return err
+	}
+
+	_, err = api.ExecRow("add_to_email_verifications", userId, email, hashAccountToken(token), int(VERIFY_TOKEN_LIFETIME.Seconds()))
+	if err != nil {
+		Error.Println("Failed to save verification token", err)
+		return err
+	}
+
+	api.sendMail(Mail{
+		To:      email,
+		Subject: "Verify your shr.me email",
+		Body: fmt.Sprintf("Confirm this is the email of your shr.me account at %v/verify?token=%v\n\n"+
+			"The link works within %v. If you didn't sign up, you can ignore this email.\n",
+			api.config.Mail.BaseURL, token, VERIFY_TOKEN_LIFETIME),
+	})
+	Info.Printf("Sent a verification link to UserID(%d)\n", userId)
+	return nil
+}
+
+// Marks the email a verification link was sent to as verified, which lifts the limits of new accounts.
+// The link stops working once the user changes their email
+func (api *API) verifyEmail(token string) error {
+	if token == "" {
+		return &InvalidInput{}
+	}
+
+	var userId int
+	err := api.Transaction(func(tx *sql.Tx) error {
+		txApi := api.InTransaction(tx)
+
+		var email string
+		err := txApi.QueryRow("email_verification_from_hash", []any{hashAccountToken(token)}, &userId, &email)
+		if err == sql.ErrNoRows {
+			return &Unauthorized{}
+		} else if err != nil {
+			Error.Println("Failed to get email verification", err)
+			return err
+		}
+
+		verified, err := txApi.ExecRow("verify_email", userId, email)
+		if err != nil {
+			return err
+		}
+		if verified == 0 {
+			return &Unauthorized{} // Sent to a previous email
+		}
+
+		_, err = txApi.ExecRow("delete_email_verification", userId)
+		return err
+	})
+	if err != nil {
+		if _, invalid := err.(*Unauthorized); invalid {
+			Info.Println("Rejecting invalid or expired email verification token")
+		}
+		return err
+	}
+
+	Info.Printf("UserID(%d) verified their email\n", userId)
+	return nil
+}
+
+// Returns EmailNotVerified while the session's user hasn't verified the email they signed up with.
+// Accounts from before sign-up required an email, and single sign-on ones, aren't limited, nor is anyone without an SMTP server
+func (api *API) requireVerifiedEmail(session *Session) error {
+	if api.config.Mail.SMTPAddress == "" {
+		return nil
+	}
+
+	var pending bool
+	err := api.QueryRow("verify_by_from_userId", []any{session.userId}, &pending)
+	if err == sql.ErrNoRows {
+		return &NoSuchUser{}
+	} else if err != nil {
+		Error.Println("Failed to get email verification status", err)
+		return err
+	}
+
+	if pending {
+		Info.Printf("Rejecting action of UserID(%d) with an unverified email\n", session.userId)
+		return &EmailNotVerified{}
+	}
+	return nil
+}
+
+// Statements deleting what belongs to a user, in the order they run. Workspace links stay in their workspace,
+// detach_links_of_user clears their creator so the workspace's editors keep managing them
+var userDeleteStatements = []string{
+	"delete_personal_links_of_user",
+	"detach_links_of_user",
+	"delete_memberships_of_user",
+	"delete_access_tokens_of_user",
+	"delete_webhook_deliveries_of_user",
+	"delete_webhooks_of_user",
+	"delete_identities_of_user",
+	"delete_totp_of_user",
+	"delete_recovery_codes_of_user",
+	"delete_login_failures_of_user",
+	"purge_password_resets_of_user",
+	"delete_email_verification",
+	"delete_from_users_data",
+	"delete_from_users_auth",
+}
+
+// Deletes a user and their personal links in one transaction, then signs out their sessions.
+// The personal links are moved to the workspace instead when workspaceId isn't 0. Refused with InvalidInput
+// while the user is the only owner of a workspace, nobody could manage it afterwards
+func (api *API) deleteUser(userId int, workspaceId int) error {
+	var shortUrls []string
+	err := api.Transaction(func(tx *sql.Tx) error {
+		txApi := api.InTransaction(tx)
+
+		soleOwned, err := txApi.soleOwnedWorkspaces(userId)
+		if err != nil {
+			return err
+		}
+		if len(soleOwned) > 0 {
+			Info.Printf("Rejecting deletion of userID(%d), only owner of %d workspaces\n", userId, len(soleOwned))
+			return &InvalidInput{Reason: "Make someone else owner of these workspaces first: " + strings.Join(soleOwned, ", ")}
+		}
+
+		if workspaceId != 0 {
+			handed, err := txApi.ExecRow("hand_links_to_workspace", workspaceId, userId)
+			if err != nil {
+				return err
+			}
+			Info.Printf("Handing %d links of userID(%d) to workspace %d\n", handed, userId, workspaceId)
+		}
+
+		rows, err := txApi.Query("links_from_userId", userId)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var shortUrl, longUrl string
+			err = rows.Scan(&shortUrl, &longUrl)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			shortUrls = append(shortUrls, shortUrl)
+		}
+		rows.Close()
+
+		_, err = txApi.ExecRow("delete_link_transfers_from_userId", userId, userId)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range userDeleteStatements {
+			_, err = txApi.ExecRow(name, userId)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if _, refused := err.(*InvalidInput); refused {
+		return err
+	} else if err != nil {
+		Error.Printf("Failed to delete userID(%d), %v\n", userId, err)
+		return err
+	}
+
+	for _, shortUrl := range shortUrls {
+		api.cache.Invalidate(shortUrl)
+	}
+	if api.sessions != nil {
+		api.sessions.DestroyUser(userId, "")
+	}
+	Info.Printf("Deleted userID(%d) and %d links\n", userId, len(shortUrls))
+	return nil
+}
+
+// Returns the names of the workspaces userId is the only owner of
+func (api *API) soleOwnedWorkspaces(userId int) ([]string, error) {
+	rows, err := api.Query("sole_owned_workspaces_of_userId", userId)
+	if err != nil {
+		Error.Println("Failed to get the workspaces owned by a user", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// Deletes the account of the session's user after checking their password, and their two-factor code if it's on.
+// Accounts created through single sign-on have no password, they must have signed in within DELETE_REAUTH_WINDOW.
+// Their personal links are deleted, or moved to a workspace they can edit when workspaceId isn't 0
+func (api *API) deleteAccount(session *Session, password string, code string, workspaceId int) error {
+	if !session.signedIn || !session.hasScope(SCOPE_ACCOUNT) {
+		Info.Printf("Rejecting account deletion with SID(%v)\n", session.sid)
+		return &Unauthorized{}
+	}
+
+	var stored []byte
+	err := api.QueryRow("passwordHash_from_userId", []any{session.userId}, &stored)
+	if err != nil {
+		Error.Println("Failed to get stored password hash", err)
+		return err
+	}
+	if stored == nil {
+		if time.Since(session.signedInAt) > DELETE_REAUTH_WINDOW {
+			Info.Printf("Rejecting account deletion of UserID(%d), no recent sign-in\n", session.userId)
+			return &Unauthorized{}
+		}
+	} else if ok, _ := verifyPassword(password, stored); !ok {
+		Info.Printf("Rejecting account deletion of UserID(%d), wrong password\n", session.userId)
+		return &Unauthorized{}
+	}
+
+	twoFactor, err := api.twoFactorEnabled(session.userId)
+	if err != nil {
+		return err
+	}
+	if twoFactor {
+		ok, err := api.checkTwoFactorCode(session.userId, code)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			Info.Printf("Rejecting account deletion of UserID(%d), wrong code\n", session.userId)
+			return &Unauthorized{}
+		}
+	}
+
+	if workspaceId != 0 {
+		role, err := api.workspaceRole(session, workspaceId)
+		if err != nil {
+			return err
+		}
+		if !role.CanEdit() {
+			return &Unauthorized{}
+		}
+	}
+
+	userId := session.userId
+	err = api.deleteUser(userId, workspaceId)
+	if err != nil {
+		return err
+	}
+	session.signedIn = false
+	session.userId = 0
+	Info.Printf("UserID(%d) deleted their account\n", userId)
+	return nil
+}
+
+// Deletes the accounts which didn't verify their email in time, returns how many were deleted
+func (api *API) purgeUnverifiedUsers() (int, error) {
+	rows, err := api.Query("unverified_userIds")
+	if err != nil {
+		return 0, err
+	}
+
+	var userIds []int
+	for rows.Next() {
+		var userId int
+		err = rows.Scan(&userId)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		userIds = append(userIds, userId)
+	}
+	rows.Close()
+
+	deleted := 0
+	for _, userId := range userIds {
+		if api.deleteUser(userId, 0) == nil {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// Mails a password reset link to the user named username if they have a verified email.
+// It succeeds whether or not the user exists so it can't be used to find usernames
+func (api *API) requestPasswordReset(username string) error {
+	var userId int
+	var email sql.NullString
+	err := api.QueryRow("email_from_username", []any{username}, &userId, &email)
+	if err == sql.ErrNoRows || (err == nil && !email.Valid) {
+		Info.Printf("Ignoring password reset of %v, unknown user or no verified email\n", username)
+		return nil
+	} else if err != nil {
+		Error.Println("Failed to get email", err)
+		return err
+	}
+
+	token, err := newAccountToken()
+	if err != nil {
+		Error.Println("Failed to generate reset token", err)
+		return err
+	}
+
+	// Only the latest link works
+	_, err = api.ExecRow("delete_password_resets_of_user", userId)
+	if err != nil {
+		return err
+	}
+	_, err = api.ExecRow("add_to_password_resets", userId, hashAccountToken(token), int(RESET_TOKEN_LIFETIME.Seconds()))
+	if err != nil {
+		return err
+	}
+
+	api.sendMail(Mail{
+		To:      email.String,
+		Subject: "Reset your shr.me password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your shr.me account %v.\n\n"+
+			"Choose a new password at %v/reset?token=%v\n\n"+
+			"The link works once within %v. If you didn't ask for it, you can ignore this email.\n",
+			username, api.config.Mail.BaseURL, token, RESET_TOKEN_LIFETIME),
+	})
+	Info.Printf("Sent a password reset link to UserID(%d)\n", userId)
+	return nil
+}
+
+// Sets a new password with a reset token, which can only be used once. Every session of the user is signed out
+func (api *API) resetPassword(token string, password string) error {
+	if token == "" || password == "" {
+		return &InvalidInput{}
+	}
+
+	var userId int
+	err := api.Transaction(func(tx *sql.Tx) error {
+		txApi := api.InTransaction(tx)
+
+		var resetId int
+		err := txApi.QueryRow("password_reset_from_hash", []any{hashAccountToken(token)}, &resetId, &userId)
+		if err == sql.ErrNoRows {
+			return &Unauthorized{}
+		} else if err != nil {
+			Error.Println("Failed to get password reset", err)
+			return err
+		}
+
+		used, err := txApi.ExecRow("use_password_reset", resetId)
+		if err != nil {
+			return err
+		}
+		if used == 0 {
+			return &Unauthorized{} // Used by a concurrent request
+		}
+
+		return txApi.setPassword(userId, password)
+	})
+	if err != nil {
+		if _, invalid := err.(*Unauthorized); invalid {
+			Info.Println("Rejecting invalid, used or expired password reset token")
+		}
+		return err
+	}
+
+	api.sessions.DestroyUser(userId, "")
+	Info.Printf("UserID(%d) reset their password\n", userId)
+	return nil
+}
+
+func (api *API) handlePasswordChange(w http.ResponseWriter, r *http.Request, session *Session) {
+	err := r.ParseForm()
+	if err != nil {
+		Warning.Println("Failed to parse form", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = api.changePassword(session, r.PostForm.Get("current"), r.PostForm.Get("password"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (api *API) handleAccountDelete(w http.ResponseWriter, r *http.Request, session *Session) {
+	err := r.ParseForm()
+	if err != nil {
+		Warning.Println("Failed to parse form", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Empty or 0 deletes the personal links
+	workspaceId := 0
+	if workspace := r.PostForm.Get("workspace"); workspace != "" {
+		workspaceId, err = strconv.Atoi(workspace)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = api.deleteAccount(session, r.PostForm.Get("password"), r.PostForm.Get("code"), workspaceId)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (api *API) handleEmail(w http.ResponseWriter, r *http.Request, session *Session) {
+	err := r.ParseForm()
+	if err != nil {
+		Warning.Println("Failed to parse form", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = api.setEmail(session, r.PostForm.Get("email"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (api *API) handlePasswordResetRequest(w http.ResponseWriter, r *http.Request, session *Session) {
+	err := r.ParseForm()
+	if err != nil {
+		Warning.Println("Failed to parse form", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = api.requestPasswordReset(r.PostForm.Get("username"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (api *API) handlePasswordReset(w http.ResponseWriter, r *http.Request, session *Session) {
+	err := r.ParseForm()
+	if err != nil {
+		Warning.Println("Failed to parse form", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = api.resetPassword(r.PostForm.Get("token"), r.PostForm.Get("password"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (api *API) handleEmailVerify(w http.ResponseWriter, r *http.Request, session *Session) {
+	err := r.ParseForm()
+	if err != nil {
+		Warning.Println("Failed to parse form", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = api.verifyEmail(r.PostForm.Get("token"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var mailedToken = regexp.MustCompile(`\?token=([A-Za-z0-9_-]+)`)
+
+// Waits for the background sends to keep the count mails, and returns the last one
+func waitForMail(t *testing.T, mailer *MemoryMailer, count int) Mail {
+	deadline := time.Now().Add(time.Second)
+	for {
+		sent := mailer.Sent()
+		if len(sent) >= count {
+			return sent[count-1]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Got %d mails, want %d", len(sent), count)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Answers the lookup of the stored token hash with the row if it is the hash of the mailed token
+func onTokenHash(db *fakeDB, fragment string, mailed *string, row ...driver.Value) {
+	db.on(fragment, func(args []driver.Value) (fakeResult, error) {
+		if hash, ok := args[0].([]byte); ok && bytes.Equal(hash, hashAccountToken(*mailed)) {
+			return fakeResult{rows: [][]driver.Value{row}}, nil
+		}
+		return fakeResult{}, nil
+	})
+}
+
+func TestPasswordResetMail(t *testing.T) {
+	db, config := newFakeDB(t)
+	api := newTestAPI(t, config)
+	api.sessions = NewManager(http.NotFoundHandler(), "session_id", time.Hour, time.Minute)
+	mailer := api.mailer.(*MemoryMailer)
+
+	db.onRow("select userID, email from users_auth where username = ?", int64(7), "alice@example.com")
+	var mailed string
+	onTokenHash(db, "from password_resets where token_hash = ?", &mailed, int64(3), int64(7))
+	db.on("update password_resets set used = now()", func(args []driver.Value) (fakeResult, error) {
+		return fakeResult{affected: 1}, nil
+	})
+
+	err := api.requestPasswordReset("alice")
+	if err != nil {
+		t.Fatal("Reset request failed", err)
+	}
+
+	mail := waitForMail(t, mailer, 1)
+	if mail.To != "alice@example.com" || !bytes.Contains([]byte(mail.Body), []byte(config.Mail.BaseURL+"/reset?token=")) {
+		t.Fatalf("Unexpected reset mail %+v", mail)
+	}
+	match := mailedToken.FindStringSubmatch(mail.Body)
+	if match == nil {
+		t.Fatalf("No token in the reset mail %q", mail.Body)
+	}
+
+	mailed = match[1]
+	if _, unauthorized := api.resetPassword("not the mailed one", "new password").(*Unauthorized); !unauthorized {
+		t.Error("Reset accepted a token which wasn't mailed")
+	}
+
+	err = api.resetPassword(mailed, "new password")
+	if err != nil {
+		t.Fatal("Reset with the mailed token failed", err)
+	}
+	updates := db.executed("update users_auth set password_hash = ?")
+	if len(updates) != 1 || updates[0][1] != int64(7) {
+		t.Errorf("Reset didn't set the password of userID(7): %v", updates)
+	}
+}
+
+func TestEmailVerificationMail(t *testing.T) {
+	db, config := newFakeDB(t)
+	api := newTestAPI(t, config)
+	mailer := api.mailer.(*MemoryMailer)
+
+	db.onRow("select email, email_verified is not null from users_auth where userID = ?", nil, int64(0))
+	var mailed string
+	onTokenHash(db, "from email_verifications where token_hash = ?", &mailed, int64(7), "alice@example.com")
+	db.on("update users_auth set email_verified = now()", func(args []driver.Value) (fakeResult, error) {
+		return fakeResult{affected: 1}, nil
+	})
+
+	session := &Session{sid: "verify-test", userId: 7, signedIn: true, expiry: time.Now().Add(time.Hour)}
+	err := api.setEmail(session, "alice@example.com")
+	if err != nil {
+		t.Fatal("Setting the email failed", err)
+	}
+
+	mail := waitForMail(t, mailer, 1)
+	if mail.To != "alice@example.com" || !bytes.Contains([]byte(mail.Body), []byte(config.Mail.BaseURL+"/verify?token=")) {
+		t.Fatalf("Unexpected verification mail %+v", mail)
+	}
+	match := mailedToken.FindStringSubmatch(mail.Body)
+	if match == nil {
+		t.Fatalf("No token in the verification mail %q", mail.Body)
+	}
+	stored := db.executed("replace into email_verifications")
+	if len(stored) != 1 || !bytes.Equal(stored[0][2].([]byte), hashAccountToken(match[1])) {
+		t.Errorf("The stored hash isn't the one of the mailed token: %v", stored)
+	}
+
+	mailed = match[1]
+	err = api.verifyEmail(mailed)
+	if err != nil {
+		t.Fatal("Verification with the mailed token failed", err)
+	}
+	verified := db.executed("update users_auth set email_verified = now()")
+	if len(verified) != 1 || verified[0][0] != int64(7) || verified[0][1] != "alice@example.com" {
+		t.Errorf("Verification didn't mark the email of userID(7): %v", verified)
+	}
+}
+
+func TestDeleteAccountWithoutPassword(t *testing.T) {
+	db, config := newFakeDB(t)
+	api := newTestAPI(t, config)
+	api.sessions = NewManager(http.NotFoundHandler(), "session_id", time.Hour, time.Minute)
+	db.onRow("select password_hash from users_auth where userID = ?", nil) // Created through single sign-on
+
+	session := &Session{sid: "delete-test", userId: 7, signedIn: true, expiry: time.Now().Add(time.Hour)}
+	session.signedInAt = time.Now().Add(-DELETE_REAUTH_WINDOW - time.Minute)
+	if _, unauthorized := api.deleteAccount(session, "", "", 0).(*Unauthorized); !unauthorized {
+		t.Fatal("Account without a password deleted long after signing in")
+	}
+	if deleted := db.executed("delete from users_auth where userID = ?"); len(deleted) != 0 {
+		t.Fatalf("Refused deletion deleted the user: %v", deleted)
+	}
+
+	session.signedInAt = time.Now()
+	err := api.deleteAccount(session, "", "", 0)
+	if err != nil {
+		t.Fatal("Account without a password not deleted right after signing in", err)
+	}
+	if deleted := db.executed("delete from users_auth where userID = ?"); len(deleted) != 1 || deleted[0][0] != int64(7) {
+		t.Errorf("userID(7) wasn't deleted: %v", deleted)
+	}
+	if session.signedIn {
+		t.Error("Session still signed in after deleting its account")
+	}
+}
+
+func TestDeleteAccountOfWorkspaceOwner(t *testing.T) {
+	db, config := newFakeDB(t)
+	api := newTestAPI(t, config)
+	api.sessions = NewManager(http.NotFoundHandler(), "session_id", time.Hour, time.Minute)
+	db.onRow("select password_hash from users_auth where userID = ?", nil)
+	db.onRow("from workspaces w join workspace_members m", "Marketing")
+	db.onRow("select role from workspace_members where workspaceID = ? and userID = ?", "editor")
+
+	session := &Session{sid: "delete-test", userId: 7, signedIn: true, expiry: time.Now().Add(time.Hour), signedInAt: time.Now()}
+	err := api.deleteAccount(session, "", "", 3)
+	if invalid, ok := err.(*InvalidInput); !ok || !strings.Contains(invalid.Error(), "Marketing") {
+		t.Fatalf("Deletion of the only owner of a workspace returned %v, want InvalidInput naming it", err)
+	}
+	if deleted := db.executed("delete from users_auth where userID = ?"); len(deleted) != 0 || !session.signedIn {
+		t.Fatalf("Only owner of a workspace deleted: %v", deleted)
+	}
+
+	// Another member was made owner in the meantime
+	db.on("from workspaces w join workspace_members m", func(args []driver.Value) (fakeResult, error) {
+		return fakeResult{}, nil
+	})
+	err = api.deleteAccount(session, "", "", 3)
+	if err != nil {
+		t.Fatal("Deletion handing the links to a workspace failed", err)
+	}
+
+	handed := db.executed("update links set workspaceID = ? where userID = ?")
+	if len(handed) != 1 || handed[0][0] != int64(3) || handed[0][1] != int64(7) {
+		t.Errorf("Personal links of userID(7) weren't handed to workspace 3: %v", handed)
+	}
+	if detached := db.executed("update links set userID = null where userID = ?"); len(detached) != 1 || detached[0][0] != int64(7) {
+		t.Errorf("Workspace links of userID(7) weren't detached from their creator: %v", detached)
+	}
+
+	var order []string
+	for _, query := range db.queries() {
+		for _, statement := range []string{"update links set workspaceID", "delete from links where userID", "update links set userID = null", "delete from users_auth"} {
+			if strings.HasPrefix(query, statement) {
+				order = append(order, statement)
+			}
+		}
+	}
+	if strings.Join(order, ", ") != "update links set workspaceID, delete from links where userID, update links set userID = null, delete from users_auth" {
+		t.Errorf("Links handed to the workspace after the personal ones were deleted: %v", order)
+	}
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
-	"bytes"
+	"crypto/rand"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
 )
 
 var (
@@ -18,9 +24,15 @@ var (
 )
 
 const (
-	HASH_LENGTH         = 8
 	SHORT_URL_LENGTH    = 6
 	LONG_URL_MAX_LENGTH = 1024
+
+	SHORT_URL_ALPHABET         = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	SHORT_URL_GENERATE_RETRIES = 5
+	LINK_PURGE_DELAY           = 10 * time.Minute
+	WORKSPACE_NAME_MAX_LENGTH  = 100
+
+	MYSQL_DUPLICATE_ENTRY = 1062
 )
 
 func init() {
@@ -32,14 +44,29 @@ func init() {
 type API struct {
 	db       *sql.DB
 	sqlStmts map[string]*sql.Stmt
+	config   *Config
+	cache    *RedirectCache // nil when caching is disabled
+
+	anonIPLimiter      *Limiter // Anonymous link creation quotas
+	anonSessionLimiter *Limiter
+	clicks             *ClickCounter
+	oidc               *OIDCProvider // nil when OpenID Connect is disabled
+	webhookClient      *http.Client  // nil when webhooks are disabled
+	tx                 *sql.Tx       // Set on the copies returned by InTransaction
+	txStmts            map[string]*sql.Stmt
+	trustedProxies     []*net.IPNet // Reverse proxies allowed to set X-Forwarded-For
+	clickHub           *ClickHub    // Live click streams
+	sessions           *Manager     // Set once the session manager wrapping the API is created
+	mailer             Mailer
 }
 
-func InitAPI(sqlDriverName string, dataSourceName string) (*API, error) {
+func InitAPI(config *Config) (*API, error) {
+	sqlDriverName := config.SqlDriver
 	if sqlDriverName == "" {
 		sqlDriverName = "mysql"
 	}
 
-	db, err := sql.Open(sqlDriverName, dataSourceName)
+	db, err := sql.Open(sqlDriverName, config.DataSource)
 	if err != nil {
 		Error.Println("Failed to create connection to SQL database", err)
 		return nil, err
@@ -52,25 +79,171 @@ func InitAPI(sqlDriverName string, dataSourceName string) (*API, error) {
 	}
 
 	sqlStmtsStr := map[string]string{
-		"passwordHash_from_username": "select password_hash from users_auth where username = ?",
-		"username_from_userId":       "select username from users_auth where userID = ?",
-		"userId_from_username":       "select userID from users_auth where username = ?",
-		"userData_from_userId":       "select * from users_data where userID = ?",
-		"insert_into_users_auth":     "insert into users_auth(username, password_hash) values(?, ?)",
-		"insert_into_users_data":     "insert into users_data values(?, ?, ?, ?)",
-		"longUrl_from_shortUrl":      "select longURL from links where shortURL = ?",
-		"shortUrl_exists":            "select 1 from links where shortURL = ?",
-		"username_exists":            "select 1 from users_auth where username = ?",
-		"userId_from_shortUrl":       "select userID from links where shortURL = ?",
-		"add_to_links":               "insert into links values(?, ?, ?)",
-		"links_from_userId":          "select shortURL, longURL from links where userID = ?",
-		"delete_from_links":          "delete from links where shortURL = ? and userID = ?",
+		"auth_from_username":                "select userID, password_hash from users_auth where username = ?",
+		"username_from_userId":              "select username from users_auth where userID = ?",
+		"userId_from_username":              "select userID from users_auth where username = ?",
+		"userData_from_userId":              "select * from users_data where userID = ?",
+		"insert_into_users_auth":            "insert into users_auth(username, password_hash) values(?, ?)",
+		"update_password_hash":              "update users_auth set password_hash = ? where userID = ?",
+		"passwordHash_from_userId":          "select password_hash from users_auth where userID = ?",
+		"insert_into_users_auth_with_email": "insert into users_auth(username, password_hash, email, verify_by) values(?, ?, ?, date_add(now(), interval ? second))",
+		"email_from_username":               "select userID, email from users_auth where username = ? and email_verified is not null",
+		"email_from_userId":                 "select email, email_verified is not null from users_auth where userID = ?",
+		"email_exists":                      "select 1 from users_auth where email = ?",
+		"update_email":                      "update users_auth set email = ?, email_verified = null where userID = ?",
+		"verify_by_from_userId":             "select verify_by is not null from users_auth where userID = ?",
+		"add_to_email_verifications":        "replace into email_verifications(userID, email, token_hash, expires) values(?, ?, ?, date_add(now(), interval ? second))",
+		"email_verification_from_hash":      "select userID, email from email_verifications where token_hash = ? and expires > now()",
+		"verify_email":                      "update users_auth set email_verified = now(), verify_by = null where userID = ? and email = ?",
+		"delete_email_verification":         "delete from email_verifications where userID = ?",
+		"delete_expired_verifications":      "delete from email_verifications where expires < now()",
+		"unverified_userIds":                "select userID from users_auth where verify_by < now()",
+		"delete_personal_links_of_user":     "delete from links where userID = ? and workspaceID is null",
+		"detach_links_of_user":              "update links set userID = null where userID = ?",
+		"sole_owned_workspaces_of_userId":   "select w.name from workspaces w join workspace_members m on m.workspaceID = w.workspaceID where m.userID = ? and m.role = 'owner' and (select count(*) from workspace_members o where o.workspaceID = w.workspaceID and o.role = 'owner') = 1 order by w.name for update",
+		"delete_memberships_of_user":        "delete from workspace_members where userID = ?",
+		"delete_access_tokens_of_user":      "delete from access_tokens where userID = ?",
+		"delete_webhook_deliveries_of_user": "delete d from webhook_deliveries d join webhooks w on w.webhookID = d.webhookID where w.userID = ?",
+		"delete_webhooks_of_user":           "delete from webhooks where userID = ?",
+		"delete_identities_of_user":         "delete from user_identities where userID = ?",
+		"purge_password_resets_of_user":     "delete from password_resets where userID = ?",
+		"totp_from_userId":                  "select secret, enabled is not null, last_step from user_totp where userID = ?",
+		"add_to_user_totp":                  "insert into user_totp(userID, secret) values(?, ?) on duplicate key update secret = if(enabled is null, values(secret), secret)",
+		"enable_totp":                       "update user_totp set enabled = now(), last_step = ? where userID = ? and enabled is null",
+		"use_totp_step":                     "update user_totp set last_step = ? where userID = ? and enabled is not null and last_step < ?",
+		"delete_totp_of_user":               "delete from user_totp where userID = ?",
+		"add_to_recovery_codes":             "insert into totp_recovery_codes(userID, code_hash) values(?, ?)",
+		"use_recovery_code":                 "update totp_recovery_codes set used = now() where userID = ? and code_hash = ? and used is null",
+		"unused_recovery_codes_count":       "select count(*) from totp_recovery_codes where userID = ? and used is null",
+		"delete_recovery_codes_of_user":     "delete from totp_recovery_codes where userID = ?",
+		"login_throttle_from_key":           "select failures, timestampdiff(second, last_failure, now()), greatest(coalesce(timestampdiff(second, now(), locked_until), 0), 0) from login_throttles where throttle_key = ? and (last_failure > date_sub(now(), interval ? second) or locked_until > now())",
+		"add_to_login_throttles":            "insert into login_throttles(throttle_key, failures, last_failure) values(?, 1, now()) on duplicate key update failures = if(last_failure > date_sub(now(), interval ? second), failures + 1, 1), last_failure = now()",
+		"add_empty_login_throttle":          "insert into login_throttles(throttle_key, failures, last_failure) values(?, 0, now()) on duplicate key update throttle_key = throttle_key",
+		"login_throttle_for_update":         "select failures, timestampdiff(second, last_failure, now()), greatest(coalesce(timestampdiff(second, now(), locked_until), 0), 0) from login_throttles where throttle_key = ? and (last_failure > date_sub(now(), interval ? second) or locked_until > now()) for update",
+		"release_login_throttle":            "update login_throttles set failures = greatest(failures - 1, 0) where throttle_key = ?",
+		"lock_login_throttle":               "update login_throttles set locked_until = date_add(now(), interval ? second) where throttle_key = ? and failures >= ? and (locked_until is null or locked_until < now())",
+		"delete_login_throttle":             "delete from login_throttles where throttle_key = ?",
+		"delete_old_login_throttles":        "delete from login_throttles where last_failure < date_sub(now(), interval ? second) and (locked_until is null or locked_until < now())",
+		"add_to_login_failures":             "insert into login_failures(userID, ip) values(?, ?)",
+		"login_failures_of_user":            "select ip, created from login_failures where userID = ? order by failureID desc limit ?",
+		"delete_login_failures_of_user":     "delete from login_failures where userID = ?",
+		"export_login_failures_of_user":     "select ip, created from login_failures where userID = ? order by failureID",
+		"export_links_of_user":              "select shortURL, longURL, workspaceID, expires, created, clicks from links where userID = ? order by created, shortURL",
+		"hand_links_to_workspace":           "update links set workspaceID = ? where userID = ? and workspaceID is null",
+		"delete_old_login_failures":         "delete from login_failures where created < date_sub(now(), interval ? second)",
+		"delete_from_users_data":            "delete from users_data where userID = ?",
+		"delete_from_users_auth":            "delete from users_auth where userID = ?",
+		"add_to_password_resets":            "insert into password_resets(userID, token_hash, expires) values(?, ?, date_add(now(), interval ? second))",
+		"password_reset_from_hash":          "select resetID, userID from password_resets where token_hash = ? and used is null and expires > now()",
+		"use_password_reset":                "update password_resets set used = now() where resetID = ? and used is null",
+		"delete_password_resets_of_user":    "delete from password_resets where userID = ? and used is null",
+		"delete_old_password_resets":        "delete from password_resets where expires < date_sub(now(), interval ? second)",
+		"insert_into_users_data":            "insert into users_data values(?, ?, ?, ?)",
+		"longUrl_from_shortUrl":             "select longURL, timestampdiff(second, now(), expires) from links where shortURL = ? and (expires is null or expires > now())",
+		"shortUrl_exists":                   "select 1 from links where shortURL = ?",
+		"username_exists":                   "select 1 from users_auth where username = ?",
+		"owner_from_shortUrl":               "select userID, workspaceID from links where shortURL = ?",
+		"add_to_links":                      "insert into links(userID, shortURL, longURL) values(?, ?, ?)",
+		"add_anonymous_to_links":            "insert into links(userID, shortURL, longURL, expires) values(NULL, ?, ?, date_add(now(), interval ? second))",
+		"claim_anonymous_link":              "update links set userID = ?, expires = NULL where shortURL = ? and userID is null",
+		"delete_expired_links":              "delete from links where expires <= now()",
+		"add_to_workspace_links":            "insert into links(userID, workspaceID, shortURL, longURL) values(?, ?, ?, ?)",
+		"links_from_userId":                 "select shortURL, longURL from links where userID = ? and workspaceID is null",
+		"links_from_workspaceId":            "select shortURL, longURL from links where workspaceID = ?",
+		"delete_from_links":                 "delete from links where shortURL = ?",
+		"link_from_shortUrl":                "select shortURL, longURL from links where shortURL = ?",
+		"update_link_longUrl":               "update links set longURL = ? where shortURL = ?",
+		"add_link_clicks":                   "update links set clicks = clicks + ? where shortURL = ?",
+		"clicks_from_userId":                "select shortURL, clicks from links where userID = ? and workspaceID is null",
+		"clicks_from_workspaceId":           "select shortURL, clicks from links where workspaceID = ?",
+		"stats_from_shortUrl":               "select shortURL, clicks, date_format(created, '%Y-%m-%d %H:%i') from links where shortURL = ?",
+		"add_to_access_tokens":              "insert into access_tokens(userID, name, token_hash, scopes, expires) values(?, ?, ?, ?, date_add(now(), interval ? day))",
+		"access_tokens_from_userId":         "select tokenID, name, scopes, date_format(created, '%Y-%m-%d %H:%i'), date_format(expires, '%Y-%m-%d %H:%i'), date_format(last_used, '%Y-%m-%d %H:%i') from access_tokens where userID = ? order by created",
+		"access_token_from_hash":            "select tokenID, userID, scopes from access_tokens where token_hash = ? and (expires is null or expires > now())",
+		"update_access_token_last_used":     "update access_tokens set last_used = now() where tokenID = ?",
+		"delete_from_access_tokens":         "delete from access_tokens where tokenID = ? and userID = ?",
+		"add_to_webhooks":                   "insert into webhooks(userID, workspaceID, url, secret, events) values(?, ?, ?, ?, ?)",
+		"webhooks_from_userId":              "select webhookID, url, events, date_format(created, '%Y-%m-%d %H:%i') from webhooks where userID = ? and workspaceID is null order by created",
+		"webhooks_from_workspaceId":         "select webhookID, url, events, date_format(created, '%Y-%m-%d %H:%i') from webhooks where workspaceID = ? order by created",
+		"owner_from_webhookId":              "select userID, workspaceID from webhooks where webhookID = ?",
+		"webhooks_for_owner":                "select webhookID, events from webhooks where workspaceID = ? or (userID = ? and workspaceID is null)",
+		"delete_from_webhooks":              "delete from webhooks where webhookID = ?",
+		"delete_webhook_deliveries":         "delete from webhook_deliveries where webhookID = ?",
+		"add_to_webhook_deliveries":         "insert into webhook_deliveries(webhookID, event, payload, nextAttempt) values(?, ?, ?, date_add(now(), interval ? second))",
+		"due_webhook_deliveries":            "select deliveryID from webhook_deliveries where status = 'pending' and nextAttempt <= now() order by nextAttempt limit ?",
+		"claim_webhook_delivery":            "update webhook_deliveries set nextAttempt = date_add(now(), interval ? second) where deliveryID = ? and status = 'pending' and nextAttempt <= now()",
+		"webhook_delivery_from_deliveryId":  "select d.webhookID, d.event, d.payload, d.attempts, w.url, w.secret from webhook_deliveries d join webhooks w on w.webhookID = d.webhookID where d.deliveryID = ?",
+		"update_webhook_delivery_delivered": "update webhook_deliveries set status = 'delivered', attempts = attempts + 1, responseStatus = ?, error = null where deliveryID = ?",
+		"update_webhook_delivery_failed":    "update webhook_deliveries set status = 'failed', attempts = attempts + 1, responseStatus = ?, error = ? where deliveryID = ?",
+		"update_webhook_delivery_retry":     "update webhook_deliveries set attempts = attempts + 1, responseStatus = ?, error = ?, nextAttempt = date_add(now(), interval ? second) where deliveryID = ?",
+		"deliveries_from_webhookId":         "select deliveryID, event, status, attempts, responseStatus, error, date_format(created, '%Y-%m-%d %H:%i:%s'), date_format(nextAttempt, '%Y-%m-%d %H:%i:%s') from webhook_deliveries where webhookID = ? order by deliveryID desc limit ?",
+		"add_to_idempotency_keys":           "insert ignore into idempotency_keys(owner, idemKey, fingerprint) values(?, ?, ?)",
+		"idempotency_key_from_owner":        "select fingerprint, status, headers, body from idempotency_keys where owner = ? and idemKey = ?",
+		"update_idempotency_key_response":   "update idempotency_keys set status = ?, headers = ?, body = ? where owner = ? and idemKey = ?",
+		"delete_from_idempotency_keys":      "delete from idempotency_keys where owner = ? and idemKey = ?",
+		"delete_expired_idempotency_keys":   "delete from idempotency_keys where created < date_sub(now(), interval ? second)",
+		"delete_old_webhook_deliveries":     "delete from webhook_deliveries where status <> 'pending' and created < date_sub(now(), interval ? second)",
+		"add_to_link_transfers":             "insert into link_transfers(fromUserID, toUserID, shortURL) values(?, ?, ?)",
+		"link_transfer_from_id":             "select fromUserID, toUserID, shortURL from link_transfers where transferID = ?",
+		"link_transfers_from_userId":        "select t.transferID, f.username, t.toUserID, r.username, t.shortURL, date_format(t.created, '%Y-%m-%d %H:%i') from link_transfers t join users_auth f on f.userID = t.fromUserID join users_auth r on r.userID = t.toUserID where t.fromUserID = ? or t.toUserID = ? order by t.created",
+		"delete_from_link_transfers":        "delete from link_transfers where transferID = ?",
+		"delete_link_transfers_from_userId": "delete from link_transfers where fromUserID = ? or toUserID = ?",
+		"transfer_link":                     "update links set userID = ? where shortURL = ? and userID = ? and workspaceID is null",
+		"transfer_all_links":                "update links set userID = ? where userID = ? and workspaceID is null",
+		"add_to_workspaces":                 "insert into workspaces(name) values(?)",
+		"add_to_workspace_members":          "insert into workspace_members(workspaceID, userID, role) values(?, ?, ?) on duplicate key update role = values(role)",
+		"role_from_workspace_member":        "select role from workspace_members where workspaceID = ? and userID = ?",
+		"count_workspace_owners":            "select count(*) from workspace_members where workspaceID = ? and role = 'owner'",
+		"delete_from_workspace_members":     "delete from workspace_members where workspaceID = ? and userID = ?",
+		"workspaces_from_userId":            "select w.workspaceID, w.name, m.role from workspaces w join workspace_members m on m.workspaceID = w.workspaceID where m.userID = ? order by w.name",
+		"members_from_workspaceId":          "select u.username, m.role from workspace_members m join users_auth u on u.userID = m.userID where m.workspaceID = ? order by u.username",
+		"userId_from_identity":              "select userID from user_identities where issuer = ? and subject = ?",
+		"add_to_user_identities":            "insert into user_identities(issuer, subject, userID) values(?, ?, ?)",
+		"case_conflicting_shortUrls":        "select lower(shortURL), group_concat(shortURL separator ' ') from links group by lower(shortURL) having count(*) > 1",
+		"lowercase_shortUrls":               "update links set shortURL = lower(shortURL) where binary shortURL <> binary lower(shortURL)",
+		"lowercase_transfer_shortUrls":      "update link_transfers set shortURL = lower(shortURL) where binary shortURL <> binary lower(shortURL)",
 	}
 
 	sqlStmts := make(map[string]*sql.Stmt)
+	cache := NewRedirectCache(config.Cache.Size, config.Cache.TTL.Duration, config.Cache.NegativeTTL.Duration)
+	if cache == nil {
+		Info.Println("Redirect cache disabled")
+	}
+
 	api := &API{
 		db,
 		sqlStmts,
+		config,
+		cache,
+		NewLimiter(config.Anonymous.PerIP, config.RateLimit.MaxKeys),
+		NewLimiter(config.Anonymous.PerSession, config.RateLimit.MaxKeys),
+		NewClickCounter(),
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		NewClickHub(STREAM_MAX_PER_USER),
+		nil,
+		NewMailer(config.Mail),
+	}
+
+	api.trustedProxies, err = parseTrustedProxies(config.RateLimit.TrustedProxies)
+	if err != nil {
+		Error.Println("Failed to parse trusted proxies", err)
+		return nil, err
+	}
+
+	if config.OIDC.Enabled {
+		api.oidc = NewOIDCProvider(config.OIDC, &http.Client{Timeout: OIDC_HTTP_TIMEOUT})
+	}
+
+	for name, query := range linkPageStatements() {
+		sqlStmtsStr[name] = query
+	}
+
+	if config.Webhooks.Enabled {
+		api.webhookClient = NewWebhookClient(config.Webhooks.Timeout.Duration, config.Webhooks.AllowPrivateNetworks)
 	}
 
 	err = api.AddStatements(sqlStmtsStr)
@@ -79,9 +252,74 @@ func InitAPI(sqlDriverName string, dataSourceName string) (*API, error) {
 		return nil, err
 	}
 
+	go api.BackgroundPurge(LINK_PURGE_DELAY)
+	go api.BackgroundFlushClicks(CLICKS_FLUSH_DELAY)
+	if api.webhookClient != nil {
+		go api.BackgroundDeliverWebhooks(WEBHOOK_POLL_DELAY)
+	}
+	go api.anonIPLimiter.BackgroundCleanup(LINK_PURGE_DELAY)
+	go api.anonSessionLimiter.BackgroundCleanup(LINK_PURGE_DELAY)
+
 	return api, nil
 }
 
+// Deletes expired links, idempotency keys, password resets, email verifications and the accounts which didn't
+// verify their email in time with delay, run in goroutine
+func (api *API) BackgroundPurge(delay time.Duration) {
+	for {
+		affected, err := api.ExecRow("delete_expired_links")
+		if err != nil {
+			Error.Println("Failed to purge expired links", err)
+		} else if affected > 0 {
+			Info.Printf("Purged %d expired links\n", affected)
+		}
+
+		affected, err = api.ExecRow("delete_expired_idempotency_keys", int(IDEMPOTENCY_KEY_RETENTION.Seconds()))
+		if err != nil {
+			Error.Println("Failed to purge idempotency keys", err)
+		} else if affected > 0 {
+			Info.Printf("Purged %d idempotency keys\n", affected)
+		}
+
+		affected, err = api.ExecRow("delete_old_password_resets", int(RESET_TOKEN_RETENTION.Seconds()))
+		if err != nil {
+			Error.Println("Failed to purge password resets", err)
+		} else if affected > 0 {
+			Info.Printf("Purged %d password resets\n", affected)
+		}
+
+		affected, err = api.ExecRow("delete_expired_verifications")
+		if err != nil {
+			Error.Println("Failed to purge email verifications", err)
+		} else if affected > 0 {
+			Info.Printf("Purged %d email verifications\n", affected)
+		}
+
+		_, err = api.ExecRow("delete_old_login_throttles", int(api.config.Lockout.Window.Seconds()))
+		if err != nil {
+			Error.Println("Failed to purge login throttles", err)
+		}
+
+		affected, err = api.ExecRow("delete_old_login_failures", int(LOGIN_FAILURE_RETENTION.Seconds()))
+		if err != nil {
+			Error.Println("Failed to purge failed sign-ins", err)
+		} else if affected > 0 {
+			Info.Printf("Purged %d failed sign-ins\n", affected)
+		}
+
+		// Without an SMTP server the accounts created while there was one couldn't get a new link
+		if api.config.Mail.SMTPAddress != "" {
+			deleted, err := api.purgeUnverifiedUsers()
+			if err != nil {
+				Error.Println("Failed to purge unverified accounts", err)
+			} else if deleted > 0 {
+				Info.Printf("Purged %d accounts with an unverified email\n", deleted)
+			}
+		}
+		time.Sleep(delay)
+	}
+}
+
 // Adds a prepared SQL statement to the map, which will be automatically managed and able to run
 func (api *API) AddStatement(name string, query string) error {
 	stmt, err := api.db.Prepare(query)
@@ -106,8 +344,31 @@ func (api *API) AddStatements(stmtsStr map[string]string) error {
 	return nil
 }
 
+// Returns the prepared statement, bound to the API's transaction if it has one
+func (api *API) stmt(name string) (*sql.Stmt, bool) {
+	stmt, exists := api.sqlStmts[name]
+	if exists && api.tx != nil {
+		txStmt, prepared := api.txStmts[name]
+		if !prepared {
+			txStmt = api.tx.Stmt(stmt)
+			api.txStmts[name] = txStmt
+		}
+		return txStmt, true
+	}
+	return stmt, exists
+}
+
+// Returns a copy of the API running every statement in tx, so the usual methods can be composed atomically.
+// The copy isn't safe for concurrent use, like tx
+func (api *API) InTransaction(tx *sql.Tx) *API {
+	txApi := *api
+	txApi.tx = tx
+	txApi.txStmts = make(map[string]*sql.Stmt)
+	return &txApi
+}
+
 func (api *API) QueryRow(name string, args []any, dest ...any) error {
-	if stmt, exists := api.sqlStmts[name]; exists {
+	if stmt, exists := api.stmt(name); exists {
 		return stmt.QueryRow(args...).Scan(dest...)
 	} else {
 		return &NoSuchStatementError{}
@@ -115,7 +376,7 @@ func (api *API) QueryRow(name string, args []any, dest ...any) error {
 }
 
 func (api *API) ExecRow(name string, args ...any) (int64, error) {
-	if stmt, exists := api.sqlStmts[name]; exists {
+	if stmt, exists := api.stmt(name); exists {
 		res, err := stmt.Exec(args...)
 		if err != nil {
 			Error.Println("Failed to execute statement", err)
@@ -134,8 +395,23 @@ func (api *API) ExecRow(name string, args ...any) (int64, error) {
 	}
 }
 
+// Executes an insert statement and returns the auto increment ID of the new row
+func (api *API) InsertRow(name string, args ...any) (int64, error) {
+	if stmt, exists := api.stmt(name); exists {
+		res, err := stmt.Exec(args...)
+		if err != nil {
+			Error.Println("Failed to execute statement", err)
+			return 0, err
+		}
+
+		return res.LastInsertId()
+	} else {
+		return 0, &NoSuchStatementError{}
+	}
+}
+
 func (api *API) Query(name string, args ...any) (*sql.Rows, error) {
-	if stmt, exists := api.sqlStmts[name]; exists {
+	if stmt, exists := api.stmt(name); exists {
 		rows, err := stmt.Query(args...)
 		if err != nil {
 			Warning.Println("Failed to query:", err)
@@ -148,6 +424,40 @@ func (api *API) Query(name string, args ...any) (*sql.Rows, error) {
 	}
 }
 
+// Returns the prepared statement bound to the transaction
+func (api *API) TxStmt(tx *sql.Tx, name string) (*sql.Stmt, error) {
+	if stmt, exists := api.sqlStmts[name]; exists {
+		return tx.Stmt(stmt), nil
+	} else {
+		return nil, &NoSuchStatementError{}
+	}
+}
+
+// Runs f in a transaction which is committed if f succeeds and rolled back otherwise.
+// An API returned by InTransaction runs f in its own transaction, left to the caller to commit
+func (api *API) Transaction(f func(tx *sql.Tx) error) error {
+	if api.tx != nil {
+		return f(api.tx)
+	}
+
+	tx, err := api.db.Begin()
+	if err != nil {
+		Error.Println("Failed to begin transaction", err)
+		return err
+	}
+
+	err = f(tx)
+	if err != nil {
+		rollbackErr := tx.Rollback()
+		if rollbackErr != nil {
+			Error.Println("Failed to rollback transaction", rollbackErr)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
 func (api *API) Close() {
 	api.db.Close()
 
@@ -158,16 +468,22 @@ func (api *API) Close() {
 
 // Signs up the user using data in a form, fails if no data in request body
 // Returns true if successful
-func (api *API) signup(name, age, born, username, password string) error {
+func (api *API) signup(session *Session, name, age, born, username, password, email string) error {
 	Info.Printf("Attempting to sign up %v", username)
 
-	if name == "" || age == "" || born == "" || username == "" || password == "" {
+	if name == "" || age == "" || born == "" || username == "" || password == "" || email == "" {
 		log.Println("Invalid input")
 		return &InvalidInput{}
 	}
 
+	email, err := parseEmail(email)
+	if err != nil {
+		Info.Println("Rejecting invalid email")
+		return err
+	}
+
 	var exists string
-	err := api.QueryRow("username_exists", []any{username}, &exists)
+	err = api.QueryRow("username_exists", []any{username}, &exists)
 	if err != nil && err != sql.ErrNoRows {
 		Error.Println("Failed to check if username already exists", err)
 		return err
@@ -178,9 +494,33 @@ func (api *API) signup(name, age, born, username, password string) error {
 		return &Unauthorized{}
 	}
 
-	password_hash := hash([]byte(password), HASH_LENGTH)
-	_, err = api.ExecRow("insert_into_users_auth", username, password_hash)
+	err = api.QueryRow("email_exists", []any{email}, &exists)
+	if err != nil && err != sql.ErrNoRows {
+		Error.Println("Failed to check if email already exists", err)
+		return err
+	}
+
+	if exists == "1" {
+		Info.Println("Rejecting sign up with an email already used")
+		return &Conflict{}
+	}
+
+	password_hash, err := hashPassword(password)
 	if err != nil {
+		Error.Println("Failed to hash password", err)
+		return err
+	}
+
+	var verifyWithin any // NULL never deletes the account
+	if api.config.Mail.VerifyWithin.Duration > 0 {
+		verifyWithin = int64(api.config.Mail.VerifyWithin.Seconds())
+	}
+
+	_, err = api.ExecRow("insert_into_users_auth_with_email", username, password_hash, email, verifyWithin)
+	if isDuplicateKey(err) {
+		Info.Println("Rejecting sign up with a username or email taken concurrently")
+		return &Conflict{}
+	} else if err != nil {
 		log.Println("Failed to save auth data", err)
 		return err
 	}
@@ -199,60 +539,172 @@ func (api *API) signup(name, age, born, username, password string) error {
 	}
 
 	Info.Printf("Successfully signed up user %v with userID(%d)", username, newUserId)
+	api.claimAnonymousLinks(session, newUserId)
+
+	// The account works without it, a new link can be sent from the manage page
+	err = api.sendVerification(newUserId, email)
+	if err != nil {
+		Warning.Printf("Failed to send verification link to userID(%d), %v\n", newUserId, err)
+	}
 	return nil
 }
 
 // Signs in the user using data in a form, fails if no data in request body
-// Returns true if successful
-func (api *API) signin(session *Session, username, password string) error {
+// Returns true if successful. Unknown usernames are answered like wrong passwords, after as long, and both are throttled
+func (api *API) signin(session *Session, username, password, ip string) error {
 	Info.Printf("Attempting to login %v", username)
-	password_hash := hash([]byte(password), HASH_LENGTH)
-	var stored_password_hash []byte
-
-	err := api.QueryRow("passwordHash_from_username", []any{username}, &stored_password_hash)
+	err := api.reserveLoginAttempt(username, ip)
 	if err != nil {
-		Error.Println("Failed to get stored password hash", err)
+		return err
+	}
+
+	// Unknown usernames take the same statements and the same password check, so timing doesn't tell they don't exist
+	var userId int
+	var stored_password_hash []byte
+	err = api.QueryRow("auth_from_username", []any{username}, &userId, &stored_password_hash)
+	if err == sql.ErrNoRows {
+		verifyPassword(password, dummyPasswordHash())
+		api.recordLoginFailure(username, ip, 0)
 		return &NoSuchUser{}
+	} else if err != nil {
+		Error.Println("Failed to get stored password hash", err)
+		return err
 	}
 
-	log.Println(username, password_hash, stored_password_hash)
+	ok, rehash := verifyPassword(password, stored_password_hash)
+	if ok {
 
-	if bytes.Equal(password_hash, stored_password_hash) {
-		// w.Write([]byte("Success"))
-		var userId int
-		err = api.QueryRow("userId_from_username", []any{username}, &userId)
-		if err != nil {
-			Error.Println("Failed to get userID", err)
-			return &NoSuchUser{}
+		// Upgrades legacy and outdated hashes now that the password is known, signing in works even if it fails
+		if rehash {
+			api.rehashPassword(userId, password)
 		}
 
-		Info.Printf("SID(%v) associated with user %v with UserID %d. Elevating session access...\n", session.sid, username, userId)
-		session.signedIn = true
-		session.userId = userId
-
-		return nil
+		// The username's count is kept while a two-factor code is pending
+		api.releaseLoginAttempt(ip)
+		return api.completeSignin(session, userId, username)
 	} else {
+		Info.Printf("Wrong password for UserID(%d) from %v\n", userId, ip)
+		api.recordLoginFailure(username, ip, userId)
 		return &Unauthorized{}
 	}
 }
 
-// Adds a redirect pair into the database
-func (api *API) addURL(session *Session, shortUrl string, longUrl string) error {
-	if !session.signedIn {
+// Signs the session in as the user once they proved who they are, with their password or through the identity
+// provider. Users with two-factor authentication get TwoFactorRequired instead, the session then waits for their code
+func (api *API) completeSignin(session *Session, userId int, username string) error {
+	twoFactor, err := api.twoFactorEnabled(userId)
+	if err != nil {
+		return err
+	}
+	if twoFactor {
+		Info.Printf("SID(%v) authenticated as UserID %d, waiting for the two-factor code\n", session.sid, userId)
+		session.signedIn = false
+		session.userId = 0
+		session.twoFactor = &twoFactorLogin{userId, username, time.Now().Add(TWO_FACTOR_LOGIN_TIMEOUT), 0}
+		return &TwoFactorRequired{}
+	}
+
+	// Only now with two-factor authentication, so that an attacker knowing the password can't reset the count of wrong codes
+	api.clearLoginFailures(username)
+	Info.Printf("SID(%v) associated with user %v with UserID %d. Elevating session access...\n", session.sid, username, userId)
+	session.signedIn = true
+	session.signedInAt = time.Now()
+	session.userId = userId
+	return nil
+}
+
+// Replaces the stored password hash of the user by one made with the current parameters
+func (api *API) rehashPassword(userId int, password string) {
+	password_hash, err := hashPassword(password)
+	if err != nil {
+		Error.Println("Failed to hash password", err)
+		return
+	}
+
+	_, err = api.ExecRow("update_password_hash", password_hash, userId)
+	if err != nil {
+		Error.Println("Failed to upgrade password hash", err)
+		return
+	}
+	Info.Printf("Upgraded the password hash of UserID(%d)\n", userId)
+}
+
+// Signs the session out, or every session of its user when everywhere is set
+func (api *API) signout(w http.ResponseWriter, session *Session, everywhere bool) error {
+	if session.tokenId != 0 {
+		return &BadRequest{} // Access tokens are revoked instead
+	}
+
+	if everywhere {
+		if !session.signedIn {
+			return &Unauthorized{}
+		}
+		Info.Printf("Signing out every session of UserID(%d)\n", session.userId)
+		api.sessions.DestroyUser(session.userId, "")
+	}
+	api.sessions.Destroy(w, session)
+	return nil
+}
+
+// Adds a redirect pair into the database, owned by the workspace if workspaceId isn't 0. An empty shortUrl gets a
+// generated one, the only kind accounts with an unverified email can add. Returns the stored short URL
+func (api *API) addURL(session *Session, workspaceId int, shortUrl string, longUrl string) (string, error) {
+	if !session.signedIn || !session.hasScope(SCOPE_LINKS_WRITE) {
 		Info.Printf("Rejecting unauthorized user with SID(%v)\n", session.sid)
-		return &Unauthorized{}
+		return "", &Unauthorized{}
+	}
+
+	if workspaceId != 0 {
+		role, err := api.workspaceRole(session, workspaceId)
+		if err != nil {
+			return "", err
+		}
+		if !role.CanEdit() {
+			Info.Printf("Rejecting link creation in workspace %d by SID(%v)\n", workspaceId, session.sid)
+			return "", &Unauthorized{}
+		}
+	}
+
+	if longUrl == "" || len(longUrl) > LONG_URL_MAX_LENGTH {
+		Info.Printf("Rejecting invalid longURL length with SID(%v)\n", session.sid)
+		return "", &InvalidInput{}
+	}
+
+	if shortUrl == "" {
+		for i := 0; i < SHORT_URL_GENERATE_RETRIES; i++ {
+			generated, err := randomShortUrl()
+			if err != nil {
+				Error.Println("Failed to generate short URL", err)
+				return "", err
+			}
+			generated = api.normalizeShortUrl(generated)
+
+			err = api.insertURL(session, workspaceId, generated, longUrl)
+			if _, taken := err.(*Conflict); !taken {
+				return generated, err
+			}
+		}
+
+		Error.Println("Failed to generate an unused short URL")
+		return "", &BadRequest{}
 	}
 
 	if len(shortUrl) != SHORT_URL_LENGTH {
-		Info.Printf("Rejecting unauthorized shortURL length with SID(%v)\n", session.sid)
-		return &Unauthorized{}
+		Info.Printf("Rejecting invalid shortURL length with SID(%v)\n", session.sid)
+		return "", &InvalidInput{}
 	}
 
-	if len(longUrl) > LONG_URL_MAX_LENGTH {
-		Info.Printf("Rejecting unauthorized longURL length with SID(%v)\n", session.sid)
-		return &Unauthorized{}
+	err := api.requireVerifiedEmail(session)
+	if err != nil {
+		return "", err
 	}
 
+	shortUrl = api.normalizeShortUrl(shortUrl)
+	return shortUrl, api.insertURL(session, workspaceId, shortUrl, longUrl)
+}
+
+// Stores a checked link, Conflict if the short URL is taken
+func (api *API) insertURL(session *Session, workspaceId int, shortUrl string, longUrl string) error {
 	var exists string
 	err := api.QueryRow("shortUrl_exists", []any{shortUrl}, &exists)
 	if err != nil && err != sql.ErrNoRows {
@@ -262,207 +714,656 @@ func (api *API) addURL(session *Session, shortUrl string, longUrl string) error
 
 	if exists == "1" {
 		Info.Println("Rejecting adding existing short URL")
-		return &BadRequest{}
+		return &Conflict{}
 	}
 
-	_, err = api.ExecRow("add_to_links", session.userId, shortUrl, longUrl)
-	if err != nil {
+	if workspaceId != 0 {
+		_, err = api.ExecRow("add_to_workspace_links", session.userId, workspaceId, shortUrl, longUrl)
+	} else {
+		_, err = api.ExecRow("add_to_links", session.userId, shortUrl, longUrl)
+	}
+	if isDuplicateKey(err) {
+		Info.Println("Rejecting adding existing short URL")
+		return &Conflict{} // Added concurrently since the check above
+	} else if err != nil {
 		Error.Println("Failed to add link pair", err)
 		return err
 	}
+
+	api.cache.Invalidate(shortUrl) // The short link may be cached as unknown
+
+	owner := linkOwner{userId: sql.NullInt64{Int64: int64(session.userId), Valid: true}}
+	if workspaceId != 0 {
+		owner = linkOwner{workspaceId: sql.NullInt64{Int64: int64(workspaceId), Valid: true}}
+	}
+	api.emitLinkEvent(EVENT_LINK_CREATED, owner, LinkData{shortUrl, longUrl})
 	return nil
 }
 
-// Gets all link pairs from a user identified by the session
-func (api *API) getURL(session *Session) (res []LinkData, err error) {
-	if !session.signedIn {
-		return nil, &Unauthorized{}
+// Adds a link with a generated short URL for a session which isn't signed in, returns the generated short URL
+func (api *API) addAnonymousURL(session *Session, ip string, longUrl string) (string, error) {
+	if !api.config.Anonymous.Enabled {
+		Info.Printf("Rejecting anonymous link creation with SID(%v)\n", session.sid)
+		return "", &Unauthorized{}
+	}
+
+	if longUrl == "" || len(longUrl) > LONG_URL_MAX_LENGTH {
+		Info.Printf("Rejecting invalid longURL with SID(%v)\n", session.sid)
+		return "", &InvalidInput{}
+	}
+
+	if !api.anonIPLimiter.Allow(ip) || !api.anonSessionLimiter.Allow(session.sid) {
+		Info.Printf("Rate limiting anonymous link creation from %v with SID(%v)\n", ip, session.sid)
+		return "", &RateLimited{}
+	}
+
+	var lifetime any // NULL keeps the link forever
+	if api.config.Anonymous.LinkLifetime.Duration > 0 {
+		lifetime = int64(api.config.Anonymous.LinkLifetime.Seconds())
 	}
 
-	rows, err := api.Query("links_from_userId", session.userId)
+	for i := 0; i < SHORT_URL_GENERATE_RETRIES; i++ {
+		shortUrl, err := randomShortUrl()
+		if err != nil {
+			Error.Println("Failed to generate short URL", err)
+			return "", err
+		}
+		shortUrl = api.normalizeShortUrl(shortUrl)
+
+		var exists string
+		err = api.QueryRow("shortUrl_exists", []any{shortUrl}, &exists)
+		if err != nil && err != sql.ErrNoRows {
+			Error.Println("Failed to read if short link already exists", err)
+			return "", err
+		}
+		if exists == "1" {
+			continue
+		}
+
+		_, err = api.ExecRow("add_anonymous_to_links", shortUrl, longUrl, lifetime)
+		if err != nil {
+			Error.Println("Failed to add anonymous link pair", err)
+			return "", err
+		}
+
+		api.cache.Invalidate(shortUrl)
+		session.anonLinks = append(session.anonLinks, shortUrl)
+		Info.Printf("Added anonymous short link %v for SID(%v)\n", shortUrl, session.sid)
+		return shortUrl, nil
+	}
+
+	Error.Println("Failed to generate an unused short URL")
+	return "", &BadRequest{}
+}
+
+// Gives the anonymous links created during the session to the user
+func (api *API) claimAnonymousLinks(session *Session, userId int) {
+	for _, shortUrl := range session.anonLinks {
+		affected, err := api.ExecRow("claim_anonymous_link", userId, shortUrl)
+		if err != nil || affected == 0 {
+			Warning.Printf("Failed to claim anonymous link %v for userID(%d), %v\n", shortUrl, userId, err)
+			continue
+		}
+		api.cache.Invalidate(shortUrl) // The link doesn't expire anymore
+	}
+	session.anonLinks = nil
+}
+
+// Generates a random short URL, it may already exist
+func randomShortUrl() (string, error) {
+	shortUrl := make([]byte, 0, SHORT_URL_LENGTH)
+	buf := make([]byte, 1)
+	for len(shortUrl) < SHORT_URL_LENGTH {
+		_, err := rand.Read(buf)
+		if err != nil {
+			return "", err
+		}
+
+		// Rejects the bytes above the largest multiple of the alphabet size to keep an uniform distribution
+		if int(buf[0]) >= 256-256%len(SHORT_URL_ALPHABET) {
+			continue
+		}
+		shortUrl = append(shortUrl, SHORT_URL_ALPHABET[int(buf[0])%len(SHORT_URL_ALPHABET)])
+	}
+
+	return string(shortUrl), nil
+}
+
+// Returns the form a short URL is stored and cached in, lower case when codes are case insensitive
+func (api *API) normalizeShortUrl(shortUrl string) string {
+	if api.config.CaseInsensitiveCodes {
+		return strings.ToLower(shortUrl)
+	}
+	return shortUrl
+}
+
+// Returns the longURL a shortURL redirects to, going through the cache first
+func (api *API) resolveURL(shortUrl string) (string, error) {
+	shortUrl = api.normalizeShortUrl(shortUrl)
+	if longUrl, found, ok := api.cache.Get(shortUrl); ok {
+		if !found {
+			return "", &NoSuchLink{}
+		}
+		return longUrl, nil
+	}
+
+	generation := api.cache.StartFill(shortUrl)
+	defer api.cache.EndFill(shortUrl)
+
+	var longUrl string
+	var expiresIn sql.NullInt64 // Seconds until the link expires, NULL if it doesn't
+	err := api.QueryRow("longUrl_from_shortUrl", []any{shortUrl}, &longUrl, &expiresIn)
+	if err == sql.ErrNoRows {
+		api.cache.Set(shortUrl, "", false, generation)
+		return "", &NoSuchLink{}
+	} else if err != nil {
+		return "", err
+	}
+
+	if expiresIn.Valid {
+		api.cache.SetUntil(shortUrl, longUrl, time.Now().Add(time.Duration(expiresIn.Int64)*time.Second), generation)
+	} else {
+		api.cache.Set(shortUrl, longUrl, true, generation)
+	}
+	return longUrl, nil
+}
+
+// Gets a page of the personal link pairs of the session's user, or of the links of the workspace if workspaceId isn't 0.
+// Returns the cursor of the next page, empty on the last page
+func (api *API) getURL(session *Session, workspaceId int, query LinkQuery) (res []LinkData, next string, err error) {
+	if !session.signedIn || !session.hasScope(SCOPE_LINKS_READ) {
+		return nil, "", &Unauthorized{}
+	}
+
+	owner := session.userId
+	if workspaceId != 0 {
+		var role Role
+		role, err = api.workspaceRole(session, workspaceId)
+		if err != nil {
+			return nil, "", err
+		}
+		if !role.CanView() {
+			return nil, "", &Unauthorized{}
+		}
+		owner = workspaceId
+	}
+
+	if query.Limit <= 0 || query.Limit > LINK_PAGE_MAX_SIZE {
+		query.Limit = LINK_PAGE_DEFAULT_SIZE
+	}
+	if _, exists := linkSortColumns[query.Sort]; !exists {
+		query.Sort = "code"
+	}
+
+	pattern := "%" + likeEscaper.Replace(query.Search) + "%"
+	args := []any{owner, query.Search, pattern, pattern}
+	if query.Cursor != "" {
+		var cursor linkCursor
+		cursor, err = decodeLinkCursor(query.Cursor, query.order())
+		if err != nil {
+			return nil, "", err
+		}
+		args = append(args, cursor.Value, cursor.Value, cursor.Short)
+	}
+	args = append(args, query.Limit+1) // The extra row tells if there's a next page
+
+	rows, err := api.Query(linkPageStatement(workspaceId != 0, query.Sort, query.Desc, query.Cursor != ""), args...)
 	if err != nil {
 		Error.Println("Failed to get link pair", err)
 		return
 	}
 	defer rows.Close()
 
+	var last linkCursor
 	for rows.Next() {
 		var data LinkData
-		err = rows.Scan(&data.Short, &data.Long)
+		var sortValue string
+		err = rows.Scan(&data.Short, &data.Long, &sortValue)
 		if err != nil {
 			break
 		}
+
+		if len(res) == query.Limit {
+			next = encodeLinkCursor(last)
+			break
+		}
 		res = append(res, data)
+		last = linkCursor{query.order(), sortValue, data.Short}
 	}
 
 	return
 }
 
+// Gets a single link pair the session's user can view
+func (api *API) getLink(session *Session, shortUrl string) (LinkData, error) {
+	if !session.signedIn || !session.hasScope(SCOPE_LINKS_READ) {
+		return LinkData{}, &Unauthorized{}
+	}
+	shortUrl = api.normalizeShortUrl(shortUrl)
+
+	role, err := api.linkRole(session, shortUrl)
+	if err != nil {
+		return LinkData{}, err
+	}
+	if !role.CanView() {
+		Info.Printf("Rejecting unauthorized user with SID(%v)\n", session.sid)
+		return LinkData{}, &Unauthorized{}
+	}
+
+	var data LinkData
+	err = api.QueryRow("link_from_shortUrl", []any{shortUrl}, &data.Short, &data.Long)
+	if err == sql.ErrNoRows {
+		return LinkData{}, &NoSuchLink{}
+	}
+	return data, err
+}
+
+// Changes the longURL a shortURL redirects to
+func (api *API) updateURL(session *Session, shortUrl string, longUrl string) error {
+	if !session.signedIn || !session.hasScope(SCOPE_LINKS_WRITE) {
+		Info.Printf("Rejecting unauthorized user with SID(%v)\n", session.sid)
+		return &Unauthorized{}
+	}
+	shortUrl = api.normalizeShortUrl(shortUrl)
+
+	if longUrl == "" || len(longUrl) > LONG_URL_MAX_LENGTH {
+		Info.Printf("Rejecting invalid longURL length with SID(%v)\n", session.sid)
+		return &InvalidInput{}
+	}
+
+	role, err := api.linkRole(session, shortUrl)
+	if err != nil {
+		return err
+	}
+	if !role.CanEdit() {
+		Info.Printf("Rejecting unauthorized user with SID(%v)\n", session.sid)
+		return &Unauthorized{}
+	}
+
+	_, err = api.ExecRow("update_link_longUrl", longUrl, shortUrl)
+	api.cache.Invalidate(shortUrl)
+	if err != nil {
+		Error.Printf("Failed to update shortURL(%v), %v\n", shortUrl, err)
+		return err
+	}
+
+	owner, err := api.linkOwner(shortUrl)
+	if err == nil {
+		api.emitLinkEvent(EVENT_LINK_UPDATED, owner, LinkData{shortUrl, longUrl})
+	}
+	return nil
+}
+
 // Deletes the shortURL and it's associated longURL
 func (api *API) deleteURL(session *Session, shortUrl string) error {
-	if !session.signedIn {
+	if !session.signedIn || !session.hasScope(SCOPE_LINKS_WRITE) {
 		Info.Printf("Rejecting unauthorized user with SID(%v)\n", session.sid)
 		return &Unauthorized{}
 	}
+	shortUrl = api.normalizeShortUrl(shortUrl)
 
-	var userId int
-	err := api.QueryRow("userId_from_shortUrl", []any{shortUrl}, &userId)
+	role, err := api.linkRole(session, shortUrl)
 	if err != nil {
-		Error.Printf("Failed to get userID from shortURL(%v), %v", shortUrl, err)
+		Error.Printf("Failed to get role on shortURL(%v), %v", shortUrl, err)
+		return err
 	}
 
-	if userId != session.userId {
+	if !role.CanEdit() {
 		Info.Printf("Rejecting unauthorized user with SID(%v)\n", session.sid)
 		return &Unauthorized{}
 	}
 
-	affected, err := api.ExecRow("delete_from_links", shortUrl, session.userId)
+	owner, err := api.linkOwner(shortUrl) // Read before the link is gone
+	if err != nil {
+		return err
+	}
+
+	affected, err := api.ExecRow("delete_from_links", shortUrl)
+	api.cache.Invalidate(shortUrl)
 	if err != nil || affected == 0 {
 		Error.Printf("Failed to execute delete_from_links with argument %v, %v\n", shortUrl, err)
 		return err
 	}
+
+	api.emitLinkEvent(EVENT_LINK_DELETED, owner, map[string]string{"Short": shortUrl})
 	return nil
 }
 
-func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	session := r.Context().Value(SessionKey).(*Session)
-	endpoint := strings.Split(r.URL.String(), "?")[0]
-	Info.Printf("Processing API request for SID(%v) @ %v, endpoint[%v]", session.sid, r.URL.String(), endpoint)
+// Returns the IP address of the client, behind the trusted proxies
+func (api *API) clientIP(r *http.Request) string {
+	return clientIP(r, api.trustedProxies)
+}
 
-	switch r.Method {
-	case "POST":
-		switch endpoint {
-		case "auth":
-			err := r.ParseForm()
-			if err != nil {
-				log.Println("Failed to parse form", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+// Returns true if err is MySQL's duplicate entry error for a unique key
+func isDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == MYSQL_DUPLICATE_ENTRY
+}
 
-			username := r.PostForm.Get("username")
-			password := r.PostForm.Get("password")
-			err = api.signin(session, username, password)
-			if err != nil {
-				switch err.(type) {
-				case *NoSuchUser, *Unauthorized:
-					w.WriteHeader(http.StatusUnauthorized)
-					w.Write([]byte("Username or password incorrect"))
-				default:
-					w.WriteHeader(http.StatusInternalServerError)
-					w.Write([]byte("Internal server error"))
-				}
-				return
-			}
-			w.WriteHeader(http.StatusOK)
+// Writes the status code matching the error type with the error message
+func writeAPIError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case *Unauthorized:
+		w.WriteHeader(http.StatusUnauthorized)
+	case *BadRequest, *InvalidInput:
+		w.WriteHeader(http.StatusBadRequest)
+	case *NoSuchUser, *NoSuchLink, *NoSuchTransfer:
+		w.WriteHeader(http.StatusNotFound)
+	case *Conflict:
+		w.WriteHeader(http.StatusConflict)
+	case *RateLimited:
+		w.WriteHeader(http.StatusTooManyRequests)
+	case *LoginThrottled:
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(err.(*LoginThrottled).RetryAfter)))
+		w.WriteHeader(http.StatusTooManyRequests)
+	case *IdempotencyKeyReused:
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	case *IdempotencyKeyInUse:
+		w.WriteHeader(http.StatusConflict)
+	case *EmailNotVerified:
+		w.WriteHeader(http.StatusForbidden)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+		return
+	}
+	w.Write([]byte(err.Error()))
+}
 
-		case "add":
-			err := r.ParseForm()
-			if err != nil {
-				log.Println("Failed to parse form", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+func (api *API) handleSignout(w http.ResponseWriter, r *http.Request, session *Session) {
+	err := api.signout(w, session, false)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
 
-			short := r.PostForm.Get("short")
-			long := r.PostForm.Get("long")
+func (api *API) handleSignoutEverywhere(w http.ResponseWriter, r *http.Request, session *Session) {
+	err := api.signout(w, session, true)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
 
-			Info.Println("Got arguments:", short, long)
-			err = api.addURL(session, short, long)
-			if err != nil {
-				Warning.Println("Got error:", err)
-				switch err.(type) {
-				case *BadRequest:
-					w.WriteHeader(http.StatusBadRequest)
-				case *Unauthorized:
-					w.WriteHeader(http.StatusUnauthorized)
-				default:
-					w.WriteHeader(http.StatusInternalServerError)
-				}
-				w.Write([]byte(err.Error()))
-			} else {
-				http.Redirect(w, r, "/manage", http.StatusPermanentRedirect)
-			}
-		case "signup":
-			err := r.ParseForm()
-			if err != nil {
-				Warning.Println("Failed to parse form", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+func (api *API) handleAuth(w http.ResponseWriter, r *http.Request, session *Session) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println("Failed to parse form", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-			name := r.PostForm.Get("name")
-			age := r.PostForm.Get("age")
-			born := r.PostForm.Get("born")
-			username := r.PostForm.Get("username")
-			password := r.PostForm.Get("password")
-			err = api.signup(name, age, born, username, password)
-			if err != nil {
-				switch err.(type) {
-				case *Unauthorized, *InvalidInput:
-					w.WriteHeader(http.StatusUnauthorized)
-					w.Write([]byte("Invalid input, please fill all the fields"))
-				default:
-					w.WriteHeader(http.StatusInternalServerError)
-					w.Write([]byte("Internal server error"))
-				}
-				return
-			}
-			w.WriteHeader(http.StatusOK)
+	username := r.PostForm.Get("username")
+	password := r.PostForm.Get("password")
+	err = api.signin(session, username, password, api.clientIP(r))
+	if err != nil {
+		switch err.(type) {
+		case *NoSuchUser, *Unauthorized:
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("Username or password incorrect"))
+		case *TwoFactorRequired:
+			w.WriteHeader(http.StatusAccepted) // Not signed in yet, the code goes to /api/2fa/verify
+			w.Write([]byte(err.Error()))
+		case *LoginThrottled:
+			writeAPIError(w, err)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error"))
 		}
-	case "GET":
-		switch endpoint {
-		case "get":
-			res, err := api.getURL(session)
-			if err != nil {
-				switch err.(type) {
-				default:
-					w.WriteHeader(http.StatusInternalServerError)
-				case *Unauthorized:
-					w.WriteHeader(http.StatusUnauthorized)
-				}
-				return
-			}
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
 
-			resData, err := json.Marshal(res)
-			if err != nil {
+func (api *API) handleAdd(w http.ResponseWriter, r *http.Request, session *Session) {
+	api.idempotent(w, r, session, writeAPIError, func(w http.ResponseWriter, r *http.Request) {
+		api.addFromForm(w, r, session)
+	})
+}
+
+func (api *API) addFromForm(w http.ResponseWriter, r *http.Request, session *Session) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println("Failed to parse form", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	short := r.PostForm.Get("short")
+	long := r.PostForm.Get("long")
+
+	if !session.signedIn && api.config.Anonymous.Enabled {
+		short, err = api.addAnonymousURL(session, api.clientIP(r), long)
+		if err != nil {
+			Warning.Println("Got error:", err)
+			switch err.(type) {
+			case *InvalidInput:
+				w.WriteHeader(http.StatusBadRequest)
+			case *RateLimited:
+				w.WriteHeader(http.StatusTooManyRequests)
+			default:
 				w.WriteHeader(http.StatusInternalServerError)
-			} else {
-				w.Write(resData)
 			}
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		resData, err := json.Marshal(LinkData{short, long})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(resData)
+		return
+	}
+
+	workspaceId, _ := strconv.Atoi(r.PostForm.Get("workspace")) // Personal link if missing
+
+	Info.Println("Got arguments:", short, long)
+	_, err = api.addURL(session, workspaceId, short, long)
+	if err != nil {
+		Warning.Println("Got error:", err)
+		switch err.(type) {
+		case *BadRequest, *InvalidInput, *Conflict:
+			w.WriteHeader(http.StatusBadRequest)
+		case *Unauthorized:
+			w.WriteHeader(http.StatusUnauthorized)
+		case *EmailNotVerified:
+			w.WriteHeader(http.StatusForbidden)
 		default:
-			http.Redirect(w, r, "/notfound", http.StatusPermanentRedirect)
+			w.WriteHeader(http.StatusInternalServerError)
 		}
-	case "DELETE":
-		switch endpoint {
-		case "delete":
-			err := r.ParseForm()
-			if err != nil {
-				Warning.Println("Failed to parse form", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+		w.Write([]byte(err.Error()))
+	} else {
+		http.Redirect(w, r, "/manage", http.StatusPermanentRedirect)
+	}
+}
 
-			short := r.URL.Query().Get("short")
-			if short == "" {
-				Info.Printf("Empty query")
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
+func (api *API) handleSignup(w http.ResponseWriter, r *http.Request, session *Session) {
+	err := r.ParseForm()
+	if err != nil {
+		Warning.Println("Failed to parse form", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-			Info.Printf("Removing link pair with shortURL: %v\n", short)
-			err = api.deleteURL(session, short)
-			if err != nil {
-				switch err {
-				default:
-					w.WriteHeader(http.StatusInternalServerError)
-				case &Unauthorized{}:
-					w.WriteHeader(http.StatusUnauthorized)
-					w.Write([]byte(fmt.Sprintf("Cannot remove short link %v because you are unauthorized", short)))
-				}
-				Warning.Printf("Failed to delete %v, %v", short, err)
-			}
+	name := r.PostForm.Get("name")
+	age := r.PostForm.Get("age")
+	born := r.PostForm.Get("born")
+	username := r.PostForm.Get("username")
+	password := r.PostForm.Get("password")
+	email := r.PostForm.Get("email")
+	err = api.signup(session, name, age, born, username, password, email)
+	if err != nil {
+		switch err.(type) {
+		case *Unauthorized, *InvalidInput:
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("Invalid input, please fill all the fields"))
+		case *Conflict:
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("This email is already used by another account"))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error"))
+		}
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (api *API) handleGet(w http.ResponseWriter, r *http.Request, session *Session) {
+	workspaceId, _ := strconv.Atoi(r.URL.Query().Get("workspace"))
+	query, err := ParseLinkQuery(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	res, next, err := api.getURL(session, workspaceId, query)
+	if err != nil {
+		switch err.(type) {
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		case *Unauthorized:
+			w.WriteHeader(http.StatusUnauthorized)
+		case *InvalidInput:
+			w.WriteHeader(http.StatusBadRequest)
 		}
+		return
 	}
+	writeNextLink(w, r, next)
 
+	resData, err := json.Marshal(res)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		w.Write(resData)
+	}
+}
+
+func (api *API) handleCache(w http.ResponseWriter, r *http.Request, session *Session) {
+	if !session.signedIn || !session.hasScope(SCOPE_STATS_READ) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	resData, err := json.Marshal(api.cache.Stats())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(resData)
+	}
+}
+
+func (api *API) handleDelete(w http.ResponseWriter, r *http.Request, session *Session) {
+	err := r.ParseForm()
+	if err != nil {
+		Warning.Println("Failed to parse form", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	short := r.URL.Query().Get("short")
+	if short == "" {
+		Info.Printf("Empty query")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	Info.Printf("Removing link pair with shortURL: %v\n", short)
+	err = api.deleteURL(session, short)
+	if err != nil {
+		switch err.(type) {
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		case *Unauthorized:
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(fmt.Sprintf("Cannot remove short link %v because you are unauthorized", short)))
+		}
+		Warning.Printf("Failed to delete %v, %v", short, err)
+	}
+}
+
+type apiRoute struct {
+	method   string
+	endpoint string // Path after /api/
+	handler  func(api *API, w http.ResponseWriter, r *http.Request, session *Session)
+}
+
+// Every endpoint served by API.ServeHTTP, each one needs an entry in the OpenAPI description (see openapi.go)
+var apiRoutes = []apiRoute{
+	{http.MethodPost, "auth", (*API).handleAuth},
+	{http.MethodPost, "signup", (*API).handleSignup},
+	{http.MethodPost, "signout", (*API).handleSignout},
+	{http.MethodPost, "signout/everywhere", (*API).handleSignoutEverywhere},
+	{http.MethodPost, "password", (*API).handlePasswordChange},
+	{http.MethodPost, "email", (*API).handleEmail},
+	{http.MethodPost, "email/verify", (*API).handleEmailVerify},
+	{http.MethodGet, "account/export", (*API).handleExport},
+	{http.MethodPost, "account/delete", (*API).handleAccountDelete},
+	{http.MethodPost, "2fa/setup", (*API).handleTwoFactorSetup},
+	{http.MethodPost, "2fa/enable", (*API).handleTwoFactorEnable},
+	{http.MethodPost, "2fa/disable", (*API).handleTwoFactorDisable},
+	{http.MethodPost, "2fa/recovery", (*API).handleRecoveryCodes},
+	{http.MethodPost, "2fa/verify", (*API).handleTwoFactorVerify},
+	{http.MethodPost, "password/reset/request", (*API).handlePasswordResetRequest},
+	{http.MethodPost, "password/reset", (*API).handlePasswordReset},
+	{http.MethodPost, "add", (*API).handleAdd},
+	{http.MethodGet, "get", (*API).handleGet},
+	{http.MethodDelete, "delete", (*API).handleDelete},
+	{http.MethodGet, "stats", (*API).handleStats},
+	{http.MethodGet, "stream", (*API).handleStream},
+	{http.MethodGet, "cache", (*API).handleCache},
+	{http.MethodPost, "transfer", (*API).handleTransfer},
+	{http.MethodDelete, "transfer", (*API).handleTransferCancel},
+	{http.MethodPost, "transfer/accept", (*API).handleTransferAccept},
+	{http.MethodGet, "transfers", (*API).handleTransfers},
+	{http.MethodPost, "admin/transfer", (*API).handleAdminTransfer},
+	{http.MethodPost, "workspace", (*API).handleWorkspaceCreate},
+	{http.MethodGet, "workspaces", (*API).handleWorkspaces},
+	{http.MethodGet, "workspace/members", (*API).handleWorkspaceMembers},
+	{http.MethodPost, "workspace/member", (*API).handleWorkspaceMemberSet},
+	{http.MethodDelete, "workspace/member", (*API).handleWorkspaceMemberRemove},
+	{http.MethodPost, "token", (*API).handleTokenCreate},
+	{http.MethodGet, "tokens", (*API).handleTokens},
+	{http.MethodDelete, "token", (*API).handleTokenRevoke},
+	{http.MethodPost, "webhook", (*API).handleWebhookCreate},
+	{http.MethodGet, "webhooks", (*API).handleWebhooks},
+	{http.MethodDelete, "webhook", (*API).handleWebhookDelete},
+	{http.MethodGet, "webhook/deliveries", (*API).handleWebhookDeliveries},
+	{http.MethodPost, "webhook/test", (*API).handleWebhookTest},
+	{http.MethodGet, "openapi.json", (*API).handleOpenAPI},
+}
+
+func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(SessionKey).(*Session)
+	endpoint := strings.Split(r.URL.String(), "?")[0]
+	Info.Printf("Processing API request for SID(%v) @ %v, endpoint[%v]", session.sid, r.URL.String(), endpoint)
+
+	var allowed []string
+	for _, route := range apiRoutes {
+		if route.endpoint != endpoint {
+			continue
+		}
+
+		if route.method == r.Method {
+			route.handler(api, w, r, session)
+			return
+		}
+		allowed = append(allowed, route.method)
+	}
+
+	if len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	} else if r.Method == http.MethodGet {
+		http.Redirect(w, r, "/notfound", http.StatusPermanentRedirect)
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+	}
 }
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	API_V1_PREFIX         = "/api/v1"
+	API_V1_MAX_BODY_BYTES = 1 << 20
+)
+
+// Body of every error response of the versioned API
+type ErrorEnvelope struct {
+	Error ErrorBody `json:"error"`
+}
+
+type ErrorBody struct {
+	Code    string `json:"code"` // Machine readable, stable across versions
+	Message string `json:"message"`
+}
+
+// Body of POST /links and PATCH /links/{code}
+type LinkRequest struct {
+	Short     string `json:"short"`
+	Long      string `json:"long"`
+	Workspace int    `json:"workspace"` // Personal link if 0
+}
+
+// Versioned JSON API with resource style routes, served under /api/v1/
+type APIv1 struct {
+	api *API
+}
+
+func NewAPIv1(api *API) *APIv1 {
+	return &APIv1{api}
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	resData, err := json.Marshal(data)
+	if err != nil {
+		Error.Println("Failed to encode response", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(resData)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, code string, message string) {
+	resData, _ := json.Marshal(ErrorEnvelope{ErrorBody{code, message}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(resData)
+}
+
+// Returns the status code and the machine readable code of an error
+func errorStatus(session *Session, err error) (int, string) {
+	switch err.(type) {
+	case *Unauthorized:
+		if session == nil || !session.signedIn {
+			return http.StatusUnauthorized, "unauthenticated"
+		}
+		return http.StatusForbidden, "forbidden"
+	case *InvalidInput, *BadRequest:
+		return http.StatusBadRequest, "invalid_input"
+	case *NoSuchLink:
+		return http.StatusNotFound, "link_not_found"
+	case *NoSuchUser:
+		return http.StatusNotFound, "user_not_found"
+	case *NoSuchTransfer:
+		return http.StatusNotFound, "transfer_not_found"
+	case *Conflict:
+		return http.StatusConflict, "conflict"
+	case *RateLimited:
+		return http.StatusTooManyRequests, "rate_limited"
+	case *IdempotencyKeyReused:
+		return http.StatusUnprocessableEntity, "idempotency_key_reused"
+	case *IdempotencyKeyInUse:
+		return http.StatusConflict, "idempotency_key_in_use"
+	case *EmailNotVerified:
+		return http.StatusForbidden, "email_not_verified"
+	default:
+		return http.StatusInternalServerError, "internal_error"
+	}
+}
+
+// Writes the error envelope matching the error, internal errors aren't described to the client
+func writeV1Error(w http.ResponseWriter, session *Session, err error) {
+	status, code := errorStatus(session, err)
+	message := err.Error()
+	if status == http.StatusInternalServerError {
+		Error.Println("Internal error in API v1", err)
+		message = "Internal server error"
+	}
+	writeJSONError(w, status, code, message)
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed, use "+strings.Join(allowed, ", "))
+}
+
+// Decodes the JSON body into dest, rejecting unknown fields and oversized bodies
+func readJSON(w http.ResponseWriter, r *http.Request, dest any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, API_V1_MAX_BODY_BYTES))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(dest)
+	if err != nil {
+		Info.Println("Failed to decode JSON body", err)
+		return &InvalidInput{}
+	}
+
+	if decoder.Decode(&struct{}{}) != io.EOF {
+		return &InvalidInput{} // Trailing data after the JSON value
+	}
+	return nil
+}
+
+func (v1 *APIv1) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(SessionKey).(*Session)
+	path := strings.TrimPrefix(r.URL.Path, API_V1_PREFIX)
+	Info.Printf("Processing API v1 request for SID(%v) @ %v %v", session.sid, r.Method, path)
+
+	switch {
+	case path == "/links":
+		switch r.Method {
+		case http.MethodGet:
+			v1.listLinks(w, r, session)
+		case http.MethodPost:
+			v1.createLink(w, r, session)
+		default:
+			writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+	case strings.HasPrefix(path, "/links/") && !strings.Contains(path[len("/links/"):], "/"):
+		code := path[len("/links/"):]
+		switch r.Method {
+		case http.MethodGet:
+			v1.getLink(w, r, session, code)
+		case http.MethodPatch:
+			v1.updateLink(w, r, session, code)
+		case http.MethodDelete:
+			v1.deleteLink(w, r, session, code)
+		default:
+			writeMethodNotAllowed(w, http.MethodGet, http.MethodPatch, http.MethodDelete)
+		}
+	case strings.HasPrefix(path, "/links/") && strings.HasSuffix(path, "/stats") && strings.Count(path, "/") == 3:
+		code := strings.TrimSuffix(path[len("/links/"):], "/stats")
+		switch r.Method {
+		case http.MethodGet:
+			v1.getStats(w, r, session, code)
+		default:
+			writeMethodNotAllowed(w, http.MethodGet)
+		}
+	case path == "/batch":
+		switch r.Method {
+		case http.MethodPost:
+			v1.batch(w, r, session)
+		default:
+			writeMethodNotAllowed(w, http.MethodPost)
+		}
+	default:
+		writeJSONError(w, http.StatusNotFound, "not_found", "No such endpoint")
+	}
+}
+
+// GET /links?workspace={id}&sort={code|destination|created|clicks}&order={asc|desc}&q={search}&cursor={next}&limit={n}
+func (v1 *APIv1) listLinks(w http.ResponseWriter, r *http.Request, session *Session) {
+	var workspaceId int
+	if workspace := r.URL.Query().Get("workspace"); workspace != "" {
+		var err error
+		workspaceId, err = strconv.Atoi(workspace)
+		if err != nil {
+			writeV1Error(w, session, &InvalidInput{})
+			return
+		}
+	}
+
+	query, err := ParseLinkQuery(r.URL.Query())
+	if err != nil {
+		writeV1Error(w, session, err)
+		return
+	}
+
+	res, next, err := v1.api.getURL(session, workspaceId, query)
+	if err != nil {
+		writeV1Error(w, session, err)
+		return
+	}
+	writeNextLink(w, r, next)
+
+	if res == nil {
+		res = []LinkData{} // Encoded as [] instead of null
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// POST /links, the short code is generated for anonymous sessions. Retries with the same Idempotency-Key replay the response
+func (v1 *APIv1) createLink(w http.ResponseWriter, r *http.Request, session *Session) {
+	writeError := func(w http.ResponseWriter, err error) {
+		writeV1Error(w, session, err)
+	}
+	v1.api.idempotent(w, r, session, writeError, func(w http.ResponseWriter, r *http.Request) {
+		v1.addFromJSON(w, r, session)
+	})
+}
+
+func (v1 *APIv1) addFromJSON(w http.ResponseWriter, r *http.Request, session *Session) {
+	var req LinkRequest
+	err := readJSON(w, r, &req)
+	if err != nil {
+		writeV1Error(w, session, err)
+		return
+	}
+
+	if !session.signedIn && v1.api.config.Anonymous.Enabled {
+		req.Short, err = v1.api.addAnonymousURL(session, v1.api.clientIP(r), req.Long)
+	} else {
+		req.Short, err = v1.api.addURL(session, req.Workspace, req.Short, req.Long)
+	}
+	if err != nil {
+		writeV1Error(w, session, err)
+		return
+	}
+
+	w.Header().Set("Location", API_V1_PREFIX+"/links/"+req.Short)
+	writeJSON(w, http.StatusCreated, LinkData{req.Short, req.Long})
+}
+
+// GET /links/{code}
+func (v1 *APIv1) getLink(w http.ResponseWriter, r *http.Request, session *Session, code string) {
+	data, err := v1.api.getLink(session, code)
+	if err != nil {
+		writeV1Error(w, session, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// PATCH /links/{code}, only the long URL can be changed
+func (v1 *APIv1) updateLink(w http.ResponseWriter, r *http.Request, session *Session, code string) {
+	var req LinkRequest
+	err := readJSON(w, r, &req)
+	if err != nil {
+		writeV1Error(w, session, err)
+		return
+	}
+
+	if req.Short != "" && v1.api.normalizeShortUrl(req.Short) != v1.api.normalizeShortUrl(code) {
+		writeV1Error(w, session, &InvalidInput{}) // The short code can't be changed
+		return
+	}
+
+	err = v1.api.updateURL(session, code, req.Long)
+	if err != nil {
+		writeV1Error(w, session, err)
+		return
+	}
+
+	data, err := v1.api.getLink(session, code)
+	if err != nil {
+		writeV1Error(w, session, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// DELETE /links/{code}
+func (v1 *APIv1) deleteLink(w http.ResponseWriter, r *http.Request, session *Session, code string) {
+	err := v1.api.deleteURL(session, code)
+	if err != nil {
+		writeV1Error(w, session, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /links/{code}/stats
+func (v1 *APIv1) getStats(w http.ResponseWriter, r *http.Request, session *Session, code string) {
+	stats, err := v1.api.getStats(session, code)
+	if err != nil {
+		writeV1Error(w, session, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
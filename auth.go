@@ -8,7 +8,6 @@ import (
 	"time"
 
 	"github.com/google/uuid"
-	"golang.org/x/crypto/argon2"
 )
 
 type ContextKey int
@@ -18,19 +17,39 @@ const (
 )
 
 type Session struct { // Represents the state of a session
-	sid      string // Unique session ID, generated with a (May be useless since we already have the sid as a key in the manager)
-	userId   int
-	signedIn bool
-	expiry   time.Time
+	sid        string // Unique session ID, generated with a (May be useless since we already have the sid as a key in the manager)
+	userId     int
+	signedIn   bool
+	signedInAt time.Time // When the user last proved who they are, password-less accounts confirm deletions with it
+	expiry     time.Time
+
+	anonLinks []string        // Short URLs created before signing up, claimed by the account on sign-up
+	scopes    []string        // Scopes of the access token, nil for cookie sessions which have every scope
+	tokenId   int             // ID of the access token, 0 for cookie sessions
+	twoFactor *twoFactorLogin // Sign-in waiting for a two-factor code
+}
+
+// Returns true if the session is allowed to act within the scope
+func (session *Session) hasScope(scope string) bool {
+	if session.scopes == nil {
+		return true
+	}
+
+	for _, s := range session.scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
 }
 
 // Creates and returns a session with minimal privileges
 func NewLowSession(sid string, lifetime time.Duration) *Session {
 	return &Session{
-		sid,
-		0,
-		false,
-		time.Now().Add(lifetime),
+		sid:      sid,
+		userId:   0,
+		signedIn: false,
+		expiry:   time.Now().Add(lifetime),
 	}
 }
 
@@ -117,6 +136,62 @@ func (manager *Manager) createSession(w http.ResponseWriter, r *http.Request) (s
 	return
 }
 
+// Removes the session and expires its cookie, the next request of the client gets a new session
+func (manager *Manager) Destroy(w http.ResponseWriter, session *Session) {
+	manager.mutex.Lock()
+	delete(manager.sessions, session.sid)
+	manager.mutex.Unlock()
+
+	Info.Printf("Destroyed SID(%v)\n", session.sid)
+	http.SetCookie(w, &http.Cookie{Name: manager.cookieName, Value: "", MaxAge: -1, Path: "/", SameSite: http.SameSiteStrictMode})
+}
+
+// Switches the client back to its session with the SID after a cross-site request came without the session cookie,
+// the session the manager created for that request is removed. Returns nil if the session doesn't exist anymore
+func (manager *Manager) Resume(w http.ResponseWriter, current *Session, sid string) *Session {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	session := manager.sessions[sid]
+	if session == nil || time.Now().After(session.expiry) {
+		return nil
+	}
+	if current.sid == sid {
+		return session
+	}
+
+	if !current.signedIn {
+		delete(manager.sessions, current.sid)
+	}
+	Info.Printf("Resuming SID(%v) instead of SID(%v)\n", sid, current.sid)
+	http.SetCookie(w, &http.Cookie{Name: manager.cookieName, Value: url.QueryEscape(sid), Expires: session.expiry, Path: "/", SameSite: http.SameSiteStrictMode})
+	return session
+}
+
+// Removes every session signed in as the user, or waiting for their two-factor code, except the one with the SID keep.
+// Returns how many there were
+func (manager *Manager) DestroyUser(userId int, keep string) int {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	destroyed := 0
+	for sid, session := range manager.sessions {
+		pending := session.twoFactor != nil && session.twoFactor.userId == userId
+		if ((session.signedIn && session.userId == userId) || pending) && sid != keep {
+			delete(manager.sessions, sid)
+			destroyed++
+		}
+	}
+	Info.Printf("Destroyed %d sessions of UserID(%d)\n", destroyed, userId)
+	return destroyed
+}
+
+// Returns true if the request's session is signed in
+func signedIn(r *http.Request) bool {
+	session, ok := r.Context().Value(SessionKey).(*Session)
+	return ok && session.signedIn
+}
+
 func (manager *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Make the session available to the following handlers
 	session := manager.GetSession(w, r)
@@ -125,7 +200,3 @@ func (manager *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	newContext := context.WithValue(r.Context(), SessionKey, session)
 	manager.handler.ServeHTTP(w, r.WithContext(newContext))
 }
-
-func hash(input []byte, length int) []byte {
-	return (argon2.Key(input, nil, 2, 32*1024, 4, uint32(length)))
-}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+const (
+	BATCH_MAX_OPERATIONS = 500
+
+	BATCH_CREATE = "create"
+	BATCH_UPDATE = "update"
+	BATCH_DELETE = "delete"
+)
+
+// Body of POST /batch
+type BatchRequest struct {
+	Atomic     bool             `json:"atomic"` // All operations are rolled back if one fails
+	Operations []BatchOperation `json:"operations"`
+}
+
+type BatchOperation struct {
+	Op        string `json:"op"` // create, update or delete
+	Short     string `json:"short"`
+	Long      string `json:"long"`      // Destination of create and update
+	Workspace int    `json:"workspace"` // Workspace of create, personal link if 0
+}
+
+// Outcome of one operation, with the status code and error the single operation endpoints would have answered
+type BatchResult struct {
+	Status int        `json:"status"`
+	Link   *LinkData  `json:"link,omitempty"`
+	Error  *ErrorBody `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Committed bool          `json:"committed"` // false when an atomic batch was rolled back
+	Results   []BatchResult `json:"results"`   // In the order of the operations
+}
+
+// Runs one operation of a batch, api may be bound to the batch's transaction
+func (api *API) runBatchOperation(session *Session, op BatchOperation) (BatchResult, error) {
+	switch op.Op {
+	case BATCH_CREATE:
+		shortUrl, err := api.addURL(session, op.Workspace, op.Short, op.Long)
+		if err != nil {
+			return BatchResult{}, err
+		}
+		return BatchResult{Status: http.StatusCreated, Link: &LinkData{shortUrl, op.Long}}, nil
+
+	case BATCH_UPDATE:
+		err := api.updateURL(session, op.Short, op.Long)
+		if err != nil {
+			return BatchResult{}, err
+		}
+		return BatchResult{Status: http.StatusOK, Link: &LinkData{api.normalizeShortUrl(op.Short), op.Long}}, nil
+
+	case BATCH_DELETE:
+		err := api.deleteURL(session, op.Short)
+		if err != nil {
+			return BatchResult{}, err
+		}
+		return BatchResult{Status: http.StatusNoContent}, nil
+
+	default:
+		return BatchResult{}, &InvalidInput{}
+	}
+}
+
+func batchError(session *Session, err error) BatchResult {
+	status, code := errorStatus(session, err)
+	message := err.Error()
+	if status == http.StatusInternalServerError {
+		Error.Println("Internal error in batch operation", err)
+		message = "Internal server error"
+	}
+	return BatchResult{Status: status, Error: &ErrorBody{code, message}}
+}
+
+// Runs the operations in order. Atomic batches run in one transaction which is rolled back at the first failure,
+// the other operations then get a 424 rolled_back result. Best effort batches run every operation on its own
+func (api *API) runBatch(session *Session, req BatchRequest) (BatchResponse, error) {
+	if !session.signedIn || !session.hasScope(SCOPE_LINKS_WRITE) {
+		Info.Printf("Rejecting unauthorized user with SID(%v)\n", session.sid)
+		return BatchResponse{}, &Unauthorized{}
+	}
+	if len(req.Operations) == 0 || len(req.Operations) > BATCH_MAX_OPERATIONS {
+		return BatchResponse{}, &InvalidInput{}
+	}
+
+	res := BatchResponse{Committed: true, Results: make([]BatchResult, len(req.Operations))}
+	if !req.Atomic {
+		for i, op := range req.Operations {
+			result, err := api.runBatchOperation(session, op)
+			if err != nil {
+				result = batchError(session, err)
+			}
+			res.Results[i] = result
+		}
+		return res, nil
+	}
+
+	failed := -1
+	err := api.Transaction(func(tx *sql.Tx) error {
+		txApi := api.InTransaction(tx)
+		for i, op := range req.Operations {
+			result, err := txApi.runBatchOperation(session, op)
+			if err != nil {
+				failed = i
+				res.Results[i] = batchError(session, err)
+				return err
+			}
+			res.Results[i] = result
+		}
+		return nil
+	})
+
+	// The operations invalidated their links before the commit, a lookup in between may have cached the old value
+	for i, op := range req.Operations {
+		if link := res.Results[i].Link; link != nil {
+			api.cache.Invalidate(link.Short) // Generated codes aren't in the operation
+		} else {
+			api.cache.Invalidate(api.normalizeShortUrl(op.Short))
+		}
+	}
+
+	if err != nil && failed < 0 {
+		return BatchResponse{}, err // The transaction itself failed
+	}
+
+	if failed >= 0 {
+		res.Committed = false
+		for i := range res.Results {
+			if i != failed {
+				res.Results[i] = BatchResult{
+					Status: http.StatusFailedDependency,
+					Error:  &ErrorBody{"rolled_back", "Not applied since another operation of the atomic batch failed"},
+				}
+			}
+		}
+		Info.Printf("Rolled back atomic batch of SID(%v) at operation %d\n", session.sid, failed)
+	}
+	return res, nil
+}
+
+// POST /batch, answers 200 when the batch ran even if some best effort operations failed,
+// and 422 when an atomic batch was rolled back
+func (v1 *APIv1) batch(w http.ResponseWriter, r *http.Request, session *Session) {
+	var req BatchRequest
+	err := readJSON(w, r, &req)
+	if err != nil {
+		writeV1Error(w, session, err)
+		return
+	}
+
+	res, err := v1.api.runBatch(session, req)
+	if err != nil {
+		writeV1Error(w, session, err)
+		return
+	}
+
+	status := http.StatusOK
+	if !res.Committed {
+		status = http.StatusUnprocessableEntity
+	}
+	writeJSON(w, status, res)
+}
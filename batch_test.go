@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// userID(7) owns mine01, taken1 belongs to someone else
+func newBatchTest(t *testing.T) (*fakeDB, *API, *Session) {
+	db, config := newFakeDB(t)
+	api := newTestAPI(t, config)
+	db.on("select 1 from links where shortURL = ?", func(args []driver.Value) (fakeResult, error) {
+		if args[0] == "mine01" || args[0] == "taken1" {
+			return fakeResult{rows: [][]driver.Value{{"1"}}}, nil
+		}
+		return fakeResult{}, nil
+	})
+	db.on("select userID, workspaceID from links where shortURL = ?", func(args []driver.Value) (fakeResult, error) {
+		switch args[0] {
+		case "mine01":
+			return fakeResult{rows: [][]driver.Value{{int64(7), nil}}}, nil
+		case "taken1":
+			return fakeResult{rows: [][]driver.Value{{int64(8), nil}}}, nil
+		}
+		return fakeResult{}, nil
+	})
+	for _, fragment := range []string{"insert into links", "update links set longURL = ?", "delete from links where shortURL = ?"} {
+		db.on(fragment, func(args []driver.Value) (fakeResult, error) {
+			return fakeResult{affected: 1}, nil
+		})
+	}
+
+	session := &Session{sid: "batch-test", userId: 7, signedIn: true, expiry: time.Now().Add(time.Hour)}
+	return db, api, session
+}
+
+var batchTestOperations = []BatchOperation{
+	{Op: BATCH_CREATE, Short: "new001", Long: "https://example.com/new"},
+	{Op: BATCH_UPDATE, Short: "mine01", Long: "https://example.com/updated"},
+	{Op: BATCH_CREATE, Short: "taken1", Long: "https://example.com/taken"},
+	{Op: BATCH_DELETE, Short: "taken1"},
+	{Op: BATCH_DELETE, Short: "mine01"},
+}
+
+func TestAtomicBatchRollback(t *testing.T) {
+	db, api, session := newBatchTest(t)
+
+	body, _ := json.Marshal(BatchRequest{Atomic: true, Operations: batchTestOperations})
+	w := httptest.NewRecorder()
+	NewAPIv1(api).batch(w, httptest.NewRequest(http.MethodPost, API_V1_PREFIX+"/batch", strings.NewReader(string(body))), session)
+
+	var res BatchResponse
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if w.Code != http.StatusUnprocessableEntity || res.Committed || len(res.Results) != len(batchTestOperations) {
+		t.Fatalf("Failed atomic batch answered %v %v", w.Code, w.Body.String())
+	}
+	for i, result := range res.Results {
+		if i == 2 {
+			if result.Status != http.StatusConflict || result.Error == nil || result.Error.Code != "conflict" || result.Link != nil {
+				t.Errorf("Failed operation has the result %+v", result)
+			}
+		} else if result.Status != http.StatusFailedDependency || result.Error == nil || result.Error.Code != "rolled_back" || result.Link != nil {
+			t.Errorf("Operation %d has the result %+v, want rolled_back", i, result)
+		}
+	}
+
+	// The operations before the failure ran in the transaction, the ones after it didn't run
+	var statements []string
+	for _, query := range db.queries() {
+		for _, statement := range []string{"begin", "insert into links", "update links set longURL", "delete from links where shortURL", "commit", "rollback"} {
+			if strings.HasPrefix(query, statement) {
+				statements = append(statements, statement)
+			}
+		}
+	}
+	if strings.Join(statements, ", ") != "begin, insert into links, update links set longURL, rollback" {
+		t.Errorf("Atomic batch ran %v", statements)
+	}
+}
+
+func TestBestEffortBatch(t *testing.T) {
+	db, api, session := newBatchTest(t)
+
+	res, err := api.runBatch(session, BatchRequest{Operations: batchTestOperations})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Committed || len(res.Results) != len(batchTestOperations) {
+		t.Fatalf("Best effort batch answered %+v", res)
+	}
+
+	want := []int{http.StatusCreated, http.StatusOK, http.StatusConflict, http.StatusForbidden, http.StatusNoContent}
+	for i, result := range res.Results {
+		if result.Status != want[i] || (result.Error != nil) != (want[i] >= 400) {
+			t.Errorf("Operation %d has the result %+v, want status %d", i, result, want[i])
+		}
+	}
+	if link := res.Results[1].Link; link == nil || *link != (LinkData{"mine01", "https://example.com/updated"}) {
+		t.Errorf("Update has the link %+v", link)
+	}
+
+	if deleted := db.executed("delete from links where shortURL = ?"); len(deleted) != 1 || deleted[0][0] != "mine01" {
+		t.Errorf("Deleted %v, want only mine01", deleted)
+	}
+	for _, query := range db.queries() {
+		if query == "begin" {
+			t.Error("Best effort batch ran in a transaction")
+		}
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	_, api, session := newBatchTest(t)
+
+	for _, size := range []int{0, BATCH_MAX_OPERATIONS + 1} {
+		operations := make([]BatchOperation, size)
+		if _, err := api.runBatch(session, BatchRequest{Operations: operations}); err == nil {
+			t.Errorf("Batch of %d operations accepted", size)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	short  string
+	long   string
+	found  bool // False when the short link is known not to exist (negative caching)
+	expiry time.Time
+}
+
+// Database lookup of a missed short link in progress
+type cacheFill struct {
+	generation uint64 // Bumped by Invalidate, the lookup's result is stale if it changed
+	waiting    int    // Lookups of the short link in progress
+}
+
+type CacheStats struct {
+	Enabled bool   `json:"enabled"`
+	Entries int    `json:"entries"`
+	MaxSize int    `json:"maxSize"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+// Bounded LRU cache for shortURL -> longURL lookups, entries expire after their TTL.
+// A nil *RedirectCache is valid and behaves as a disabled cache
+type RedirectCache struct {
+	mutex       *sync.Mutex
+	entries     map[string]*list.Element
+	order       *list.List // Front is the most recently used entry
+	fills       map[string]*cacheFill
+	maxSize     int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	hits        uint64
+	misses      uint64
+}
+
+// Returns nil if maxSize is not positive, which disables caching
+func NewRedirectCache(maxSize int, ttl, negativeTTL time.Duration) *RedirectCache {
+	if maxSize <= 0 {
+		return nil
+	}
+
+	return &RedirectCache{
+		mutex:       new(sync.Mutex),
+		entries:     make(map[string]*list.Element),
+		order:       list.New(),
+		fills:       make(map[string]*cacheFill),
+		maxSize:     maxSize,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+	}
+}
+
+// Looks up a short link, ok is false on a cache miss.
+// found is false if the short link is cached as unknown
+func (cache *RedirectCache) Get(short string) (long string, found bool, ok bool) {
+	if cache == nil {
+		return "", false, false
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	elem, exists := cache.entries[short]
+	if !exists {
+		cache.misses++
+		return "", false, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expiry) {
+		cache.removeElement(elem)
+		cache.misses++
+		return "", false, false
+	}
+
+	cache.order.MoveToFront(elem)
+	cache.hits++
+	return entry.long, entry.found, true
+}
+
+// Registers a database lookup after a miss and returns the generation to pass to Set, so that a link invalidated
+// during the lookup isn't cached with its old value. EndFill must be called once the lookup is done
+func (cache *RedirectCache) StartFill(short string) uint64 {
+	if cache == nil {
+		return 0
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	fill, exists := cache.fills[short]
+	if !exists {
+		fill = &cacheFill{}
+		cache.fills[short] = fill
+	}
+	fill.waiting++
+	return fill.generation
+}
+
+func (cache *RedirectCache) EndFill(short string) {
+	if cache == nil {
+		return
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if fill, exists := cache.fills[short]; exists {
+		fill.waiting--
+		if fill.waiting <= 0 {
+			delete(cache.fills, short)
+		}
+	}
+}
+
+// Stores the result of a lookup started with StartFill, found = false caches the short link as unknown
+func (cache *RedirectCache) Set(short, long string, found bool, generation uint64) {
+	if cache == nil {
+		return
+	}
+
+	ttl := cache.ttl
+	if !found {
+		ttl = cache.negativeTTL
+	}
+	cache.set(short, long, found, time.Now().Add(ttl), generation)
+}
+
+// Same as Set for a found link, but the entry never outlives until (for links which expire)
+func (cache *RedirectCache) SetUntil(short, long string, until time.Time, generation uint64) {
+	if cache == nil {
+		return
+	}
+
+	expiry := time.Now().Add(cache.ttl)
+	if until.Before(expiry) {
+		expiry = until
+	}
+	cache.set(short, long, true, expiry, generation)
+}
+
+func (cache *RedirectCache) set(short, long string, found bool, expiry time.Time, generation uint64) {
+	if !expiry.After(time.Now()) {
+		return
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	// The link changed since the lookup started, its result may be stale
+	if fill, exists := cache.fills[short]; !exists || fill.generation != generation {
+		return
+	}
+
+	entry := &cacheEntry{short, long, found, expiry}
+	if elem, exists := cache.entries[short]; exists {
+		elem.Value = entry
+		cache.order.MoveToFront(elem)
+		return
+	}
+
+	cache.entries[short] = cache.order.PushFront(entry)
+	for cache.order.Len() > cache.maxSize {
+		cache.removeElement(cache.order.Back())
+	}
+}
+
+// Drops a short link from the cache, must be called whenever the link is created, modified or deleted
+func (cache *RedirectCache) Invalidate(short string) {
+	if cache == nil {
+		return
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if elem, exists := cache.entries[short]; exists {
+		cache.removeElement(elem)
+	}
+	if fill, exists := cache.fills[short]; exists {
+		fill.generation++
+	}
+}
+
+func (cache *RedirectCache) Stats() CacheStats {
+	if cache == nil {
+		return CacheStats{}
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	return CacheStats{
+		Enabled: true,
+		Entries: cache.order.Len(),
+		MaxSize: cache.maxSize,
+		Hits:    cache.hits,
+		Misses:  cache.misses,
+	}
+}
+
+// Needs the mutex to be held
+func (cache *RedirectCache) removeElement(elem *list.Element) {
+	cache.order.Remove(elem)
+	delete(cache.entries, elem.Value.(*cacheEntry).short)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+)
+
+// Caches a lookup of short the way resolveURL does
+func fillCache(cache *RedirectCache, short, long string, found bool) {
+	generation := cache.StartFill(short)
+	cache.Set(short, long, found, generation)
+	cache.EndFill(short)
+}
+
+func TestRedirectCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewRedirectCache(2, time.Hour, time.Hour)
+	fillCache(cache, "a", "https://example.com/a", true)
+	fillCache(cache, "b", "https://example.com/b", true)
+
+	// Using a makes b the least recently used
+	if long, found, ok := cache.Get("a"); !ok || !found || long != "https://example.com/a" {
+		t.Fatalf("Cached a gives %q, %v, %v", long, found, ok)
+	}
+	fillCache(cache, "c", "https://example.com/c", true)
+
+	if _, _, ok := cache.Get("b"); ok {
+		t.Error("Least recently used b kept")
+	}
+	for _, short := range []string{"a", "c"} {
+		if _, _, ok := cache.Get(short); !ok {
+			t.Errorf("%v evicted instead of b", short)
+		}
+	}
+	if stats := cache.Stats(); stats.Entries != 2 || stats.MaxSize != 2 || stats.Hits != 3 || stats.Misses != 1 {
+		t.Errorf("Stats %+v", stats)
+	}
+}
+
+func TestRedirectCacheExpiry(t *testing.T) {
+	cache := NewRedirectCache(10, 50*time.Millisecond, time.Hour)
+	fillCache(cache, "a", "https://example.com/a", true)
+	generation := cache.StartFill("b")
+	cache.SetUntil("b", "https://example.com/b", time.Now().Add(time.Hour), generation)
+	cache.EndFill("b")
+	generation = cache.StartFill("c")
+	cache.SetUntil("c", "https://example.com/c", time.Now().Add(-time.Second), generation)
+	cache.EndFill("c")
+
+	if _, _, ok := cache.Get("c"); ok {
+		t.Error("Link which already expired cached")
+	}
+	if _, _, ok := cache.Get("a"); !ok {
+		t.Fatal("Link expired before its TTL")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	// The TTL is shorter than the link's own expiry
+	for _, short := range []string{"a", "b"} {
+		if _, _, ok := cache.Get(short); ok {
+			t.Errorf("%v still cached after the TTL", short)
+		}
+	}
+	if stats := cache.Stats(); stats.Entries != 0 {
+		t.Errorf("%d expired entries kept", stats.Entries)
+	}
+}
+
+func TestRedirectCacheNegativeEntries(t *testing.T) {
+	cache := NewRedirectCache(10, time.Hour, 50*time.Millisecond)
+	fillCache(cache, "unknown", "", false)
+
+	if long, found, ok := cache.Get("unknown"); !ok || found || long != "" {
+		t.Fatalf("Unknown link gives %q, %v, %v, want a negative entry", long, found, ok)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, _, ok := cache.Get("unknown"); ok {
+		t.Error("Unknown link still cached after the negative TTL")
+	}
+
+	// Creating the link must drop its negative entry
+	fillCache(cache, "unknown", "", false)
+	cache.Invalidate("unknown")
+	if _, _, ok := cache.Get("unknown"); ok {
+		t.Error("Negative entry kept after Invalidate")
+	}
+}
+
+func TestRedirectCacheFillRacingInvalidate(t *testing.T) {
+	cache := NewRedirectCache(10, time.Hour, time.Hour)
+
+	generation := cache.StartFill("a")
+	cache.Invalidate("a") // The link changes while its old value is read
+	cache.Set("a", "https://example.com/old", true, generation)
+	cache.EndFill("a")
+	if _, _, ok := cache.Get("a"); ok {
+		t.Error("Lookup started before Invalidate cached")
+	}
+
+	// Concurrent lookups share the generation until the last one ends
+	first := cache.StartFill("a")
+	second := cache.StartFill("a")
+	cache.EndFill("a")
+	cache.Invalidate("a")
+	cache.Set("a", "https://example.com/old", true, second)
+	cache.EndFill("a")
+	if _, _, ok := cache.Get("a"); ok || first != second {
+		t.Error("Lookup started before Invalidate cached after another one ended")
+	}
+
+	// Set without a lookup in progress is ignored
+	cache.Set("a", "https://example.com/a", true, 0)
+	if _, _, ok := cache.Get("a"); ok {
+		t.Error("Link cached without StartFill")
+	}
+}
+
+func TestRedirectCacheDisabled(t *testing.T) {
+	cache := NewRedirectCache(0, time.Hour, time.Hour)
+	if cache != nil {
+		t.Fatal("Cache of size 0 enabled")
+	}
+	fillCache(cache, "a", "https://example.com/a", true)
+	cache.Invalidate("a")
+	if _, _, ok := cache.Get("a"); ok || cache.Stats().Enabled {
+		t.Error("Disabled cache answered")
+	}
+}
+
+func TestResolveURLInvalidatedDuringLookup(t *testing.T) {
+	db, config := newFakeDB(t)
+	config.Cache = CacheConfig{10, Duration{time.Hour}, Duration{time.Hour}}
+	api := newTestAPI(t, config)
+
+	// The link is modified while its old value is read
+	long := "https://example.com/old"
+	db.on("select longURL, timestampdiff(second, now(), expires) from links", func(args []driver.Value) (fakeResult, error) {
+		row := []driver.Value{long, nil}
+		if long == "https://example.com/old" {
+			api.cache.Invalidate("abc123")
+			long = "https://example.com/new"
+		}
+		return fakeResult{rows: [][]driver.Value{row}}, nil
+	})
+
+	if got, err := api.resolveURL("abc123"); err != nil || got != "https://example.com/old" {
+		t.Fatalf("First lookup gives %q, %v", got, err)
+	}
+	if got, err := api.resolveURL("abc123"); err != nil || got != "https://example.com/new" {
+		t.Errorf("Lookup after the change gives %q, %v, the old value was cached", got, err)
+	}
+	if got, _ := api.resolveURL("abc123"); got != "https://example.com/new" {
+		t.Errorf("Cached lookup gives %q", got)
+	}
+	if lookups := db.executed("select longURL, timestampdiff(second, now(), expires) from links"); len(lookups) != 2 {
+		t.Errorf("%d database lookups, want 2 with the last one cached", len(lookups))
+	}
+
+	// Unknown links are cached as such
+	db.on("select longURL, timestampdiff(second, now(), expires) from links", func(args []driver.Value) (fakeResult, error) {
+		return fakeResult{}, nil
+	})
+	for i := 0; i < 2; i++ {
+		if _, err := api.resolveURL("unknown"); err == nil {
+			t.Error("Unknown link resolved")
+		}
+	}
+	if lookups := db.executed("select longURL, timestampdiff(second, now(), expires) from links"); len(lookups) != 3 {
+		t.Errorf("%d database lookups, the unknown link wasn't cached", len(lookups))
+	}
+}
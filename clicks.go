@@ -0,0 +1,116 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	CLICKS_FLUSH_DELAY = 10 * time.Second
+)
+
+// Counts redirects in memory so they don't cost a database write each, flushed by API.BackgroundFlushClicks
+type ClickCounter struct {
+	mutex  *sync.Mutex
+	counts map[string]int64
+}
+
+func NewClickCounter() *ClickCounter {
+	return &ClickCounter{new(sync.Mutex), make(map[string]int64)}
+}
+
+func (counter *ClickCounter) Add(shortUrl string) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	counter.counts[shortUrl]++
+}
+
+// Returns the clicks of shortUrl which aren't in the database yet
+func (counter *ClickCounter) Pending(shortUrl string) int64 {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	return counter.counts[shortUrl]
+}
+
+// Returns the pending clicks and resets them
+func (counter *ClickCounter) take() map[string]int64 {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	counts := counter.counts
+	counter.counts = make(map[string]int64)
+	return counts
+}
+
+// Writes the pending clicks to the database with delay, run in goroutine
+func (api *API) BackgroundFlushClicks(delay time.Duration) {
+	for {
+		time.Sleep(delay)
+		api.flushClicks()
+	}
+}
+
+func (api *API) flushClicks() {
+	for shortUrl, clicks := range api.clicks.take() {
+		_, err := api.ExecRow("add_link_clicks", clicks, shortUrl)
+		if err != nil {
+			Error.Printf("Failed to save %d clicks of %v, %v\n", clicks, shortUrl, err)
+			continue
+		}
+
+		// Batched per flush so redirects never wait on webhooks
+		if api.webhookClient != nil {
+			owner, err := api.linkOwner(shortUrl)
+			if err == nil {
+				api.emitLinkEvent(EVENT_LINK_CLICKED, owner, map[string]any{"Short": shortUrl, "Clicks": clicks})
+			}
+		}
+	}
+}
+
+// Called by the redirect handler for each successful redirect
+func (api *API) recordClick(shortUrl string) {
+	shortUrl = api.normalizeShortUrl(shortUrl)
+	api.clicks.Add(shortUrl)
+	api.clickHub.Publish(shortUrl)
+}
+
+// Gets the click statistics of a link the session's user can view
+func (api *API) getStats(session *Session, shortUrl string) (LinkStats, error) {
+	if !session.signedIn || !session.hasScope(SCOPE_STATS_READ) {
+		return LinkStats{}, &Unauthorized{}
+	}
+	shortUrl = api.normalizeShortUrl(shortUrl)
+
+	role, err := api.linkRole(session, shortUrl)
+	if err != nil {
+		return LinkStats{}, err
+	}
+	if !role.CanView() {
+		Info.Printf("Rejecting unauthorized user with SID(%v)\n", session.sid)
+		return LinkStats{}, &Unauthorized{}
+	}
+
+	var stats LinkStats
+	err = api.QueryRow("stats_from_shortUrl", []any{shortUrl}, &stats.Short, &stats.Clicks, &stats.Created)
+	if err == sql.ErrNoRows {
+		return LinkStats{}, &NoSuchLink{}
+	} else if err != nil {
+		Error.Println("Failed to get link stats", err)
+		return LinkStats{}, err
+	}
+
+	stats.Clicks += api.clicks.Pending(shortUrl)
+	return stats, nil
+}
+
+func (api *API) handleStats(w http.ResponseWriter, r *http.Request, session *Session) {
+	stats, err := api.getStats(session, r.URL.Query().Get("short"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
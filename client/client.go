@@ -0,0 +1,448 @@
+// Package client is a Go client of the shr.me API.
+//
+// It authenticates with a personal access token or by signing in with a username and password,
+// and retries idempotent requests on network errors, rate limiting and unavailable servers.
+// Link creation is retried too, with an Idempotency-Key so the link is only created once.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_RETRIES     = 3
+	DEFAULT_RETRY_DELAY = 500 * time.Millisecond
+	DEFAULT_TIMEOUT     = 30 * time.Second
+	MAX_RETRY_DELAY     = 30 * time.Second
+	MAX_ERROR_BYTES     = 4096
+)
+
+type Link struct {
+	Short string
+	Long  string
+}
+
+type Stats struct {
+	Short   string
+	Clicks  int64
+	Created string
+}
+
+// Link to create, the server generates the short code of anonymous sessions
+type NewLink struct {
+	Short     string `json:"short"`
+	Long      string `json:"long"`
+	Workspace int    `json:"workspace,omitempty"` // Personal link if 0
+}
+
+// Options of List, the zero value lists the first page of personal links sorted by code
+type ListOptions struct {
+	Workspace int
+	Sort      string // code, destination, created or clicks
+	Desc      bool
+	Search    string // Substring of the code or the destination
+	Cursor    string // Next of the previous page
+	Limit     int    // Server default if 0
+}
+
+type Page struct {
+	Links []Link
+	Next  string // Cursor of the next page, empty on the last page
+}
+
+type Client struct {
+	baseUrl    *url.URL
+	httpClient *http.Client
+	token      string // Sent as a bearer token, cookie sessions are used when empty
+	retries    int
+	retryDelay time.Duration
+}
+
+type Option func(*Client)
+
+// Authenticates every request with a personal access token
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// Replaces the default HTTP client, SignIn needs it to have a cookie jar
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// Sets how many times an idempotent request is retried, and the delay before the first retry which doubles each time
+func WithRetries(retries int, delay time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.retryDelay = delay
+	}
+}
+
+// Creates a client of the server at baseUrl, like "https://shr.me"
+func New(baseUrl string, options ...Option) (*Client, error) {
+	parsed, err := url.Parse(strings.TrimSuffix(baseUrl, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "https" && parsed.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported URL scheme %q", parsed.Scheme)
+	}
+
+	jar, _ := cookiejar.New(nil)
+	c := &Client{
+		baseUrl:    parsed,
+		httpClient: &http.Client{Jar: jar, Timeout: DEFAULT_TIMEOUT},
+		retries:    DEFAULT_RETRIES,
+		retryDelay: DEFAULT_RETRY_DELAY,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c, nil
+}
+
+// Signs in the client's cookie session, the alternative to WithToken
+func (c *Client) SignIn(ctx context.Context, username string, password string) error {
+	if c.httpClient.Jar == nil {
+		return errors.New("signing in needs an HTTP client with a cookie jar")
+	}
+
+	form := url.Values{"username": {username}, "password": {password}}
+	res, err := c.do(ctx, http.MethodPost, "/api/auth", nil, "application/x-www-form-urlencoded", []byte(form.Encode()), "")
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusAccepted {
+		return ErrTwoFactorRequired
+	}
+	return nil
+}
+
+// Finishes a sign-in which returned ErrTwoFactorRequired with a TOTP or recovery code
+func (c *Client) VerifyTwoFactor(ctx context.Context, code string) error {
+	form := url.Values{"code": {code}}
+	res, err := c.do(ctx, http.MethodPost, "/api/2fa/verify", nil, "application/x-www-form-urlencoded", []byte(form.Encode()), "")
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Creates a link, retried like the other requests thanks to an Idempotency-Key
+func (c *Client) Add(ctx context.Context, link NewLink) (Link, error) {
+	body, err := json.Marshal(link)
+	if err != nil {
+		return Link{}, err
+	}
+
+	key := make([]byte, 16)
+	_, err = rand.Read(key)
+	if err != nil {
+		return Link{}, err
+	}
+
+	res, err := c.do(ctx, http.MethodPost, "/api/v1/links", nil, "application/json", body, hex.EncodeToString(key))
+	if err != nil {
+		return Link{}, err
+	}
+	defer res.Body.Close()
+
+	var created Link
+	err = json.NewDecoder(res.Body).Decode(&created)
+	return created, err
+}
+
+func (c *Client) Get(ctx context.Context, short string) (Link, error) {
+	var link Link
+	err := c.doJSON(ctx, http.MethodGet, "/api/v1/links/"+url.PathEscape(short), nil, nil, &link)
+	return link, err
+}
+
+// Changes the destination of a link
+func (c *Client) Update(ctx context.Context, short string, long string) (Link, error) {
+	var link Link
+	err := c.doJSON(ctx, http.MethodPatch, "/api/v1/links/"+url.PathEscape(short), nil, NewLink{Long: long}, &link)
+	return link, err
+}
+
+func (c *Client) Delete(ctx context.Context, short string) error {
+	return c.doJSON(ctx, http.MethodDelete, "/api/v1/links/"+url.PathEscape(short), nil, nil, nil)
+}
+
+func (c *Client) Stats(ctx context.Context, short string) (Stats, error) {
+	var stats Stats
+	err := c.doJSON(ctx, http.MethodGet, "/api/v1/links/"+url.PathEscape(short)+"/stats", nil, nil, &stats)
+	return stats, err
+}
+
+// Lists a page of links, pass Page.Next as the Cursor of the next call to get the following one
+func (c *Client) List(ctx context.Context, options ListOptions) (Page, error) {
+	query := url.Values{}
+	if options.Workspace != 0 {
+		query.Set("workspace", strconv.Itoa(options.Workspace))
+	}
+	if options.Sort != "" {
+		query.Set("sort", options.Sort)
+	}
+	if options.Desc {
+		query.Set("order", "desc")
+	}
+	if options.Search != "" {
+		query.Set("q", options.Search)
+	}
+	if options.Cursor != "" {
+		query.Set("cursor", options.Cursor)
+	}
+	if options.Limit != 0 {
+		query.Set("limit", strconv.Itoa(options.Limit))
+	}
+
+	res, err := c.do(ctx, http.MethodGet, "/api/v1/links", query, "", nil, "")
+	if err != nil {
+		return Page{}, err
+	}
+	defer res.Body.Close()
+
+	var page Page
+	err = json.NewDecoder(res.Body).Decode(&page.Links)
+	if err != nil {
+		return Page{}, err
+	}
+	page.Next = nextCursor(res.Header.Get("Link"))
+	return page, nil
+}
+
+// Calls f with every link matching the options, page by page
+func (c *Client) Each(ctx context.Context, options ListOptions, f func(Link) error) error {
+	for {
+		page, err := c.List(ctx, options)
+		if err != nil {
+			return err
+		}
+		for _, link := range page.Links {
+			err = f(link)
+			if err != nil {
+				return err
+			}
+		}
+		if page.Next == "" {
+			return nil
+		}
+		options.Cursor = page.Next
+	}
+}
+
+// Writes every link matching the options to w as "json" (an array) or "csv" (with a header row),
+// returns the number of links written
+func (c *Client) Export(ctx context.Context, w io.Writer, format string, options ListOptions) (int, error) {
+	count := 0
+	switch format {
+	case "json":
+		links := []Link{}
+		err := c.Each(ctx, options, func(link Link) error {
+			links = append(links, link)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return len(links), encoder.Encode(links)
+
+	case "csv":
+		writer := csv.NewWriter(w)
+		err := writer.Write([]string{"short", "long"})
+		if err != nil {
+			return 0, err
+		}
+		err = c.Each(ctx, options, func(link Link) error {
+			count++
+			return writer.Write([]string{link.Short, link.Long})
+		})
+		writer.Flush()
+		if err == nil {
+			err = writer.Error()
+		}
+		return count, err
+
+	default:
+		return 0, fmt.Errorf("unknown export format %q, use json or csv", format)
+	}
+}
+
+// Returns the cursor of the rel="next" URL of a Link header
+func nextCursor(header string) string {
+	for _, link := range strings.Split(header, ",") {
+		target, params, _ := strings.Cut(strings.TrimSpace(link), ";")
+		if !strings.Contains(params, `rel="next"`) {
+			continue
+		}
+		next, err := url.Parse(strings.Trim(strings.TrimSpace(target), "<>"))
+		if err == nil {
+			return next.Query().Get("cursor")
+		}
+	}
+	return ""
+}
+
+// Sends a JSON body if in isn't nil and decodes the response into out if it isn't nil
+func (c *Client) doJSON(ctx context.Context, method string, path string, query url.Values, in any, out any) error {
+	var body []byte
+	contentType := ""
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		contentType = "application/json"
+	}
+
+	res, err := c.do(ctx, method, path, query, contentType, body, "")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// Sends the request, retrying idempotent methods and requests with an idempotency key, and turns error responses
+// into typed errors. The caller closes the body of the returned response
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, contentType string, body []byte, idempotencyKey string) (*http.Response, error) {
+	target := *c.baseUrl
+	target.Path += path
+	target.RawQuery = query.Encode()
+
+	// POST isn't safe to send twice without a key
+	retries := c.retries
+	if method == http.MethodPost && idempotencyKey == "" {
+		retries = 0
+	}
+
+	delay := c.retryDelay
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		if idempotencyKey != "" {
+			req.Header.Set("Idempotency-Key", idempotencyKey)
+		}
+
+		res, err := c.httpClient.Do(req)
+		if err == nil && res.StatusCode < 400 {
+			return res, nil
+		}
+
+		retryAfter := time.Duration(0)
+		if err == nil {
+			retryAfter = parseRetryAfter(res.Header)
+			err = readError(res)
+		}
+
+		if attempt >= retries || !retryable(ctx, err) {
+			return nil, err
+		}
+
+		wait := delay
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		if wait > MAX_RETRY_DELAY {
+			wait = MAX_RETRY_DELAY
+		}
+		delay *= 2
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Network errors, rate limiting and unavailable servers are worth retrying, other errors would fail again
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	apiErr, ok := AsAPIError(err)
+	if !ok {
+		return true
+	}
+	if apiErr.Code == "idempotency_key_in_use" {
+		return true // The first attempt is still running, the retry gets its response once it's done
+	}
+	switch apiErr.Status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Returns the delay in seconds of the Retry-After header, sent with 429 and by servers or proxies with 503, 0 if absent
+func parseRetryAfter(header http.Header) time.Duration {
+	seconds, err := strconv.Atoi(header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Reads the error envelope of a response, or its text for the form endpoints, and closes the body
+func readError(res *http.Response) error {
+	defer res.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(res.Body, MAX_ERROR_BYTES))
+	retryAfter := parseRetryAfter(res.Header)
+
+	var envelope struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(data, &envelope) == nil && envelope.Error.Code != "" {
+		return newError(res.StatusCode, envelope.Error.Code, envelope.Error.Message, retryAfter)
+	}
+
+	message := strings.TrimSpace(string(data))
+	if message == "" {
+		message = http.StatusText(res.StatusCode)
+	}
+	return newError(res.StatusCode, "", message, retryAfter)
+}
@@ -0,0 +1,121 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNextCursor(t *testing.T) {
+	for header, want := range map[string]string{
+		"": "",
+		`</api/v1/links?cursor=abc&limit=2>; rel="next"`:                                      "abc",
+		`</api/v1/links?limit=2>; rel="prev", </api/v1/links?cursor=def&limit=2>; rel="next"`: "def",
+		`</api/v1/links?cursor=abc>; rel="prev"`:                                              "",
+		`<https://shr.me/api/v1/links?q=a%20b&cursor=e30>; rel="next"`:                        "e30",
+	} {
+		if cursor := nextCursor(header); cursor != want {
+			t.Errorf("Link header %q gives the cursor %q, want %q", header, cursor, want)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	ctx := context.Background()
+	for status, want := range map[int]bool{
+		http.StatusBadRequest:          false,
+		http.StatusUnauthorized:        false,
+		http.StatusNotFound:            false,
+		http.StatusConflict:            false,
+		http.StatusTooManyRequests:     true,
+		http.StatusInternalServerError: false,
+		http.StatusBadGateway:          true,
+		http.StatusServiceUnavailable:  true,
+		http.StatusGatewayTimeout:      true,
+	} {
+		if retry := retryable(ctx, newError(status, "", "", 0)); retry != want {
+			t.Errorf("Status %d retryable %v, want %v", status, retry, want)
+		}
+	}
+
+	if !retryable(ctx, errors.New("connection reset by peer")) {
+		t.Error("Network error not retried")
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if retryable(cancelled, newError(http.StatusServiceUnavailable, "", "", 0)) {
+		t.Error("Request retried after its context was cancelled")
+	}
+}
+
+// Serves the given statuses in turn, with their Retry-After if not empty, then 200 with an empty link
+func newRetryServer(t *testing.T, retryAfter string, statuses ...int) (*Client, *int32) {
+	requests := new(int32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := int(atomic.AddInt32(requests, 1)) - 1
+		if i < len(statuses) {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(statuses[i])
+			return
+		}
+		w.Write([]byte(`{"short":"abc123","long":"https://example.com"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	c, err := New(server.URL, WithHTTPClient(server.Client()), WithRetries(2, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, requests
+}
+
+func TestRetriesWaitForRetryAfter(t *testing.T) {
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		c, requests := newRetryServer(t, "1", status)
+		start := time.Now()
+		link, err := c.Get(context.Background(), "abc123")
+		if err != nil || link.Short != "abc123" {
+			t.Fatalf("Retry after %d gives %+v, %v", status, link, err)
+		}
+		if elapsed := time.Since(start); elapsed < time.Second {
+			t.Errorf("Retried %d after %v, before its Retry-After", status, elapsed)
+		}
+		if *requests != 2 {
+			t.Errorf("%d requests after a %d, want 2", *requests, status)
+		}
+	}
+}
+
+func TestRetriesGiveUp(t *testing.T) {
+	c, requests := newRetryServer(t, "", http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+	_, err := c.Get(context.Background(), "abc123")
+	if apiErr, ok := AsAPIError(err); !ok || apiErr.Status != http.StatusBadGateway || *requests != 3 {
+		t.Errorf("Gave up with %v after %d requests, want 502 after 3", err, *requests)
+	}
+
+	c, requests = newRetryServer(t, "", http.StatusNotFound)
+	var badRequest *BadRequest
+	if _, err = c.Get(context.Background(), "abc123"); !errors.As(err, &badRequest) || *requests != 1 {
+		t.Errorf("Client error %v retried, %d requests", err, *requests)
+	}
+}
+
+func TestRetryFollowsContext(t *testing.T) {
+	c, _ := newRetryServer(t, "30", http.StatusServiceUnavailable)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := c.Get(ctx, "abc123"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Cancelled retry gives %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Cancelled retry returned after %v", elapsed)
+	}
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Error response of the API, the typed errors below embed it so callers can match them with errors.As
+type APIError struct {
+	Status  int    // HTTP status code
+	Code    string // Error code of the envelope, like "link_not_found", empty for the form endpoints
+	Message string
+}
+
+func (e *APIError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%v (%d)", e.Message, e.Status)
+	}
+	return fmt.Sprintf("%v (%d %v)", e.Message, e.Status, e.Code)
+}
+
+func (e *APIError) apiError() *APIError {
+	return e
+}
+
+// Same errors as the server's custom_errors.go
+
+type Unauthorized struct{ APIError } // Not signed in, or not allowed to act on the resource
+
+type BadRequest struct{ APIError }
+
+type InvalidInput struct{ APIError }
+
+type NoSuchUser struct{ APIError }
+
+type NoSuchLink struct{ APIError }
+
+type NoSuchTransfer struct{ APIError }
+
+type Conflict struct{ APIError } // The short code is already used
+
+type IdempotencyKeyReused struct{ APIError } // The key was sent with another request
+
+type IdempotencyKeyInUse struct{ APIError } // The first request with the key is still running
+
+type EmailNotVerified struct{ APIError } // The account can't pick short codes until its email is verified
+
+// Returned by SignIn when the password is right but the account has two-factor authentication, VerifyTwoFactor
+// finishes the sign-in
+var ErrTwoFactorRequired = errors.New("two-factor code required")
+
+type RateLimited struct {
+	APIError
+	RetryAfter time.Duration // 0 if the server didn't say
+}
+
+// Returns the APIError of any error returned by the client, false for network and context errors
+func AsAPIError(err error) (*APIError, bool) {
+	var target interface{ apiError() *APIError }
+	if errors.As(err, &target) {
+		return target.apiError(), true
+	}
+	return nil, false
+}
+
+// Builds the typed error of an error response
+func newError(status int, code string, message string, retryAfter time.Duration) error {
+	base := APIError{status, code, message}
+	switch code {
+	case "unauthenticated", "forbidden":
+		return &Unauthorized{base}
+	case "invalid_input":
+		return &InvalidInput{base}
+	case "link_not_found":
+		return &NoSuchLink{base}
+	case "user_not_found":
+		return &NoSuchUser{base}
+	case "transfer_not_found":
+		return &NoSuchTransfer{base}
+	case "conflict":
+		return &Conflict{base}
+	case "rate_limited":
+		return &RateLimited{base, retryAfter}
+	case "idempotency_key_reused":
+		return &IdempotencyKeyReused{base}
+	case "idempotency_key_in_use":
+		return &IdempotencyKeyInUse{base}
+	case "email_not_verified":
+		return &EmailNotVerified{base}
+	}
+
+	// Responses without a known code, like the plain text ones of the form endpoints
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return &Unauthorized{base}
+	case status == http.StatusTooManyRequests:
+		return &RateLimited{base, retryAfter}
+	case status == http.StatusConflict:
+		return &Conflict{base}
+	case status >= 400 && status < 500:
+		return &BadRequest{base}
+	default:
+		return &base
+	}
+}
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Builds the response to decode, header holds name and value pairs
+func response(status int, body string, header ...string) *http.Response {
+	res := &http.Response{StatusCode: status, Header: make(http.Header), Body: io.NopCloser(strings.NewReader(body))}
+	for i := 0; i+1 < len(header); i += 2 {
+		res.Header.Set(header[i], header[i+1])
+	}
+	return res
+}
+
+func TestReadError(t *testing.T) {
+	tests := []struct {
+		name string
+		res  *http.Response
+		want error
+	}{
+		{"envelope", response(404, `{"error":{"code":"link_not_found","message":"No such link"}}`),
+			&NoSuchLink{APIError{404, "link_not_found", "No such link"}}},
+		{"forbidden", response(403, `{"error":{"code":"forbidden","message":"Not allowed"}}`),
+			&Unauthorized{APIError{403, "forbidden", "Not allowed"}}},
+		{"rate limited", response(429, `{"error":{"code":"rate_limited","message":"Too many requests"}}`, "Retry-After", "7"),
+			&RateLimited{APIError{429, "rate_limited", "Too many requests"}, 7 * time.Second}},
+		{"unknown code", response(422, `{"error":{"code":"new_code","message":"Something new"}}`),
+			&BadRequest{APIError{422, "new_code", "Something new"}}},
+		{"plain text", response(409, "Short URL already exists\n"),
+			&Conflict{APIError{409, "", "Short URL already exists"}}},
+		{"plain text rate limited", response(429, "Too many sign-ins", "Retry-After", "60"),
+			&RateLimited{APIError{429, "", "Too many sign-ins"}, time.Minute}},
+		{"empty body", response(400, ""),
+			&BadRequest{APIError{400, "", "Bad Request"}}},
+		{"envelope without code", response(401, `{"error":{}}`),
+			&Unauthorized{APIError{401, "", `{"error":{}}`}}},
+		{"server error", response(500, "Internal server error"),
+			&APIError{500, "", "Internal server error"}},
+	}
+
+	for _, test := range tests {
+		if err := readError(test.res); !reflect.DeepEqual(err, test.want) {
+			t.Errorf("%v: error %#v, want %#v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestReadErrorLimitsTheBody(t *testing.T) {
+	err := readError(response(502, strings.Repeat("a", 2*MAX_ERROR_BYTES)))
+	apiErr, ok := AsAPIError(err)
+	if !ok {
+		t.Fatalf("Error %v isn't an APIError", err)
+	}
+	if len(apiErr.Message) != MAX_ERROR_BYTES {
+		t.Errorf("Error of a long body has a message of %d bytes, want %d", len(apiErr.Message), MAX_ERROR_BYTES)
+	}
+}
+
+func TestErrorsAs(t *testing.T) {
+	err := error(&NoSuchLink{APIError{404, "link_not_found", "No such link"}})
+	wrapped := fmt.Errorf("getting abc123: %w", err)
+
+	var noSuchLink *NoSuchLink
+	if !errors.As(wrapped, &noSuchLink) || noSuchLink.Code != "link_not_found" {
+		t.Errorf("Wrapped error %v isn't a NoSuchLink", wrapped)
+	}
+	if apiErr, ok := AsAPIError(wrapped); !ok || apiErr.Status != 404 {
+		t.Errorf("Wrapped error %v has the APIError %v, %v", wrapped, apiErr, ok)
+	}
+	if err.Error() != "No such link (404 link_not_found)" {
+		t.Errorf("Error message %q", err.Error())
+	}
+
+	if _, ok := AsAPIError(io.ErrUnexpectedEOF); ok {
+		t.Error("Network error is an APIError")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"":                              0,
+		"3":                             3 * time.Second,
+		"0":                             0,
+		"-1":                            0,
+		"soon":                          0,
+		"Wed, 21 Oct 2015 07:28:00 GMT": 0, // HTTP dates aren't sent by the server
+	} {
+		header := make(http.Header)
+		header.Set("Retry-After", value)
+		if delay := parseRetryAfter(header); delay != want {
+			t.Errorf("Retry-After %q gives %v, want %v", value, delay, want)
+		}
+	}
+}
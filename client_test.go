@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"shr.me/client"
+)
+
+type clientTest struct {
+	db       *fakeDB
+	server   *httptest.Server
+	requests *int32 // Requests which reached the server, retries included
+}
+
+// Serves the API like main does behind a TLS server, wrap can put a misbehaving proxy in front of it
+func newClientTest(t *testing.T, configure func(*Config), wrap func(http.Handler) http.Handler) *clientTest {
+	db, config := newFakeDB(t)
+	if configure != nil {
+		configure(config)
+	}
+	api := newTestAPI(t, config)
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", http.StripPrefix("/api/", api))
+	mux.Handle(API_V1_PREFIX+"/", NewAPIv1(api))
+	rateLimiter := NewRateLimiter(api, mux, config.RateLimit)
+	manager := NewManager(rateLimiter, "session_id", time.Hour, time.Minute)
+	api.sessions = manager
+
+	var handler http.Handler = NewTokenAuth(api, rateLimiter, manager)
+	if wrap != nil {
+		handler = wrap(handler)
+	}
+	requests := new(int32)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	onAlice(t, db)
+	db.on("select userID, workspaceID from links where shortURL = ?", func(args []driver.Value) (fakeResult, error) {
+		if args[0] == "docs01" {
+			return fakeResult{rows: [][]driver.Value{{int64(7), nil}}}, nil
+		}
+		return fakeResult{}, nil
+	})
+	db.onRow("select shortURL, longURL from links where shortURL = ?", "docs01", "https://example.com/docs")
+	db.on("update links set longURL = ?", func(args []driver.Value) (fakeResult, error) {
+		return fakeResult{affected: 1}, nil
+	})
+	db.on("insert into links(", func(args []driver.Value) (fakeResult, error) {
+		return fakeResult{affected: 1}, nil
+	})
+	onIdempotencyKeys(db)
+	return &clientTest{db, server, requests}
+}
+
+// Returns a client of the test server signed in as alice, retrying after 10ms unless the server asks for longer
+func (test *clientTest) signedIn(t *testing.T) *client.Client {
+	httpClient := test.server.Client()
+	httpClient.Jar, _ = cookiejar.New(nil)
+	c, err := client.New(test.server.URL, client.WithHTTPClient(httpClient), client.WithRetries(3, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.SignIn(context.Background(), "alice", "right password")
+	if err != nil {
+		t.Fatal("Sign-in failed", err)
+	}
+	atomic.StoreInt32(test.requests, 0)
+	return c
+}
+
+func TestClientErrors(t *testing.T) {
+	test := newClientTest(t, nil, nil)
+	test.db.onRow("select 1 from links where shortURL = ?", "1")
+	ctx := context.Background()
+
+	anonymous, err := client.New(test.server.URL, client.WithHTTPClient(test.server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unauthorized *client.Unauthorized
+	if _, err = anonymous.Get(ctx, "docs01"); !errors.As(err, &unauthorized) || unauthorized.Code != "unauthenticated" {
+		t.Errorf("Get without a session returned %#v, want Unauthorized", err)
+	}
+
+	// The form endpoints answer in plain text
+	httpClient := test.server.Client()
+	httpClient.Jar, _ = cookiejar.New(nil)
+	c, err := client.New(test.server.URL, client.WithHTTPClient(httpClient))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.SignIn(ctx, "alice", "wrong password"); !errors.As(err, &unauthorized) || unauthorized.Status != http.StatusUnauthorized {
+		t.Errorf("Sign-in with a wrong password returned %#v, want Unauthorized", err)
+	}
+
+	c = test.signedIn(t)
+	var noSuchLink *client.NoSuchLink
+	if _, err = c.Get(ctx, "nope00"); !errors.As(err, &noSuchLink) || noSuchLink.Status != http.StatusNotFound {
+		t.Errorf("Get of an unknown link returned %#v, want NoSuchLink", err)
+	}
+	var conflict *client.Conflict
+	if _, err = c.Add(ctx, client.NewLink{Short: "docs01", Long: "https://example.com/other"}); !errors.As(err, &conflict) {
+		t.Errorf("Add of a used short code returned %#v, want Conflict", err)
+	}
+
+	if atomic.LoadInt32(test.requests) != 2 {
+		t.Errorf("Client errors were retried, %d requests for 2 calls", atomic.LoadInt32(test.requests))
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	t.Run("waits for the Retry-After of 429", func(t *testing.T) {
+		test := newClientTest(t, func(config *Config) {
+			config.RateLimit.Write = RateConfig{1, Duration{time.Second}, 1}
+		}, nil)
+		c := test.signedIn(t)
+
+		_, err := c.Update(context.Background(), "docs01", "https://example.com/first")
+		if err != nil {
+			t.Fatal("First update failed", err)
+		}
+
+		start := time.Now()
+		link, err := c.Update(context.Background(), "docs01", "https://example.com/second")
+		if err != nil {
+			t.Fatal("Rate limited update wasn't retried", err)
+		}
+		if elapsed := time.Since(start); elapsed < time.Second {
+			t.Errorf("Retried after %v, before the Retry-After of 1s", elapsed)
+		}
+		if link.Short != "docs01" {
+			t.Errorf("Update returned %+v", link)
+		}
+		if updates := test.db.executed("update links set longURL = ?"); len(updates) != 2 {
+			t.Errorf("%d updates saved, want 2", len(updates))
+		}
+		if requests := atomic.LoadInt32(test.requests); requests != 3 {
+			t.Errorf("%d requests, want the 2 updates and a retry", requests)
+		}
+	})
+
+	t.Run("waits for the Retry-After of 503", func(t *testing.T) {
+		var unavailable int32 = 1
+		test := newClientTest(t, nil, func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == API_V1_PREFIX+"/links/docs01" && atomic.CompareAndSwapInt32(&unavailable, 1, 0) {
+					w.Header().Set("Retry-After", "1")
+					http.Error(w, "Down for maintenance", http.StatusServiceUnavailable)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		})
+		c := test.signedIn(t)
+
+		start := time.Now()
+		link, err := c.Get(context.Background(), "docs01")
+		if err != nil {
+			t.Fatal("Get wasn't retried after 503", err)
+		}
+		if elapsed := time.Since(start); elapsed < time.Second {
+			t.Errorf("Retried after %v, before the Retry-After of 1s", elapsed)
+		}
+		if link.Long != "https://example.com/docs" {
+			t.Errorf("Get returned %+v", link)
+		}
+		if requests := atomic.LoadInt32(test.requests); requests != 2 {
+			t.Errorf("%d requests, want 2", requests)
+		}
+	})
+}
+
+func TestClientAddReplaysLostResponse(t *testing.T) {
+	// The first response is lost on its way back, like when a proxy times out after the link was created
+	var lost int32 = 1
+	test := newClientTest(t, nil, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || r.URL.Path != API_V1_PREFIX+"/links" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if atomic.CompareAndSwapInt32(&lost, 1, 0) {
+				next.ServeHTTP(httptest.NewRecorder(), r)
+				http.Error(w, "Gateway timeout", http.StatusGatewayTimeout)
+				return
+			}
+
+			recorder := httptest.NewRecorder()
+			next.ServeHTTP(recorder, r)
+			if recorder.Header().Get("Idempotent-Replayed") != "true" {
+				t.Errorf("Retry answered %v without replaying the recorded response", recorder.Code)
+			}
+			for name, values := range recorder.Header() {
+				w.Header()[name] = values
+			}
+			w.WriteHeader(recorder.Code)
+			w.Write(recorder.Body.Bytes())
+		})
+	})
+	c := test.signedIn(t)
+
+	link, err := c.Add(context.Background(), client.NewLink{Short: "new001", Long: "https://example.com/new"})
+	if err != nil {
+		t.Fatal("Add failed after the lost response", err)
+	}
+	if link.Short != "new001" || link.Long != "https://example.com/new" {
+		t.Errorf("Add returned %+v", link)
+	}
+
+	inserts := test.db.executed("insert into links(")
+	if len(inserts) != 1 {
+		t.Errorf("Link inserted %d times, want once", len(inserts))
+	}
+	keys := test.db.executed("insert ignore into idempotency_keys")
+	if len(keys) != 2 || keys[0][1] != keys[1][1] || keys[0][0] != "user:7" {
+		t.Errorf("Retry didn't send the same Idempotency-Key for userID(7): %v", keys)
+	}
+}
+
+func TestClientContextCancellation(t *testing.T) {
+	t.Run("stops waiting for Retry-After", func(t *testing.T) {
+		test := newClientTest(t, nil, func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == API_V1_PREFIX+"/links/docs01" {
+					w.Header().Set("Retry-After", "30")
+					http.Error(w, "Down for maintenance", http.StatusServiceUnavailable)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		})
+		c := test.signedIn(t)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err := c.Get(ctx, "docs01")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Get returned %#v, want the context's error", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("Get returned %v after the deadline", elapsed)
+		}
+		if requests := atomic.LoadInt32(test.requests); requests != 1 {
+			t.Errorf("%d requests, want 1", requests)
+		}
+	})
+
+	t.Run("aborts the request in flight", func(t *testing.T) {
+		started := make(chan struct{})
+		test := newClientTest(t, nil, func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == API_V1_PREFIX+"/links/docs01" {
+					close(started)
+					<-r.Context().Done()
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		})
+		c := test.signedIn(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-started
+			cancel()
+		}()
+		_, err := c.Get(ctx, "docs01")
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Get returned %#v, want context.Canceled", err)
+		}
+		if requests := atomic.LoadInt32(test.requests); requests != 1 {
+			t.Errorf("Canceled request was retried, %d requests", requests)
+		}
+	})
+}
@@ -0,0 +1,481 @@
+// Command shrctl manages shr.me links from the terminal, see shrctl help
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"shr.me/client"
+)
+
+// Exit codes, scripts can tell the API's errors apart with them
+const (
+	EXIT_OK           = 0
+	EXIT_ERROR        = 1 // Network errors and anything else
+	EXIT_USAGE        = 2
+	EXIT_UNAUTHORIZED = 3
+	EXIT_NOT_FOUND    = 4
+	EXIT_CONFLICT     = 5
+	EXIT_INVALID      = 6
+	EXIT_RATE_LIMITED = 7
+	EXIT_SERVER       = 8
+)
+
+const USAGE = `Usage: shrctl <command> [arguments] [flags]
+
+Commands:
+  login --url https://shr.me [--token shr_...]   Saves the server and a personal access token, read from stdin if not given
+  logout                                         Forgets the saved token
+  add <url> [--code docs01] [--workspace id]     Creates a link, the code is generated when not given
+  ls [--search text] [--sort code|destination|created|clicks] [--desc] [--workspace id] [--limit n] [--cursor c] [--all]
+  rm <code>...                                   Deletes links
+  stats <code>...                                Shows click statistics
+  export [--format json|csv] [--workspace id]    Writes every link
+
+Flags can be given before or after the arguments. Every command accepts:
+  -o, --output table|json|csv   Output format, table by default
+  --config path                 Config file, <user config dir>/shrctl/config.json by default
+  --url, --token                Override the saved server and token, also read from SHR_URL and SHR_TOKEN
+
+Exit codes: 0 success, 1 error, 2 usage, 3 unauthorized, 4 not found, 5 conflict,
+6 invalid input, 7 rate limited, 8 server error
+`
+
+// Saved by login, the token grants the scopes it was created with on the manage page
+type Config struct {
+	Url   string `json:"url"`
+	Token string `json:"token"`
+}
+
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "shrctl.json"
+	}
+	return filepath.Join(dir, "shrctl", "config.json")
+}
+
+func loadConfig(pathname string) (Config, error) {
+	var config Config
+	data, err := os.ReadFile(pathname)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	} else if err != nil {
+		return config, err
+	}
+	return config, json.Unmarshal(data, &config)
+}
+
+// Writes the config readable by the user only since it holds the token
+func saveConfig(pathname string, config Config) error {
+	err := os.MkdirAll(filepath.Dir(pathname), 0700)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(pathname, data, 0600)
+}
+
+// Error of the command line itself rather than of the API
+type usageError struct {
+	message string
+}
+
+func (e *usageError) Error() string {
+	return e.message
+}
+
+func usagef(format string, args ...any) error {
+	return &usageError{fmt.Sprintf(format, args...)}
+}
+
+// Parses flags placed anywhere between the positional arguments, "--" ends the flags
+func parseArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		err := flags.Parse(args)
+		if err == flag.ErrHelp {
+			return nil, &usageError{"usage:\n\n" + USAGE}
+		} else if err != nil {
+			return nil, &usageError{err.Error()}
+		}
+
+		rest := flags.Args()
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// Flags and state shared by every command
+type command struct {
+	flags      *flag.FlagSet
+	output     string
+	configPath string
+	url        string
+	token      string
+	stdout     io.Writer
+}
+
+func newCommand(name string) *command {
+	cmd := &command{flags: flag.NewFlagSet(name, flag.ContinueOnError), stdout: os.Stdout}
+	cmd.flags.SetOutput(io.Discard) // Errors are reported once by main
+	cmd.flags.StringVar(&cmd.output, "output", "table", "")
+	cmd.flags.StringVar(&cmd.output, "o", "table", "")
+	cmd.flags.StringVar(&cmd.configPath, "config", defaultConfigPath(), "")
+	cmd.flags.StringVar(&cmd.url, "url", os.Getenv("SHR_URL"), "")
+	cmd.flags.StringVar(&cmd.token, "token", os.Getenv("SHR_TOKEN"), "")
+	return cmd
+}
+
+func (cmd *command) parse(args []string, minArgs int, maxArgs int) ([]string, error) {
+	positional, err := parseArgs(cmd.flags, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(positional) < minArgs || (maxArgs >= 0 && len(positional) > maxArgs) {
+		return nil, usagef("wrong number of arguments for %v", cmd.flags.Name())
+	}
+	if cmd.output != "table" && cmd.output != "json" && cmd.output != "csv" {
+		return nil, usagef("unknown output format %q, use table, json or csv", cmd.output)
+	}
+	return positional, nil
+}
+
+// Returns a client of the saved server, the flags and environment take precedence over the config file
+func (cmd *command) client() (*client.Client, error) {
+	config, err := loadConfig(cmd.configPath)
+	if err != nil {
+		return nil, err
+	}
+	if cmd.url != "" {
+		config.Url = cmd.url
+	}
+	if cmd.token != "" {
+		config.Token = cmd.token
+	}
+
+	if config.Url == "" {
+		return nil, usagef("no server configured, run shrctl login --url https://...")
+	}
+
+	var options []client.Option
+	if config.Token != "" {
+		options = append(options, client.WithToken(config.Token))
+	}
+	return client.New(config.Url, options...)
+}
+
+// Writes rows in the selected output format, JSON output is data marshalled as is
+func (cmd *command) write(header []string, rows [][]string, data any) error {
+	switch cmd.output {
+	case "json":
+		encoder := json.NewEncoder(cmd.stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(data)
+
+	case "csv":
+		writer := csv.NewWriter(cmd.stdout)
+		writer.Write(header)
+		writer.WriteAll(rows)
+		return writer.Error()
+
+	default:
+		writer := tabwriter.NewWriter(cmd.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, strings.ToUpper(strings.Join(header, "\t")))
+		for _, row := range rows {
+			fmt.Fprintln(writer, strings.Join(row, "\t"))
+		}
+		return writer.Flush()
+	}
+}
+
+func (cmd *command) writeLinks(links []client.Link) error {
+	if links == nil {
+		links = []client.Link{}
+	}
+	rows := make([][]string, 0, len(links))
+	for _, link := range links {
+		rows = append(rows, []string{link.Short, link.Long})
+	}
+	return cmd.write([]string{"short", "long"}, rows, links)
+}
+
+func runLogin(ctx context.Context, args []string) error {
+	cmd := newCommand("login")
+	_, err := cmd.parse(args, 0, 0)
+	if err != nil {
+		return err
+	}
+	if cmd.url == "" {
+		return usagef("login needs --url")
+	}
+
+	token := cmd.token
+	if token == "" {
+		fmt.Fprint(os.Stderr, "Personal access token (create one on the manage page): ")
+		token, err = bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && token == "" {
+			return usagef("no token given")
+		}
+		token = strings.TrimSpace(token)
+	}
+
+	// Checks the token before saving it
+	c, err := client.New(cmd.url, client.WithToken(token))
+	if err != nil {
+		return usagef("%v", err)
+	}
+	_, err = c.List(ctx, client.ListOptions{Limit: 1})
+	if err != nil {
+		return err
+	}
+
+	err = saveConfig(cmd.configPath, Config{cmd.url, token})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Saved to %v\n", cmd.configPath)
+	return nil
+}
+
+func runLogout(ctx context.Context, args []string) error {
+	cmd := newCommand("logout")
+	_, err := cmd.parse(args, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig(cmd.configPath)
+	if err != nil {
+		return err
+	}
+	config.Token = ""
+	return saveConfig(cmd.configPath, config)
+}
+
+func runAdd(ctx context.Context, args []string) error {
+	cmd := newCommand("add")
+	code := cmd.flags.String("code", "", "")
+	workspace := cmd.flags.Int("workspace", 0, "")
+	positional, err := cmd.parse(args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	c, err := cmd.client()
+	if err != nil {
+		return err
+	}
+	link, err := c.Add(ctx, client.NewLink{Short: *code, Long: positional[0], Workspace: *workspace})
+	if err != nil {
+		return err
+	}
+	return cmd.writeLinks([]client.Link{link})
+}
+
+func runList(ctx context.Context, args []string) error {
+	cmd := newCommand("ls")
+	var options client.ListOptions
+	cmd.flags.StringVar(&options.Search, "search", "", "")
+	cmd.flags.StringVar(&options.Sort, "sort", "", "")
+	cmd.flags.BoolVar(&options.Desc, "desc", false, "")
+	cmd.flags.IntVar(&options.Workspace, "workspace", 0, "")
+	cmd.flags.IntVar(&options.Limit, "limit", 0, "")
+	cmd.flags.StringVar(&options.Cursor, "cursor", "", "")
+	all := cmd.flags.Bool("all", false, "")
+	tag := cmd.flags.String("tag", "", "")
+	_, err := cmd.parse(args, 0, 0)
+	if err != nil {
+		return err
+	}
+	if *tag != "" {
+		return usagef("links have no tags, use --search to filter on the code or destination")
+	}
+
+	c, err := cmd.client()
+	if err != nil {
+		return err
+	}
+
+	if *all {
+		var links []client.Link
+		err = c.Each(ctx, options, func(link client.Link) error {
+			links = append(links, link)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return cmd.writeLinks(links)
+	}
+
+	page, err := c.List(ctx, options)
+	if err != nil {
+		return err
+	}
+	err = cmd.writeLinks(page.Links)
+	if err == nil && page.Next != "" {
+		fmt.Fprintf(os.Stderr, "More links with --cursor %v or --all\n", page.Next)
+	}
+	return err
+}
+
+func runRemove(ctx context.Context, args []string) error {
+	cmd := newCommand("rm")
+	positional, err := cmd.parse(args, 1, -1)
+	if err != nil {
+		return err
+	}
+
+	c, err := cmd.client()
+	if err != nil {
+		return err
+	}
+	for _, code := range positional {
+		err = c.Delete(ctx, code)
+		if err != nil {
+			return fmt.Errorf("%v: %w", code, err)
+		}
+	}
+	return nil
+}
+
+func runStats(ctx context.Context, args []string) error {
+	cmd := newCommand("stats")
+	positional, err := cmd.parse(args, 1, -1)
+	if err != nil {
+		return err
+	}
+
+	c, err := cmd.client()
+	if err != nil {
+		return err
+	}
+
+	var stats []client.Stats
+	var rows [][]string
+	for _, code := range positional {
+		linkStats, err := c.Stats(ctx, code)
+		if err != nil {
+			return fmt.Errorf("%v: %w", code, err)
+		}
+		stats = append(stats, linkStats)
+		rows = append(rows, []string{linkStats.Short, strconv.FormatInt(linkStats.Clicks, 10), linkStats.Created})
+	}
+	return cmd.write([]string{"short", "clicks", "created"}, rows, stats)
+}
+
+func runExport(ctx context.Context, args []string) error {
+	cmd := newCommand("export")
+	format := cmd.flags.String("format", "json", "")
+	var options client.ListOptions
+	cmd.flags.IntVar(&options.Workspace, "workspace", 0, "")
+	_, err := cmd.parse(args, 0, 0)
+	if err != nil {
+		return err
+	}
+	if *format != "json" && *format != "csv" {
+		return usagef("unknown export format %q, use json or csv", *format)
+	}
+
+	c, err := cmd.client()
+	if err != nil {
+		return err
+	}
+	count, err := c.Export(ctx, cmd.stdout, *format, options)
+	if err == nil {
+		fmt.Fprintf(os.Stderr, "Exported %d links\n", count)
+	}
+	return err
+}
+
+var commands = map[string]func(context.Context, []string) error{
+	"login":  runLogin,
+	"logout": runLogout,
+	"add":    runAdd,
+	"ls":     runList,
+	"rm":     runRemove,
+	"stats":  runStats,
+	"export": runExport,
+}
+
+// Maps the typed errors of the client to the exit codes
+func exitCode(err error) int {
+	var usage *usageError
+	if errors.As(err, &usage) {
+		return EXIT_USAGE
+	}
+
+	var (
+		unauthorized *client.Unauthorized
+		noSuchLink   *client.NoSuchLink
+		noSuchUser   *client.NoSuchUser
+		conflict     *client.Conflict
+		invalidInput *client.InvalidInput
+		badRequest   *client.BadRequest
+		rateLimited  *client.RateLimited
+		keyReused    *client.IdempotencyKeyReused
+		keyInUse     *client.IdempotencyKeyInUse
+		notVerified  *client.EmailNotVerified
+	)
+	switch {
+	case errors.As(err, &unauthorized), errors.As(err, &notVerified):
+		return EXIT_UNAUTHORIZED
+	case errors.As(err, &noSuchLink), errors.As(err, &noSuchUser):
+		return EXIT_NOT_FOUND
+	case errors.As(err, &conflict), errors.As(err, &keyInUse):
+		return EXIT_CONFLICT
+	case errors.As(err, &invalidInput), errors.As(err, &badRequest), errors.As(err, &keyReused):
+		return EXIT_INVALID
+	case errors.As(err, &rateLimited):
+		return EXIT_RATE_LIMITED
+	}
+	if apiErr, ok := client.AsAPIError(err); ok && apiErr.Status >= 500 {
+		return EXIT_SERVER
+	}
+	return EXIT_ERROR
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "help" || os.Args[1] == "-h" || os.Args[1] == "--help" {
+		fmt.Print(USAGE)
+		return
+	}
+
+	run, exists := commands[os.Args[1]]
+	if !exists {
+		fmt.Fprintf(os.Stderr, "shrctl: unknown command %q\n\n%v", os.Args[1], USAGE)
+		os.Exit(EXIT_USAGE)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	err := run(ctx, os.Args[2:])
+	stop()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "shrctl: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	os.Exit(EXIT_OK)
+}
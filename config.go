@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Wraps time.Duration so it can be written as "10m" or "1h30m" in the config file
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+type CacheConfig struct {
+	Size        int      // Maximum number of short links kept in memory, 0 disables the cache
+	TTL         Duration // How long a resolved short link stays cached
+	NegativeTTL Duration // How long an unknown short link stays cached
+}
+
+type RateConfig struct {
+	Requests int // Number of requests refilled every Per
+	Per      Duration
+	Burst    int // Maximum number of requests allowed at once
+}
+
+// Returns an error if the rate can't refill, its limiter divides by Per
+func (rate RateConfig) validate(name string) error {
+	if rate.Per.Duration <= 0 {
+		return fmt.Errorf("%v.Per must be positive, got %v", name, rate.Per)
+	}
+	return nil
+}
+
+type AnonymousConfig struct {
+	Enabled      bool       // Allows sessions which aren't signed in to create links with a generated code
+	LinkLifetime Duration   // Anonymous links are deleted after this, 0 keeps them until they are claimed or deleted
+	PerIP        RateConfig // Creation quota for each client IP
+	PerSession   RateConfig // Creation quota for each session
+}
+
+type OIDCConfig struct {
+	Enabled      bool
+	Issuer       string // Must exactly match the "iss" of the provider, its metadata is discovered from it
+	ClientID     string
+	ClientSecret string   // Sent with HTTP basic authentication, may be empty for public clients
+	RedirectURL  string   // https://<host>/oidc/callback, registered at the provider
+	Scopes       []string // Defaults to openid, profile and email
+	AutoCreate   bool     // Creates a local user on the first sign-in of an unknown identity
+	ButtonLabel  string
+}
+
+type WebhookConfig struct {
+	Enabled              bool
+	Timeout              Duration // Time an endpoint has to answer a delivery
+	MaxAttempts          int      // A delivery is given up after this many failures, retried with exponential backoff
+	AllowPrivateNetworks bool     // Allows endpoints on loopback and private addresses, off so users can't reach internal services
+}
+
+type RateLimitConfig struct {
+	Enabled        bool
+	TrustedProxies []string   // Addresses or CIDR ranges of reverse proxies whose X-Forwarded-For header is believed
+	MaxKeys        int        // Clients tracked by each limiter, the fullest buckets are dropped beyond it
+	Redirect       RateConfig // Short link redirects
+	Auth           RateConfig // Sign-in, sign-up and single sign-on
+	Write          RateConfig // Requests changing data through the API
+}
+
+type LockoutConfig struct {
+	Enabled     bool
+	Window      Duration // Failures are forgotten once there was none for this long
+	DelayAfter  int      // Failures of a username after which it waits between attempts, 1s doubling with each failure
+	MaxDelay    Duration
+	Threshold   int // Failures of a username locking it for LockFor, whether or not the user exists
+	IPThreshold int // Failures from one IP, across usernames, locking it for LockFor
+	LockFor     Duration
+}
+
+type CORSConfig struct {
+	AllowedOrigins   []string // Like "https://dashboard.example.com", "*" allows any origin without credentials
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string // Response headers readable by the other origin
+	AllowCredentials bool     // Sends cookies along, only with listed origins
+	MaxAge           Duration // How long browsers cache a preflight response
+}
+
+type MailConfig struct {
+	SMTPAddress string // host:port, mails are only kept in memory when empty
+	Username    string // SMTP authentication, none when empty
+	Password    string
+	From        string
+	BaseURL     string // Public URL of the site used in the links of the mails, like https://shr.me
+
+	VerifyWithin Duration // Accounts created at sign-up are deleted if their email isn't verified within this, 0 keeps them
+}
+
+type Config struct {
+	Address    string
+	CertFile   string
+	KeyFile    string
+	SqlDriver  string
+	DataSource string
+	Cache      CacheConfig
+	Anonymous  AnonymousConfig
+
+	CaseInsensitiveCodes bool     // Short codes are stored in lower case and matched regardless of case
+	Admins               []string // Usernames allowed to use the /api/admin/ endpoints
+	OIDC                 OIDCConfig
+	Webhooks             WebhookConfig
+	RateLimit            RateLimitConfig
+	Lockout              LockoutConfig
+	CORS                 CORSConfig
+	Mail                 MailConfig
+}
+
+// Returns the configuration used when no config file overrides it
+func DefaultConfig() *Config {
+	return &Config{
+		Address:    ":443",
+		CertFile:   "server.crt",
+		KeyFile:    "private.key",
+		SqlDriver:  "mysql",
+		DataSource: "root:W.dVTc_+;7JC@tcp(localhost:3306)/test",
+		Cache: CacheConfig{
+			Size:        10000,
+			TTL:         Duration{10 * time.Minute},
+			NegativeTTL: Duration{time.Minute},
+		},
+		Anonymous: AnonymousConfig{
+			Enabled:      false,
+			LinkLifetime: Duration{7 * 24 * time.Hour},
+			PerIP:        RateConfig{20, Duration{time.Hour}, 5},
+			PerSession:   RateConfig{10, Duration{time.Hour}, 5},
+		},
+		OIDC: OIDCConfig{
+			Scopes:      []string{"openid", "profile", "email"},
+			ButtonLabel: "Sign in with SSO",
+		},
+		Webhooks: WebhookConfig{
+			Enabled:     true,
+			Timeout:     Duration{10 * time.Second},
+			MaxAttempts: 8,
+		},
+		RateLimit: RateLimitConfig{
+			Enabled:  true,
+			MaxKeys:  100000,
+			Redirect: RateConfig{600, Duration{time.Minute}, 100},
+			Auth:     RateConfig{10, Duration{time.Minute}, 5},
+			Write:    RateConfig{120, Duration{time.Minute}, 30},
+		},
+		Lockout: LockoutConfig{
+			Enabled:     true,
+			Window:      Duration{time.Hour},
+			DelayAfter:  3,
+			MaxDelay:    Duration{30 * time.Second},
+			Threshold:   10,
+			IPThreshold: 100,
+			LockFor:     Duration{15 * time.Minute},
+		},
+		Mail: MailConfig{
+			From:         "shr.me <no-reply@shr.me>",
+			BaseURL:      "https://shr.me",
+			VerifyWithin: Duration{7 * 24 * time.Hour},
+		},
+		CORS: CORSConfig{
+			AllowedMethods: []string{"GET", "POST", "PATCH", "DELETE"},
+			AllowedHeaders: []string{"Authorization", "Content-Type", "Idempotency-Key"},
+			ExposedHeaders: []string{"Link", "Location", "Retry-After", "Idempotent-Replayed", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy"},
+			MaxAge:         Duration{10 * time.Minute},
+		},
+	}
+}
+
+// Reads the JSON config file on top of the defaults, a missing file leaves the defaults untouched
+func LoadConfig(pathname string) (*Config, error) {
+	config := DefaultConfig()
+
+	data, err := os.ReadFile(pathname)
+	if errors.Is(err, fs.ErrNotExist) {
+		Warning.Printf("No config file found at %v, using defaults\n", pathname)
+	} else if err != nil {
+		return nil, err
+	} else {
+		err = json.Unmarshal(data, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = config.validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Returns an error for the values the server can't run with, and turns off what needs a setting which is missing
+func (config *Config) validate() error {
+	rates := map[string]struct {
+		RateConfig
+		enabled bool
+	}{
+		"Anonymous.PerIP":      {config.Anonymous.PerIP, config.Anonymous.Enabled},
+		"Anonymous.PerSession": {config.Anonymous.PerSession, config.Anonymous.Enabled},
+		"RateLimit.Redirect":   {config.RateLimit.Redirect, config.RateLimit.Enabled},
+		"RateLimit.Auth":       {config.RateLimit.Auth, config.RateLimit.Enabled},
+		"RateLimit.Write":      {config.RateLimit.Write, config.RateLimit.Enabled},
+	}
+	for name, rate := range rates {
+		// Like NewRateLimiter, a class without requests or burst isn't limited and its Per is unused
+		if !rate.enabled || rate.Requests <= 0 || rate.Burst <= 0 {
+			continue
+		}
+		err := rate.validate(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The verification links would never arrive, new accounts would be limited and then deleted for nothing
+	if config.Mail.SMTPAddress == "" && config.Mail.VerifyWithin.Duration > 0 {
+		Warning.Println("No SMTP server configured, accounts with an unverified email are kept and not limited")
+		config.Mail.VerifyWithin = Duration{}
+	}
+	return nil
+}
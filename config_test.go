@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigRejectsNonPositivePer(t *testing.T) {
+	configs := map[string]string{
+		"RateLimit.Auth":       `{"RateLimit": {"Auth": {"Requests": 10, "Per": "0s", "Burst": 5}}}`,
+		"Anonymous.PerSession": `{"Anonymous": {"Enabled": true, "PerSession": {"Requests": 10, "Per": "-1m", "Burst": 5}}}`,
+	}
+
+	for name, content := range configs {
+		path := filepath.Join(t.TempDir(), "config.json")
+		err := os.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = LoadConfig(path)
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("Config %v loaded with error %v, want one about %v", content, err, name)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(`{"RateLimit": {"Auth": {"Requests": 10, "Per": "30s", "Burst": 5}}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadConfig(path); err != nil {
+		t.Errorf("Valid config refused: %v", err)
+	}
+}
+
+// The limiters skip disabled classes, so their Per is never divided by
+func TestLoadConfigIgnoresDisabledRates(t *testing.T) {
+	configs := []string{
+		`{"RateLimit": {"Enabled": false, "Auth": {"Requests": 10, "Per": "0s", "Burst": 5}}}`,
+		`{"RateLimit": {"Write": {"Requests": 0, "Per": "0s", "Burst": 0}}}`,
+		`{"Anonymous": {"Enabled": false, "PerIP": {"Requests": 10, "Per": "0s", "Burst": 5}}}`,
+	}
+
+	for _, content := range configs {
+		path := filepath.Join(t.TempDir(), "config.json")
+		err := os.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = LoadConfig(path); err != nil {
+			t.Errorf("Config %v with a disabled rate refused: %v", content, err)
+		}
+	}
+}
+
+func TestLoadConfigKeepsUnverifiedAccountsWithoutSMTP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(`{"Mail": {"VerifyWithin": "24h"}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Mail.VerifyWithin.Duration != 0 {
+		t.Errorf("VerifyWithin is %v without an SMTP server, unverified accounts would be deleted", config.Mail.VerifyWithin)
+	}
+
+	err = os.WriteFile(path, []byte(`{"Mail": {"SMTPAddress": "smtp.example.com:587", "VerifyWithin": "24h"}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err = LoadConfig(path)
+	if err != nil || config.Mail.VerifyWithin.Duration != 24*time.Hour {
+		t.Errorf("VerifyWithin changed with an SMTP server: %v, %v", config.Mail.VerifyWithin, err)
+	}
+}
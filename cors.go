@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	CORS_PATH_PREFIX = "/api/" // Only the API is shared with other origins, pages and redirects aren't
+)
+
+// Middleware answering CORS preflight requests and adding the CORS headers to the API responses of allowed origins.
+// It wraps everything so rate limited and token errors can be read by the other origin too
+type CORS struct {
+	handler        http.Handler
+	origins        map[string]bool // Lower case, "*" allows any origin
+	methods        map[string]bool
+	headers        map[string]bool // Canonical header names
+	allowedMethods string
+	allowedHeaders string
+	exposedHeaders string
+	credentials    bool
+	maxAge         string // Seconds, empty to leave preflight caching to the browser
+}
+
+func NewCORS(config CORSConfig, handler http.Handler) *CORS {
+	cors := &CORS{
+		handler:        handler,
+		origins:        make(map[string]bool),
+		methods:        make(map[string]bool),
+		headers:        make(map[string]bool),
+		allowedMethods: strings.Join(config.AllowedMethods, ", "),
+		allowedHeaders: strings.Join(config.AllowedHeaders, ", "),
+		exposedHeaders: strings.Join(config.ExposedHeaders, ", "),
+		credentials:    config.AllowCredentials,
+	}
+	for _, origin := range config.AllowedOrigins {
+		cors.origins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+	for _, method := range config.AllowedMethods {
+		cors.methods[strings.ToUpper(method)] = true
+	}
+	for _, header := range config.AllowedHeaders {
+		cors.headers[http.CanonicalHeaderKey(header)] = true
+	}
+	if config.MaxAge.Duration > 0 {
+		cors.maxAge = strconv.Itoa(int(config.MaxAge.Seconds()))
+	}
+	if cors.origins["*"] && cors.credentials {
+		Warning.Println("CORS credentials aren't allowed with the \"*\" origin, browsers would reject them")
+		cors.credentials = false
+	}
+	return cors
+}
+
+// Returns the Access-Control-Allow-Origin value for origin, empty when it isn't allowed.
+// Only listed origins are echoed, anything else never makes it into a response
+func (cors *CORS) allowOrigin(origin string) string {
+	if cors.origins[strings.ToLower(origin)] {
+		return origin
+	}
+	if cors.origins["*"] {
+		return "*"
+	}
+	return ""
+}
+
+// Returns true if every header of the comma separated Access-Control-Request-Headers list is allowed
+func (cors *CORS) allowHeaders(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header != "" && !cors.headers[http.CanonicalHeaderKey(header)] {
+			return false
+		}
+	}
+	return true
+}
+
+func (cors *CORS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" || !strings.HasPrefix(r.URL.Path, CORS_PATH_PREFIX) {
+		cors.handler.ServeHTTP(w, r)
+		return
+	}
+
+	// The response depends on the origin, caches mustn't give it to another one
+	w.Header().Add("Vary", "Origin")
+	allowed := cors.allowOrigin(origin)
+
+	requestedMethod := r.Header.Get("Access-Control-Request-Method")
+	if r.Method == http.MethodOptions && requestedMethod != "" {
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		requestedHeaders := strings.Join(r.Header.Values("Access-Control-Request-Headers"), ",")
+		if allowed == "" || !cors.methods[requestedMethod] || !cors.allowHeaders(requestedHeaders) {
+			Info.Printf("Rejecting CORS preflight from %v for %v %v\n", origin, requestedMethod, r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", allowed)
+		w.Header().Set("Access-Control-Allow-Methods", cors.allowedMethods)
+		if cors.allowedHeaders != "" {
+			w.Header().Set("Access-Control-Allow-Headers", cors.allowedHeaders)
+		}
+		if cors.credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if cors.maxAge != "" {
+			w.Header().Set("Access-Control-Max-Age", cors.maxAge)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if allowed != "" {
+		w.Header().Set("Access-Control-Allow-Origin", allowed)
+		if cors.credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if cors.exposedHeaders != "" {
+			w.Header().Set("Access-Control-Expose-Headers", cors.exposedHeaders)
+		}
+	}
+	cors.handler.ServeHTTP(w, r)
+}
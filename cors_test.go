@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type corsTest struct {
+	cors   *CORS
+	served int
+}
+
+func newCORSTest(origins ...string) *corsTest {
+	config := DefaultConfig().CORS
+	config.AllowedOrigins = origins
+	config.AllowCredentials = true
+
+	test := &corsTest{}
+	test.cors = NewCORS(config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		test.served++
+		w.WriteHeader(http.StatusOK)
+	}))
+	return test
+}
+
+func (test *corsTest) do(method string, path string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	for name, value := range header {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	test.cors.ServeHTTP(w, r)
+	return w
+}
+
+// The origin must not appear anywhere in the response, a reflected origin would let any site read it
+func assertNotReflected(t *testing.T, w *httptest.ResponseRecorder, origin string) {
+	t.Helper()
+	for name, values := range w.Header() {
+		for _, value := range values {
+			if strings.Contains(value, origin) || (name == "Access-Control-Allow-Origin" && value != "") {
+				t.Errorf("Origin %v allowed by %v: %v", origin, name, value)
+			}
+		}
+	}
+	if w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("Credentials allowed for origin %v", origin)
+	}
+}
+
+func TestCORSAllowedOrigin(t *testing.T) {
+	test := newCORSTest("https://dashboard.example.com")
+
+	w := test.do(http.MethodGet, API_V1_PREFIX+"/links", map[string]string{"Origin": "https://dashboard.example.com"})
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://dashboard.example.com" || w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("Listed origin answered with %v", w.Header())
+	}
+	if !strings.Contains(w.Header().Get("Access-Control-Expose-Headers"), "Retry-After") || w.Header().Get("Vary") != "Origin" {
+		t.Errorf("Listed origin answered with %v", w.Header())
+	}
+
+	w = test.do(http.MethodOptions, API_V1_PREFIX+"/links", map[string]string{
+		"Origin":                         "https://dashboard.example.com",
+		"Access-Control-Request-Method":  "POST",
+		"Access-Control-Request-Headers": "content-type, idempotency-key",
+	})
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "https://dashboard.example.com" {
+		t.Errorf("Preflight of the listed origin answered %v with %v", w.Code, w.Header())
+	}
+	if w.Header().Get("Access-Control-Allow-Methods") != "GET, POST, PATCH, DELETE" || w.Header().Get("Access-Control-Max-Age") != "600" {
+		t.Errorf("Preflight of the listed origin answered with %v", w.Header())
+	}
+	if test.served != 1 {
+		t.Errorf("Preflight reached the API, %d requests served", test.served)
+	}
+}
+
+func TestCORSDisallowedOriginNeverReflected(t *testing.T) {
+	test := newCORSTest("https://dashboard.example.com")
+
+	for _, origin := range []string{
+		"https://evil.example.net",
+		"https://dashboard.example.com.evil.example.net",
+		"http://dashboard.example.com",
+		"null",
+	} {
+		w := test.do(http.MethodPost, API_V1_PREFIX+"/links", map[string]string{"Origin": origin})
+		assertNotReflected(t, w, origin)
+		if w.Header().Get("Vary") != "Origin" {
+			t.Errorf("Response to %v can be cached for other origins: %v", origin, w.Header())
+		}
+
+		w = test.do(http.MethodOptions, API_V1_PREFIX+"/links", map[string]string{"Origin": origin, "Access-Control-Request-Method": "GET"})
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Preflight from %v answered %v", origin, w.Code)
+		}
+		assertNotReflected(t, w, origin)
+	}
+}
+
+func TestCORSPreflightRefusals(t *testing.T) {
+	test := newCORSTest("https://dashboard.example.com")
+
+	for name, header := range map[string]map[string]string{
+		"method":  {"Access-Control-Request-Method": "PUT"},
+		"header":  {"Access-Control-Request-Method": "POST", "Access-Control-Request-Headers": "Content-Type, X-Debug"},
+		"cookies": {"Access-Control-Request-Method": "GET", "Access-Control-Request-Headers": "Cookie"},
+	} {
+		header["Origin"] = "https://dashboard.example.com"
+		w := test.do(http.MethodOptions, API_V1_PREFIX+"/links", header)
+		if w.Code != http.StatusForbidden || w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("Preflight with a %v which isn't allowed answered %v with %v", name, w.Code, w.Header())
+		}
+	}
+	if test.served != 0 {
+		t.Errorf("Refused preflights reached the API, %d requests served", test.served)
+	}
+}
+
+func TestCORSAnyOriginWithoutCredentials(t *testing.T) {
+	test := newCORSTest("*")
+
+	w := test.do(http.MethodGet, API_V1_PREFIX+"/links", map[string]string{"Origin": "https://anywhere.example.net"})
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" || w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("Any origin answered with %v, want * without credentials", w.Header())
+	}
+
+	w = test.do(http.MethodOptions, API_V1_PREFIX+"/links", map[string]string{"Origin": "https://anywhere.example.net", "Access-Control-Request-Method": "DELETE"})
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "*" || w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("Preflight of any origin answered %v with %v", w.Code, w.Header())
+	}
+}
+
+func TestCORSOnlyOnTheAPI(t *testing.T) {
+	test := newCORSTest("https://dashboard.example.com")
+
+	for _, path := range []string{"/manage", "/abc123"} {
+		w := test.do(http.MethodGet, path, map[string]string{"Origin": "https://dashboard.example.com"})
+		if w.Header().Get("Access-Control-Allow-Origin") != "" || w.Header().Get("Vary") != "" {
+			t.Errorf("%v shared with another origin: %v", path, w.Header())
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 type NoSuchStatementError struct{}
 
 func (e *NoSuchStatementError) Error() string {
@@ -24,8 +26,69 @@ func (e *NoSuchUser) Error() string {
 	return "User does not exist"
 }
 
-type InvalidInput struct{}
+type InvalidInput struct {
+	Reason string // Told to the user instead of the generic message when set
+}
 
 func (e *InvalidInput) Error() string {
+	if e.Reason != "" {
+		return e.Reason
+	}
 	return "Input was unvalid"
 }
+
+type NoSuchLink struct{}
+
+func (e *NoSuchLink) Error() string {
+	return "Short link does not exist"
+}
+
+type RateLimited struct{}
+
+func (e *RateLimited) Error() string {
+	return "Too many requests, try again later"
+}
+
+type NoSuchTransfer struct{}
+
+func (e *NoSuchTransfer) Error() string {
+	return "Transfer request does not exist"
+}
+
+type Conflict struct{}
+
+func (e *Conflict) Error() string {
+	return "Resource already exists"
+}
+
+type IdempotencyKeyReused struct{}
+
+func (e *IdempotencyKeyReused) Error() string {
+	return "Idempotency key already used with another request"
+}
+
+type IdempotencyKeyInUse struct{}
+
+func (e *IdempotencyKeyInUse) Error() string {
+	return "A request with this idempotency key is still running"
+}
+
+type EmailNotVerified struct{}
+
+func (e *EmailNotVerified) Error() string {
+	return "Verify your email address first"
+}
+
+type TwoFactorRequired struct{}
+
+func (e *TwoFactorRequired) Error() string {
+	return "Enter the code of your authenticator app"
+}
+
+type LoginThrottled struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginThrottled) Error() string {
+	return "Too many failed sign-ins, try again later"
+}
@@ -1,5 +1,7 @@
 package main
 
+import "html/template"
+
 type UserData struct {
 	Id   int
 	Name string
@@ -11,7 +13,128 @@ type LinkData struct {
 	Short, Long string
 }
 
+type LinkStats struct {
+	Short   string
+	Clicks  int64
+	Created string
+}
+
+type TokenData struct {
+	Id       int
+	Name     string
+	Scopes   []string
+	Created  string
+	Expires  string // Empty if the token never expires
+	LastUsed string // Empty if the token was never used
+}
+
+type TransferData struct {
+	Id       int
+	From, To string // Usernames
+	Short    string // Empty when every link is transferred
+	Created  string
+	Incoming bool // True if the session's user is the recipient
+}
+
+type WorkspaceData struct {
+	Id   int
+	Name string
+	Role Role // Role of the session's user
+}
+
+type MemberData struct {
+	Username string
+	Role     Role
+}
+
+// Data of base.template.html, Content is the page inside it
+type BasePageData struct {
+	Content  template.HTML
+	SignedIn bool
+}
+
+type ResetPageData struct {
+	Token string // From the reset link, sent back with the new password
+}
+
+// Returned when setting up two-factor authentication, the secret is for apps which can't scan the QR code
+type TwoFactorSetup struct {
+	Secret string // Base32
+	URI    string // otpauth:// provisioning URI
+	QR     string // SVG image of the URI, empty if it's too long for a QR code
+}
+
+type VerifyPageData struct {
+	Token string // From the verification link, posted when the user confirms
+}
+
+type LoginPageData struct {
+	OIDCEnabled bool
+	OIDCLabel   string
+}
+
+type LoginFailureData struct {
+	IP      string
+	Created string
+}
+
+type ExportedProfile struct {
+	User          UserData
+	Username      string
+	Email         string
+	EmailVerified bool
+	TwoFactor     bool
+}
+
+type ExportedLink struct {
+	Short, Long string
+	Workspace   int    // 0 for personal links
+	Expires     string // Empty if it never expires
+	Created     string
+}
+
+type ExportedAudit struct {
+	FailedSignIns []LoginFailureData
+	Transfers     []TransferData // Pending link transfers from and to the user
+}
+
+type WebhookData struct {
+	Id      int
+	Url     string
+	Events  []string
+	Created string
+}
+
+type DeliveryData struct {
+	Id             int
+	Event          string
+	Status         string // pending, delivered or failed
+	Attempts       int
+	ResponseStatus int    // 0 when no response was received
+	Error          string // Why the last attempt failed
+	Created        string
+	NextAttempt    string // Only set for pending deliveries
+}
+
 type ManagePageData struct {
-	User  UserData
-	Links []LinkData
+	User       UserData
+	Username   string
+	Email      string // Where password reset links are sent, empty if none
+	Verified   bool   // The email was verified, reset links are only sent to verified emails
+	Password   bool   // Single sign-on accounts have none, they sign in again to delete the account
+	TwoFactor  bool
+	Recovery   int // Unused recovery codes, when TwoFactor is on
+	Failures   []LoginFailureData
+	Links      []LinkData
+	LinkQuery  LinkQuery // Sort, order and search of the displayed page
+	NextPage   string    // URL of the next page of links, empty on the last page
+	Transfers  []TransferData
+	Workspaces []WorkspaceData
+	Workspace  *WorkspaceData // Currently selected workspace, nil for personal links
+	Members    []MemberData
+	CanEdit    bool // The session's user can add and delete the displayed links
+	Tokens     []TokenData
+	OIDC       bool // Shows the button linking an SSO identity
+	Webhooks   []WebhookData
+	CanHook    bool // The session's user can manage the webhooks of the displayed links
 }
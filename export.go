@@ -0,0 +1,153 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Collects the personal data of the session's user in a ZIP of JSON files: profile.json, links.json, stats.json
+// and audit.json with the failed sign-ins and link transfers, plus the access tokens and workspace memberships
+func (api *API) exportData(session *Session) ([]byte, string, error) {
+	if !session.signedIn || !session.hasScope(SCOPE_ACCOUNT) {
+		Info.Printf("Rejecting data export with SID(%v)\n", session.sid)
+		return nil, "", &Unauthorized{}
+	}
+
+	var profile ExportedProfile
+	err := api.QueryRow("userData_from_userId", []any{session.userId}, &profile.User.Id, &profile.User.Name, &profile.User.Age, &profile.User.Born)
+	if err != nil {
+		Error.Println("Failed to get user data", err)
+		return nil, "", err
+	}
+	err = api.QueryRow("username_from_userId", []any{session.userId}, &profile.Username)
+	if err != nil {
+		Error.Println("Failed to get username", err)
+		return nil, "", err
+	}
+	var email sql.NullString
+	err = api.QueryRow("email_from_userId", []any{session.userId}, &email, &profile.EmailVerified)
+	if err != nil {
+		Error.Println("Failed to get email", err)
+		return nil, "", err
+	}
+	profile.Email = email.String
+	profile.TwoFactor, err = api.twoFactorEnabled(session.userId)
+	if err != nil {
+		return nil, "", err
+	}
+
+	links, stats, err := api.exportLinks(session.userId)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var audit ExportedAudit
+	rows, err := api.Query("export_login_failures_of_user", session.userId)
+	if err != nil {
+		Error.Println("Failed to get failed sign-ins", err)
+		return nil, "", err
+	}
+	for rows.Next() {
+		var failure LoginFailureData
+		err = rows.Scan(&failure.IP, &failure.Created)
+		if err != nil {
+			rows.Close()
+			return nil, "", err
+		}
+		audit.FailedSignIns = append(audit.FailedSignIns, failure)
+	}
+	rows.Close()
+	audit.Transfers, err = api.getTransfers(session)
+	if err != nil {
+		return nil, "", err
+	}
+
+	tokens, err := api.getTokens(session)
+	if err != nil {
+		return nil, "", err
+	}
+	workspaces, err := api.getWorkspaces(session)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	files := []struct {
+		name string
+		data any
+	}{
+		{"profile.json", profile},
+		{"links.json", links},
+		{"stats.json", stats},
+		{"audit.json", audit},
+		{"tokens.json", tokens},
+		{"workspaces.json", workspaces},
+	}
+	for _, file := range files {
+		content, err := json.MarshalIndent(file.data, "", "\t")
+		if err != nil {
+			return nil, "", err
+		}
+		f, err := archive.Create(file.name)
+		if err != nil {
+			return nil, "", err
+		}
+		_, err = f.Write(content)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	err = archive.Close()
+	if err != nil {
+		return nil, "", err
+	}
+
+	Info.Printf("UserID(%d) exported their data\n", session.userId)
+	return buf.Bytes(), "shr.me-export-" + time.Now().Format("2006-01-02") + ".zip", nil
+}
+
+// Returns every link created by the user, personal and in workspaces, with their stats
+func (api *API) exportLinks(userId int) (links []ExportedLink, stats []LinkStats, err error) {
+	rows, err := api.Query("export_links_of_user", userId)
+	if err != nil {
+		Error.Println("Failed to get links", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var link ExportedLink
+		var workspaceId sql.NullInt64
+		var expires, created sql.NullString
+		var clicks int64
+		err = rows.Scan(&link.Short, &link.Long, &workspaceId, &expires, &created, &clicks)
+		if err != nil {
+			return
+		}
+		link.Workspace = int(workspaceId.Int64)
+		link.Expires = expires.String
+		link.Created = created.String
+		links = append(links, link)
+		stats = append(stats, LinkStats{link.Short, clicks, link.Created})
+	}
+
+	return
+}
+
+func (api *API) handleExport(w http.ResponseWriter, r *http.Request, session *Session) {
+	archive, filename, err := api.exportData(session)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(archive)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// database/sql driver answering the API's statements from handlers registered by the test, so the handlers can run
+// without MySQL. The data source name picks the fakeDB
+const FAKE_SQL_DRIVER = "shrtest"
+
+var (
+	fakeDBs      = make(map[string]*fakeDB)
+	fakeDBsMutex = new(sync.Mutex)
+)
+
+func init() {
+	sql.Register(FAKE_SQL_DRIVER, fakeDriver{})
+}
+
+// Answer of a statement, rows for queries and affected rows for the others
+type fakeResult struct {
+	rows     [][]driver.Value
+	affected int64
+	insertId int64
+}
+
+type fakeHandler struct {
+	fragment string
+	answer   func(args []driver.Value) (fakeResult, error)
+}
+
+type fakeDB struct {
+	mutex    *sync.Mutex
+	handlers []fakeHandler
+	calls    []fakeCall
+	lastId   int64
+}
+
+type fakeCall struct {
+	query string
+	args  []driver.Value
+}
+
+// Returns a fakeDB and the config of an API using it, unknown statements return no rows and affect nothing
+func newFakeDB(t *testing.T) (*fakeDB, *Config) {
+	db := &fakeDB{mutex: new(sync.Mutex)}
+
+	fakeDBsMutex.Lock()
+	dsn := fmt.Sprintf("%v#%d", t.Name(), len(fakeDBs))
+	fakeDBs[dsn] = db
+	fakeDBsMutex.Unlock()
+
+	config := DefaultConfig()
+	config.SqlDriver = FAKE_SQL_DRIVER
+	config.DataSource = dsn
+	config.Webhooks.Enabled = false
+	return db, config
+}
+
+// Answers the statements containing the fragment, the handlers registered last are tried first
+func (db *fakeDB) on(fragment string, answer func(args []driver.Value) (fakeResult, error)) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.handlers = append(db.handlers, fakeHandler{fragment, answer})
+}
+
+// Answers the queries containing the fragment with a single row
+func (db *fakeDB) onRow(fragment string, values ...driver.Value) {
+	db.on(fragment, func(args []driver.Value) (fakeResult, error) {
+		return fakeResult{rows: [][]driver.Value{values}}, nil
+	})
+}
+
+// Returns the arguments of every execution of the statements containing the fragment, oldest first
+func (db *fakeDB) executed(fragment string) (res [][]driver.Value) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	for _, call := range db.calls {
+		if strings.Contains(call.query, fragment) {
+			res = append(res, call.args)
+		}
+	}
+	return
+}
+
+// Returns the statements run so far, oldest first
+func (db *fakeDB) queries() (res []string) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	for _, call := range db.calls {
+		res = append(res, call.query)
+	}
+	return
+}
+
+func (db *fakeDB) run(query string, args []driver.Value) (fakeResult, error) {
+	db.mutex.Lock()
+	var handler *fakeHandler
+	for i := len(db.handlers) - 1; i >= 0; i-- {
+		if strings.Contains(query, db.handlers[i].fragment) {
+			handler = &db.handlers[i]
+			break
+		}
+	}
+	db.lastId++
+	lastId := db.lastId
+	db.calls = append(db.calls, fakeCall{query, args})
+	db.mutex.Unlock()
+
+	if handler == nil {
+		return fakeResult{}, nil
+	}
+	res, err := handler.answer(args)
+	if res.insertId == 0 {
+		res.insertId = lastId
+	}
+	return res, err
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBsMutex.Lock()
+	defer fakeDBsMutex.Unlock()
+
+	db, exists := fakeDBs[name]
+	if !exists {
+		return nil, fmt.Errorf("no fake database %v", name)
+	}
+	return &fakeConn{db}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (conn *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn.db, query}, nil
+}
+
+func (conn *fakeConn) Close() error {
+	return nil
+}
+
+// Transactions run the begin, commit and rollback statements, so tests can see and answer them like the others
+func (conn *fakeConn) Begin() (driver.Tx, error) {
+	_, err := conn.db.run("begin", nil)
+	if err != nil {
+		return nil, err
+	}
+	return fakeTx{conn.db}, nil
+}
+
+type fakeTx struct {
+	db *fakeDB
+}
+
+func (tx fakeTx) Commit() error {
+	_, err := tx.db.run("commit", nil)
+	return err
+}
+
+func (tx fakeTx) Rollback() error {
+	_, err := tx.db.run("rollback", nil)
+	return err
+}
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (stmt *fakeStmt) Close() error {
+	return nil
+}
+
+func (stmt *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (stmt *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	res, err := stmt.db.run(stmt.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return fakeExecResult(res), nil
+}
+
+func (stmt *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	res, err := stmt.db.run(stmt.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{rows: res.rows}, nil
+}
+
+type fakeExecResult fakeResult
+
+func (res fakeExecResult) LastInsertId() (int64, error) {
+	return res.insertId, nil
+}
+
+func (res fakeExecResult) RowsAffected() (int64, error) {
+	return res.affected, nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+	next int
+}
+
+func (rows *fakeRows) Columns() []string {
+	if len(rows.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(rows.rows[0]))
+}
+
+func (rows *fakeRows) Close() error {
+	return nil
+}
+
+func (rows *fakeRows) Next(dest []driver.Value) error {
+	if rows.next >= len(rows.rows) {
+		return io.EOF
+	}
+	copy(dest, rows.rows[rows.next])
+	rows.next++
+	return nil
+}
+
+// Returns an API on the fakeDB of the config
+func newTestAPI(t *testing.T, config *Config) *API {
+	api, err := InitAPI(config)
+	if err != nil {
+		t.Fatal("Failed to init API", err)
+	}
+	t.Cleanup(api.Close)
+	return api
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	IDEMPOTENCY_KEY_HEADER     = "Idempotency-Key"
+	IDEMPOTENCY_KEY_MAX_LENGTH = 255
+	IDEMPOTENCY_KEY_RETENTION  = 24 * time.Hour
+	IDEMPOTENCY_MAX_BODY_BYTES = 1 << 20
+)
+
+// Response headers kept with an idempotency key, the others are generated again on replay
+var idempotentHeaders = []string{"Content-Type", "Location"}
+
+// Records the response of a handler while writing it
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(data []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(data)
+	return rw.ResponseWriter.Write(data)
+}
+
+// Keys are scoped to the user, or to the session for anonymous requests, so nobody can replay someone else's response
+func idempotencyOwner(session *Session) string {
+	if session.signedIn {
+		return fmt.Sprintf("user:%d", session.userId)
+	}
+	return "session:" + session.sid
+}
+
+// Runs handler at most once per Idempotency-Key header, retries with the same key and payload get the recorded response.
+// Requests without the header run handler directly, errors are written with writeError
+func (api *API) idempotent(w http.ResponseWriter, r *http.Request, session *Session, writeError func(http.ResponseWriter, error), handler func(http.ResponseWriter, *http.Request)) {
+	key := r.Header.Get(IDEMPOTENCY_KEY_HEADER)
+	if key == "" {
+		handler(w, r)
+		return
+	}
+	if len(key) > IDEMPOTENCY_KEY_MAX_LENGTH {
+		writeError(w, &InvalidInput{})
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, IDEMPOTENCY_MAX_BODY_BYTES))
+	if err != nil {
+		writeError(w, &InvalidInput{})
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body)) // Read again by the handler
+
+	fingerprint := sha256.New()
+	fmt.Fprintf(fingerprint, "%v %v\n", r.Method, r.URL.Path)
+	fingerprint.Write(body)
+
+	owner := idempotencyOwner(session)
+	claimed, err := api.ExecRow("add_to_idempotency_keys", owner, key, fingerprint.Sum(nil))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if claimed == 0 {
+		api.replayIdempotent(w, owner, key, fingerprint.Sum(nil), writeError)
+		return
+	}
+
+	recorder := &recordingWriter{ResponseWriter: w}
+	handler(recorder, r)
+
+	// Server errors aren't kept so the retry gets another chance
+	if recorder.status == 0 || recorder.status >= 500 {
+		_, err = api.ExecRow("delete_from_idempotency_keys", owner, key)
+		if err != nil {
+			Error.Println("Failed to release idempotency key", err)
+		}
+		return
+	}
+
+	headers := make(map[string]string)
+	for _, name := range idempotentHeaders {
+		if value := recorder.Header().Get(name); value != "" {
+			headers[name] = value
+		}
+	}
+	headerData, _ := json.Marshal(headers)
+
+	_, err = api.ExecRow("update_idempotency_key_response", recorder.status, headerData, recorder.body.Bytes(), owner, key)
+	if err != nil {
+		Error.Println("Failed to save idempotent response", err)
+	}
+}
+
+func (api *API) replayIdempotent(w http.ResponseWriter, owner string, key string, fingerprint []byte, writeError func(http.ResponseWriter, error)) {
+	var storedFingerprint, headerData, body []byte
+	var status sql.NullInt64
+	err := api.QueryRow("idempotency_key_from_owner", []any{owner, key}, &storedFingerprint, &status, &headerData, &body)
+	if err == sql.ErrNoRows {
+		writeError(w, &IdempotencyKeyInUse{}) // Released by a failed first request in the meantime
+		return
+	} else if err != nil {
+		Error.Println("Failed to get idempotency key", err)
+		writeError(w, err)
+		return
+	}
+
+	if !bytes.Equal(storedFingerprint, fingerprint) {
+		Info.Printf("Rejecting reuse of idempotency key by %v with another payload\n", owner)
+		writeError(w, &IdempotencyKeyReused{})
+		return
+	}
+
+	if !status.Valid {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, &IdempotencyKeyInUse{})
+		return
+	}
+
+	var headers map[string]string
+	json.Unmarshal(headerData, &headers)
+	for name, value := range headers {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(int(status.Int64))
+	w.Write(body)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Keeps the idempotency keys in memory like the idempotency_keys table
+func onIdempotencyKeys(db *fakeDB) {
+	type record struct {
+		fingerprint, headers, body []byte
+		status                     driver.Value
+	}
+	records := make(map[string]*record)
+	mutex := new(sync.Mutex)
+	id := func(owner driver.Value, key driver.Value) string {
+		return owner.(string) + " " + key.(string)
+	}
+
+	db.on("insert ignore into idempotency_keys", func(args []driver.Value) (fakeResult, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if records[id(args[0], args[1])] != nil {
+			return fakeResult{}, nil
+		}
+		records[id(args[0], args[1])] = &record{fingerprint: args[2].([]byte)}
+		return fakeResult{affected: 1}, nil
+	})
+	db.on("select fingerprint, status, headers, body from idempotency_keys", func(args []driver.Value) (fakeResult, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if rec := records[id(args[0], args[1])]; rec != nil {
+			return fakeResult{rows: [][]driver.Value{{rec.fingerprint, rec.status, rec.headers, rec.body}}}, nil
+		}
+		return fakeResult{}, nil
+	})
+	db.on("update idempotency_keys set status = ?", func(args []driver.Value) (fakeResult, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if rec := records[id(args[3], args[4])]; rec != nil {
+			rec.status, rec.headers, rec.body = args[0], args[1].([]byte), args[2].([]byte)
+			return fakeResult{affected: 1}, nil
+		}
+		return fakeResult{}, nil
+	})
+	db.on("delete from idempotency_keys where owner = ?", func(args []driver.Value) (fakeResult, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		delete(records, id(args[0], args[1]))
+		return fakeResult{affected: 1}, nil
+	})
+}
+
+type idempotencyTest struct {
+	api    *API
+	db     *fakeDB
+	status int // Answered by the handler
+	served int
+}
+
+func newIdempotencyTest(t *testing.T) *idempotencyTest {
+	db, config := newFakeDB(t)
+	onIdempotencyKeys(db)
+	return &idempotencyTest{api: newTestAPI(t, config), db: db, status: http.StatusCreated}
+}
+
+func (test *idempotencyTest) do(session *Session, path string, key string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	if key != "" {
+		r.Header.Set(IDEMPOTENCY_KEY_HEADER, key)
+	}
+	w := httptest.NewRecorder()
+	test.api.idempotent(w, r, session, writeAPIError, func(w http.ResponseWriter, r *http.Request) {
+		test.served++
+		w.Header().Set("Location", "/api/v1/links/abc123")
+		w.Header().Set("X-Request-Number", strings.Repeat("I", test.served))
+		w.WriteHeader(test.status)
+		w.Write([]byte(`{"short":"abc123"}`))
+	})
+	return w
+}
+
+// Signed in session of userID(7)
+func idempotencySession() *Session {
+	return &Session{sid: "idempotency-test", userId: 7, signedIn: true, expiry: time.Now().Add(time.Hour)}
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	test := newIdempotencyTest(t)
+
+	first := test.do(idempotencySession(), "/api/v1/links", "key-1", "url=https://example.com")
+	retry := test.do(idempotencySession(), "/api/v1/links", "key-1", "url=https://example.com")
+	if test.served != 1 {
+		t.Fatalf("Handler ran %d times for one key", test.served)
+	}
+	if retry.Code != first.Code || retry.Body.String() != first.Body.String() || retry.Header().Get("Location") != "/api/v1/links/abc123" {
+		t.Errorf("Retry answered %v %q with %v, want the recorded response", retry.Code, retry.Body.String(), retry.Header())
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("Replayed response not marked as such: %v", retry.Header())
+	}
+	if retry.Header().Get("X-Request-Number") != "" {
+		t.Errorf("Header kept with the key which isn't in idempotentHeaders: %v", retry.Header())
+	}
+
+	// Keys are scoped to their owner, and requests without a key always run
+	other := &Session{sid: "idempotency-test", userId: 8, signedIn: true, expiry: time.Now().Add(time.Hour)}
+	if w := test.do(other, "/api/v1/links", "key-1", "url=https://example.com"); w.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("Response replayed to another user")
+	}
+	test.do(idempotencySession(), "/api/v1/links", "", "url=https://example.com")
+	if test.served != 3 {
+		t.Errorf("Handler ran %d times, want 3", test.served)
+	}
+}
+
+func TestIdempotencyKeyReused(t *testing.T) {
+	test := newIdempotencyTest(t)
+	test.do(idempotencySession(), "/api/v1/links", "key-1", "url=https://example.com")
+
+	for name, w := range map[string]*httptest.ResponseRecorder{
+		"body": test.do(idempotencySession(), "/api/v1/links", "key-1", "url=https://example.net"),
+		"path": test.do(idempotencySession(), "/api/v1/links/abc123", "key-1", "url=https://example.com"),
+	} {
+		if w.Code != http.StatusUnprocessableEntity || w.Header().Get("Idempotent-Replayed") != "" {
+			t.Errorf("Key reused with another %v answered %v with %v", name, w.Code, w.Header())
+		}
+	}
+	if test.served != 1 {
+		t.Errorf("Handler ran %d times, the reused key wasn't refused", test.served)
+	}
+}
+
+func TestIdempotencyKeyInUse(t *testing.T) {
+	test := newIdempotencyTest(t)
+
+	// Retried while the first request is still running
+	var retry *httptest.ResponseRecorder
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/links", strings.NewReader("url=https://example.com"))
+	r.Header.Set(IDEMPOTENCY_KEY_HEADER, "key-1")
+	test.api.idempotent(httptest.NewRecorder(), r, idempotencySession(), writeAPIError, func(w http.ResponseWriter, r *http.Request) {
+		retry = test.do(idempotencySession(), "/api/v1/links", "key-1", "url=https://example.com")
+		w.WriteHeader(http.StatusCreated)
+	})
+	if retry.Code != http.StatusConflict || retry.Header().Get("Retry-After") != "1" || test.served != 0 {
+		t.Errorf("Retry during the first request answered %v with %v", retry.Code, retry.Header())
+	}
+}
+
+func TestIdempotencyKeyReleasedOnServerError(t *testing.T) {
+	test := newIdempotencyTest(t)
+	test.status = http.StatusInternalServerError
+	test.do(idempotencySession(), "/api/v1/links", "key-1", "url=https://example.com")
+
+	test.status = http.StatusCreated
+	if w := test.do(idempotencySession(), "/api/v1/links", "key-1", "url=https://example.com"); w.Code != http.StatusCreated || test.served != 2 {
+		t.Errorf("Retry after a server error answered %v, handler ran %d times", w.Code, test.served)
+	}
+	if w := test.do(idempotencySession(), "/api/v1/links", "key-1", "url=https://example.com"); w.Code != http.StatusCreated || test.served != 2 {
+		t.Errorf("Successful retry not recorded, answered %v, handler ran %d times", w.Code, test.served)
+	}
+}
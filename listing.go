@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	LINK_PAGE_DEFAULT_SIZE = 50
+	LINK_PAGE_MAX_SIZE     = 200
+	LINK_SEARCH_MAX_LENGTH = 100
+)
+
+// Columns the link listing can be sorted by, shortURL breaks ties so every row has a unique position
+var linkSortColumns = map[string]string{
+	"code":        "shortURL",
+	"destination": "longURL",
+	"created":     "created",
+	"clicks":      "clicks",
+}
+
+// Options of a link listing, the zero value is the first page sorted by code
+type LinkQuery struct {
+	Sort   string // Key of linkSortColumns
+	Desc   bool
+	Search string // Substring of the code or the destination
+	Cursor string // Position after which the page starts, from the previous page
+	Limit  int
+}
+
+// Parses the sort, order, q, cursor and limit query parameters
+func ParseLinkQuery(values url.Values) (LinkQuery, error) {
+	query := LinkQuery{
+		Sort:   values.Get("sort"),
+		Search: values.Get("q"),
+		Cursor: values.Get("cursor"),
+		Limit:  LINK_PAGE_DEFAULT_SIZE,
+	}
+
+	if query.Sort == "" {
+		query.Sort = "code"
+	}
+	if _, exists := linkSortColumns[query.Sort]; !exists {
+		return LinkQuery{}, &InvalidInput{}
+	}
+
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		query.Desc = true
+	default:
+		return LinkQuery{}, &InvalidInput{}
+	}
+
+	if len(query.Search) > LINK_SEARCH_MAX_LENGTH {
+		return LinkQuery{}, &InvalidInput{}
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		var err error
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 || query.Limit > LINK_PAGE_MAX_SIZE {
+			return LinkQuery{}, &InvalidInput{}
+		}
+	}
+
+	if query.Cursor != "" {
+		if _, err := decodeLinkCursor(query.Cursor, query.order()); err != nil {
+			return LinkQuery{}, err
+		}
+	}
+
+	return query, nil
+}
+
+// Sort column and direction, like "clicks desc"
+func (query LinkQuery) order() string {
+	if query.Desc {
+		return query.Sort + " desc"
+	}
+	return query.Sort
+}
+
+// Ordering, sort value and short code of the last link of a page, encoded in the cursor
+type linkCursor struct {
+	Order string `json:"o"`
+	Value string `json:"v"`
+	Short string `json:"s"`
+}
+
+func encodeLinkCursor(cursor linkCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Refuses cursors which don't decode, or from a listing with another ordering since their position means nothing in it
+func decodeLinkCursor(encoded string, order string) (linkCursor, error) {
+	var cursor linkCursor
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, &InvalidInput{}
+	}
+	err = json.Unmarshal(data, &cursor)
+	if err != nil || cursor.Order != order {
+		return cursor, &InvalidInput{}
+	}
+	return cursor, nil
+}
+
+// Escapes the wildcards of like patterns, backslash being MySQL's default escape character
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// Name of the prepared statement listing a page of links
+func linkPageStatement(workspace bool, sort string, desc bool, after bool) string {
+	owner, order := "user", "asc"
+	if workspace {
+		owner = "workspace"
+	}
+	if desc {
+		order = "desc"
+	}
+	name := fmt.Sprintf("links_page_%v_%v_%v", owner, sort, order)
+	if after {
+		name += "_after"
+	}
+	return name
+}
+
+// Generates the statements listing pages of links for every owner, sort column and order, with and without cursor.
+// The ordering uses the links_<owner>_<sort> indexes documented in sql_schema.txt
+func linkPageStatements() map[string]string {
+	stmts := make(map[string]string)
+	for _, workspace := range []bool{false, true} {
+		ownerCondition := "userID = ? and workspaceID is null"
+		if workspace {
+			ownerCondition = "workspaceID = ?"
+		}
+
+		for sort, column := range linkSortColumns {
+			for _, desc := range []bool{false, true} {
+				order, comparison := "asc", ">"
+				if desc {
+					order, comparison = "desc", "<"
+				}
+
+				query := "select shortURL, longURL, " + column + " from links where " + ownerCondition +
+					" and (? = '' or shortURL like ? or longURL like ?)"
+				orderBy := fmt.Sprintf(" order by %v %v, shortURL %v limit ?", column, order, order)
+
+				stmts[linkPageStatement(workspace, sort, desc, false)] = query + orderBy
+				stmts[linkPageStatement(workspace, sort, desc, true)] = query +
+					fmt.Sprintf(" and (%v %v ? or (%v = ? and shortURL %v ?))", column, comparison, column, comparison) + orderBy
+			}
+		}
+	}
+	return stmts
+}
+
+// Replaces the cursor of the request's URL, used for the Link header and the manage page's next page link
+func pageURL(requestUrl *url.URL, cursor string) string {
+	values := requestUrl.Query()
+	values.Set("cursor", cursor)
+	pageUrl := *requestUrl
+	pageUrl.RawQuery = values.Encode()
+	return pageUrl.RequestURI()
+}
+
+// Advertises the next page of a listing like RFC 8288, nothing is written on the last page
+func writeNextLink(w http.ResponseWriter, r *http.Request, next string) {
+	if next != "" {
+		w.Header().Set("Link", fmt.Sprintf(`<%v>; rel="next"`, pageURL(r.URL, next)))
+	}
+}
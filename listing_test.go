@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLinkQuery(t *testing.T) {
+	query, err := ParseLinkQuery(url.Values{})
+	if err != nil || query != (LinkQuery{Sort: "code", Limit: LINK_PAGE_DEFAULT_SIZE}) {
+		t.Errorf("Empty query parsed as %+v, %v", query, err)
+	}
+
+	query, err = ParseLinkQuery(url.Values{"sort": {"clicks"}, "order": {"desc"}, "q": {"docs"}, "limit": {"10"}})
+	if err != nil || query != (LinkQuery{Sort: "clicks", Desc: true, Search: "docs", Limit: 10}) {
+		t.Errorf("Query parsed as %+v, %v", query, err)
+	}
+
+	for _, values := range []url.Values{
+		{"sort": {"longURL"}},
+		{"order": {"random"}},
+		{"limit": {"0"}},
+		{"limit": {"201"}},
+		{"limit": {"ten"}},
+		{"q": {strings.Repeat("a", LINK_SEARCH_MAX_LENGTH+1)}},
+	} {
+		if _, err := ParseLinkQuery(values); err == nil {
+			t.Errorf("Invalid query %v accepted", values)
+		}
+	}
+}
+
+// Answers the listing of the links of userID(7) sorted by clicks, from the given rows sorted the same way
+func onLinksByClicks(db *fakeDB, links [][]driver.Value) {
+	db.on("order by clicks desc, shortURL desc limit ?", func(args []driver.Value) (fakeResult, error) {
+		limit := int(args[len(args)-1].(int64))
+		var rows [][]driver.Value
+		for _, link := range links {
+			// Skips the links up to the cursor's position, given as its value twice then its short code
+			if len(args) == 8 {
+				clicks, _ := strconv.ParseInt(args[4].(string), 10, 64)
+				if link[2].(int64) > clicks || (link[2].(int64) == clicks && link[0].(string) >= args[6].(string)) {
+					continue
+				}
+			}
+			if len(rows) < limit {
+				rows = append(rows, link)
+			}
+		}
+		return fakeResult{rows: rows}, nil
+	})
+}
+
+func TestLinkCursorRoundTrip(t *testing.T) {
+	db, config := newFakeDB(t)
+	api := newTestAPI(t, config)
+	session := &Session{sid: "listing-test", userId: 7, signedIn: true, expiry: time.Now().Add(time.Hour)}
+	onLinksByClicks(db, [][]driver.Value{
+		{"d", "https://example.com/d", int64(5)},
+		{"c", "https://example.com/c", int64(3)},
+		{"b", "https://example.com/b", int64(3)},
+		{"a", "https://example.com/a", int64(1)},
+	})
+
+	var pages [][]LinkData
+	values := url.Values{"sort": {"clicks"}, "order": {"desc"}, "limit": {"2"}}
+	for i := 0; i < 3; i++ {
+		query, err := ParseLinkQuery(values)
+		if err != nil {
+			t.Fatalf("Query of page %d refused: %v", i+1, err)
+		}
+		links, next, err := api.getURL(session, 0, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, links)
+		if next == "" {
+			break
+		}
+		values.Set("cursor", next)
+	}
+
+	if len(pages) != 2 || len(pages[0]) != 2 || len(pages[1]) != 2 ||
+		pages[0][1].Short != "c" || pages[1][0].Short != "b" || pages[1][1].Short != "a" {
+		t.Fatalf("Pages %+v, want d, c then b, a", pages)
+	}
+
+	// The second page starts after the value and the short code of the last link of the first one
+	after := db.executed("and (clicks < ? or (clicks = ? and shortURL < ?)) order by clicks desc")
+	if len(after) != 1 || after[0][4] != "3" || after[0][5] != "3" || after[0][6] != "c" {
+		t.Errorf("Second page queried with %v", after)
+	}
+}
+
+func TestParseLinkQueryTamperedCursor(t *testing.T) {
+	cursor := encodeLinkCursor(linkCursor{"clicks desc", "3", "c"})
+	if _, err := ParseLinkQuery(url.Values{"sort": {"clicks"}, "order": {"desc"}, "cursor": {cursor}}); err != nil {
+		t.Fatal("Untouched cursor refused", err)
+	}
+
+	for name, values := range map[string]url.Values{
+		"garbage":         {"sort": {"clicks"}, "order": {"desc"}, "cursor": {"not a cursor"}},
+		"truncated":       {"sort": {"clicks"}, "order": {"desc"}, "cursor": {cursor[:len(cursor)-3]}},
+		"not json":        {"sort": {"clicks"}, "order": {"desc"}, "cursor": {"bm90IGpzb24"}},
+		"other sort":      {"sort": {"code"}, "order": {"desc"}, "cursor": {cursor}},
+		"other direction": {"sort": {"clicks"}, "cursor": {cursor}},
+		"rewritten order": {"sort": {"code"}, "cursor": {encodeLinkCursor(linkCursor{"code desc", "c", "c"})}},
+	} {
+		_, err := ParseLinkQuery(values)
+		if _, ok := err.(*InvalidInput); !ok {
+			t.Errorf("Cursor %v gives %v, want InvalidInput", name, err)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	LOGIN_FAILURE_RETENTION = 90 * 24 * time.Hour
+	LOGIN_HISTORY_SIZE      = 20 // Failures listed on the manage page
+	LOGIN_FIRST_DELAY       = time.Second
+)
+
+// Keys of the login_throttles rows counting the failures of a username and of an IP. The username one is used
+// whether or not the user exists, so unknown usernames are throttled like the others
+func throttleKeys(username, ip string) (string, string) {
+	username = strings.ToLower(username)
+	if len(username) > 100 {
+		username = username[:100] // No longer username can exist
+	}
+	return "user:" + username, "ip:" + ip
+}
+
+// Returns how long a username has to wait between attempts after failures, doubling with each failure beyond DelayAfter
+func loginDelay(failures int, config LockoutConfig) time.Duration {
+	if failures < config.DelayAfter {
+		return 0
+	}
+	delay := LOGIN_FIRST_DELAY
+	for i := config.DelayAfter; i < failures && delay < config.MaxDelay.Duration; i++ {
+		delay *= 2
+	}
+	if delay > config.MaxDelay.Duration {
+		delay = config.MaxDelay.Duration
+	}
+	return delay
+}
+
+// Returns how long the key has to wait before its next attempt, delayed adds the progressive delay to the lockout.
+// stmt reads the row, login_throttle_for_update also locks it until the end of the transaction
+func (api *API) throttleWait(stmt string, key string, delayed bool) (time.Duration, error) {
+	var failures int
+	var elapsed, locked int64
+	err := api.QueryRow(stmt, []any{key, int(api.config.Lockout.Window.Seconds())}, &failures, &elapsed, &locked)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		Error.Println("Failed to get login throttle", err)
+		return 0, err
+	}
+
+	wait := time.Duration(locked) * time.Second
+	if delayed {
+		delay := loginDelay(failures, api.config.Lockout) - time.Duration(elapsed)*time.Second
+		if delay > wait {
+			wait = delay
+		}
+	}
+	return wait, nil
+}
+
+// Returns how long the username and the IP have to wait, the longest of both
+func (api *API) loginWait(stmt string, username, ip string) (time.Duration, error) {
+	userKey, ipKey := throttleKeys(username, ip)
+	userWait, err := api.throttleWait(stmt, userKey, true)
+	if err != nil {
+		return 0, err
+	}
+	ipWait, err := api.throttleWait(stmt, ipKey, false)
+	if err != nil {
+		return 0, err
+	}
+
+	if ipWait > userWait {
+		return ipWait, nil
+	}
+	return userWait, nil
+}
+
+// Refuses the sign-in if the username or the IP failed too often, for sign-ins without a secret to guess
+func (api *API) checkLoginThrottle(username, ip string) error {
+	if !api.config.Lockout.Enabled {
+		return nil
+	}
+
+	wait, err := api.loginWait("login_throttle_from_key", username, ip)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		Info.Printf("Throttling sign-in of %v from %v for %v\n", username, ip, wait)
+		return &LoginThrottled{wait}
+	}
+	return nil
+}
+
+// Counts the attempt as a failure of the username and of the IP before the password or code is checked, unless one
+// of them has to wait. The rows stay locked from the check to the count, so concurrent guesses see each other instead
+// of all passing the check before the first failure is counted. A successful attempt gives the count back
+func (api *API) reserveLoginAttempt(username, ip string) error {
+	if !api.config.Lockout.Enabled {
+		return nil
+	}
+
+	userKey, ipKey := throttleKeys(username, ip)
+	var wait time.Duration
+	err := api.Transaction(func(tx *sql.Tx) error {
+		txApi := api.InTransaction(tx)
+
+		// Always the username first, so concurrent attempts lock the rows in the same order
+		for _, key := range []string{userKey, ipKey} {
+			_, err := txApi.ExecRow("add_empty_login_throttle", key)
+			if err != nil {
+				return err
+			}
+		}
+
+		var err error
+		wait, err = txApi.loginWait("login_throttle_for_update", username, ip)
+		if err != nil || wait > 0 {
+			return err
+		}
+
+		for _, key := range []string{userKey, ipKey} {
+			_, err = txApi.ExecRow("add_to_login_throttles", key, int(api.config.Lockout.Window.Seconds()))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		Error.Println("Failed to reserve login attempt", err)
+		return err
+	}
+
+	if wait > 0 {
+		Info.Printf("Throttling sign-in of %v from %v for %v\n", username, ip, wait)
+		return &LoginThrottled{wait}
+	}
+	return nil
+}
+
+// Gives back the IP's count of a successful attempt, the username's is deleted by clearLoginFailures once the
+// sign-in is complete
+func (api *API) releaseLoginAttempt(ip string) {
+	if !api.config.Lockout.Enabled {
+		return
+	}
+
+	_, ipKey := throttleKeys("", ip)
+	_, err := api.ExecRow("release_login_throttle", ipKey)
+	if err != nil {
+		Error.Println("Failed to release login attempt", err)
+	}
+}
+
+// Keeps a failed attempt, already counted by reserveLoginAttempt, in the user's history and locks the username and
+// the IP past their threshold. Unknown users have userId 0 and go through the same statements, so the time a
+// failure takes doesn't tell whether the user exists. The owner is mailed when their account gets locked
+func (api *API) recordLoginFailure(username, ip string, userId int) {
+	_, err := api.ExecRow("add_to_login_failures", userId, ip)
+	if err != nil {
+		Error.Println("Failed to save failed sign-in", err)
+	}
+
+	if !api.config.Lockout.Enabled {
+		return
+	}
+
+	userKey, ipKey := throttleKeys(username, ip)
+	if api.lockLoginThrottle(userKey, api.config.Lockout.Threshold) {
+		Warning.Printf("Locking sign-in of %v for %v after too many failures\n", username, api.config.Lockout.LockFor)
+		api.notifyLockout(userId, ip)
+	}
+	if api.lockLoginThrottle(ipKey, api.config.Lockout.IPThreshold) {
+		Warning.Printf("Locking sign-in from %v for %v after too many failures\n", ip, api.config.Lockout.LockFor)
+	}
+}
+
+// Locks the key if its failures reached the threshold, returns true if it locked it
+func (api *API) lockLoginThrottle(key string, threshold int) bool {
+	if threshold <= 0 {
+		return false
+	}
+
+	locked, err := api.ExecRow("lock_login_throttle", int(api.config.Lockout.LockFor.Seconds()), key, threshold)
+	if err != nil {
+		Error.Println("Failed to lock sign-in", err)
+		return false
+	}
+	return locked == 1
+}
+
+// Forgets the failures of the username once it signed in, those of the IP are kept so an attacker can't reset them
+// by signing in to their own account
+func (api *API) clearLoginFailures(username string) {
+	if !api.config.Lockout.Enabled {
+		return
+	}
+
+	userKey, _ := throttleKeys(username, "")
+	_, err := api.ExecRow("delete_login_throttle", userKey)
+	if err != nil {
+		Error.Println("Failed to clear login throttle", err)
+	}
+}
+
+// Mails the user that their account was locked, if they exist and have a verified email
+func (api *API) notifyLockout(userId int, ip string) {
+	var email sql.NullString
+	var verified bool
+	err := api.QueryRow("email_from_userId", []any{userId}, &email, &verified)
+	if err != nil && err != sql.ErrNoRows {
+		Error.Println("Failed to get email", err)
+		return
+	}
+	if !email.Valid || !verified { // Also unknown users
+		return
+	}
+
+	api.sendMail(Mail{
+		To:      email.String,
+		Subject: "Sign-in to your shr.me account locked",
+		Body: fmt.Sprintf("There were too many failed sign-ins to your shr.me account, the last one from %v. "+
+			"Signing in is blocked for %v.\n\n"+
+			"If it wasn't you, someone may be guessing your password. The failed sign-ins are listed at %v/manage, "+
+			"and turning on two-factor authentication there protects your account even if they find it.\n",
+			ip, api.config.Lockout.LockFor, api.config.Mail.BaseURL),
+	})
+	Info.Printf("Mailed UserID(%d) about the lockout of their account\n", userId)
+}
+
+// Returns the latest failed sign-ins of the session's user
+func (api *API) getLoginFailures(session *Session) (res []LoginFailureData, err error) {
+	if !session.signedIn || !session.hasScope(SCOPE_ACCOUNT) {
+		return nil, &Unauthorized{}
+	}
+
+	rows, err := api.Query("login_failures_of_user", session.userId, LOGIN_HISTORY_SIZE)
+	if err != nil {
+		Error.Println("Failed to get failed sign-ins", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data LoginFailureData
+		err = rows.Scan(&data.IP, &data.Created)
+		if err != nil {
+			break
+		}
+		res = append(res, data)
+	}
+
+	return
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Answers the sign-in lookup of alice, userID(7) with the password "right password"
+func onAlice(t *testing.T, db *fakeDB) {
+	hash, err := hashPassword("right password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.on("select userID, password_hash from users_auth where username = ?", func(args []driver.Value) (fakeResult, error) {
+		if args[0] == "alice" {
+			return fakeResult{rows: [][]driver.Value{{int64(7), hash}}}, nil
+		}
+		return fakeResult{}, nil
+	})
+}
+
+func TestSigninFailureOfUnknownUser(t *testing.T) {
+	db, config := newFakeDB(t)
+	api := newTestAPI(t, config)
+	onAlice(t, db)
+
+	// Statements of a failed sign-in, without the deletes of the background purge
+	failedSignin := func(username string) []string {
+		before := len(db.queries())
+		err := api.signin(NewLowSession("lockout-test", time.Hour), username, "wrong password", "192.0.2.1")
+		if err == nil {
+			t.Fatalf("Sign-in of %v succeeded with a wrong password", username)
+		}
+
+		var statements []string
+		for _, query := range db.queries()[before:] {
+			if !strings.HasPrefix(query, "delete") {
+				statements = append(statements, query)
+			}
+		}
+		return statements
+	}
+
+	known := failedSignin("alice")
+	unknown := failedSignin("mallory")
+	if strings.Join(known, "\n") != strings.Join(unknown, "\n") {
+		t.Errorf("Failed sign-ins of known and unknown users run different statements:\n%v\n\n%v", strings.Join(known, "\n"), strings.Join(unknown, "\n"))
+	}
+
+	failures := db.executed("insert into login_failures")
+	if len(failures) != 2 || failures[0][0] != int64(7) || failures[1][0] != int64(0) {
+		t.Errorf("Failures saved for %v, want userID(7) then 0", failures)
+	}
+}
+
+func TestSigninReservesTheAttempt(t *testing.T) {
+	t.Run("counts the attempt before the password is checked", func(t *testing.T) {
+		db, config := newFakeDB(t)
+		api := newTestAPI(t, config)
+		onAlice(t, db)
+
+		err := api.signin(NewLowSession("lockout-test", time.Hour), "alice", "right password", "192.0.2.1")
+		if err != nil {
+			t.Fatal("Sign-in failed", err)
+		}
+
+		var counted []driver.Value
+		for _, args := range db.executed("insert into login_throttles(throttle_key, failures, last_failure) values(?, 1") {
+			counted = append(counted, args[0])
+		}
+		if len(counted) != 2 || counted[0] != "user:alice" || counted[1] != "ip:192.0.2.1" {
+			t.Errorf("Attempt counted for %v, want the username and the IP", counted)
+		}
+
+		released := db.executed("update login_throttles set failures = greatest(failures - 1, 0)")
+		if len(released) != 1 || released[0][0] != "ip:192.0.2.1" {
+			t.Errorf("IP count given back for %v", released)
+		}
+		cleared := db.executed("delete from login_throttles where throttle_key = ?")
+		if len(cleared) != 1 || cleared[0][0] != "user:alice" {
+			t.Errorf("Username count cleared for %v", cleared)
+		}
+	})
+
+	t.Run("checks nothing while locked", func(t *testing.T) {
+		db, config := newFakeDB(t)
+		api := newTestAPI(t, config)
+		onAlice(t, db)
+		db.on(" for update", func(args []driver.Value) (fakeResult, error) {
+			if args[0] == "user:alice" {
+				return fakeResult{rows: [][]driver.Value{{int64(10), int64(0), int64(600)}}}, nil
+			}
+			return fakeResult{}, nil
+		})
+
+		err := api.signin(NewLowSession("lockout-test", time.Hour), "alice", "right password", "192.0.2.1")
+		throttled, ok := err.(*LoginThrottled)
+		if !ok || throttled.RetryAfter != 600*time.Second {
+			t.Fatalf("Locked sign-in answered %v, want LoginThrottled for 10m", err)
+		}
+		if lookups := db.executed("from users_auth where username = ?"); len(lookups) != 0 {
+			t.Error("Locked sign-in checked the password")
+		}
+		if counted := db.executed("insert into login_throttles(throttle_key, failures, last_failure) values(?, 1"); len(counted) != 0 {
+			t.Errorf("Refused attempt counted: %v", counted)
+		}
+	})
+}
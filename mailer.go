@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MEMORY_MAILER_MAX_MAILS = 100 // Older mails are dropped
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string // Plain text
+}
+
+// Sends the account emails, SMTPMailer in production and MemoryMailer when no SMTP server is configured
+type Mailer interface {
+	Send(mail Mail) error
+}
+
+// Returns the mailer of the config, a MemoryMailer if no SMTP server is set
+func NewMailer(config MailConfig) Mailer {
+	if config.SMTPAddress == "" {
+		Warning.Println("No SMTP server configured, emails are only kept in memory")
+		return NewMemoryMailer()
+	}
+	return NewSMTPMailer(config)
+}
+
+// Sends mails through an SMTP server, with STARTTLS when the server offers it
+type SMTPMailer struct {
+	address string // host:port
+	auth    smtp.Auth
+	from    string
+}
+
+func NewSMTPMailer(config MailConfig) *SMTPMailer {
+	var auth smtp.Auth
+	if config.Username != "" {
+		host, _, _ := net.SplitHostPort(config.SMTPAddress)
+		auth = smtp.PlainAuth("", config.Username, config.Password, host)
+	}
+	return &SMTPMailer{config.SMTPAddress, auth, config.From}
+}
+
+func (mailer *SMTPMailer) Send(mail Mail) error {
+	// Header injection would let a crafted address add recipients
+	if strings.ContainsAny(mail.To, "\r\n") || strings.ContainsAny(mail.Subject, "\r\n") {
+		return &InvalidInput{}
+	}
+
+	var message strings.Builder
+	fmt.Fprintf(&message, "From: %v\r\n", mailer.from)
+	fmt.Fprintf(&message, "To: %v\r\n", mail.To)
+	fmt.Fprintf(&message, "Subject: %v\r\n", mail.Subject)
+	fmt.Fprintf(&message, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	message.WriteString(strings.ReplaceAll(mail.Body, "\n", "\r\n"))
+
+	return smtp.SendMail(mailer.address, mailer.auth, mailer.from, []string{mail.To}, []byte(message.String()))
+}
+
+// Keeps the mails in memory instead of sending them, for tests and development
+type MemoryMailer struct {
+	mutex *sync.Mutex
+	sent  []Mail
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{mutex: new(sync.Mutex)}
+}
+
+func (mailer *MemoryMailer) Send(mail Mail) error {
+	mailer.mutex.Lock()
+	defer mailer.mutex.Unlock()
+	mailer.sent = append(mailer.sent, mail)
+	if len(mailer.sent) > MEMORY_MAILER_MAX_MAILS {
+		mailer.sent = mailer.sent[1:]
+	}
+	Info.Printf("Kept mail %q to %v in memory\n", mail.Subject, mail.To)
+	return nil
+}
+
+// Returns the mails sent so far, oldest first
+func (mailer *MemoryMailer) Sent() []Mail {
+	mailer.mutex.Lock()
+	defer mailer.mutex.Unlock()
+	return append([]Mail(nil), mailer.sent...)
+}
+
+// Sends the mail in the background so the time a request takes doesn't tell whether a mail was sent
+func (api *API) sendMail(mail Mail) {
+	go func() {
+		err := api.mailer.Send(mail)
+		if err != nil {
+			Error.Printf("Failed to send mail %q, %v\n", mail.Subject, err)
+		}
+	}()
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"database/sql"
+	"flag"
 	"html/template"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -14,6 +18,16 @@ const (
 )
 
 func main() {
+	configPath := flag.String("config", "./config.json", "Path to the JSON configuration file")
+	reportCaseConflicts := flag.Bool("report-case-conflicts", false, "Lists the short URLs conflicting when ignoring case and exits, without changing them")
+	lowercaseShortCodes := flag.Bool("lowercase-short-codes", false, "Rewrites the stored short codes in lower case and exits, needs CaseInsensitiveCodes")
+	flag.Parse()
+
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalln("Failed to load config", err)
+	}
+
 	htmlBase, err := loadTemplateFile("./html/base.template.html")
 	if err != nil {
 		log.Println("Failed to load template", err)
@@ -24,40 +38,77 @@ func main() {
 		log.Println("Failed to load template", err)
 	}
 
+	loginPageBase, err := loadTemplateFile("./html/account/login.template.html")
+	if err != nil {
+		log.Println("Failed to load template", err)
+	}
+
+	resetPageBase, err := loadTemplateFile("./html/account/reset.template.html")
+	if err != nil {
+		log.Println("Failed to load template", err)
+	}
+
+	verifyPageBase, err := loadTemplateFile("./html/account/verify.template.html")
+	if err != nil {
+		log.Println("Failed to load template", err)
+	}
+
 	if err != nil {
 		Error.Fatalln("Failed to parse template", err)
 	}
 
-	api, err := InitAPI("", "root:W.dVTc_+;7JC@tcp(localhost:3306)/test")
+	api, err := InitAPI(config)
 	if err != nil {
 		log.Fatalln("Failed to create init API", err)
 	}
 	defer api.Close()
 
+	if *reportCaseConflicts {
+		conflicts, err := api.reportCaseConflicts()
+		if err != nil {
+			Error.Fatalln("Failed to report case conflicts", err)
+		}
+		if conflicts > 0 {
+			api.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *lowercaseShortCodes {
+		err = api.lowercaseStoredCodes()
+		if err != nil {
+			Error.Fatalln("Failed to lowercase the short codes", err)
+		}
+		return
+	}
+
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/" {
 			shortUrl := r.URL.Path[1:]
-			var longUrl string
-			err = api.QueryRow("longUrl_from_shortUrl", []any{shortUrl}, &longUrl)
+			longUrl, err := api.resolveURL(shortUrl)
 			if err != nil {
 				Warning.Println("Failed to query longUrl", err)
 				http.Redirect(w, r, "/notfound", http.StatusPermanentRedirect)
+				return
 			}
 
+			api.recordClick(shortUrl)
 			Info.Printf("Received request for short link %v, redirecting to %v\n", shortUrl, longUrl)
 			http.Redirect(w, r, longUrl, http.StatusPermanentRedirect)
 		} else {
-			htmlBase.WriteFile("./html/index.html", w)
+			htmlBase.WriteFile("./html/index.html", signedIn(r), w)
 		}
 	})
 
 	mux.Handle("/api/", http.StripPrefix("/api/", api))
+	mux.Handle(API_V1_PREFIX+"/", NewAPIv1(api))
 
 	mux.HandleFunc("/notfound", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
-		htmlBase.WriteFile("./html/notfound.html", w)
+		htmlBase.WriteFile("./html/notfound.html", signedIn(r), w)
 	})
 
 	mux.HandleFunc("/home", func(w http.ResponseWriter, r *http.Request) {
@@ -80,14 +131,142 @@ func main() {
 			return
 		}
 
-		data, err := api.getURL(session)
+		var username string
+		err = api.QueryRow("username_from_userId", []any{session.userId}, &username)
 		if err != nil {
+			Error.Println("Failed to get username", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		var email sql.NullString
+		var emailVerified bool
+		err = api.QueryRow("email_from_userId", []any{session.userId}, &email, &emailVerified)
+		if err != nil {
+			Error.Println("Failed to get email", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		var passwordHash []byte
+		err = api.QueryRow("passwordHash_from_userId", []any{session.userId}, &passwordHash)
+		if err != nil {
+			Error.Println("Failed to get stored password hash", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		twoFactor, err := api.twoFactorEnabled(session.userId)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		var recovery int
+		if twoFactor {
+			err = api.QueryRow("unused_recovery_codes_count", []any{session.userId}, &recovery)
+			if err != nil {
+				Error.Println("Failed to count recovery codes", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		failures, err := api.getLoginFailures(session)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		workspaces, err := api.getWorkspaces(session)
+		if err != nil {
+			Error.Println("Failed to get workspaces", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// The workspace switcher selects the workspace with the query, personal links are shown without one
+		var workspace *WorkspaceData
+		if workspaceId, err := strconv.Atoi(r.URL.Query().Get("workspace")); err == nil {
+			for i := range workspaces {
+				if workspaces[i].Id == workspaceId {
+					workspace = &workspaces[i]
+				}
+			}
+			if workspace == nil {
+				http.Redirect(w, r, "/manage", http.StatusTemporaryRedirect)
+				return
+			}
+		}
+
+		// Invalid sort, search or cursor parameters start over from the first page
+		linkQuery, err := ParseLinkQuery(r.URL.Query())
+		firstPage := "/manage"
+		if workspace != nil {
+			firstPage += "?workspace=" + strconv.Itoa(workspace.Id)
+		}
+		if err != nil {
+			http.Redirect(w, r, firstPage, http.StatusTemporaryRedirect)
+			return
+		}
+
+		var data []LinkData
+		var next string
+		var members []MemberData
+		canEdit := true
+		if workspace != nil {
+			data, next, err = api.getURL(session, workspace.Id, linkQuery)
+			if err == nil {
+				members, err = api.getWorkspaceMembers(session, workspace.Id)
+			}
+			canEdit = workspace.Role.CanEdit()
+		} else {
+			data, next, err = api.getURL(session, 0, linkQuery)
+		}
+		if _, invalid := err.(*InvalidInput); invalid {
+			http.Redirect(w, r, firstPage, http.StatusTemporaryRedirect)
+			return
+		} else if err != nil {
 			Error.Println("Failed to get link data", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		managePageData := &ManagePageData{userData, data}
+		transfers, err := api.getTransfers(session)
+		if err != nil {
+			Error.Println("Failed to get transfer requests", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		tokens, err := api.getTokens(session)
+		if err != nil {
+			Error.Println("Failed to get tokens", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		var webhooks []WebhookData
+		canHook := config.Webhooks.Enabled && (workspace == nil || workspace.Role.CanManage())
+		if canHook {
+			webhookWorkspaceId := 0
+			if workspace != nil {
+				webhookWorkspaceId = workspace.Id
+			}
+			webhooks, err = api.getWebhooks(session, webhookWorkspaceId)
+			if err != nil {
+				Error.Println("Failed to get webhooks", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		var nextPage string
+		if next != "" {
+			nextPage = pageURL(r.URL, next)
+		}
+
+		managePageData := &ManagePageData{userData, username, email.String, emailVerified, passwordHash != nil, twoFactor, recovery, failures, data, linkQuery, nextPage, transfers, workspaces, workspace, members, canEdit, tokens, config.OIDC.Enabled, webhooks, canHook}
 		managePageOutput, err := managePageBase.ApplyToData(managePageData)
 		if err != nil {
 			Error.Println("Failed to apply template", err)
@@ -95,7 +274,7 @@ func main() {
 			return
 		}
 
-		htmlBase.WriteData(template.HTML(managePageOutput), w)
+		htmlBase.WriteData(&BasePageData{template.HTML(managePageOutput), true}, w)
 	})
 
 	mux.HandleFunc("/signin", func(w http.ResponseWriter, r *http.Request) {
@@ -103,11 +282,50 @@ func main() {
 			http.Redirect(w, r, "/", http.StatusPermanentRedirect)
 			return
 		}
-		htmlBase.WriteFile("./html/account/login.html", w)
+		loginPageData := &LoginPageData{config.OIDC.Enabled, config.OIDC.ButtonLabel}
+		loginPageOutput, err := loginPageBase.ApplyToData(loginPageData)
+		if err != nil {
+			Error.Println("Failed to apply template", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		htmlBase.WriteData(&BasePageData{template.HTML(loginPageOutput), false}, w)
+	})
+
+	mux.HandleFunc("/forgot", func(w http.ResponseWriter, r *http.Request) {
+		htmlBase.WriteFile("./html/account/forgot.html", signedIn(r), w)
+	})
+
+	mux.HandleFunc("/reset", func(w http.ResponseWriter, r *http.Request) {
+		resetPageOutput, err := resetPageBase.ApplyToData(&ResetPageData{r.URL.Query().Get("token")})
+		if err != nil {
+			Error.Println("Failed to apply template", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Referrer-Policy", "no-referrer") // Keeps the token out of the Referer of the page's requests
+		htmlBase.WriteData(&BasePageData{template.HTML(resetPageOutput), signedIn(r)}, w)
+	})
+
+	mux.HandleFunc("/verify", func(w http.ResponseWriter, r *http.Request) {
+		verifyPageOutput, err := verifyPageBase.ApplyToData(&VerifyPageData{r.URL.Query().Get("token")})
+		if err != nil {
+			Error.Println("Failed to apply template", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		htmlBase.WriteData(&BasePageData{template.HTML(verifyPageOutput), signedIn(r)}, w)
 	})
 
+	mux.HandleFunc("/oidc/login", api.handleOIDCLogin)
+	mux.HandleFunc("/oidc/callback", api.handleOIDCCallback)
+
 	mux.HandleFunc("/signup", func(w http.ResponseWriter, r *http.Request) {
-		htmlBase.WriteFile("./html/account/signup.html", w)
+		htmlBase.WriteFile("./html/account/signup.html", signedIn(r), w)
 	})
 
 	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) { http.ServeFile(w, r, "./static/transparent.ico") })
@@ -115,10 +333,14 @@ func main() {
 	static_server := http.FileServer(http.Dir("./static/"))
 	mux.Handle("/static/", http.StripPrefix("/static/", static_server)) // Removes the /static/ from the file names so the file server gets the correct names
 
-	sessionManager := NewManager(mux, "session_id", time.Hour, SESSION_MANAGER_UPDATE_DELAY)
+	rateLimiter := NewRateLimiter(api, mux, config.RateLimit)
+	sessionManager := NewManager(rateLimiter, "session_id", time.Hour, SESSION_MANAGER_UPDATE_DELAY)
+	api.sessions = sessionManager
+	tokenAuth := NewTokenAuth(api, rateLimiter, sessionManager)
+	cors := NewCORS(config.CORS, tokenAuth)
 
 	Info.Println("Listening...")
-	err = http.ListenAndServeTLS(":443", "server.crt", "private.key", sessionManager)
+	err = http.ListenAndServeTLS(config.Address, config.CertFile, config.KeyFile, cors)
 	if err != nil {
 		Error.Fatalln("ListenAndServe: ", err)
 	}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Prints the short URLs which would become ambiguous once codes are case insensitive,
+// returns the number of conflicting groups. Nothing is changed, see lowercaseStoredCodes
+func (api *API) reportCaseConflicts() (int, error) {
+	rows, err := api.Query("case_conflicting_shortUrls")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	conflicts := 0
+	for rows.Next() {
+		var lowered, shortUrls string
+		err = rows.Scan(&lowered, &shortUrls)
+		if err != nil {
+			return conflicts, err
+		}
+
+		fmt.Printf("%v: %v\n", lowered, shortUrls)
+		conflicts++
+	}
+	err = rows.Err()
+	if err != nil {
+		return conflicts, err
+	}
+
+	if conflicts > 0 {
+		fmt.Printf("%d short URLs conflict, rename or delete them before turning on case insensitive codes\n", conflicts)
+		return conflicts, nil
+	}
+	fmt.Println("No conflicting short URLs, case insensitive codes can be turned on")
+	return 0, nil
+}
+
+// Lowercases the stored codes for case insensitive mode, which only looks up the lower case form.
+// Refused while the mode is off, the links stored in upper case would stop resolving, or while codes conflict
+func (api *API) lowercaseStoredCodes() error {
+	if !api.config.CaseInsensitiveCodes {
+		return errors.New("CaseInsensitiveCodes is off, turn it on before lowercasing the stored codes")
+	}
+
+	conflicts, err := api.reportCaseConflicts()
+	if err != nil {
+		return err
+	}
+	if conflicts > 0 {
+		return fmt.Errorf("%d short URLs conflict when ignoring case", conflicts)
+	}
+
+	lowered, err := api.lowercaseShortUrls()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Lowercased %d codes\n", lowered)
+	return nil
+}
+
+// Rewrites the stored short URLs, and those of pending transfers, in lower case. Returns the number of links changed
+func (api *API) lowercaseShortUrls() (int64, error) {
+	var lowered int64
+	err := api.Transaction(func(tx *sql.Tx) error {
+		txApi := api.InTransaction(tx)
+
+		var err error
+		lowered, err = txApi.ExecRow("lowercase_shortUrls")
+		if err != nil {
+			return err
+		}
+		_, err = txApi.ExecRow("lowercase_transfer_shortUrls")
+		return err
+	})
+	if err != nil {
+		Error.Println("Failed to lowercase short URLs", err)
+		return 0, err
+	}
+
+	Info.Printf("Lowercased %d short URLs\n", lowered)
+	return lowered, nil
+}
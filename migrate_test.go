@@ -0,0 +1,51 @@
+package main
+
+import (
+	"database/sql/driver"
+	"testing"
+)
+
+func TestCaseConflictReportIsReadOnly(t *testing.T) {
+	db, config := newFakeDB(t)
+	api := newTestAPI(t, config)
+
+	conflicts, err := api.reportCaseConflicts()
+	if err != nil || conflicts != 0 {
+		t.Fatalf("Report found %d conflicts, %v", conflicts, err)
+	}
+	if lowered := db.executed("set shortURL = lower(shortURL)"); len(lowered) != 0 {
+		t.Errorf("Report rewrote the stored codes: %v", lowered)
+	}
+
+	// Codes stored in upper case only resolve while the mode is off
+	if err = api.lowercaseStoredCodes(); err == nil {
+		t.Error("Codes lowercased while CaseInsensitiveCodes is off")
+	}
+	if lowered := db.executed("set shortURL = lower(shortURL)"); len(lowered) != 0 {
+		t.Errorf("Refused rewrite changed the stored codes: %v", lowered)
+	}
+}
+
+func TestLowercaseStoredCodes(t *testing.T) {
+	db, config := newFakeDB(t)
+	config.CaseInsensitiveCodes = true
+	api := newTestAPI(t, config)
+
+	db.onRow("select lower(shortURL), group_concat(shortURL", "abc123", "ABC123 abc123")
+	if err := api.lowercaseStoredCodes(); err == nil {
+		t.Error("Codes lowercased while some conflict")
+	}
+	if lowered := db.executed("set shortURL = lower(shortURL)"); len(lowered) != 0 {
+		t.Errorf("Conflicting codes rewritten: %v", lowered)
+	}
+
+	db.on("select lower(shortURL), group_concat(shortURL", func(args []driver.Value) (fakeResult, error) {
+		return fakeResult{}, nil
+	})
+	if err := api.lowercaseStoredCodes(); err != nil {
+		t.Fatal("Lowercasing failed", err)
+	}
+	if links, transfers := db.executed("update links set shortURL = lower"), db.executed("update link_transfers set shortURL = lower"); len(links) != 1 || len(transfers) != 1 {
+		t.Errorf("Rewrote links %d and transfers %d times, want once each", len(links), len(transfers))
+	}
+}
@@ -0,0 +1,700 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OIDC_HTTP_TIMEOUT       = 10 * time.Second
+	OIDC_LOGIN_LIFETIME     = 10 * time.Minute // Time allowed between leaving for the provider and coming back
+	OIDC_CLOCK_SKEW         = time.Minute
+	OIDC_JWKS_REFRESH_DELAY = time.Minute // Minimum delay between two JWKS downloads
+	OIDC_MAX_RESPONSE_BYTES = 1 << 20
+	OIDC_STATE_COOKIE       = "oidc_state"
+)
+
+// State of a login started by a session, checked when the provider redirects back. The browser comes back from the
+// provider through a cross-site redirect which doesn't carry the SameSite=Strict session cookie, so logins are kept
+// by the provider under their state and tied to the browser by a SameSite=Lax cookie only sent to the callback
+type oidcLogin struct {
+	sid      string // Session which started the login, resumed by the callback
+	state    string
+	nonce    string
+	verifier string // PKCE code verifier
+	redirect string
+	expiry   time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// The "aud" claim is either a single string or an array of strings
+type audience []string
+
+func (aud *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*aud = audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(aud))
+}
+
+type IDTokenClaims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	AuthorizedParty   string   `json:"azp"`
+	Expiry            int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email"`
+	EmailVerified     bool     `json:"email_verified"`
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+}
+
+// OpenID Connect relying party for a single provider, the endpoints and keys are discovered from the issuer
+type OIDCProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	mutex       *sync.Mutex // Protects the fields below
+	discovery   *oidcDiscovery
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+	logins      map[string]*oidcLogin // Pending logins by state
+}
+
+// The client is used for every request to the provider, tests can pass the client of an httptest.Server
+func NewOIDCProvider(config OIDCConfig, client *http.Client) *OIDCProvider {
+	return &OIDCProvider{
+		config: config,
+		client: client,
+		mutex:  new(sync.Mutex),
+		logins: make(map[string]*oidcLogin),
+	}
+}
+
+// Keeps the login until the provider sends the user back, and forgets the expired ones
+func (provider *OIDCProvider) startLogin(login *oidcLogin) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	now := time.Now()
+	for state, pending := range provider.logins {
+		if now.After(pending.expiry) {
+			delete(provider.logins, state)
+		}
+	}
+	provider.logins[login.state] = login
+}
+
+// Returns the pending login with the state and forgets it, a login can only be completed once.
+// Returns nil if there is none or it expired
+func (provider *OIDCProvider) finishLogin(state string) *oidcLogin {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	login := provider.logins[state]
+	delete(provider.logins, state)
+	if login == nil || time.Now().After(login.expiry) {
+		return nil
+	}
+	return login
+}
+
+func (provider *OIDCProvider) getJSON(endpoint string, dest any) error {
+	res, err := provider.client.Get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %v returned %v", endpoint, res.Status)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, OIDC_MAX_RESPONSE_BYTES)).Decode(dest)
+}
+
+// Returns the provider metadata, fetched once from the issuer's well-known configuration
+func (provider *OIDCProvider) Discover() (*oidcDiscovery, error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	if provider.discovery != nil {
+		return provider.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	err := provider.getJSON(strings.TrimSuffix(provider.config.Issuer, "/")+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return nil, err
+	}
+
+	if discovery.Issuer != provider.config.Issuer {
+		return nil, fmt.Errorf("discovered issuer %v doesn't match configured issuer %v", discovery.Issuer, provider.config.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JwksURI == "" {
+		return nil, errors.New("provider metadata is missing endpoints")
+	}
+
+	provider.discovery = &discovery
+	return provider.discovery, nil
+}
+
+// Returns the URL of the provider's login page, the code challenge is derived from the PKCE verifier
+func (provider *OIDCProvider) AuthURL(login *oidcLogin) (string, error) {
+	discovery, err := provider.Discover()
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(login.verifier))
+	scopes := provider.config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", provider.config.ClientID)
+	query.Set("redirect_uri", provider.config.RedirectURL)
+	query.Set("scope", strings.Join(scopes, " "))
+	query.Set("state", login.state)
+	query.Set("nonce", login.nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchanges the authorization code for the raw ID token
+func (provider *OIDCProvider) Exchange(code string, verifier string) (string, error) {
+	discovery, err := provider.Discover()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", provider.config.RedirectURL)
+	form.Set("client_id", provider.config.ClientID)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if provider.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(provider.config.ClientID), url.QueryEscape(provider.config.ClientSecret))
+	}
+
+	res, err := provider.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	err = json.NewDecoder(io.LimitReader(res.Body, OIDC_MAX_RESPONSE_BYTES)).Decode(&tokens)
+	if err != nil {
+		return "", err
+	}
+
+	if res.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return "", fmt.Errorf("token endpoint returned %v %v", res.Status, tokens.Error)
+	}
+	return tokens.IDToken, nil
+}
+
+// Returns the key with the ID kid from the provider's JWKS, downloaded again when the key is unknown
+func (provider *OIDCProvider) key(kid string) (crypto.PublicKey, error) {
+	discovery, err := provider.Discover()
+	if err != nil {
+		return nil, err
+	}
+
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	if key, exists := provider.keys[kid]; exists {
+		return key, nil
+	}
+
+	if time.Since(provider.keysFetched) < OIDC_JWKS_REFRESH_DELAY {
+		return nil, fmt.Errorf("unknown key %v", kid)
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = provider.getJSON(discovery.JwksURI, &jwks)
+	if err != nil {
+		return nil, err
+	}
+	provider.keysFetched = time.Now()
+
+	provider.keys = make(map[string]crypto.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			Warning.Printf("Ignoring provider key %v, %v\n", jwk.Kid, err)
+			continue
+		}
+		provider.keys[jwk.Kid] = key
+	}
+
+	if key, exists := provider.keys[kid]; exists {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %v", kid)
+}
+
+func (jwk *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %v", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %v", jwk.Kty)
+	}
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed []byte, signature []byte) error {
+	digest := sha256.Sum256(signed)
+
+	switch alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("RS256 token signed with a non RSA key")
+		}
+		return rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature)
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return errors.New("invalid ES256 signature")
+		}
+
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return errors.New("invalid ES256 signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported signing algorithm %v", alg) // Also rejects "none"
+	}
+}
+
+// Checks the signature and the claims of an ID token, nonce must be the one sent in the authorization request
+func (provider *OIDCProvider) VerifyIDToken(rawToken string, nonce string) (*IDTokenClaims, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+
+	headerData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err = json.Unmarshal(headerData, &header)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := provider.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims IDTokenClaims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Issuer != provider.config.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %v", claims.Issuer)
+	}
+
+	audienceOk := false
+	for _, aud := range claims.Audience {
+		audienceOk = audienceOk || aud == provider.config.ClientID
+	}
+	if !audienceOk || (len(claims.Audience) > 1 && claims.AuthorizedParty != provider.config.ClientID) {
+		return nil, errors.New("ID token wasn't issued for this client")
+	}
+
+	now := time.Now()
+	if now.After(time.Unix(claims.Expiry, 0).Add(OIDC_CLOCK_SKEW)) {
+		return nil, errors.New("ID token expired")
+	}
+	if time.Unix(claims.IssuedAt, 0).After(now.Add(OIDC_CLOCK_SKEW)) {
+		return nil, errors.New("ID token issued in the future")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, errors.New("ID token nonce mismatch")
+	}
+
+	if claims.Subject == "" {
+		return nil, errors.New("ID token without subject")
+	}
+	return &claims, nil
+}
+
+func randomURLString(length int) (string, error) {
+	buf := make([]byte, length)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Returns redirect if it is a path on this site, "/" otherwise so the login can't send users elsewhere
+func localRedirect(redirect string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		return "/"
+	}
+	return redirect
+}
+
+// Returns the local user linked to the identity, creating it if the config allows it.
+// A signed in session links the identity to its user instead
+func (api *API) userFromIdentity(session *Session, claims *IDTokenClaims) (int, error) {
+	var userId int
+	err := api.QueryRow("userId_from_identity", []any{claims.Issuer, claims.Subject}, &userId)
+	if err == nil {
+		return userId, nil
+	} else if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	if session.signedIn {
+		_, err = api.ExecRow("add_to_user_identities", claims.Issuer, claims.Subject, session.userId)
+		if err != nil {
+			return 0, err
+		}
+
+		Info.Printf("Linked identity %v of %v to userID(%d)\n", claims.Subject, claims.Issuer, session.userId)
+		return session.userId, nil
+	}
+
+	if !api.config.OIDC.AutoCreate {
+		return 0, &NoSuchUser{}
+	}
+
+	username := claims.PreferredUsername
+	if username == "" {
+		username = claims.Email
+	}
+	if username == "" {
+		username = "sso-" + claims.Subject
+	}
+
+	var exists string
+	err = api.QueryRow("username_exists", []any{username}, &exists)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if exists == "1" {
+		// Never take over a local account just because the names match
+		suffix, err := randomShortUrl()
+		if err != nil {
+			return 0, err
+		}
+		username += "-" + suffix
+	}
+
+	name := claims.Name
+	if name == "" {
+		name = username
+	}
+
+	err = api.Transaction(func(tx *sql.Tx) error {
+		stmt, err := api.TxStmt(tx, "insert_into_users_auth")
+		if err != nil {
+			return err
+		}
+
+		res, err := stmt.Exec(username, nil) // No password, the user can only sign in through the provider
+		if err != nil {
+			return err
+		}
+
+		newUserId, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		userId = int(newUserId)
+
+		stmt, err = api.TxStmt(tx, "insert_into_users_data")
+		if err != nil {
+			return err
+		}
+
+		_, err = stmt.Exec(userId, name, 0, "")
+		if err != nil {
+			return err
+		}
+
+		stmt, err = api.TxStmt(tx, "add_to_user_identities")
+		if err != nil {
+			return err
+		}
+
+		_, err = stmt.Exec(claims.Issuer, claims.Subject, userId)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	Info.Printf("Created user %v with userID(%d) for identity %v of %v\n", username, userId, claims.Subject, claims.Issuer)
+	return userId, nil
+}
+
+// Sends the browser to a local path with a page rather than a 302. The callback is reached through a cross-site
+// redirect and a 302 from it would still be one, the navigation started by the page is same-site so the session
+// cookie goes with it
+func sameSiteRedirect(w http.ResponseWriter, target string) {
+	escaped := html.EscapeString(target)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer") // Keeps the code and state out of the Referer
+	fmt.Fprintf(w, `<!DOCTYPE html><meta http-equiv="refresh" content="0; url=%v"><a href="%v">Continue</a>`, escaped, escaped)
+}
+
+// GET /oidc/login?redirect=/manage, sends the user to the provider
+func (api *API) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(SessionKey).(*Session)
+	if api.oidc == nil {
+		http.Redirect(w, r, "/notfound", http.StatusTemporaryRedirect)
+		return
+	}
+
+	login := &oidcLogin{
+		sid:      session.sid,
+		redirect: localRedirect(r.URL.Query().Get("redirect")),
+		expiry:   time.Now().Add(OIDC_LOGIN_LIFETIME),
+	}
+
+	var err error
+	for _, value := range []*string{&login.state, &login.nonce, &login.verifier} {
+		*value, err = randomURLString(32)
+		if err != nil {
+			Error.Println("Failed to generate OIDC login state", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	authUrl, err := api.oidc.AuthURL(login)
+	if err != nil {
+		Error.Println("Failed to build OIDC authorization URL", err)
+		http.Redirect(w, r, "/signin?error=sso", http.StatusTemporaryRedirect)
+		return
+	}
+
+	api.oidc.startLogin(login)
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDC_STATE_COOKIE,
+		Value:    login.state,
+		Path:     "/oidc/callback",
+		MaxAge:   int(OIDC_LOGIN_LIFETIME.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode, // Sent on the top-level navigation back from the provider
+	})
+	http.Redirect(w, r, authUrl, http.StatusFound)
+}
+
+// GET /oidc/callback?code=...&state=..., where the provider sends the user back. The identity then goes through the
+// same checks as a password, the lockout and the two-factor code
+func (api *API) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(SessionKey).(*Session)
+	query := r.URL.Query()
+
+	// The login is over whatever happens next
+	http.SetCookie(w, &http.Cookie{Name: OIDC_STATE_COOKIE, Value: "", MaxAge: -1, Path: "/oidc/callback", HttpOnly: true, Secure: true, SameSite: http.SameSiteLaxMode})
+
+	fail := func(reason string, err error) {
+		Warning.Printf("OIDC login failed for SID(%v), %v: %v\n", session.sid, reason, err)
+		sameSiteRedirect(w, "/signin?error=sso")
+	}
+
+	if api.oidc == nil {
+		fail("no pending login", nil)
+		return
+	}
+
+	// The state must come from this browser, so nobody can have a victim complete a login they started
+	cookie, err := r.Cookie(OIDC_STATE_COOKIE)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(query.Get("state"))) != 1 {
+		fail("state mismatch", err)
+		return
+	}
+	login := api.oidc.finishLogin(query.Get("state"))
+	if login == nil {
+		fail("no pending login", nil)
+		return
+	}
+	if query.Get("error") != "" {
+		fail("provider returned an error", errors.New(query.Get("error")))
+		return
+	}
+
+	// The request came without the session cookie, the manager gave it a new session
+	if api.sessions != nil {
+		if resumed := api.sessions.Resume(w, session, login.sid); resumed != nil {
+			session = resumed
+		}
+	}
+
+	rawToken, err := api.oidc.Exchange(query.Get("code"), login.verifier)
+	if err != nil {
+		fail("code exchange", err)
+		return
+	}
+
+	claims, err := api.oidc.VerifyIDToken(rawToken, login.nonce)
+	if err != nil {
+		fail("ID token verification", err)
+		return
+	}
+
+	userId, err := api.userFromIdentity(session, claims)
+	if err != nil {
+		fail("no local user", err)
+		return
+	}
+
+	if session.signedIn && session.userId == userId {
+		Info.Printf("SID(%v) authenticated again, or linked an identity to its userID(%d)\n", session.sid, userId)
+		session.signedInAt = time.Now()
+		sameSiteRedirect(w, login.redirect)
+		return
+	}
+
+	var username string
+	err = api.QueryRow("username_from_userId", []any{userId}, &username)
+	if err != nil {
+		fail("no local user", err)
+		return
+	}
+
+	err = api.checkLoginThrottle(username, api.clientIP(r))
+	if err != nil {
+		fail("sign-in throttled", err)
+		return
+	}
+
+	wasSignedIn := session.signedIn
+	err = api.completeSignin(session, userId, username)
+	if _, ok := err.(*TwoFactorRequired); ok {
+		sameSiteRedirect(w, "/signin?twofactor=1&redirect="+url.QueryEscape(login.redirect))
+		return
+	} else if err != nil {
+		fail("sign-in", err)
+		return
+	}
+
+	if !wasSignedIn {
+		api.claimAnonymousLinks(session, userId)
+	}
+	sameSiteRedirect(w, login.redirect)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Identity provider issuing RS256 ID tokens for a single user, it checks the PKCE verifier of each code
+type testProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mutex      *sync.Mutex
+	challenges map[string]string // PKCE code challenge by code
+	nonces     map[string]string
+}
+
+func newTestProvider(t *testing.T, clientId string) *testProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &testProvider{key: key, mutex: new(sync.Mutex), challenges: make(map[string]string), nonces: make(map[string]string)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                provider.URL,
+			AuthorizationEndpoint: provider.URL + "/authorize",
+			TokenEndpoint:         provider.URL + "/token",
+			JwksURI:               provider.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]jsonWebKey{"keys": {{
+			Kty: "RSA",
+			Kid: "test",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		code := r.FormValue("code")
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+
+		provider.mutex.Lock()
+		challenge, nonce := provider.challenges[code], provider.nonces[code]
+		delete(provider.challenges, code)
+		provider.mutex.Unlock()
+
+		if challenge == "" || challenge != base64.RawURLEncoding.EncodeToString(verifier[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		now := time.Now().Unix()
+		claims, _ := json.Marshal(map[string]any{
+			"iss":                provider.URL,
+			"sub":                "alice-subject",
+			"aud":                clientId,
+			"exp":                now + 60,
+			"iat":                now,
+			"nonce":              nonce,
+			"preferred_username": "alice",
+		})
+		json.NewEncoder(w).Encode(map[string]string{"id_token": provider.sign(t, claims)})
+	})
+
+	provider.Server = httptest.NewServer(mux)
+	t.Cleanup(provider.Close)
+	return provider
+}
+
+func (provider *testProvider) sign(t *testing.T, claims []byte) string {
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"test"}`)) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, provider.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// Plays the user signing in at the provider, returns the code of the authorization request
+func (provider *testProvider) authorize(t *testing.T, authUrl string) (code string, state string) {
+	parsed, err := url.Parse(authUrl)
+	if err != nil || !strings.HasPrefix(authUrl, provider.URL+"/authorize") {
+		t.Fatalf("Login redirected to %v instead of the provider", authUrl)
+	}
+	query := parsed.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("Authorization request without PKCE: %v", authUrl)
+	}
+
+	code, err = randomURLString(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.mutex.Lock()
+	provider.challenges[code] = query.Get("code_challenge")
+	provider.nonces[code] = query.Get("nonce")
+	provider.mutex.Unlock()
+	return code, query.Get("state")
+}
+
+type oidcTest struct {
+	db       *fakeDB
+	provider *testProvider
+	manager  *Manager
+	app      *httptest.Server
+	client   *http.Client
+}
+
+func newOIDCTest(t *testing.T) *oidcTest {
+	db, config := newFakeDB(t)
+	provider := newTestProvider(t, "shr.me")
+
+	mux := http.NewServeMux()
+	app := httptest.NewUnstartedServer(nil)
+	config.OIDC.Enabled = true
+	config.OIDC.Issuer = provider.URL
+	config.OIDC.ClientID = "shr.me"
+	config.OIDC.RedirectURL = "https://" + app.Listener.Addr().String() + "/oidc/callback"
+	api := newTestAPI(t, config)
+
+	mux.HandleFunc("/oidc/login", api.handleOIDCLogin)
+	mux.HandleFunc("/oidc/callback", api.handleOIDCCallback)
+	manager := NewManager(mux, "session_id", time.Hour, time.Minute)
+	api.sessions = manager
+	app.Config.Handler = manager
+	app.StartTLS()
+	t.Cleanup(app.Close)
+
+	// The test decides which cookies each request carries, like the browser would
+	client := app.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }
+
+	db.onRow("from user_identities where issuer = ?", int64(42))
+	db.onRow("select username from users_auth where userID = ?", "alice")
+	return &oidcTest{db, provider, manager, app, client}
+}
+
+func (test *oidcTest) get(t *testing.T, path string, cookies ...*http.Cookie) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, test.app.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	res, err := test.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res
+}
+
+func responseCookie(res *http.Response, name string) *http.Cookie {
+	var found *http.Cookie
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == name {
+			found = cookie // The last one is the one the browser keeps
+		}
+	}
+	return found
+}
+
+// Starts a login from a new session, returns the session cookie, the state cookie and the code from the provider
+func (test *oidcTest) startLogin(t *testing.T) (*http.Cookie, *http.Cookie, string, string) {
+	res := test.get(t, "/oidc/login?redirect=/manage")
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("GET /oidc/login answered %v", res.Status)
+	}
+
+	sessionCookie, stateCookie := responseCookie(res, "session_id"), responseCookie(res, OIDC_STATE_COOKIE)
+	if sessionCookie == nil || stateCookie == nil {
+		t.Fatalf("GET /oidc/login didn't set the session and state cookies: %v", res.Header["Set-Cookie"])
+	}
+	if stateCookie.SameSite != http.SameSiteLaxMode || stateCookie.Path != "/oidc/callback" || !stateCookie.HttpOnly {
+		t.Errorf("State cookie %v isn't a Lax cookie limited to the callback", stateCookie)
+	}
+
+	code, state := test.provider.authorize(t, res.Header.Get("Location"))
+	return sessionCookie, stateCookie, code, state
+}
+
+func (test *oidcTest) session(t *testing.T, cookie *http.Cookie) *Session {
+	test.manager.mutex.Lock()
+	defer test.manager.mutex.Unlock()
+
+	sid, _ := url.QueryUnescape(cookie.Value)
+	session := test.manager.sessions[sid]
+	if session == nil {
+		t.Fatalf("No session for SID(%v)", sid)
+	}
+	return session
+}
+
+func TestOIDCLoginRoundTrip(t *testing.T) {
+	t.Run("signs in the session which started the login", func(t *testing.T) {
+		test := newOIDCTest(t)
+		sessionCookie, stateCookie, code, state := test.startLogin(t)
+
+		// The provider's cross-site redirect doesn't carry the SameSite=Strict session cookie
+		res := test.get(t, "/oidc/callback?code="+url.QueryEscape(code)+"&state="+url.QueryEscape(state), stateCookie)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Callback answered %v", res.Status)
+		}
+		if resumed := responseCookie(res, "session_id"); resumed == nil || resumed.Value != sessionCookie.Value {
+			t.Errorf("Callback didn't switch the browser back to its session, got cookie %v", resumed)
+		}
+
+		session := test.session(t, sessionCookie)
+		if !session.signedIn || session.userId != 42 {
+			t.Errorf("Session not signed in as userID(42) after the callback: signedIn %v, userId %d", session.signedIn, session.userId)
+		}
+
+		test.manager.mutex.Lock()
+		sessions := len(test.manager.sessions)
+		test.manager.mutex.Unlock()
+		if sessions != 1 {
+			t.Errorf("The session created for the callback request wasn't removed, %d sessions", sessions)
+		}
+
+		// A login is completed once
+		res = test.get(t, "/oidc/callback?code="+url.QueryEscape(code)+"&state="+url.QueryEscape(state), stateCookie)
+		if session := test.session(t, responseCookie(res, "session_id")); session.signedIn {
+			t.Error("Replayed callback signed in another session")
+		}
+	})
+
+	t.Run("waits for the two-factor code", func(t *testing.T) {
+		test := newOIDCTest(t)
+		test.db.onRow("from user_totp where userID = ?", []byte("secret"), int64(1), int64(0))
+		sessionCookie, stateCookie, code, state := test.startLogin(t)
+
+		test.get(t, "/oidc/callback?code="+url.QueryEscape(code)+"&state="+url.QueryEscape(state), stateCookie)
+		session := test.session(t, sessionCookie)
+		if session.signedIn {
+			t.Error("Session signed in without the two-factor code")
+		}
+		if session.twoFactor == nil || session.twoFactor.userId != 42 || session.twoFactor.username != "alice" {
+			t.Errorf("Session isn't waiting for the two-factor code of userID(42): %+v", session.twoFactor)
+		}
+	})
+
+	t.Run("refuses locked accounts", func(t *testing.T) {
+		test := newOIDCTest(t)
+		test.db.on("from login_throttles where throttle_key = ?", func(args []driver.Value) (fakeResult, error) {
+			if args[0] == "user:alice" {
+				return fakeResult{rows: [][]driver.Value{{int64(10), int64(5), int64(600)}}}, nil
+			}
+			return fakeResult{}, nil
+		})
+		sessionCookie, stateCookie, code, state := test.startLogin(t)
+
+		test.get(t, "/oidc/callback?code="+url.QueryEscape(code)+"&state="+url.QueryEscape(state), stateCookie)
+		if session := test.session(t, sessionCookie); session.signedIn {
+			t.Error("Locked account signed in through the provider")
+		}
+	})
+
+	t.Run("refuses a callback from another browser", func(t *testing.T) {
+		test := newOIDCTest(t)
+		sessionCookie, _, code, state := test.startLogin(t)
+
+		// Someone else's browser completing the login without the state cookie
+		res := test.get(t, "/oidc/callback?code="+url.QueryEscape(code)+"&state="+url.QueryEscape(state))
+		if session := test.session(t, responseCookie(res, "session_id")); session.signedIn {
+			t.Error("Callback without the state cookie signed in")
+		}
+		if session := test.session(t, sessionCookie); session.signedIn {
+			t.Error("Callback without the state cookie signed in the session which started the login")
+		}
+	})
+}
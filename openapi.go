@@ -0,0 +1,744 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Subset of the OpenAPI 3.0 objects needed to describe the API, schemas are plain JSON schema maps
+
+type OpenAPIOperation struct {
+	Summary     string                     `json:"summary"`
+	Security    []map[string][]string      `json:"security,omitempty"`
+	Parameters  []OpenAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]OpenAPIResponse `json:"responses"`
+}
+
+type OpenAPIParameter struct {
+	Name     string         `json:"name"`
+	In       string         `json:"in"` // query, path or header
+	Required bool           `json:"required,omitempty"`
+	Schema   map[string]any `json:"schema"`
+}
+
+type OpenAPIRequestBody struct {
+	Required bool                    `json:"required"`
+	Content  map[string]OpenAPIMedia `json:"content"`
+}
+
+type OpenAPIMedia struct {
+	Schema map[string]any `json:"schema"`
+}
+
+type OpenAPIResponse struct {
+	Description string                  `json:"description"`
+	Headers     map[string]any          `json:"headers,omitempty"`
+	Content     map[string]OpenAPIMedia `json:"content,omitempty"`
+}
+
+func schemaRef(name string) map[string]any {
+	return map[string]any{"$ref": "#/components/schemas/" + name}
+}
+
+func arrayOf(items map[string]any) map[string]any {
+	return map[string]any{"type": "array", "items": items}
+}
+
+func stringSchema() map[string]any {
+	return map[string]any{"type": "string"}
+}
+
+func integerSchema() map[string]any {
+	return map[string]any{"type": "integer"}
+}
+
+func objectSchema(properties map[string]map[string]any, required ...string) map[string]any {
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func queryParam(name string, required bool, schema map[string]any) OpenAPIParameter {
+	return OpenAPIParameter{name, "query", required, schema}
+}
+
+// Optional header making link creation safe to retry, see API.idempotent
+var idempotencyKeyParam = OpenAPIParameter{IDEMPOTENCY_KEY_HEADER, "header", false, map[string]any{"type": "string", "maxLength": IDEMPOTENCY_KEY_MAX_LENGTH}}
+
+func pathParam(name string) OpenAPIParameter {
+	return OpenAPIParameter{name, "path", true, stringSchema()}
+}
+
+// Form body with string fields, the required ones are listed separately
+func formBody(fields []string, required ...string) *OpenAPIRequestBody {
+	properties := make(map[string]map[string]any)
+	for _, field := range fields {
+		properties[field] = stringSchema()
+	}
+	return &OpenAPIRequestBody{true, map[string]OpenAPIMedia{
+		"application/x-www-form-urlencoded": {objectSchema(properties, required...)},
+	}}
+}
+
+func jsonBody(schema map[string]any) *OpenAPIRequestBody {
+	return &OpenAPIRequestBody{true, map[string]OpenAPIMedia{"application/json": {schema}}}
+}
+
+func emptyResponse(description string) OpenAPIResponse {
+	return OpenAPIResponse{Description: description}
+}
+
+func textResponse(description string) OpenAPIResponse {
+	return OpenAPIResponse{Description: description, Content: map[string]OpenAPIMedia{"text/plain": {stringSchema()}}}
+}
+
+func jsonResponse(description string, schema map[string]any) OpenAPIResponse {
+	return OpenAPIResponse{Description: description, Content: map[string]OpenAPIMedia{"application/json": {schema}}}
+}
+
+func withHeaders(response OpenAPIResponse, headers map[string]any) OpenAPIResponse {
+	response.Headers = headers
+	return response
+}
+
+func errorResponse(description string) OpenAPIResponse {
+	return jsonResponse(description, schemaRef("ErrorEnvelope"))
+}
+
+// Parameters of the paginated link listings, see ParseLinkQuery
+var linkListParams = []OpenAPIParameter{
+	queryParam("workspace", false, integerSchema()),
+	queryParam("sort", false, map[string]any{"type": "string", "enum": []string{"code", "destination", "created", "clicks"}}),
+	queryParam("order", false, map[string]any{"type": "string", "enum": []string{"asc", "desc"}}),
+	queryParam("q", false, stringSchema()),
+	queryParam("cursor", false, stringSchema()),
+	queryParam("limit", false, map[string]any{"type": "integer", "minimum": 1, "maximum": LINK_PAGE_MAX_SIZE}),
+}
+
+// Link header of the paginated link listings, absent on the last page
+var linkListHeaders = map[string]any{
+	"Link": map[string]any{"description": `URL of the next page with rel="next"`, "schema": stringSchema()},
+}
+
+var (
+	securitySignedIn = []map[string][]string{{"session": {}}, {"token": {}}}
+	securityCookie   = []map[string][]string{{"session": {}}}
+)
+
+var openAPISchemas = map[string]map[string]any{
+	"LinkData": objectSchema(map[string]map[string]any{
+		"Short": stringSchema(),
+		"Long":  stringSchema(),
+	}, "Short", "Long"),
+	"LinkStats": objectSchema(map[string]map[string]any{
+		"Short":   stringSchema(),
+		"Clicks":  integerSchema(),
+		"Created": stringSchema(),
+	}),
+	"LinkRequest": objectSchema(map[string]map[string]any{
+		"short":     stringSchema(),
+		"long":      stringSchema(),
+		"workspace": integerSchema(),
+	}, "long"),
+	"CacheStats": objectSchema(map[string]map[string]any{
+		"enabled": {"type": "boolean"},
+		"entries": integerSchema(),
+		"maxSize": integerSchema(),
+		"hits":    integerSchema(),
+		"misses":  integerSchema(),
+	}),
+	"TransferData": objectSchema(map[string]map[string]any{
+		"Id":       integerSchema(),
+		"From":     stringSchema(),
+		"To":       stringSchema(),
+		"Short":    stringSchema(),
+		"Created":  stringSchema(),
+		"Incoming": {"type": "boolean"},
+	}),
+	"WorkspaceData": objectSchema(map[string]map[string]any{
+		"Id":   integerSchema(),
+		"Name": stringSchema(),
+		"Role": schemaRef("Role"),
+	}),
+	"MemberData": objectSchema(map[string]map[string]any{
+		"Username": stringSchema(),
+		"Role":     schemaRef("Role"),
+	}),
+	"Role": {"type": "string", "enum": []string{"viewer", "editor", "owner"}},
+	"TokenData": objectSchema(map[string]map[string]any{
+		"Id":       integerSchema(),
+		"Name":     stringSchema(),
+		"Scopes":   arrayOf(stringSchema()),
+		"Created":  stringSchema(),
+		"Expires":  stringSchema(),
+		"LastUsed": stringSchema(),
+	}),
+	"TwoFactorSetup": objectSchema(map[string]map[string]any{
+		"Secret": stringSchema(), // Base32, for apps without a camera
+		"URI":    stringSchema(),
+		"QR":     stringSchema(), // SVG, empty if the URI is too long
+	}),
+	"WebhookData": objectSchema(map[string]map[string]any{
+		"Id":      integerSchema(),
+		"Url":     stringSchema(),
+		"Events":  arrayOf(stringSchema()),
+		"Created": stringSchema(),
+	}),
+	"DeliveryData": objectSchema(map[string]map[string]any{
+		"Id":             integerSchema(),
+		"Event":          stringSchema(),
+		"Status":         {"type": "string", "enum": []string{DELIVERY_PENDING, DELIVERY_DELIVERED, DELIVERY_FAILED}},
+		"Attempts":       integerSchema(),
+		"ResponseStatus": integerSchema(),
+		"Error":          stringSchema(),
+		"Created":        stringSchema(),
+		"NextAttempt":    stringSchema(),
+	}),
+	"BatchRequest": objectSchema(map[string]map[string]any{
+		"atomic":     {"type": "boolean"},
+		"operations": {"type": "array", "items": schemaRef("BatchOperation"), "minItems": 1, "maxItems": BATCH_MAX_OPERATIONS},
+	}, "operations"),
+	"BatchOperation": objectSchema(map[string]map[string]any{
+		"op":        {"type": "string", "enum": []string{BATCH_CREATE, BATCH_UPDATE, BATCH_DELETE}},
+		"short":     stringSchema(),
+		"long":      stringSchema(),
+		"workspace": integerSchema(),
+	}, "op", "short"),
+	"BatchResponse": objectSchema(map[string]map[string]any{
+		"committed": {"type": "boolean"},
+		"results": arrayOf(objectSchema(map[string]map[string]any{
+			"status": integerSchema(),
+			"link":   schemaRef("LinkData"),
+			"error":  schemaRef("ErrorBody"),
+		}, "status")),
+	}, "committed", "results"),
+	"ErrorBody": objectSchema(map[string]map[string]any{
+		"code":    stringSchema(),
+		"message": stringSchema(),
+	}, "code", "message"),
+	"ErrorEnvelope": objectSchema(map[string]map[string]any{
+		"error": objectSchema(map[string]map[string]any{
+			"code":    stringSchema(),
+			"message": stringSchema(),
+		}, "code", "message"),
+	}, "error"),
+}
+
+// Operations of API.ServeHTTP keyed by "<method> <endpoint>", checked against apiRoutes by TestOpenAPICoverage
+var apiOperations = map[string]OpenAPIOperation{
+	"POST auth": {
+		Summary:     "Signs in the session, failures delay and then lock further attempts of the username and the IP",
+		RequestBody: formBody([]string{"username", "password"}, "username", "password"),
+		Responses: map[string]OpenAPIResponse{
+			"200": emptyResponse("Signed in"),
+			"202": textResponse("Password correct, the sign-in finishes with a code of POST 2fa/verify"),
+			"401": textResponse("Username or password incorrect"),
+			"429": withHeaders(textResponse("Too many failed sign-ins"), map[string]any{"Retry-After": map[string]any{"schema": integerSchema()}}),
+		},
+	},
+	"POST 2fa/verify": {
+		Summary:     "Finishes a sign-in with two-factor authentication with a TOTP or recovery code, each is accepted once",
+		RequestBody: formBody([]string{"code"}, "code"),
+		Responses: map[string]OpenAPIResponse{
+			"200": emptyResponse("Signed in"),
+			"401": textResponse("Wrong code, or no pending sign-in. Too many wrong codes cancel the sign-in"),
+			"429": withHeaders(textResponse("Too many failed sign-ins"), map[string]any{"Retry-After": map[string]any{"schema": integerSchema()}}),
+		},
+	},
+	"POST 2fa/setup": {
+		Summary:  "Generates a TOTP secret, two-factor authentication is off until POST 2fa/enable",
+		Security: securityCookie,
+		Responses: map[string]OpenAPIResponse{
+			"200": jsonResponse("Secret, provisioning URI and its QR code", schemaRef("TwoFactorSetup")),
+			"401": textResponse("Not signed in"),
+			"409": textResponse("Two-factor authentication already on"),
+		},
+	},
+	"POST 2fa/enable": {
+		Summary:     "Turns two-factor authentication on with a code of the new secret",
+		Security:    securityCookie,
+		RequestBody: formBody([]string{"code"}, "code"),
+		Responses: map[string]OpenAPIResponse{
+			"200": textResponse("Recovery codes, one per line"),
+			"400": textResponse("Wrong code, or no setup"),
+			"401": textResponse("Not signed in"),
+			"409": textResponse("Two-factor authentication already on"),
+		},
+	},
+	"POST 2fa/disable": {
+		Summary:     "Turns two-factor authentication off",
+		Security:    securityCookie,
+		RequestBody: formBody([]string{"password", "code"}, "password", "code"),
+		Responses: map[string]OpenAPIResponse{
+			"200": emptyResponse("Two-factor authentication off"),
+			"401": textResponse("Not signed in, or wrong password or code"),
+		},
+	},
+	"POST 2fa/recovery": {
+		Summary:     "Replaces the recovery codes",
+		Security:    securityCookie,
+		RequestBody: formBody([]string{"code"}, "code"),
+		Responses: map[string]OpenAPIResponse{
+			"200": textResponse("Recovery codes, one per line"),
+			"401": textResponse("Not signed in, or wrong code"),
+		},
+	},
+	"POST signup": {
+		Summary:     "Creates an account and mails a link verifying its email, it is deleted if not verified in time",
+		RequestBody: formBody([]string{"name", "age", "born", "username", "password", "email"}, "name", "age", "born", "username", "password", "email"),
+		Responses: map[string]OpenAPIResponse{
+			"200": emptyResponse("Account created"),
+			"401": textResponse("Missing field, invalid email or username taken"),
+			"409": textResponse("Email used by another account"),
+		},
+	},
+	"POST signout": {
+		Summary:  "Signs out, destroying the session and clearing its cookie",
+		Security: securityCookie,
+		Responses: map[string]OpenAPIResponse{
+			"200": emptyResponse("Signed out"),
+			"400": textResponse("Access tokens can't sign out, revoke them instead"),
+		},
+	},
+	"POST signout/everywhere": {
+		Summary:  "Signs out every session of the user, access tokens stay valid",
+		Security: securityCookie,
+		Responses: map[string]OpenAPIResponse{
+			"200": emptyResponse("Every session signed out"),
+			"400": textResponse("Access tokens can't sign out, revoke them instead"),
+			"401": textResponse("Not signed in"),
+		},
+	},
+	"POST password": {
+		Summary:     "Changes the password, the other sessions of the user are signed out",
+		Security:    securityCookie,
+		RequestBody: formBody([]string{"current", "password"}, "current", "password"),
+		Responses: map[string]OpenAPIResponse{
+			"200": emptyResponse("Password changed"),
+			"400": textResponse("Empty new password"),
+			"401": textResponse("Not signed in or wrong current password"),
+		},
+	},
+	"GET account/export": {
+		Summary:  "Downloads the personal data of the user: profile, links, stats, failed sign-ins, transfers, tokens and workspaces",
+		Security: securityCookie,
+		Responses: map[string]OpenAPIResponse{
+			"200": {Description: "ZIP of JSON files", Content: map[string]OpenAPIMedia{"application/zip": {map[string]any{"type": "string", "format": "binary"}}}},
+			"401": textResponse("Not signed in"),
+		},
+	},
+	"POST account/delete": {
+		Summary:     "Deletes the account and its personal links, or hands them to a workspace, and signs out every session. Accounts without a password must have signed in within 10 minutes instead",
+		Security:    securityCookie,
+		RequestBody: formBody([]string{"password", "code", "workspace"}),
+		Responses: map[string]OpenAPIResponse{
+			"200": emptyResponse("Account deleted"),
+			"400": textResponse("Invalid workspace, or the account is the only owner of the workspaces named in the message"),
+			"401": textResponse("Not signed in, wrong password or two-factor code, no recent sign-in, or the links can't be added to the workspace"),
+		},
+	},
+	"POST email": {
+		Summary:     "Sets the email password reset links are sent to and mails it a verification link, an empty email removes it",
+		Security:    securityCookie,
+		RequestBody: formBody([]string{"email"}),
+		Responses: map[string]OpenAPIResponse{
+			"200": emptyResponse("Email changed, or verification link sent again"),
+			"400": textResponse("Invalid email"),
+			"401": textResponse("Not signed in"),
+			"409": textResponse("Email used by another account"),
+		},
+	},
+	"POST email/verify": {
+		Summary:     "Verifies an email with the token of a verification link, which lifts the limits of new accounts",
+		RequestBody: formBody([]string{"token"}, "token"),
+		Responses: map[string]OpenAPIResponse{
+			"200": emptyResponse("Email verified"),
+			"400": textResponse("Missing token"),
+			"401": textResponse("Invalid or expired token, or the email changed since"),
+		},
+	},
+	"POST password/reset/request": {
+		Summary:     "Mails a single use password reset link to the user if they have an email, answers the same for unknown users",
+		RequestBody: formBody([]string{"username"}, "username"),
+		Responses: map[string]OpenAPIResponse{
+			"200": emptyResponse("Link sent if the user exists and has an email"),
+		},
+	},
+	"POST password/reset": {
+		Summary:     "Sets a new password with the token of a reset link, every session of the user is signed out",
+		RequestBody: formBody([]string{"token", "password"}, "token", "password"),
+		Responses: map[string]OpenAPIResponse{
+			"200": emptyResponse("Password changed"),
+			"400": textResponse("Missing token or password"),
+			"401": textResponse("Invalid, used or expired token"),
+		},
+	},
+	"POST add": {
+		Summary:     "Adds a link, a short code is generated when short is empty and for anonymous sessions when enabled",
+		Parameters:  []OpenAPIParameter{idempotencyKeyParam},
+		RequestBody: formBody([]string{"short", "long", "workspace"}, "long"),
+		Responses: map[string]OpenAPIResponse{
+			"200": jsonResponse("Anonymous link created", schemaRef("LinkData")),
+			"308": emptyResponse("Link created, redirects to /manage"),
+			"400": textResponse("Invalid or already used short link"),
+			"401": textResponse("Not signed in or not allowed in the workspace"),
+			"403": textResponse("Choosing the short link needs a verified email"),
+			"409": textResponse("The first request with the idempotency key is still running"),
+			"422": textResponse("The idempotency key was used with another request"),
+			"429": textResponse("Anonymous creation quota exceeded"),
+		},
+	},
+	"GET get": {
+		Summary:    "Lists a page of the personal links, or of the links of a workspace",
+		Security:   securitySignedIn,
+		Parameters: linkListParams,
+		Responses: map[string]OpenAPIResponse{
+			"200": withHeaders(jsonResponse("Links", arrayOf(schemaRef("LinkData"))), linkListHeaders),
+			"400": emptyResponse("Invalid sort, order, search, cursor or limit"),
+			"401": emptyResponse("Not signed in"),
+		},
+	},
+	"DELETE delete": {
+		Summary:    "Deletes a link",
+		Security:   securitySignedIn,
+		Parameters: []OpenAPIParameter{queryParam("short", true, stringSchema())},
+		Responses: map[string]OpenAPIResponse{
+			"200": emptyResponse("Link deleted"),
+			"400": emptyResponse("Missing short link"),
+			"401": textResponse("Not allowed to delete the link"),
+		},
+	},
+	"GET stats": {
+		Summary:    "Gets the click statistics of a link",
+		Security:   securitySignedIn,
+		Parameters: []OpenAPIParameter{queryParam("short", true, stringSchema())},
+		Responses: map[string]OpenAPIResponse{
+			"200": jsonResponse("Statistics", schemaRef("LinkStats")),
+			"401": textResponse("Not allowed to view the link"),
+			"404": textResponse("No such link"),
+		},
+	},
+	"GET stream": {
+		Summary:  "Streams the clicks of a link, or of all the personal or workspace links, as Server-Sent Events",
+		Security: securitySignedIn,
+		Parameters: []OpenAPIParameter{
+			queryParam("short", false, stringSchema()),
+			queryParam("workspace", false, integerSchema()),
+		},
+		Responses: map[string]OpenAPIResponse{
+			"200": {Description: "\"clicks\" events with the Short link, its total Clicks and the New ones, and heartbeat comments",
+				Content: map[string]OpenAPIMedia{"text/event-stream": {stringSchema()}}},
+			"401": textResponse("Not allowed to view the links"),
+			"404": textResponse("No such link"),
+			"429": withHeaders(textResponse("Too many open streams"), map[string]any{"Retry-After": map[string]any{"schema": integerSchema()}}),
+		},
+	},
+	"GET cache": {
+		Summary:  "Gets the redirect cache counters",
+		Security: securitySignedIn,
+		Responses: map[string]OpenAPIResponse{
+			"200": jsonResponse("Counters", schemaRef("CacheStats")),
+			"401": emptyResponse("Not signed in"),
+		},
+	},
+	"POST transfer": {
+		Summary:     "Asks another user to take over a link, or every personal link if short is empty",
+		Security:    securityCookie,
+		RequestBody: formBody([]string{"to", "short"}, "to"),
+		Responses: map[string]OpenAPIResponse{
+			"200": emptyResponse("Transfer requested"),
+			"401": textResponse("Not the owner of the link"),
+			"404": textResponse("No such user or link"),
+		},
+	},
+	"DELETE transfer": {
+		Summary:    "Cancels or declines a transfer request",
+		Security:   securityCookie,
+		Parameters: []OpenAPIParameter{queryParam("id", true, integerSchema())},
+		Responses: map[string]OpenAPIResponse{
+			"200": emptyResponse("Transfer deleted"),
+			"401": textResponse("Neither sender nor recipient"),
+			"404": textResponse("No such transfer"),
+		},
+	},
+	"POST transfer/accept": {
+		Summary:    "Accepts a transfer request, moving the links in one transaction",
+		Security:   securityCookie,
+		Parameters: []OpenAPIParameter{queryParam("id", true, integerSchema())},
+		Responses: map[string]OpenAPIResponse{
+			"200": emptyResponse("Links transferred"),
+			"401": textResponse("Not the recipient"),
+			"404": textResponse("No such transfer or link"),
+		},
+	},
+	"GET transfers": {
+		Summary:  "Lists the pending transfer requests sent or received",
+		Security: securityCookie,
+		Responses: map[string]OpenAPIResponse{
+			"200": jsonResponse("Transfer requests", arrayOf(schemaRef("TransferData"))),
+			"401": textResponse("Not signed in"),
+		},
+	},
+	"POST admin/transfer": {
+		Summary:     "Moves every personal link of a user to another one, for admins",
+		Security:    securityCookie,
+		RequestBody: formBody([]string{"from", "to"}, "from", "to"),
+		Responses: map[string]OpenAPIResponse{
+			"200": textResponse("Number of links transferred"),
+			"401": textResponse("Not an admin"),
+			"404": textResponse("No such user"),
+		},
+	},
+	"POST workspace": {
+		Summary:     "Creates a workspace owned by the session's user",
+		Security:    securityCookie,
+		RequestBody: formBody([]string{"name"}, "name"),
+		Responses: map[string]OpenAPIResponse{
+			"200": textResponse("ID of the workspace"),
+			"400": textResponse("Invalid name"),
+			"403": textResponse("The email of the account isn't verified"),
+		},
+	},
+	"GET workspaces": {
+		Summary:  "Lists the workspaces of the session's user",
+		Security: securitySignedIn,
+		Responses: map[string]OpenAPIResponse{
+			"200": jsonResponse("Workspaces", arrayOf(schemaRef("WorkspaceData"))),
+			"401": textResponse("Not signed in"),
+		},
+	},
+	"GET workspace/members": {
+		Summary:    "Lists the members of a workspace",
+		Security:   securitySignedIn,
+		Parameters: []OpenAPIParameter{queryParam("workspace", true, integerSchema())},
+		Responses: map[string]OpenAPIResponse{
+			"200": jsonResponse("Members", arrayOf(schemaRef("MemberData"))),
+			"401": textResponse("Not a member"),
+		},
+	},
+	"POST workspace/member": {
+		Summary:     "Adds a member to a workspace or changes their role",
+		Security:    securityCookie,
+		RequestBody: formBody([]string{"workspace", "username", "role"}, "workspace", "username", "role"),
+		Responses: map[string]OpenAPIResponse{
+			"200": emptyResponse("Member set"),
+			"400": textResponse("Invalid role or last owner"),
+			"401": textResponse("Not an owner"),
+			"404": textResponse("No such user"),
+		},
+	},
+	"DELETE workspace/member": {
+		Summary:    "Removes a member from a workspace",
+		Security:   securityCookie,
+		Parameters: []OpenAPIParameter{queryParam("workspace", true, integerSchema()), queryParam("username", true, stringSchema())},
+		Responses: map[string]OpenAPIResponse{
+			"200": emptyResponse("Member removed"),
+			"400": textResponse("Last owner"),
+			"401": textResponse("Not an owner"),
+			"404": textResponse("No such member"),
+		},
+	},
+	"POST token": {
+		Summary:     "Creates a personal access token, the token is only returned once",
+		Security:    securityCookie,
+		RequestBody: formBody([]string{"name", "scope", "expires"}, "name", "scope"),
+		Responses: map[string]OpenAPIResponse{
+			"200": textResponse("The token"),
+			"400": textResponse("Invalid name, scope or expiry"),
+		},
+	},
+	"GET tokens": {
+		Summary:  "Lists the personal access tokens",
+		Security: securityCookie,
+		Responses: map[string]OpenAPIResponse{
+			"200": jsonResponse("Tokens", arrayOf(schemaRef("TokenData"))),
+			"401": textResponse("Not signed in"),
+		},
+	},
+	"DELETE token": {
+		Summary:    "Revokes a personal access token",
+		Security:   securityCookie,
+		Parameters: []OpenAPIParameter{queryParam("id", true, integerSchema())},
+		Responses: map[string]OpenAPIResponse{
+			"200": emptyResponse("Token revoked"),
+			"400": textResponse("No such token"),
+		},
+	},
+	"POST webhook": {
+		Summary:     "Registers a webhook for the personal links, or the links of a workspace, the signing secret is only returned once",
+		Security:    securityCookie,
+		RequestBody: formBody([]string{"url", "event", "workspace"}, "url", "event"),
+		Responses: map[string]OpenAPIResponse{
+			"200": textResponse("The signing secret"),
+			"400": textResponse("Invalid URL or event, or webhooks are disabled"),
+			"401": textResponse("Not an owner of the workspace"),
+			"403": textResponse("The email of the account isn't verified"),
+		},
+	},
+	"GET webhooks": {
+		Summary:    "Lists the personal webhooks, or the webhooks of a workspace",
+		Security:   securityCookie,
+		Parameters: []OpenAPIParameter{queryParam("workspace", false, integerSchema())},
+		Responses: map[string]OpenAPIResponse{
+			"200": jsonResponse("Webhooks", arrayOf(schemaRef("WebhookData"))),
+			"401": textResponse("Not an owner of the workspace"),
+		},
+	},
+	"DELETE webhook": {
+		Summary:    "Deletes a webhook with its delivery log",
+		Security:   securityCookie,
+		Parameters: []OpenAPIParameter{queryParam("id", true, integerSchema())},
+		Responses: map[string]OpenAPIResponse{
+			"200": emptyResponse("Webhook deleted"),
+			"400": textResponse("No such webhook"),
+		},
+	},
+	"GET webhook/deliveries": {
+		Summary:    "Lists the latest deliveries of a webhook",
+		Security:   securityCookie,
+		Parameters: []OpenAPIParameter{queryParam("id", true, integerSchema())},
+		Responses: map[string]OpenAPIResponse{
+			"200": jsonResponse("Deliveries, newest first", arrayOf(schemaRef("DeliveryData"))),
+			"400": textResponse("No such webhook"),
+		},
+	},
+	"POST webhook/test": {
+		Summary:    "Sends a ping event to a webhook right away",
+		Security:   securityCookie,
+		Parameters: []OpenAPIParameter{queryParam("id", true, integerSchema())},
+		Responses: map[string]OpenAPIResponse{
+			"200": textResponse("Delivered, with the status answered by the endpoint"),
+			"400": textResponse("No such webhook"),
+			"502": textResponse("The endpoint failed, the ping is retried"),
+		},
+	},
+	"GET openapi.json": {
+		Summary: "This description",
+		Responses: map[string]OpenAPIResponse{
+			"200": jsonResponse("OpenAPI document", map[string]any{"type": "object"}),
+		},
+	},
+}
+
+var v1ErrorResponses = map[string]OpenAPIResponse{
+	"400": errorResponse("invalid_input"),
+	"401": errorResponse("unauthenticated"),
+	"403": errorResponse("forbidden"),
+	"404": errorResponse("link_not_found"),
+	"405": errorResponse("method_not_allowed, with an Allow header"),
+	"429": errorResponse("rate_limited, with Retry-After and RateLimit-* headers"),
+}
+
+// Returns the responses of a versioned API operation with the shared error responses
+func v1Responses(responses map[string]OpenAPIResponse) map[string]OpenAPIResponse {
+	for status, response := range v1ErrorResponses {
+		if _, exists := responses[status]; !exists {
+			responses[status] = response
+		}
+	}
+	return responses
+}
+
+// Operations of APIv1 keyed by path then lower case method
+var apiV1Operations = map[string]map[string]OpenAPIOperation{
+	"/links": {
+		"get": {
+			Summary:    "Lists a page of the personal links, or of the links of a workspace",
+			Security:   securitySignedIn,
+			Parameters: linkListParams,
+			Responses:  v1Responses(map[string]OpenAPIResponse{"200": withHeaders(jsonResponse("Links", arrayOf(schemaRef("LinkData"))), linkListHeaders)}),
+		},
+		"post": {
+			Summary:     "Creates a link, a generated short code is used when short is empty and for anonymous sessions when enabled",
+			Parameters:  []OpenAPIParameter{idempotencyKeyParam},
+			RequestBody: jsonBody(schemaRef("LinkRequest")),
+			Responses: v1Responses(map[string]OpenAPIResponse{
+				"201": jsonResponse("Link created, its URL is in the Location header", schemaRef("LinkData")),
+				"403": errorResponse("forbidden, or email_not_verified when choosing the short code of an unverified account"),
+				"409": errorResponse("conflict, the short link is already used, or idempotency_key_in_use"),
+				"422": errorResponse("idempotency_key_reused with another payload"),
+				"429": errorResponse("rate_limited"),
+			}),
+		},
+	},
+	"/links/{code}": {
+		"get": {
+			Summary:    "Gets a link",
+			Security:   securitySignedIn,
+			Parameters: []OpenAPIParameter{pathParam("code")},
+			Responses:  v1Responses(map[string]OpenAPIResponse{"200": jsonResponse("Link", schemaRef("LinkData"))}),
+		},
+		"patch": {
+			Summary:     "Changes the long URL of a link",
+			Security:    securitySignedIn,
+			Parameters:  []OpenAPIParameter{pathParam("code")},
+			RequestBody: jsonBody(schemaRef("LinkRequest")),
+			Responses:   v1Responses(map[string]OpenAPIResponse{"200": jsonResponse("Updated link", schemaRef("LinkData"))}),
+		},
+		"delete": {
+			Summary:    "Deletes a link",
+			Security:   securitySignedIn,
+			Parameters: []OpenAPIParameter{pathParam("code")},
+			Responses:  v1Responses(map[string]OpenAPIResponse{"204": emptyResponse("Link deleted")}),
+		},
+	},
+	"/batch": {
+		"post": {
+			Summary:     "Creates, updates and deletes links in one request, atomically or on a best effort basis",
+			Security:    securitySignedIn,
+			RequestBody: jsonBody(schemaRef("BatchRequest")),
+			Responses: v1Responses(map[string]OpenAPIResponse{
+				"200": jsonResponse("Results of every operation, best effort operations may have failed", schemaRef("BatchResponse")),
+				"422": jsonResponse("Atomic batch rolled back, the failed operation has its error and the others rolled_back", schemaRef("BatchResponse")),
+			}),
+		},
+	},
+	"/links/{code}/stats": {
+		"get": {
+			Summary:    "Gets the click statistics of a link",
+			Security:   securitySignedIn,
+			Parameters: []OpenAPIParameter{pathParam("code")},
+			Responses:  v1Responses(map[string]OpenAPIResponse{"200": jsonResponse("Statistics", schemaRef("LinkStats"))}),
+		},
+	},
+}
+
+// Builds the OpenAPI document served at /api/openapi.json
+func OpenAPISpec() map[string]any {
+	paths := make(map[string]map[string]OpenAPIOperation)
+	for key, operation := range apiOperations {
+		method, endpoint, _ := strings.Cut(key, " ")
+		path := "/api/" + endpoint
+		if paths[path] == nil {
+			paths[path] = make(map[string]OpenAPIOperation)
+		}
+		paths[path][strings.ToLower(method)] = operation
+	}
+
+	for path, operations := range apiV1Operations {
+		paths[API_V1_PREFIX+path] = operations
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "shr.me",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": openAPISchemas,
+			"securitySchemes": map[string]any{
+				"session": map[string]any{"type": "apiKey", "in": "cookie", "name": "session_id"},
+				"token":   map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func (api *API) handleOpenAPI(w http.ResponseWriter, r *http.Request, session *Session) {
+	writeJSON(w, http.StatusOK, OpenAPISpec())
+}
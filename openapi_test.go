@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpenAPICoverage(t *testing.T) {
+	routes := make(map[string]bool)
+	for _, route := range apiRoutes {
+		key := route.method + " " + route.endpoint
+		routes[key] = true
+
+		if _, exists := apiOperations[key]; !exists {
+			t.Errorf("Route %v has no OpenAPI operation", key)
+		}
+	}
+
+	for key := range apiOperations {
+		if !routes[key] {
+			t.Errorf("OpenAPI operation %v has no route", key)
+		}
+	}
+}
+
+// The v1 routes are a switch, a method none of them serve makes each path list its methods in the Allow header
+func TestOpenAPIV1Coverage(t *testing.T) {
+	v1 := NewAPIv1(&API{})
+	session := NewLowSession("openapi-test", time.Hour)
+
+	for path, operations := range apiV1Operations {
+		var documented []string
+		for method := range operations {
+			documented = append(documented, strings.ToUpper(method))
+		}
+		sort.Strings(documented)
+
+		req := httptest.NewRequest(http.MethodPut, API_V1_PREFIX+strings.ReplaceAll(path, "{code}", "abc123"), nil)
+		req = req.WithContext(context.WithValue(req.Context(), SessionKey, session))
+		res := httptest.NewRecorder()
+		v1.ServeHTTP(res, req)
+
+		if res.Code != http.StatusMethodNotAllowed {
+			t.Errorf("OpenAPI path %v has no route, PUT answered %v", path, res.Code)
+			continue
+		}
+
+		served := strings.Split(res.Header().Get("Allow"), ", ")
+		sort.Strings(served)
+		if strings.Join(served, ", ") != strings.Join(documented, ", ") {
+			t.Errorf("Route %v serves %v but the OpenAPI description has %v", path, served, documented)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Parameters of new password hashes, hashes made with other ones are upgraded on sign-in
+const (
+	ARGON2_TIME        = 2
+	ARGON2_MEMORY      = 64 * 1024 // KiB
+	ARGON2_THREADS     = 4
+	ARGON2_SALT_LENGTH = 16
+	ARGON2_KEY_LENGTH  = 32
+
+	LEGACY_HASH_LENGTH = 8 // Unsalted argon2i hashes of the binary(8) column
+)
+
+// Hashes a password with argon2id and a random salt, in the PHC string format which keeps the parameters with the hash:
+// $argon2id$v=19$m=65536,t=2,p=4$<salt>$<hash>
+func hashPassword(password string) ([]byte, error) {
+	salt := make([]byte, ARGON2_SALT_LENGTH)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, ARGON2_TIME, ARGON2_MEMORY, ARGON2_THREADS, ARGON2_KEY_LENGTH)
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, ARGON2_MEMORY, ARGON2_TIME, ARGON2_THREADS,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+// Checks password against a stored hash in constant time. rehash is true when the password matched a legacy hash
+// or one made with other parameters, which should then be replaced by hashPassword
+func verifyPassword(password string, stored []byte) (ok bool, rehash bool) {
+	if len(stored) == LEGACY_HASH_LENGTH {
+		legacy := argon2.Key([]byte(password), nil, 2, 32*1024, 4, LEGACY_HASH_LENGTH)
+		match := subtle.ConstantTimeCompare(legacy, stored) == 1
+		return match, match
+	}
+
+	// "", "argon2id", "v=19", "m=65536,t=2,p=4", salt, hash
+	parts := strings.Split(string(stored), "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return false, false
+	}
+
+	var version int
+	var memory, time uint32
+	var threads uint8
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return false, false
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	if err != nil || memory == 0 || time == 0 || threads == 0 {
+		return false, false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false, false
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(computed, key) != 1 {
+		return false, false
+	}
+
+	rehash = memory != ARGON2_MEMORY || time != ARGON2_TIME || threads != ARGON2_THREADS ||
+		len(salt) != ARGON2_SALT_LENGTH || len(key) != ARGON2_KEY_LENGTH
+	return true, rehash
+}
+
+var dummyHash struct {
+	once sync.Once
+	hash []byte
+}
+
+// Returns a hash of no password made with the current parameters, checked when the username is unknown so that it
+// takes as long as a wrong password
+func dummyPasswordHash() []byte {
+	dummyHash.once.Do(func() {
+		hash, err := hashPassword("")
+		if err != nil {
+			Error.Println("Failed to hash dummy password", err)
+			return
+		}
+		dummyHash.hash = hash
+	})
+	return dummyHash.hash
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Hashes of "hunter2": the unsalted argon2i hash of the binary(8) column, and an argon2id PHC string with weaker
+// parameters than the current ones
+const (
+	LEGACY_TEST_HASH   = "a211187687475d87"
+	OUTDATED_TEST_HASH = "$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$TG3TNh0UlIp7ZkGKbHzVmoKy3QnTx9+peBju9GgIUrQ"
+)
+
+func TestPasswordHashRoundTrip(t *testing.T) {
+	hash, err := hashPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(hash), "$argon2id$v=19$m=65536,t=2,p=4$") {
+		t.Errorf("Hash %s isn't a PHC string with the current parameters", hash)
+	}
+
+	if ok, rehash := verifyPassword("hunter2", hash); !ok || rehash {
+		t.Errorf("Right password gives ok %v, rehash %v", ok, rehash)
+	}
+	if ok, _ := verifyPassword("hunter3", hash); ok {
+		t.Error("Wrong password accepted")
+	}
+
+	other, err := hashPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(hash, other) {
+		t.Error("Two hashes of the same password are equal, the salt isn't random")
+	}
+}
+
+func TestVerifyPasswordOlderHashes(t *testing.T) {
+	legacy, _ := hex.DecodeString(LEGACY_TEST_HASH)
+	if ok, rehash := verifyPassword("hunter2", legacy); !ok || !rehash {
+		t.Errorf("Legacy hash gives ok %v, rehash %v, want both", ok, rehash)
+	}
+	if ok, rehash := verifyPassword("hunter3", legacy); ok || rehash {
+		t.Errorf("Wrong password against the legacy hash gives ok %v, rehash %v", ok, rehash)
+	}
+
+	if ok, rehash := verifyPassword("hunter2", []byte(OUTDATED_TEST_HASH)); !ok || !rehash {
+		t.Errorf("Hash with outdated parameters gives ok %v, rehash %v, want both", ok, rehash)
+	}
+	if ok, _ := verifyPassword("hunter3", []byte(OUTDATED_TEST_HASH)); ok {
+		t.Error("Wrong password accepted against the outdated hash")
+	}
+}
+
+func TestVerifyPasswordMalformedHashes(t *testing.T) {
+	for _, stored := range []string{
+		"",
+		"hunter2",
+		strings.Replace(OUTDATED_TEST_HASH, "argon2id", "argon2i", 1),
+		strings.Replace(OUTDATED_TEST_HASH, "v=19", "v=16", 1),
+		strings.Replace(OUTDATED_TEST_HASH, "t=1", "t=0", 1),
+		strings.Replace(OUTDATED_TEST_HASH, "c2FsdHNhbHRzYWx0c2FsdA", "not base64!", 1),
+		OUTDATED_TEST_HASH[:strings.LastIndex(OUTDATED_TEST_HASH, "$")+1],
+	} {
+		if ok, rehash := verifyPassword("hunter2", []byte(stored)); ok || rehash {
+			t.Errorf("Malformed hash %q gives ok %v, rehash %v", stored, ok, rehash)
+		}
+	}
+}
+
+func TestSigninUpgradesLegacyHash(t *testing.T) {
+	db, config := newFakeDB(t)
+	api := newTestAPI(t, config)
+	legacy, _ := hex.DecodeString(LEGACY_TEST_HASH)
+	db.onRow("select userID, password_hash from users_auth where username = ?", int64(7), legacy)
+
+	err := api.signin(NewLowSession("rehash-test", time.Hour), "alice", "hunter3", "192.0.2.1")
+	if err == nil {
+		t.Fatal("Wrong password accepted against the legacy hash")
+	}
+	if updates := db.executed("update users_auth set password_hash = ?"); len(updates) != 0 {
+		t.Fatalf("Hash replaced after a wrong password: %v", updates)
+	}
+
+	err = api.signin(NewLowSession("rehash-test", time.Hour), "alice", "hunter2", "192.0.2.1")
+	if err != nil {
+		t.Fatal("Sign-in with a legacy hash failed", err)
+	}
+	updates := db.executed("update users_auth set password_hash = ?")
+	if len(updates) != 1 || updates[0][1] != int64(7) {
+		t.Fatalf("Legacy hash of userID(7) not replaced: %v", updates)
+	}
+	if ok, rehash := verifyPassword("hunter2", updates[0][0].([]byte)); !ok || rehash {
+		t.Errorf("Upgraded hash %s gives ok %v, rehash %v", updates[0][0], ok, rehash)
+	}
+
+	// Current hashes are kept
+	db.on("select userID, password_hash from users_auth where username = ?", func(args []driver.Value) (fakeResult, error) {
+		return fakeResult{rows: [][]driver.Value{{int64(7), updates[0][0]}}}, nil
+	})
+	err = api.signin(NewLowSession("rehash-test", time.Hour), "alice", "hunter2", "192.0.2.1")
+	if err != nil {
+		t.Fatal("Sign-in with the upgraded hash failed", err)
+	}
+	if updates = db.executed("update users_auth set password_hash = ?"); len(updates) != 1 {
+		t.Errorf("Current hash replaced again, %d updates", len(updates))
+	}
+}
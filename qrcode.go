@@ -0,0 +1,488 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	QR_MAX_VERSION = 10
+	QR_QUIET_ZONE  = 4 // Light modules around the code, required by scanners
+	QR_SVG_SCALE   = 5 // Pixels per module of the SVG's default size
+
+	qrFormatLevelM = 0 // Error correction bits of the format information, level M is 00
+)
+
+// Error correction blocks of a version at level M: every block has ecLen EC codewords, the first blocks1 blocks
+// have data1 data codewords and the next blocks2 ones have one more
+type qrBlocks struct {
+	ecLen   int
+	blocks1 int
+	data1   int
+	blocks2 int
+}
+
+// Indexed by version, from ISO/IEC 18004 table 9
+var qrLevelMBlocks = [QR_MAX_VERSION + 1]qrBlocks{
+	{},
+	{10, 1, 16, 0},
+	{16, 1, 28, 0},
+	{26, 1, 44, 0},
+	{18, 2, 32, 0},
+	{24, 2, 43, 0},
+	{16, 4, 27, 0},
+	{18, 4, 31, 0},
+	{22, 2, 38, 2},
+	{22, 3, 36, 2},
+	{26, 4, 43, 1},
+}
+
+// Centers of the alignment patterns on each axis, indexed by version
+var qrAlignmentPositions = [QR_MAX_VERSION + 1][]int{
+	{}, {},
+	{6, 18},
+	{6, 22},
+	{6, 26},
+	{6, 30},
+	{6, 34},
+	{6, 22, 38},
+	{6, 24, 42},
+	{6, 26, 46},
+	{6, 28, 50},
+}
+
+func (b qrBlocks) dataCodewords() int {
+	return b.blocks1*b.data1 + b.blocks2*(b.data1+1)
+}
+
+// A QR code encoding bytes in byte mode with error correction level M, only versions 1 to 10 are supported
+// which is enough for the two-factor provisioning URIs
+type QRCode struct {
+	version    int
+	size       int
+	modules    [][]bool // Dark modules, indexed by row then column
+	isFunction [][]bool // Finder, timing, alignment, format and version modules, which aren't masked
+}
+
+// Encodes data in the smallest version it fits in, InvalidInput if it's too long for version 10
+func EncodeQR(data []byte) (*QRCode, error) {
+	version := 1
+	for ; version <= QR_MAX_VERSION; version++ {
+		if qrDataBits(version, len(data)) <= qrLevelMBlocks[version].dataCodewords()*8 {
+			break
+		}
+	}
+	if version > QR_MAX_VERSION {
+		return nil, &InvalidInput{}
+	}
+
+	qr := &QRCode{version: version, size: version*4 + 17}
+	qr.modules = make([][]bool, qr.size)
+	qr.isFunction = make([][]bool, qr.size)
+	for y := range qr.modules {
+		qr.modules[y] = make([]bool, qr.size)
+		qr.isFunction[y] = make([]bool, qr.size)
+	}
+
+	qr.drawFunctionPatterns()
+	qr.drawCodewords(qrAddErrorCorrection(qrDataCodewords(version, data), qrLevelMBlocks[version]))
+
+	// Keeps the mask with the lowest penalty, masks are their own inverse
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		qr.applyMask(mask)
+		qr.drawFormatBits(mask)
+		penalty := qr.penalty()
+		if bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		qr.applyMask(mask)
+	}
+	qr.applyMask(best)
+	qr.drawFormatBits(best)
+	return qr, nil
+}
+
+// Bits of the byte mode segment holding n bytes
+func qrDataBits(version int, n int) int {
+	countBits := 8
+	if version >= 10 {
+		countBits = 16
+	}
+	return 4 + countBits + n*8
+}
+
+// Builds the data codewords: mode, length, bytes, terminator and padding
+func qrDataCodewords(version int, data []byte) []byte {
+	capacity := qrLevelMBlocks[version].dataCodewords()
+	bits := make([]bool, 0, capacity*8)
+	appendBits := func(value int, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (value>>i)&1 == 1)
+		}
+	}
+
+	appendBits(0x4, 4) // Byte mode
+	if version >= 10 {
+		appendBits(len(data), 16)
+	} else {
+		appendBits(len(data), 8)
+	}
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+
+	terminator := capacity*8 - len(bits)
+	if terminator > 4 {
+		terminator = 4
+	}
+	appendBits(0, terminator)
+	appendBits(0, (8-len(bits)%8)%8)
+
+	codewords := make([]byte, len(bits)/8, capacity)
+	for i, bit := range bits {
+		if bit {
+			codewords[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	for pad := byte(0xEC); len(codewords) < capacity; pad ^= 0xEC ^ 0x11 {
+		codewords = append(codewords, pad)
+	}
+	return codewords
+}
+
+// Splits the data codewords in blocks, adds their Reed-Solomon codewords and interleaves everything
+func qrAddErrorCorrection(data []byte, layout qrBlocks) []byte {
+	divisor := reedSolomonDivisor(layout.ecLen)
+
+	var dataBlocks, ecBlocks [][]byte
+	for i := 0; i < layout.blocks1+layout.blocks2; i++ {
+		length := layout.data1
+		if i >= layout.blocks1 {
+			length++
+		}
+		dataBlocks = append(dataBlocks, data[:length])
+		ecBlocks = append(ecBlocks, reedSolomonRemainder(data[:length], divisor))
+		data = data[length:]
+	}
+
+	var res []byte
+	for i := 0; i <= layout.data1; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				res = append(res, block[i])
+			}
+		}
+	}
+	for i := 0; i < layout.ecLen; i++ {
+		for _, block := range ecBlocks {
+			res = append(res, block[i])
+		}
+	}
+	return res
+}
+
+// Multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func gfMultiply(x byte, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// Returns the coefficients of the generator polynomial of the given degree, highest first without the leading 1
+func reedSolomonDivisor(degree int) []byte {
+	res := make([]byte, degree)
+	res[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range res {
+			res[j] = gfMultiply(res[j], root)
+			if j+1 < len(res) {
+				res[j] ^= res[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return res
+}
+
+// Returns the error correction codewords of data
+func reedSolomonRemainder(data []byte, divisor []byte) []byte {
+	res := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ res[0]
+		copy(res, res[1:])
+		res[len(res)-1] = 0
+		for i := range res {
+			res[i] ^= gfMultiply(divisor[i], factor)
+		}
+	}
+	return res
+}
+
+func (qr *QRCode) setFunction(x int, y int, dark bool) {
+	qr.modules[y][x] = dark
+	qr.isFunction[y][x] = true
+}
+
+func (qr *QRCode) drawFunctionPatterns() {
+	for i := 0; i < qr.size; i++ {
+		qr.setFunction(6, i, i%2 == 0)
+		qr.setFunction(i, 6, i%2 == 0)
+	}
+
+	qr.drawFinderPattern(3, 3)
+	qr.drawFinderPattern(qr.size-4, 3)
+	qr.drawFinderPattern(3, qr.size-4)
+
+	positions := qrAlignmentPositions[qr.version]
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			// The corners overlap the finder patterns
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			qr.drawAlignmentPattern(x, y)
+		}
+	}
+
+	qr.drawFormatBits(0) // Reserves the modules, drawn again once the mask is chosen
+	qr.drawVersion()
+}
+
+// Draws a finder pattern and its separator centered on x, y
+func (qr *QRCode) drawFinderPattern(x int, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || xx >= qr.size || yy < 0 || yy >= qr.size {
+				continue
+			}
+			dist := chebyshev(dx, dy)
+			qr.setFunction(xx, yy, dist != 2 && dist != 4)
+		}
+	}
+}
+
+func (qr *QRCode) drawAlignmentPattern(x int, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			qr.setFunction(x+dx, y+dy, chebyshev(dx, dy) != 1)
+		}
+	}
+}
+
+// Draws both copies of the level and mask with their BCH code, and the dark module
+func (qr *QRCode) drawFormatBits(mask int) {
+	data := qrFormatLevelM<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+
+	bit := func(i int) bool {
+		return (bits>>i)&1 == 1
+	}
+
+	for i := 0; i <= 5; i++ {
+		qr.setFunction(8, i, bit(i))
+	}
+	qr.setFunction(8, 7, bit(6))
+	qr.setFunction(8, 8, bit(7))
+	qr.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		qr.setFunction(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		qr.setFunction(qr.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		qr.setFunction(8, qr.size-15+i, bit(i))
+	}
+	qr.setFunction(8, qr.size-8, true)
+}
+
+// Draws both copies of the version and its BCH code, only versions 7 and up have them
+func (qr *QRCode) drawVersion() {
+	if qr.version < 7 {
+		return
+	}
+
+	rem := qr.version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	bits := qr.version<<12 | rem
+
+	for i := 0; i < 18; i++ {
+		dark := (bits>>i)&1 == 1
+		a, b := qr.size-11+i%3, i/3
+		qr.setFunction(a, b, dark)
+		qr.setFunction(b, a, dark)
+	}
+}
+
+// Places the codewords in the two module wide columns, going up and down from the bottom right corner
+func (qr *QRCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := qr.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // Skips the vertical timing pattern
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < qr.size; vert++ {
+			y := vert
+			if upward {
+				y = qr.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if qr.isFunction[y][x] || i >= len(codewords)*8 {
+					continue // The remainder bits stay light
+				}
+				qr.modules[y][x] = (codewords[i/8]>>(7-i%8))&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+func (qr *QRCode) applyMask(mask int) {
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !qr.isFunction[y][x] {
+				qr.modules[y][x] = !qr.modules[y][x]
+			}
+		}
+	}
+}
+
+var qrFinderLikePatterns = [][]bool{
+	{true, false, true, true, true, false, true, false, false, false, false},
+	{false, false, false, false, true, false, true, true, true, false, true},
+}
+
+// Scores how hard the code is to scan with the four penalty rules of the standard, lower is better
+func (qr *QRCode) penalty() int {
+	res := 0
+	dark := 0
+	at := func(x int, y int, transposed bool) bool {
+		if transposed {
+			return qr.modules[x][y]
+		}
+		return qr.modules[y][x]
+	}
+
+	for _, transposed := range []bool{false, true} {
+		for y := 0; y < qr.size; y++ {
+			// Runs of 5 or more modules of the same color
+			run := 1
+			for x := 1; x < qr.size; x++ {
+				if at(x, y, transposed) == at(x-1, y, transposed) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					res += run - 2
+				}
+				run = 1
+			}
+			if run >= 5 {
+				res += run - 2
+			}
+
+			// Patterns looking like the finder patterns
+			for x := 0; x+11 <= qr.size; x++ {
+				for _, pattern := range qrFinderLikePatterns {
+					matches := true
+					for k, module := range pattern {
+						if at(x+k, y, transposed) != module {
+							matches = false
+							break
+						}
+					}
+					if matches {
+						res += 40
+					}
+				}
+			}
+		}
+	}
+
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if qr.modules[y][x] {
+				dark++
+			}
+			// 2x2 blocks of the same color
+			if x+1 < qr.size && y+1 < qr.size {
+				module := qr.modules[y][x]
+				if module == qr.modules[y][x+1] && module == qr.modules[y+1][x] && module == qr.modules[y+1][x+1] {
+					res += 3
+				}
+			}
+		}
+	}
+
+	// Deviation from half dark modules, 10 points per 5%
+	total := qr.size * qr.size
+	res += abs(dark*100/total-50) / 5 * 10
+	return res
+}
+
+// Returns the code as an SVG image with its quiet zone
+func (qr *QRCode) SVG() string {
+	var path strings.Builder
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if qr.modules[y][x] {
+				fmt.Fprintf(&path, "M%d,%dh1v1h-1z", x+QR_QUIET_ZONE, y+QR_QUIET_ZONE)
+			}
+		}
+	}
+
+	size := qr.size + 2*QR_QUIET_ZONE
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="%d" height="%d" shape-rendering="crispEdges">`+
+		`<rect width="%d" height="%d" fill="#fff"/><path d="%s" fill="#000"/></svg>`,
+		size, size, size*QR_SVG_SCALE, size*QR_SVG_SCALE, size, size, path.String())
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// Distance from the center of a pattern, the rings of the finder and alignment patterns are at equal distances
+func chebyshev(dx int, dy int) int {
+	if abs(dx) > abs(dy) {
+		return abs(dx)
+	}
+	return abs(dy)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Format information of level M for each mask, after the XOR with 101010000010010, from ISO/IEC 18004 table C.1
+var qrTestFormatsM = [8]int{
+	0b101010000010010,
+	0b101000100100101,
+	0b101111001111100,
+	0b101101101001011,
+	0b100010111111001,
+	0b100000011001110,
+	0b100111110010111,
+	0b100101010100000,
+}
+
+// Version information of versions 7 to 10, from ISO/IEC 18004 table D.1
+var qrTestVersions = map[int]int{7: 0x07C94, 8: 0x085BC, 9: 0x09A99, 10: 0x0A4D3}
+
+// EC codewords per block and the data codewords of each block at level M, from ISO/IEC 18004 table 9
+var qrTestBlocksM = map[int]struct {
+	ecLen int
+	data  []int
+}{
+	1:  {10, []int{16}},
+	2:  {16, []int{28}},
+	3:  {26, []int{44}},
+	4:  {18, []int{32, 32}},
+	5:  {24, []int{43, 43}},
+	6:  {16, []int{27, 27, 27, 27}},
+	7:  {18, []int{31, 31, 31, 31}},
+	8:  {22, []int{38, 38, 39, 39}},
+	9:  {22, []int{36, 36, 36, 37, 37}},
+	10: {26, []int{43, 43, 43, 43, 44}},
+}
+
+// Centers of the alignment patterns, from ISO/IEC 18004 annex E
+var qrTestAlignments = map[int][]int{
+	1: {}, 2: {6, 18}, 3: {6, 22}, 4: {6, 26}, 5: {6, 30},
+	6: {6, 34}, 7: {6, 22, 38}, 8: {6, 24, 42}, 9: {6, 26, 46}, 10: {6, 28, 50},
+}
+
+// Reads a level M code back without the encoder's helpers, like a scanner would: it checks both copies of the format
+// and version information, unmasks the data modules, checks the Reed-Solomon syndromes of every block and reads
+// the byte mode segment
+func decodeQR(t *testing.T, modules [][]bool) []byte {
+	t.Helper()
+	size := len(modules)
+	version := (size - 17) / 4
+	dark := func(x int, y int) bool { return modules[y][x] }
+
+	// A scanner finds the code by its finder patterns and the module grid by the timing patterns
+	for _, corner := range [][2]int{{0, 0}, {size - 7, 0}, {0, size - 7}} {
+		for dy := 0; dy < 7; dy++ {
+			for dx := 0; dx < 7; dx++ {
+				if want := chebyshev(dx-3, dy-3) != 2; dark(corner[0]+dx, corner[1]+dy) != want {
+					t.Fatalf("Finder pattern at %v has a wrong module at %d, %d", corner, dx, dy)
+				}
+			}
+		}
+	}
+	for i := 8; i < size-8; i++ {
+		if dark(6, i) != (i%2 == 0) || dark(i, 6) != (i%2 == 0) {
+			t.Fatalf("Timing patterns broken at %d", i)
+		}
+	}
+
+	readBits := func(positions [][2]int) (value int) {
+		for i, pos := range positions {
+			if dark(pos[0], pos[1]) {
+				value |= 1 << i
+			}
+		}
+		return
+	}
+
+	// Format information, bit 0 first
+	var format1, format2 [][2]int
+	for i := 0; i < 15; i++ {
+		switch {
+		case i < 6:
+			format1 = append(format1, [2]int{8, i})
+		case i < 8:
+			format1 = append(format1, [2]int{8, i + 1})
+		case i == 8:
+			format1 = append(format1, [2]int{7, 8})
+		default:
+			format1 = append(format1, [2]int{14 - i, 8})
+		}
+		if i < 8 {
+			format2 = append(format2, [2]int{size - 1 - i, 8})
+		} else {
+			format2 = append(format2, [2]int{8, size - 15 + i})
+		}
+	}
+	format := readBits(format1)
+	if readBits(format2) != format {
+		t.Fatalf("Format information copies differ: %015b and %015b", format, readBits(format2))
+	}
+	mask := -1
+	for m, valid := range qrTestFormatsM {
+		if valid == format {
+			mask = m
+		}
+	}
+	if mask < 0 {
+		t.Fatalf("Format information %015b isn't level M", format)
+	}
+	if !dark(8, size-8) {
+		t.Error("Dark module is light")
+	}
+
+	if version >= 7 {
+		var version1, version2 [][2]int
+		for i := 0; i < 18; i++ {
+			version1 = append(version1, [2]int{size - 11 + i%3, i / 3})
+			version2 = append(version2, [2]int{i / 3, size - 11 + i%3})
+		}
+		if readBits(version1) != qrTestVersions[version] || readBits(version2) != qrTestVersions[version] {
+			t.Fatalf("Version information %018b and %018b, want %018b", readBits(version1), readBits(version2), qrTestVersions[version])
+		}
+	}
+
+	isFunction := func(x int, y int) bool {
+		switch {
+		case x < 9 && y < 9, x >= size-8 && y < 9, x < 9 && y >= size-8: // Finders, separators and format
+			return true
+		case x == 6 || y == 6: // Timing
+			return true
+		case version >= 7 && ((x >= size-11 && x < size-8 && y < 6) || (y >= size-11 && y < size-8 && x < 6)):
+			return true
+		}
+		positions := qrTestAlignments[version]
+		for i, cx := range positions {
+			for j, cy := range positions {
+				last := len(positions) - 1
+				if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+					continue
+				}
+				if abs(x-cx) <= 2 && abs(y-cy) <= 2 {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	masked := func(x int, y int) bool {
+		i, j := y, x
+		switch mask {
+		case 0:
+			return (i+j)%2 == 0
+		case 1:
+			return i%2 == 0
+		case 2:
+			return j%3 == 0
+		case 3:
+			return (i+j)%3 == 0
+		case 4:
+			return (i/2+j/3)%2 == 0
+		case 5:
+			return (i*j)%2+(i*j)%3 == 0
+		case 6:
+			return ((i*j)%2+(i*j)%3)%2 == 0
+		default:
+			return ((i+j)%2+(i*j)%3)%2 == 0
+		}
+	}
+
+	// Codewords in placement order, two columns at a time from the bottom right, alternately upwards and downwards
+	var bits []bool
+	upward := true
+	for right := size - 1; right > 0; right -= 2 {
+		if right == 6 {
+			right--
+		}
+		for vert := 0; vert < size; vert++ {
+			y := vert
+			if upward {
+				y = size - 1 - vert
+			}
+			for x := right; x > right-2; x-- {
+				if !isFunction(x, y) {
+					bits = append(bits, dark(x, y) != masked(x, y))
+				}
+			}
+		}
+		upward = !upward
+	}
+
+	layout := qrTestBlocksM[version]
+	total := 0
+	for _, data := range layout.data {
+		total += data + layout.ecLen
+	}
+	if len(bits) < total*8 {
+		t.Fatalf("Version %d has %d data modules, want at least %d", version, len(bits), total*8)
+	}
+	interleaved := make([]byte, total)
+	for i := range interleaved {
+		for k := 0; k < 8; k++ {
+			if bits[i*8+k] {
+				interleaved[i] |= 1 << (7 - k)
+			}
+		}
+	}
+
+	// Deinterleaves the blocks, the data codewords of every block come first
+	blocks := make([][]byte, len(layout.data))
+	next := 0
+	for i := 0; i < layout.data[len(layout.data)-1]; i++ {
+		for b, data := range layout.data {
+			if i < data {
+				blocks[b] = append(blocks[b], interleaved[next])
+				next++
+			}
+		}
+	}
+	for i := 0; i < layout.ecLen; i++ {
+		for b := range blocks {
+			blocks[b] = append(blocks[b], interleaved[next])
+			next++
+		}
+	}
+
+	// Every block is a multiple of the generator, whose roots are 2^0 to 2^(ecLen-1) in GF(256) modulo 0x11D
+	var exp [255]byte
+	log := make(map[byte]int)
+	for i, x := 0, 1; i < 255; i++ {
+		exp[i], log[byte(x)] = byte(x), i
+		x <<= 1
+		if x >= 256 {
+			x ^= 0x11D
+		}
+	}
+	multiply := func(x byte, y byte) byte {
+		if x == 0 || y == 0 {
+			return 0
+		}
+		return exp[(log[x]+log[y])%255]
+	}
+	var data []byte
+	for b, block := range blocks {
+		for k := 0; k < layout.ecLen; k++ {
+			syndrome := byte(0)
+			for _, codeword := range block {
+				syndrome = multiply(syndrome, exp[k]) ^ codeword
+			}
+			if syndrome != 0 {
+				t.Fatalf("Block %d has the syndrome %d for the root 2^%d", b, syndrome, k)
+			}
+		}
+		data = append(data, block[:layout.data[b]]...)
+	}
+
+	// Byte mode segment
+	readInt := func(offset int, n int) (value int) {
+		for i := 0; i < n; i++ {
+			value <<= 1
+			if data[(offset+i)/8]>>(7-(offset+i)%8)&1 == 1 {
+				value |= 1
+			}
+		}
+		return
+	}
+	if mode := readInt(0, 4); mode != 0b0100 {
+		t.Fatalf("Segment mode %04b isn't byte mode", mode)
+	}
+	countBits := 8
+	if version >= 10 {
+		countBits = 16
+	}
+	length := readInt(4, countBits)
+	res := make([]byte, length)
+	for i := range res {
+		res[i] = byte(readInt(4+countBits+i*8, 8))
+	}
+
+	// Terminator, then the padding codewords alternate
+	end := 4 + countBits + length*8
+	terminator := len(data)*8 - end
+	if terminator > 4 {
+		terminator = 4
+	}
+	if readInt(end, terminator) != 0 {
+		t.Error("Segment isn't followed by the terminator")
+	}
+	for i, pad := (end+4+7)/8, byte(0xEC); i < len(data); i, pad = i+1, pad^0xEC^0x11 {
+		if data[i] != pad {
+			t.Fatalf("Padding codeword %d is %#x, want %#x", i, data[i], pad)
+		}
+	}
+	return res
+}
+
+// The code of the provisioning URI of alice with the secret of RFC 6238, version 7 at level M
+var qrGoldenTOTP = []string{
+	"#######.#...##..#...####..#.######..#.#######",
+	"#.....#.#...##.#..#.#####..#...###.#..#.....#",
+	"#.###.#.#...#####...#.#.##.......#.#..#.###.#",
+	"#.###.#...##...#.##..#.#.##.######.##.#.###.#",
+	"#.###.#.#...#####.#########...#..####.#.###.#",
+	"#.....#..##..######.#...#..#.#...#....#.....#",
+	"#######.#.#.#.#.#.#.#.#.#.#.#.#.#.#.#.#######",
+	".........#..####.##.#...#...####.####........",
+	"#..######.#...##..#.#####...#..#.....#..#.###",
+	"###.....###.####.###....###..##.#.########.#.",
+	"#######..##########.###.....#...###.##.....##",
+	"###.....#.#.#..#..######.#.##.#.#..#..#.#.###",
+	".#....#...####....##.##..#..##..#######.#....",
+	"..###...#..##.###......####..#####.##.####...",
+	"..###.####...###..##..#####.#.#..###.##....#.",
+	"###..#.###..###..#.##.#####..#.#.#..#.##.####",
+	"#######.######.##.#.....#.#....##.##..#..#...",
+	".#.....#.######..#.##.........#..#####...##.#",
+	"......##..##.####.#...#.#..##...##.#.#..#..##",
+	"...#.#.#.##.#..##..###.#...######.#..#..####.",
+	"#...#######....#.########.####...#..########.",
+	"###.#...#.###.....###...####.##..##.#...###..",
+	"..#.#.#.#.......#...#.#.#.##.#.#.#..#.#.#####",
+	"....#...####.....#..#...##...#####.##...#.###",
+	"#..######....#..#...#####.###..##...#####...#",
+	".#.##..##..#..#...#.#.#.###.###..#.#.#.#..##.",
+	"####..####...###.####.#...###..#....#..##....",
+	"#..###..##.#..##..#..##########...##.#######.",
+	"#####.#..#.#.#.#.#......#......##..####.##..#",
+	"##..##.##.#..##.#.#....###.#..#.#.#.#..##..#.",
+	"#.#..###.##.#.#.#.##..####.##.#.#..#..#.#.#.#",
+	".#..##.#...###..##.##...#..##.#..#...#...##..",
+	"#########.#.##.#..##..###...##...##...###....",
+	".....#........##.##...#.####.###..#..#######.",
+	"....#.#..##.##.#.##...###.##.#.#..#...#..####",
+	".####..#.##.##.#..###...#.##.#...##.###.#.#..",
+	"#..##.#...#.....##########..#.#.#########.##.",
+	"........#..##...###.#...#.#..##..#..#...#.##.",
+	"#######.####.##..##.#.#.#...##...##.#.#.#.#..",
+	"#.....#.##..##.######...#..#.###.##.#...###.#",
+	"#.###.#.#..#######..#####.....#.##..######.#.",
+	"#.###.#.#..#.#.....#.#...#..#.##.#####...#.##",
+	"#.###.#..####.#####.###.##.#.#...#..#.###.#.#",
+	"#.....#....#..###.##...#.#.##..#...##.##.####",
+	"#######.#.##.#...#.....##..#####..#.#.#.##...",
+}
+
+func qrRows(qr *QRCode) []string {
+	rows := make([]string, qr.size)
+	for y, row := range qr.modules {
+		var line strings.Builder
+		for _, module := range row {
+			if module {
+				line.WriteByte('#')
+			} else {
+				line.WriteByte('.')
+			}
+		}
+		rows[y] = line.String()
+	}
+	return rows
+}
+
+func TestEncodeQRGolden(t *testing.T) {
+	uri := totpURI("alice", []byte("12345678901234567890"))
+	qr, err := EncodeQR([]byte(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := qrRows(qr)
+	if strings.Join(rows, "\n") != strings.Join(qrGoldenTOTP, "\n") {
+		t.Errorf("Code of %v changed, got\n%v", uri, strings.Join(rows, "\n"))
+	}
+
+	modules := make([][]bool, len(qrGoldenTOTP))
+	for y, row := range qrGoldenTOTP {
+		for _, module := range row {
+			modules[y] = append(modules[y], module == '#')
+		}
+	}
+	if decoded := decodeQR(t, modules); string(decoded) != uri {
+		t.Errorf("Golden code reads %q, want %q", decoded, uri)
+	}
+}
+
+func TestEncodeQRDecodes(t *testing.T) {
+	// Lengths filling versions 1 to 10 exactly, and the ones just over
+	for _, length := range []int{1, 14, 15, 26, 42, 62, 84, 106, 122, 152, 180, 213} {
+		data := bytes.Repeat([]byte("otpauth://totp/shr.me:alice?secret="), 8)[:length]
+		qr, err := EncodeQR(data)
+		if err != nil {
+			t.Fatalf("%d bytes not encoded: %v", length, err)
+		}
+		if decoded := decodeQR(t, qr.modules); !bytes.Equal(decoded, data) {
+			t.Errorf("Version %d code of %d bytes reads %q", qr.version, length, decoded)
+		}
+	}
+
+	if _, err := EncodeQR(make([]byte, 214)); err == nil {
+		t.Error("214 bytes encoded, more than version 10 holds at level M")
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LIMITER_EVICTION_SAMPLES = 8 // Buckets looked at to pick the one evicted from a full limiter
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Token bucket rate limiter keyed by an arbitrary string (IP, session ID...)
+type Limiter struct {
+	mutex   *sync.Mutex
+	buckets map[string]*tokenBucket
+	rate    float64 // Tokens refilled per second
+	burst   float64 // Bucket capacity
+	maxKeys int     // Buckets kept at most, 0 for no bound
+}
+
+// Outcome of Limiter.Take
+type LimitResult struct {
+	Allowed    bool
+	Remaining  int           // Requests which can be made right away
+	RetryAfter time.Duration // Until the next request is allowed, 0 when Allowed
+	Reset      time.Duration // Until the bucket is full again
+}
+
+func NewLimiter(rate RateConfig, maxKeys int) *Limiter {
+	return &Limiter{
+		mutex:   new(sync.Mutex),
+		buckets: make(map[string]*tokenBucket),
+		rate:    float64(rate.Requests) / rate.Per.Seconds(),
+		burst:   float64(rate.Burst),
+		maxKeys: maxKeys,
+	}
+}
+
+// Takes a token from the bucket of key, returns false if the bucket is empty
+func (limiter *Limiter) Allow(key string) bool {
+	return limiter.Take(key).Allowed
+}
+
+// Takes a token from the bucket of key and tells how long the caller has to wait when it's empty
+func (limiter *Limiter) Take(key string) LimitResult {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	bucket, exists := limiter.buckets[key]
+	if !exists {
+		if limiter.maxKeys > 0 && len(limiter.buckets) >= limiter.maxKeys {
+			limiter.evict(now)
+		}
+		bucket = &tokenBucket{limiter.burst, now}
+		limiter.buckets[key] = bucket
+	} else {
+		bucket.tokens = limiter.refilled(bucket, now)
+		bucket.last = now
+	}
+
+	res := LimitResult{Allowed: bucket.tokens >= 1}
+	if res.Allowed {
+		bucket.tokens--
+	} else {
+		res.RetryAfter = limiter.refillTime(1 - bucket.tokens)
+	}
+	res.Remaining = int(bucket.tokens)
+	res.Reset = limiter.refillTime(limiter.burst - bucket.tokens)
+	return res
+}
+
+func (limiter *Limiter) refilled(bucket *tokenBucket, now time.Time) float64 {
+	return math.Min(bucket.tokens+now.Sub(bucket.last).Seconds()*limiter.rate, limiter.burst)
+}
+
+// Returns the time needed to refill tokens
+func (limiter *Limiter) refillTime(tokens float64) time.Duration {
+	if limiter.rate <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(tokens / limiter.rate * float64(time.Second))
+}
+
+// Makes room for a bucket by removing the fullest of a few buckets, so the evicted client loses as little as possible.
+// The limiter's mutex must be held
+func (limiter *Limiter) evict(now time.Time) {
+	evicted := ""
+	evictedTokens := -1.0
+	samples := 0
+	for key, bucket := range limiter.buckets { // Map iteration starts at a random bucket
+		tokens := limiter.refilled(bucket, now)
+		if tokens > evictedTokens {
+			evicted, evictedTokens = key, tokens
+		}
+		samples++
+		if samples >= LIMITER_EVICTION_SAMPLES || tokens >= limiter.burst {
+			break
+		}
+	}
+	delete(limiter.buckets, evicted)
+}
+
+// Removes the buckets which refilled completely, they behave exactly like missing ones
+func (limiter *Limiter) Cleanup() {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	for key, bucket := range limiter.buckets {
+		if limiter.refilled(bucket, now) >= limiter.burst {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// Calls Limiter.Cleanup with delay, run in goroutine
+func (limiter *Limiter) BackgroundCleanup(delay time.Duration) {
+	for {
+		time.Sleep(delay)
+		limiter.Cleanup()
+	}
+}
+
+// Parses the trusted proxies of the config, as IP addresses or CIDR ranges
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var res []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+			}
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		res = append(res, network)
+	}
+	return res, nil
+}
+
+func isTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the IP address of the client without the port. Requests from trusted proxies are attributed to the
+// last address of X-Forwarded-For which isn't a trusted proxy, since the ones before it can be forged by the client
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrusted(ip, trusted) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break // Garbage from the client, the previous hop is the last one known
+		}
+		host = hop.String()
+		if !isTrusted(hop, trusted) {
+			break
+		}
+	}
+	return host
+}
+
+// Route classes with their own limits
+const (
+	RATE_CLASS_NONE = iota
+	RATE_CLASS_REDIRECT
+	RATE_CLASS_AUTH
+	RATE_CLASS_WRITE
+)
+
+// Endpoints checking credentials, limited by RateLimitConfig.Auth
+var authPaths = map[string]bool{
+	"/api/auth":                   true,
+	"/api/signup":                 true,
+	"/api/password":               true,
+	"/api/password/reset/request": true,
+	"/api/password/reset":         true,
+	"/api/email":                  true, // Mails a verification link
+	"/api/email/verify":           true,
+	"/api/account/delete":         true,
+	"/api/2fa/enable":             true,
+	"/api/2fa/disable":            true,
+	"/api/2fa/recovery":           true,
+	"/api/2fa/verify":             true,
+	"/oidc/login":                 true,
+	"/oidc/callback":              true,
+}
+
+// Pages served by the mux which aren't short links
+var pagePaths = map[string]bool{
+	"/":            true,
+	"/notfound":    true,
+	"/home":        true,
+	"/manage":      true,
+	"/signin":      true,
+	"/signup":      true,
+	"/forgot":      true,
+	"/reset":       true,
+	"/verify":      true,
+	"/favicon.ico": true,
+}
+
+func rateClass(r *http.Request) int {
+	path := r.URL.Path
+	switch {
+	case authPaths[path]:
+		return RATE_CLASS_AUTH
+	case strings.HasPrefix(path, "/api/"):
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			return RATE_CLASS_NONE
+		}
+		return RATE_CLASS_WRITE
+	case pagePaths[path] || strings.HasPrefix(path, "/static/") || strings.HasPrefix(path, "/oidc/"):
+		return RATE_CLASS_NONE
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return RATE_CLASS_REDIRECT
+	}
+	return RATE_CLASS_NONE
+}
+
+// Middleware limiting the request rate of each route class, it needs the session so it runs after the session manager
+// and token authentication. Clients are told their quota with the RateLimit-* headers
+type RateLimiter struct {
+	handler  http.Handler
+	api      *API
+	limiters map[int]*Limiter // By route class, classes without limits are missing
+	policies map[int]string   // RateLimit-Policy header of each class
+}
+
+func NewRateLimiter(api *API, handler http.Handler, config RateLimitConfig) *RateLimiter {
+	rateLimiter := &RateLimiter{handler, api, make(map[int]*Limiter), make(map[int]string)}
+	for class, rate := range map[int]RateConfig{
+		RATE_CLASS_REDIRECT: config.Redirect,
+		RATE_CLASS_AUTH:     config.Auth,
+		RATE_CLASS_WRITE:    config.Write,
+	} {
+		if !config.Enabled || rate.Requests <= 0 || rate.Burst <= 0 || rate.Per.Duration <= 0 {
+			continue
+		}
+		limiter := NewLimiter(rate, config.MaxKeys)
+		rateLimiter.limiters[class] = limiter
+		rateLimiter.policies[class] = fmt.Sprintf("%d;w=%d;burst=%d", rate.Requests, int(math.Ceil(rate.Per.Seconds())), rate.Burst)
+		go limiter.BackgroundCleanup(LINK_PURGE_DELAY)
+	}
+	return rateLimiter
+}
+
+// Keys requests on the most specific identity: the access token, then the user, then the client IP.
+// Anonymous sessions aren't used since a client gets a new one just by dropping its cookie
+func (rateLimiter *RateLimiter) key(r *http.Request) string {
+	session, _ := r.Context().Value(SessionKey).(*Session)
+	switch {
+	case session != nil && session.tokenId != 0:
+		return fmt.Sprintf("token:%d", session.tokenId)
+	case session != nil && session.signedIn:
+		return fmt.Sprintf("user:%d", session.userId)
+	default:
+		return "ip:" + rateLimiter.api.clientIP(r)
+	}
+}
+
+func (rateLimiter *RateLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	class := rateClass(r)
+	limiter := rateLimiter.limiters[class]
+	if limiter == nil {
+		rateLimiter.handler.ServeHTTP(w, r)
+		return
+	}
+
+	key := rateLimiter.key(r)
+	res := limiter.Take(key)
+	w.Header().Set("RateLimit-Policy", rateLimiter.policies[class])
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(int(limiter.burst)))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+	if res.Allowed {
+		rateLimiter.handler.ServeHTTP(w, r)
+		return
+	}
+
+	Info.Printf("Rate limiting %v @ %v %v\n", key, r.Method, r.URL.Path)
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+	switch {
+	case strings.HasPrefix(r.URL.Path, API_V1_PREFIX+"/"):
+		session, _ := r.Context().Value(SessionKey).(*Session)
+		writeV1Error(w, session, &RateLimited{})
+	case strings.HasPrefix(r.URL.Path, "/api/"):
+		writeAPIError(w, &RateLimited{})
+	default:
+		http.Error(w, (&RateLimited{}).Error(), http.StatusTooManyRequests)
+	}
+}
+
+// Rounds up to whole seconds, at least 1 so clients never retry right away
+func ceilSeconds(d time.Duration) int {
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct client", "203.0.113.5:4242", nil, "203.0.113.5"},
+		{"spoofed header from an untrusted peer", "203.0.113.5:4242", []string{"198.51.100.7"}, "203.0.113.5"},
+		{"trusted proxy", "10.0.0.1:4242", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"forged hops before the proxy's", "10.0.0.1:4242", []string{"192.0.2.66, 198.51.100.7"}, "198.51.100.7"},
+		{"chain of trusted proxies", "10.0.0.1:4242", []string{"192.0.2.66, 198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"header split over several lines", "10.0.0.1:4242", []string{"192.0.2.66", "198.51.100.7"}, "198.51.100.7"},
+		{"garbage appended to the header", "10.0.0.1:4242", []string{"198.51.100.7, not-an-ip"}, "10.0.0.1"},
+		{"only trusted hops", "10.0.0.1:4242", []string{"10.0.0.3"}, "10.0.0.3"},
+		{"trusted IPv6 proxy", "[2001:db8::1]:4242", []string{"2001:db8::7"}, "2001:db8::7"},
+		{"untrusted IPv6 peer", "[2001:db8::2]:4242", []string{"198.51.100.7"}, "2001:db8::2"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/abc123", nil)
+		r.RemoteAddr = test.remoteAddr
+		for _, value := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if ip := clientIP(r, trusted); ip != test.want {
+			t.Errorf("%v: client IP %v, want %v", test.name, ip, test.want)
+		}
+	}
+}
+
+func TestRateClass(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{http.MethodGet, "/abc123", RATE_CLASS_REDIRECT},
+		{http.MethodHead, "/abc123", RATE_CLASS_REDIRECT},
+		{http.MethodPost, "/api/auth", RATE_CLASS_AUTH},
+		{http.MethodGet, "/oidc/login", RATE_CLASS_AUTH},
+		{http.MethodPost, "/api/2fa/verify", RATE_CLASS_AUTH},
+		{http.MethodPost, API_V1_PREFIX + "/links", RATE_CLASS_WRITE},
+		{http.MethodDelete, API_V1_PREFIX + "/links/abc123", RATE_CLASS_WRITE},
+		{http.MethodGet, API_V1_PREFIX + "/links", RATE_CLASS_NONE},
+		{http.MethodOptions, API_V1_PREFIX + "/links", RATE_CLASS_NONE},
+		{http.MethodGet, "/manage", RATE_CLASS_NONE},
+		{http.MethodGet, "/static/style.css", RATE_CLASS_NONE},
+	}
+
+	for _, test := range tests {
+		if class := rateClass(httptest.NewRequest(test.method, test.path, nil)); class != test.want {
+			t.Errorf("%v %v is in class %d, want %d", test.method, test.path, class, test.want)
+		}
+	}
+}
+
+type rateLimitTest struct {
+	limiter *RateLimiter
+	served  int
+}
+
+// Limits sign-ins to a burst of 2 refilled once a minute, and API writes to a burst of 1
+func newRateLimitTest(t *testing.T) *rateLimitTest {
+	_, config := newFakeDB(t)
+	config.RateLimit.TrustedProxies = []string{"10.0.0.1"}
+	config.RateLimit.Auth = RateConfig{1, Duration{time.Minute}, 2}
+	config.RateLimit.Write = RateConfig{1, Duration{time.Minute}, 1}
+	api := newTestAPI(t, config)
+
+	test := &rateLimitTest{}
+	test.limiter = NewRateLimiter(api, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		test.served++
+	}), config.RateLimit)
+	return test
+}
+
+func (test *rateLimitTest) do(method string, path string, remoteAddr string, forwarded string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	r.RemoteAddr = remoteAddr
+	if forwarded != "" {
+		r.Header.Set("X-Forwarded-For", forwarded)
+	}
+	r = r.WithContext(context.WithValue(r.Context(), SessionKey, NewLowSession("ratelimit-test", time.Hour)))
+	w := httptest.NewRecorder()
+	test.limiter.ServeHTTP(w, r)
+	return w
+}
+
+func TestRateLimiterHeaders(t *testing.T) {
+	test := newRateLimitTest(t)
+
+	w := test.do(http.MethodPost, "/api/auth", "203.0.113.5:4242", "")
+	if w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "2" || w.Header().Get("RateLimit-Remaining") != "1" {
+		t.Errorf("First sign-in answered %v with %v", w.Code, w.Header())
+	}
+	if policy := w.Header().Get("RateLimit-Policy"); policy != "1;w=60;burst=2" {
+		t.Errorf("RateLimit-Policy %q", policy)
+	}
+
+	test.do(http.MethodPost, "/api/auth", "203.0.113.5:4242", "")
+	w = test.do(http.MethodPost, "/api/auth", "203.0.113.5:4242", "")
+	if w.Code != http.StatusTooManyRequests || test.served != 2 {
+		t.Fatalf("Third sign-in of the burst answered %v, %d served", w.Code, test.served)
+	}
+	// One token comes back every minute
+	if w.Header().Get("Retry-After") != "60" || w.Header().Get("RateLimit-Remaining") != "0" || w.Header().Get("RateLimit-Reset") != "120" {
+		t.Errorf("Limited sign-in has the headers %v", w.Header())
+	}
+
+	// Classes have their own buckets, and reads aren't limited
+	if w = test.do(http.MethodPost, API_V1_PREFIX+"/links", "203.0.113.5:4242", ""); w.Code != http.StatusOK {
+		t.Errorf("API write limited by the sign-ins, answered %v", w.Code)
+	}
+	w = test.do(http.MethodGet, API_V1_PREFIX+"/links", "203.0.113.5:4242", "")
+	if w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "" {
+		t.Errorf("API read answered %v with %v", w.Code, w.Header())
+	}
+
+	// The v1 API gets its error envelope
+	w = test.do(http.MethodPost, API_V1_PREFIX+"/links", "203.0.113.5:4242", "")
+	var envelope struct {
+		Error struct{ Code string }
+	}
+	json.Unmarshal(w.Body.Bytes(), &envelope)
+	if w.Code != http.StatusTooManyRequests || envelope.Error.Code != "rate_limited" || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("Limited API write answered %v %q with %v", w.Code, w.Body.String(), w.Header())
+	}
+}
+
+func TestRateLimiterForwardedFor(t *testing.T) {
+	t.Run("spoofed by the client", func(t *testing.T) {
+		test := newRateLimitTest(t)
+		for i, forwarded := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.3"} {
+			w := test.do(http.MethodPost, "/api/auth", "203.0.113.5:4242", forwarded)
+			if limited := w.Code == http.StatusTooManyRequests; limited != (i == 2) {
+				t.Errorf("Sign-in %d claiming to come from %v answered %v", i+1, forwarded, w.Code)
+			}
+		}
+	})
+
+	t.Run("set by a trusted proxy", func(t *testing.T) {
+		test := newRateLimitTest(t)
+		for _, forwarded := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.3"} {
+			if w := test.do(http.MethodPost, "/api/auth", "10.0.0.1:4242", forwarded); w.Code != http.StatusOK {
+				t.Errorf("Client %v behind the proxy limited with the others, answered %v", forwarded, w.Code)
+			}
+		}
+
+		test.do(http.MethodPost, "/api/auth", "10.0.0.1:4242", "192.0.2.66, 198.51.100.1")
+		if w := test.do(http.MethodPost, "/api/auth", "10.0.0.1:4242", "192.0.2.77, 198.51.100.1"); w.Code != http.StatusTooManyRequests {
+			t.Errorf("Client escaped its limit by forging the start of the header, answered %v", w.Code)
+		}
+	})
+}
+
+func TestLimiterEvictsTheFullestBucket(t *testing.T) {
+	limiter := NewLimiter(RateConfig{1, Duration{time.Hour}, 2}, 2)
+	limiter.Take("exhausted")
+	limiter.Take("exhausted")
+	limiter.Take("fresh")
+
+	limiter.Take("newcomer")
+	if len(limiter.buckets) != 2 {
+		t.Fatalf("%d buckets kept, want at most 2", len(limiter.buckets))
+	}
+	if limiter.Allow("exhausted") {
+		t.Error("Eviction reset the bucket of the exhausted client")
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	STREAM_HEARTBEAT_DELAY = 15 * time.Second // Keeps proxies from closing idle streams
+	STREAM_REFRESH_DELAY   = time.Minute      // Picks up links created or deleted while streaming
+	STREAM_RETRY_DELAY     = 5 * time.Second  // Sent to EventSource clients as the reconnection delay
+	STREAM_MAX_PER_USER    = 5
+)
+
+// One open click stream, clicks accumulate in pending until its handler writes them
+type clickSubscriber struct {
+	mutex   *sync.Mutex
+	shorts  map[string]bool // Followed links, guarded by the hub's mutex
+	pending map[string]int64
+	notify  chan struct{} // Signaled when pending isn't empty
+}
+
+// Returns the clicks since the last call and resets them
+func (sub *clickSubscriber) take() map[string]int64 {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	pending := sub.pending
+	sub.pending = make(map[string]int64)
+	return pending
+}
+
+// In-process fan-out of redirects to the click streams. Publishing only counts clicks for the subscribers,
+// so a slow stream coalesces its clicks instead of ever blocking a redirect
+type ClickHub struct {
+	mutex       *sync.RWMutex
+	subscribers map[string]map[*clickSubscriber]bool // By followed short link
+	connections map[int]int                          // Open streams by user ID
+	maxPerUser  int
+}
+
+func NewClickHub(maxPerUser int) *ClickHub {
+	return &ClickHub{new(sync.RWMutex), make(map[string]map[*clickSubscriber]bool), make(map[int]int), maxPerUser}
+}
+
+// Counts a click for the streams following shortUrl
+func (hub *ClickHub) Publish(shortUrl string) {
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+
+	for sub := range hub.subscribers[shortUrl] {
+		sub.mutex.Lock()
+		sub.pending[shortUrl]++
+		sub.mutex.Unlock()
+
+		select {
+		case sub.notify <- struct{}{}:
+		default: // Already signaled
+		}
+	}
+}
+
+// Opens a stream of userId following shorts, RateLimited if the user has too many open streams
+func (hub *ClickHub) Subscribe(userId int, shorts []string) (*clickSubscriber, error) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	if hub.connections[userId] >= hub.maxPerUser {
+		return nil, &RateLimited{}
+	}
+	hub.connections[userId]++
+
+	sub := &clickSubscriber{new(sync.Mutex), make(map[string]bool), make(map[string]int64), make(chan struct{}, 1)}
+	hub.follow(sub, shorts)
+	return sub, nil
+}
+
+func (hub *ClickHub) Unsubscribe(userId int, sub *clickSubscriber) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	hub.follow(sub, nil)
+	hub.connections[userId]--
+	if hub.connections[userId] <= 0 {
+		delete(hub.connections, userId)
+	}
+}
+
+// Replaces the links followed by sub
+func (hub *ClickHub) Follow(sub *clickSubscriber, shorts []string) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	hub.follow(sub, shorts)
+}
+
+// The hub's mutex must be held
+func (hub *ClickHub) follow(sub *clickSubscriber, shorts []string) {
+	for short := range sub.shorts {
+		delete(hub.subscribers[short], sub)
+		if len(hub.subscribers[short]) == 0 {
+			delete(hub.subscribers, short)
+		}
+	}
+
+	sub.shorts = make(map[string]bool)
+	for _, short := range shorts {
+		sub.shorts[short] = true
+		if hub.subscribers[short] == nil {
+			hub.subscribers[short] = make(map[*clickSubscriber]bool)
+		}
+		hub.subscribers[short][sub] = true
+	}
+}
+
+// Returns the click counts of the links a stream follows: the link shortUrl if set, else the links of the workspace,
+// else the personal links of the session's user
+func (api *API) streamLinks(session *Session, shortUrl string, workspaceId int) (map[string]int64, error) {
+	if !session.signedIn || !session.hasScope(SCOPE_STATS_READ) {
+		Info.Printf("Rejecting unauthorized user with SID(%v)\n", session.sid)
+		return nil, &Unauthorized{}
+	}
+
+	if shortUrl != "" {
+		stats, err := api.getStats(session, shortUrl)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]int64{stats.Short: stats.Clicks}, nil
+	}
+
+	name, owner := "clicks_from_userId", session.userId
+	if workspaceId != 0 {
+		role, err := api.workspaceRole(session, workspaceId)
+		if err != nil {
+			return nil, err
+		}
+		if !role.CanView() {
+			Info.Printf("Rejecting unauthorized user with SID(%v)\n", session.sid)
+			return nil, &Unauthorized{}
+		}
+		name, owner = "clicks_from_workspaceId", workspaceId
+	}
+
+	rows, err := api.Query(name, owner)
+	if err != nil {
+		Error.Println("Failed to get link clicks", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(map[string]int64)
+	for rows.Next() {
+		var short string
+		var clicks int64
+		err = rows.Scan(&short, &clicks)
+		if err != nil {
+			Error.Println("Failed to scan link clicks", err)
+			return nil, err
+		}
+		res[short] = clicks + api.clicks.Pending(short)
+	}
+	return res, rows.Err()
+}
+
+// Writes a "clicks" event with the total clicks of a link and the ones since its previous event
+func writeClickEvent(w http.ResponseWriter, shortUrl string, clicks int64, added int64) error {
+	data, _ := json.Marshal(struct {
+		Short  string
+		Clicks int64
+		New    int64
+	}{shortUrl, clicks, added})
+	_, err := fmt.Fprintf(w, "event: clicks\ndata: %s\n\n", data)
+	return err
+}
+
+func linkCodes(counts map[string]int64) []string {
+	res := make([]string, 0, len(counts))
+	for key := range counts {
+		res = append(res, key)
+	}
+	return res
+}
+
+// GET /stream?short= streams the clicks of a link as Server-Sent Events, or the clicks of all the links of the user
+// or of ?workspace= without short. It starts with the current count of every link
+func (api *API) handleStream(w http.ResponseWriter, r *http.Request, session *Session) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		Error.Println("Response writer can't stream")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	shortUrl := query.Get("short")
+	workspaceId := 0
+	if query.Has("workspace") {
+		var err error
+		workspaceId, err = strconv.Atoi(query.Get("workspace"))
+		if err != nil {
+			writeAPIError(w, &InvalidInput{})
+			return
+		}
+	}
+
+	totals, err := api.streamLinks(session, shortUrl, workspaceId)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	sub, err := api.clickHub.Subscribe(session.userId, linkCodes(totals))
+	if err != nil {
+		Info.Printf("Rejecting click stream of UserID(%d), too many open streams\n", session.userId)
+		w.Header().Set("Retry-After", strconv.Itoa(int(STREAM_RETRY_DELAY.Seconds())))
+		writeAPIError(w, err)
+		return
+	}
+	defer api.clickHub.Unsubscribe(session.userId, sub)
+	Info.Printf("UserID(%d) opened a click stream of %d links\n", session.userId, len(totals))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Stops nginx from buffering the events
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", STREAM_RETRY_DELAY.Milliseconds())
+	for short, clicks := range totals {
+		writeClickEvent(w, short, clicks, 0)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(STREAM_HEARTBEAT_DELAY)
+	defer heartbeat.Stop()
+	refresh := time.NewTicker(STREAM_REFRESH_DELAY)
+	defer refresh.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			Info.Printf("UserID(%d) closed a click stream\n", session.userId)
+			return
+
+		case <-sub.notify:
+			for short, clicks := range sub.take() {
+				if _, followed := totals[short]; !followed {
+					continue // Clicked right before a refresh stopped following it
+				}
+				totals[short] += clicks
+				err = writeClickEvent(w, short, totals[short], clicks)
+			}
+
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+
+		case <-refresh.C:
+			latest, refreshErr := api.streamLinks(session, shortUrl, workspaceId)
+			if refreshErr != nil {
+				Info.Printf("Closing click stream of UserID(%d), %v\n", session.userId, refreshErr)
+				return // Deleted link or lost access
+			}
+			for short := range totals {
+				if _, exists := latest[short]; !exists {
+					delete(totals, short)
+				}
+			}
+			for short, clicks := range latest {
+				if _, followed := totals[short]; !followed {
+					totals[short] = clicks
+					err = writeClickEvent(w, short, clicks, 0)
+				}
+			}
+			api.clickHub.Follow(sub, linkCodes(totals))
+		}
+
+		if err != nil {
+			Info.Printf("Closing click stream of UserID(%d), %v\n", session.userId, err)
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClickHubPublishDoesNotBlock(t *testing.T) {
+	hub := NewClickHub(STREAM_MAX_PER_USER)
+	slow, err := hub.Subscribe(7, []string{"abc123", "def456"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := hub.Subscribe(8, []string{"abc123"})
+
+	// Nobody reads the streams while the clicks come in
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			hub.Publish("abc123")
+		}
+		hub.Publish("def456")
+		hub.Publish("unknown")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked on streams which aren't read")
+	}
+
+	select {
+	case <-slow.notify:
+	default:
+		t.Error("Stream not signaled")
+	}
+	if pending := slow.take(); len(pending) != 2 || pending["abc123"] != 1000 || pending["def456"] != 1 {
+		t.Errorf("Stream got the clicks %v", pending)
+	}
+	if pending := slow.take(); len(pending) != 0 {
+		t.Errorf("Clicks %v taken twice", pending)
+	}
+	if pending := other.take(); len(pending) != 1 || pending["abc123"] != 1000 {
+		t.Errorf("Other stream got the clicks %v", pending)
+	}
+
+	// Clicks of the links a stream stopped following aren't counted
+	hub.Follow(slow, []string{"def456"})
+	hub.Publish("abc123")
+	if pending := slow.take(); len(pending) != 0 {
+		t.Errorf("Stream got the clicks %v of a link it doesn't follow", pending)
+	}
+	hub.Unsubscribe(7, slow)
+	hub.Publish("def456")
+	if pending := slow.take(); len(pending) != 0 || len(hub.subscribers["def456"]) != 0 {
+		t.Errorf("Closed stream got the clicks %v", pending)
+	}
+}
+
+func TestClickHubPerUserLimit(t *testing.T) {
+	hub := NewClickHub(2)
+
+	var subs []*clickSubscriber
+	for i := 0; i < 2; i++ {
+		sub, err := hub.Subscribe(7, []string{"abc123"})
+		if err != nil {
+			t.Fatalf("Stream %d refused: %v", i+1, err)
+		}
+		subs = append(subs, sub)
+	}
+	if _, err := hub.Subscribe(7, []string{"abc123"}); err == nil {
+		t.Fatal("Stream over the limit opened")
+	} else if _, ok := err.(*RateLimited); !ok {
+		t.Errorf("Stream over the limit refused with %v", err)
+	}
+	if _, err := hub.Subscribe(8, []string{"abc123"}); err != nil {
+		t.Error("Other user limited with userID(7)", err)
+	}
+
+	hub.Unsubscribe(7, subs[0])
+	if _, err := hub.Subscribe(7, []string{"abc123"}); err != nil {
+		t.Error("Stream refused after another one closed", err)
+	}
+}
+
+func TestStreamLimitAnswer(t *testing.T) {
+	_, config := newFakeDB(t)
+	api := newTestAPI(t, config)
+	for i := 0; i < STREAM_MAX_PER_USER; i++ {
+		api.clickHub.Subscribe(7, nil)
+	}
+
+	session := &Session{sid: "stream-test", userId: 7, signedIn: true, expiry: time.Now().Add(time.Hour)}
+	w := httptest.NewRecorder()
+	api.handleStream(w, httptest.NewRequest(http.MethodGet, "/stream", nil), session)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "5" {
+		t.Errorf("Stream over the limit answered %v with %v", w.Code, w.Header())
+	}
+}
@@ -13,22 +13,20 @@ type HtmlTemplate struct {
 	tmplt *template.Template
 }
 
-// Loads the file and adds it's content to the single field in the template and returns the output
-func (htmlTmplt *HtmlTemplate) ApplyToHtmlFile(pathname string) ([]byte, error) {
+// Loads the file and puts it's content in the base page template and returns the output
+func (htmlTmplt *HtmlTemplate) ApplyToHtmlFile(pathname string, signedIn bool) ([]byte, error) {
 	data, err := os.ReadFile(pathname)
 	if err != nil {
 		return []byte{}, err
 	}
 
-	var output bytes.Buffer
-	htmlTmplt.tmplt.Execute(&output, template.HTML(data))
-	return output.Bytes(), nil
+	return htmlTmplt.ApplyToHtml(data, signedIn)
 }
 
-// Adds the provided data to the single field in the template and returns the output
-func (htmlTmplt *HtmlTemplate) ApplyToHtml(data []byte) ([]byte, error) {
+// Puts the provided data in the base page template and returns the output
+func (htmlTmplt *HtmlTemplate) ApplyToHtml(data []byte, signedIn bool) ([]byte, error) {
 	var output bytes.Buffer
-	htmlTmplt.tmplt.Execute(&output, template.HTML(data))
+	htmlTmplt.tmplt.Execute(&output, &BasePageData{template.HTML(data), signedIn})
 	return output.Bytes(), nil
 }
 
@@ -39,9 +37,9 @@ func (htmlTmplt *HtmlTemplate) ApplyToData(data any) ([]byte, error) {
 	return output.Bytes(), nil
 }
 
-// Writes the http response with the template applied to a file
-func (htmlTmplt *HtmlTemplate) WriteFile(pathname string, w http.ResponseWriter) {
-	data, err := htmlTmplt.ApplyToHtmlFile(pathname)
+// Writes the http response with the base page template applied to a file
+func (htmlTmplt *HtmlTemplate) WriteFile(pathname string, signedIn bool, w http.ResponseWriter) {
+	data, err := htmlTmplt.ApplyToHtmlFile(pathname, signedIn)
 	if err != nil {
 		Error.Println("Failed to apply template", err)
 		w.WriteHeader(404)
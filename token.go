@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	SCOPE_LINKS_READ  = "links:read"
+	SCOPE_LINKS_WRITE = "links:write"
+	SCOPE_STATS_READ  = "stats:read"
+	SCOPE_ACCOUNT     = "account" // Managing the account itself, never granted to tokens
+
+	TOKEN_PREFIX          = "shr_"
+	TOKEN_BYTES           = 32
+	TOKEN_NAME_MAX_LENGTH = 100
+)
+
+// Scopes which can be granted to a personal access token
+var tokenScopes = []string{SCOPE_LINKS_READ, SCOPE_LINKS_WRITE, SCOPE_STATS_READ}
+
+func hashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// Creates a personal access token for the session's user, the returned token is only ever shown once.
+// expiresInDays = 0 creates a token which never expires
+func (api *API) createToken(session *Session, name string, scopes []string, expiresInDays int) (string, error) {
+	if !session.signedIn || !session.hasScope(SCOPE_ACCOUNT) {
+		Info.Printf("Rejecting token creation with SID(%v)\n", session.sid)
+		return "", &Unauthorized{}
+	}
+
+	if name == "" || len(name) > TOKEN_NAME_MAX_LENGTH || len(scopes) == 0 || expiresInDays < 0 {
+		return "", &InvalidInput{}
+	}
+
+	for _, scope := range scopes {
+		valid := false
+		for _, tokenScope := range tokenScopes {
+			valid = valid || scope == tokenScope
+		}
+		if !valid {
+			return "", &InvalidInput{}
+		}
+	}
+
+	secret := make([]byte, TOKEN_BYTES)
+	_, err := rand.Read(secret)
+	if err != nil {
+		Error.Println("Failed to generate token", err)
+		return "", err
+	}
+	token := TOKEN_PREFIX + base64.RawURLEncoding.EncodeToString(secret)
+
+	var expiresIn any // NULL never expires
+	if expiresInDays > 0 {
+		expiresIn = expiresInDays
+	}
+
+	_, err = api.ExecRow("add_to_access_tokens", session.userId, name, hashToken(token), strings.Join(scopes, " "), expiresIn)
+	if err != nil {
+		Error.Println("Failed to save token", err)
+		return "", err
+	}
+
+	Info.Printf("UserID(%d) created token %v with scopes %v\n", session.userId, name, scopes)
+	return token, nil
+}
+
+// Returns the tokens of the session's user, without their secret
+func (api *API) getTokens(session *Session) (res []TokenData, err error) {
+	if !session.signedIn || !session.hasScope(SCOPE_ACCOUNT) {
+		return nil, &Unauthorized{}
+	}
+
+	rows, err := api.Query("access_tokens_from_userId", session.userId)
+	if err != nil {
+		Error.Println("Failed to get tokens", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data TokenData
+		var scopes string
+		var expires, lastUsed sql.NullString
+		err = rows.Scan(&data.Id, &data.Name, &scopes, &data.Created, &expires, &lastUsed)
+		if err != nil {
+			break
+		}
+		data.Scopes = strings.Fields(scopes)
+		data.Expires = expires.String
+		data.LastUsed = lastUsed.String
+		res = append(res, data)
+	}
+
+	return
+}
+
+func (api *API) revokeToken(session *Session, tokenId int) error {
+	if !session.signedIn || !session.hasScope(SCOPE_ACCOUNT) {
+		return &Unauthorized{}
+	}
+
+	affected, err := api.ExecRow("delete_from_access_tokens", tokenId, session.userId)
+	if err != nil {
+		Error.Println("Failed to revoke token", err)
+		return err
+	}
+	if affected == 0 {
+		return &BadRequest{}
+	}
+
+	Info.Printf("UserID(%d) revoked token %d\n", session.userId, tokenId)
+	return nil
+}
+
+// Returns the session of a bearer token, or Unauthorized if the token is unknown, revoked or expired
+func (api *API) sessionFromToken(token string) (*Session, error) {
+	var tokenId, userId int
+	var scopes string
+	err := api.QueryRow("access_token_from_hash", []any{hashToken(token)}, &tokenId, &userId, &scopes)
+	if err == sql.ErrNoRows {
+		return nil, &Unauthorized{}
+	} else if err != nil {
+		Error.Println("Failed to look up token", err)
+		return nil, err
+	}
+
+	_, err = api.ExecRow("update_access_token_last_used", tokenId)
+	if err != nil {
+		Warning.Println("Failed to update token last use", err)
+	}
+
+	return &Session{
+		sid:      fmt.Sprintf("token:%d", tokenId),
+		userId:   userId,
+		signedIn: true,
+		scopes:   strings.Fields(scopes),
+		tokenId:  tokenId,
+	}, nil
+}
+
+// Middleware authenticating requests with an Authorization: Bearer header, which don't get a cookie session.
+// Other requests go through the session manager
+type TokenAuth struct {
+	api      *API
+	handler  http.Handler // Called with the token's session
+	sessions http.Handler // Session manager wrapping handler
+}
+
+func NewTokenAuth(api *API, handler http.Handler, sessions http.Handler) *TokenAuth {
+	return &TokenAuth{api, handler, sessions}
+}
+
+func (tokenAuth *TokenAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		tokenAuth.sessions.ServeHTTP(w, r)
+		return
+	}
+
+	session, err := tokenAuth.api.sessionFromToken(strings.TrimPrefix(authorization, "Bearer "))
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeV1Error(w, nil, err)
+		return
+	}
+
+	Info.Printf("Serving SID(%v) @ %v\n", session.sid, r.URL)
+	newContext := context.WithValue(r.Context(), SessionKey, session)
+	tokenAuth.handler.ServeHTTP(w, r.WithContext(newContext))
+}
+
+func (api *API) handleTokenCreate(w http.ResponseWriter, r *http.Request, session *Session) {
+	err := r.ParseForm()
+	if err != nil {
+		Warning.Println("Failed to parse form", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	expiresInDays := 0
+	if expires := r.PostForm.Get("expires"); expires != "" {
+		expiresInDays, err = strconv.Atoi(expires)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	token, err := api.createToken(session, r.PostForm.Get("name"), r.PostForm["scope"], expiresInDays)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	w.Write([]byte(token))
+}
+
+func (api *API) handleTokens(w http.ResponseWriter, r *http.Request, session *Session) {
+	res, err := api.getTokens(session)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (api *API) handleTokenRevoke(w http.ResponseWriter, r *http.Request, session *Session) {
+	tokenId, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = api.revokeToken(session, tokenId)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	TOTP_ISSUER       = "shr.me"
+	TOTP_SECRET_BYTES = 20 // Size of the HMAC-SHA1 key recommended by RFC 4226
+	TOTP_DIGITS       = 6
+	TOTP_STEP         = 30 * time.Second
+	TOTP_SKEW         = 1 // Steps accepted before and after the current one, for clocks which drifted
+
+	RECOVERY_CODE_COUNT    = 10
+	RECOVERY_CODE_LENGTH   = 10
+	RECOVERY_CODE_ALPHABET = "abcdefghjkmnpqrstuvwxyz23456789" // Without the look-alikes i, l, o, 0 and 1
+
+	TWO_FACTOR_LOGIN_TIMEOUT = 5 * time.Minute
+	TWO_FACTOR_MAX_FAILURES  = 5 // Wrong codes before the password has to be entered again
+)
+
+// Sign-in of a session which gave the right password of a user with two-factor authentication and still has to give a code
+type twoFactorLogin struct {
+	userId   int
+	username string // As typed, wrong codes count as failed sign-ins of it
+	expiry   time.Time
+	failures int
+}
+
+// Returns the HOTP code of RFC 4226 for the counter, which is the time step for TOTP
+func totpCode(secret []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0F
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7FFFFFFF
+
+	modulus := uint32(1)
+	for i := 0; i < TOTP_DIGITS; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%modulus)
+}
+
+// Returns the time step the code is valid for around now, false if it doesn't match any
+func matchTOTP(secret []byte, code string, now time.Time) (int64, bool) {
+	current := now.Unix() / int64(TOTP_STEP.Seconds())
+	for step := current - TOTP_SKEW; step <= current+TOTP_SKEW; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// Returns the otpauth:// URI authenticator apps read from the QR code
+func totpURI(username string, secret []byte) string {
+	query := url.Values{
+		"secret":    {base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)},
+		"issuer":    {TOTP_ISSUER},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(TOTP_DIGITS)},
+		"period":    {fmt.Sprint(int(TOTP_STEP.Seconds()))},
+	}
+	return "otpauth://totp/" + url.PathEscape(TOTP_ISSUER+":"+username) + "?" + query.Encode()
+}
+
+// Generates codes like abcde-fgh23, only their hashes are stored
+func newRecoveryCodes() ([]string, error) {
+	res := make([]string, 0, RECOVERY_CODE_COUNT)
+	buf := make([]byte, 1)
+	for len(res) < RECOVERY_CODE_COUNT {
+		code := make([]byte, 0, RECOVERY_CODE_LENGTH)
+		for len(code) < RECOVERY_CODE_LENGTH {
+			_, err := rand.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			if int(buf[0]) >= 256-256%len(RECOVERY_CODE_ALPHABET) {
+				continue
+			}
+			code = append(code, RECOVERY_CODE_ALPHABET[int(buf[0])%len(RECOVERY_CODE_ALPHABET)])
+		}
+		half := RECOVERY_CODE_LENGTH / 2
+		res = append(res, string(code[:half])+"-"+string(code[half:]))
+	}
+	return res, nil
+}
+
+// Removes the separators users may type in codes
+func normalizeTwoFactorCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+// Returns true if the user turned two-factor authentication on
+func (api *API) twoFactorEnabled(userId int) (bool, error) {
+	var secret []byte
+	var enabled bool
+	var lastStep int64
+	err := api.QueryRow("totp_from_userId", []any{userId}, &secret, &enabled, &lastStep)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		Error.Println("Failed to get two-factor status", err)
+		return false, err
+	}
+	return enabled, nil
+}
+
+// Checks a TOTP code or an unused recovery code of a user with two-factor authentication, and consumes it.
+// A TOTP code is refused if a code of its time step or a later one was already accepted
+func (api *API) checkTwoFactorCode(userId int, code string) (bool, error) {
+	code = normalizeTwoFactorCode(code)
+	if code == "" {
+		return false, nil
+	}
+
+	var secret []byte
+	var enabled bool
+	var lastStep int64
+	err := api.QueryRow("totp_from_userId", []any{userId}, &secret, &enabled, &lastStep)
+	if err == sql.ErrNoRows || (err == nil && !enabled) {
+		return false, nil
+	} else if err != nil {
+		Error.Println("Failed to get TOTP secret", err)
+		return false, err
+	}
+
+	if len(code) == TOTP_DIGITS {
+		step, ok := matchTOTP(secret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		if step <= lastStep {
+			Info.Printf("Rejecting replayed TOTP code of UserID(%d)\n", userId)
+			return false, nil
+		}
+
+		// The condition on last_step makes concurrent requests with the same code use it once
+		used, err := api.ExecRow("use_totp_step", step, userId, step)
+		return used == 1, err
+	}
+
+	used, err := api.ExecRow("use_recovery_code", userId, hashAccountToken(code))
+	if used == 1 {
+		Info.Printf("UserID(%d) used a recovery code\n", userId)
+	}
+	return used == 1, err
+}
+
+// Stores new recovery codes of the user, replacing the previous ones
+func (api *API) storeRecoveryCodes(userId int) ([]string, error) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		Error.Println("Failed to generate recovery codes", err)
+		return nil, err
+	}
+
+	err = api.Transaction(func(tx *sql.Tx) error {
+		txApi := api.InTransaction(tx)
+
+		_, err := txApi.ExecRow("delete_recovery_codes_of_user", userId)
+		if err != nil {
+			return err
+		}
+		for _, code := range codes {
+			_, err = txApi.ExecRow("add_to_recovery_codes", userId, hashAccountToken(normalizeTwoFactorCode(code)))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		Error.Println("Failed to save recovery codes", err)
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Generates the secret of the session's user and returns it with its QR code. Two-factor authentication is only
+// turned on by enableTwoFactor, once the user proved their app has the secret
+func (api *API) setupTwoFactor(session *Session) (TwoFactorSetup, error) {
+	if !session.signedIn || !session.hasScope(SCOPE_ACCOUNT) {
+		Info.Printf("Rejecting two-factor setup with SID(%v)\n", session.sid)
+		return TwoFactorSetup{}, &Unauthorized{}
+	}
+
+	enabled, err := api.twoFactorEnabled(session.userId)
+	if err != nil {
+		return TwoFactorSetup{}, err
+	}
+	if enabled {
+		return TwoFactorSetup{}, &Conflict{}
+	}
+
+	var username string
+	err = api.QueryRow("username_from_userId", []any{session.userId}, &username)
+	if err != nil {
+		Error.Println("Failed to get username", err)
+		return TwoFactorSetup{}, err
+	}
+
+	secret := make([]byte, TOTP_SECRET_BYTES)
+	_, err = rand.Read(secret)
+	if err != nil {
+		Error.Println("Failed to generate TOTP secret", err)
+		return TwoFactorSetup{}, err
+	}
+
+	_, err = api.ExecRow("add_to_user_totp", session.userId, secret)
+	if err != nil {
+		Error.Println("Failed to save TOTP secret", err)
+		return TwoFactorSetup{}, err
+	}
+
+	uri := totpURI(username, secret)
+	setup := TwoFactorSetup{Secret: base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), URI: uri}
+	qr, err := EncodeQR([]byte(uri))
+	if err == nil {
+		setup.QR = qr.SVG()
+	} else {
+		Info.Printf("Provisioning URI of UserID(%d) too long for a QR code, the secret has to be typed\n", session.userId)
+	}
+	return setup, nil
+}
+
+// Turns two-factor authentication on with a code of the secret from setupTwoFactor, returns the recovery codes
+func (api *API) enableTwoFactor(session *Session, code string) ([]string, error) {
+	if !session.signedIn || !session.hasScope(SCOPE_ACCOUNT) {
+		Info.Printf("Rejecting two-factor activation with SID(%v)\n", session.sid)
+		return nil, &Unauthorized{}
+	}
+
+	var secret []byte
+	var enabled bool
+	var lastStep int64
+	err := api.QueryRow("totp_from_userId", []any{session.userId}, &secret, &enabled, &lastStep)
+	if err == sql.ErrNoRows {
+		return nil, &BadRequest{} // No setup
+	} else if err != nil {
+		Error.Println("Failed to get TOTP secret", err)
+		return nil, err
+	}
+	if enabled {
+		return nil, &Conflict{}
+	}
+
+	step, ok := matchTOTP(secret, normalizeTwoFactorCode(code), time.Now())
+	if !ok {
+		return nil, &InvalidInput{}
+	}
+
+	// The activation code can't be replayed to sign in
+	affected, err := api.ExecRow("enable_totp", step, session.userId)
+	if err != nil {
+		Error.Println("Failed to enable two-factor authentication", err)
+		return nil, err
+	}
+	if affected == 0 {
+		return nil, &Conflict{} // Enabled by a concurrent request
+	}
+
+	codes, err := api.storeRecoveryCodes(session.userId)
+	if err != nil {
+		return nil, err
+	}
+
+	Info.Printf("UserID(%d) enabled two-factor authentication\n", session.userId)
+	return codes, nil
+}
+
+// Turns two-factor authentication off, which needs the password and a code
+func (api *API) disableTwoFactor(session *Session, password string, code string) error {
+	if !session.signedIn || !session.hasScope(SCOPE_ACCOUNT) {
+		Info.Printf("Rejecting two-factor deactivation with SID(%v)\n", session.sid)
+		return &Unauthorized{}
+	}
+
+	var stored []byte
+	err := api.QueryRow("passwordHash_from_userId", []any{session.userId}, &stored)
+	if err != nil {
+		Error.Println("Failed to get stored password hash", err)
+		return err
+	}
+	if ok, _ := verifyPassword(password, stored); !ok {
+		Info.Printf("Rejecting two-factor deactivation of UserID(%d), wrong password\n", session.userId)
+		return &Unauthorized{}
+	}
+
+	ok, err := api.checkTwoFactorCode(session.userId, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		Info.Printf("Rejecting two-factor deactivation of UserID(%d), wrong code\n", session.userId)
+		return &Unauthorized{}
+	}
+
+	err = api.Transaction(func(tx *sql.Tx) error {
+		txApi := api.InTransaction(tx)
+
+		_, err := txApi.ExecRow("delete_totp_of_user", session.userId)
+		if err != nil {
+			return err
+		}
+		_, err = txApi.ExecRow("delete_recovery_codes_of_user", session.userId)
+		return err
+	})
+	if err != nil {
+		Error.Println("Failed to disable two-factor authentication", err)
+		return err
+	}
+
+	Info.Printf("UserID(%d) disabled two-factor authentication\n", session.userId)
+	return nil
+}
+
+// Replaces the recovery codes of the session's user after checking a code, returns the new ones
+func (api *API) regenerateRecoveryCodes(session *Session, code string) ([]string, error) {
+	if !session.signedIn || !session.hasScope(SCOPE_ACCOUNT) {
+		Info.Printf("Rejecting recovery codes generation with SID(%v)\n", session.sid)
+		return nil, &Unauthorized{}
+	}
+
+	ok, err := api.checkTwoFactorCode(session.userId, code)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, &Unauthorized{}
+	}
+
+	codes, err := api.storeRecoveryCodes(session.userId)
+	if err != nil {
+		return nil, err
+	}
+
+	Info.Printf("UserID(%d) generated new recovery codes\n", session.userId)
+	return codes, nil
+}
+
+// Finishes the sign-in of a session pending two-factor authentication with a TOTP or recovery code.
+// Too many wrong codes, or waiting too long, cancel the sign-in. Wrong codes are throttled like wrong passwords
+func (api *API) verifyTwoFactor(session *Session, code string, ip string) error {
+	login := session.twoFactor
+	if login == nil || time.Now().After(login.expiry) {
+		session.twoFactor = nil
+		Info.Printf("Rejecting two-factor code with SID(%v), no pending sign-in\n", session.sid)
+		return &Unauthorized{}
+	}
+
+	err := api.reserveLoginAttempt(login.username, ip)
+	if err != nil {
+		return err
+	}
+
+	ok, err := api.checkTwoFactorCode(login.userId, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		api.recordLoginFailure(login.username, ip, login.userId)
+		login.failures++
+		if login.failures >= TWO_FACTOR_MAX_FAILURES {
+			Info.Printf("Cancelling sign-in of UserID(%d) with SID(%v), too many wrong codes\n", login.userId, session.sid)
+			session.twoFactor = nil
+		}
+		return &Unauthorized{}
+	}
+
+	api.releaseLoginAttempt(ip)
+	api.clearLoginFailures(login.username)
+	Info.Printf("SID(%v) associated with UserID %d after two-factor authentication. Elevating session access...\n", session.sid, login.userId)
+	session.twoFactor = nil
+	session.signedIn = true
+	session.signedInAt = time.Now()
+	session.userId = login.userId
+	return nil
+}
+
+func (api *API) handleTwoFactorSetup(w http.ResponseWriter, r *http.Request, session *Session) {
+	setup, err := api.setupTwoFactor(session)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	resData, err := json.Marshal(setup)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(resData)
+}
+
+// Writes the recovery codes, one per line
+func writeRecoveryCodes(w http.ResponseWriter, codes []string) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(strings.Join(codes, "\n")))
+}
+
+func (api *API) handleTwoFactorEnable(w http.ResponseWriter, r *http.Request, session *Session) {
+	err := r.ParseForm()
+	if err != nil {
+		Warning.Println("Failed to parse form", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	codes, err := api.enableTwoFactor(session, r.PostForm.Get("code"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeRecoveryCodes(w, codes)
+}
+
+func (api *API) handleTwoFactorDisable(w http.ResponseWriter, r *http.Request, session *Session) {
+	err := r.ParseForm()
+	if err != nil {
+		Warning.Println("Failed to parse form", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = api.disableTwoFactor(session, r.PostForm.Get("password"), r.PostForm.Get("code"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (api *API) handleRecoveryCodes(w http.ResponseWriter, r *http.Request, session *Session) {
+	err := r.ParseForm()
+	if err != nil {
+		Warning.Println("Failed to parse form", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	codes, err := api.regenerateRecoveryCodes(session, r.PostForm.Get("code"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeRecoveryCodes(w, codes)
+}
+
+func (api *API) handleTwoFactorVerify(w http.ResponseWriter, r *http.Request, session *Session) {
+	err := r.ParseForm()
+	if err != nil {
+		Warning.Println("Failed to parse form", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = api.verifyTwoFactor(session, r.PostForm.Get("code"), api.clientIP(r))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
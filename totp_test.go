@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql/driver"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test vectors of RFC 6238 appendix B for SHA-1, the last 6 of their 8 digits
+func TestTOTPCodeRFC6238(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+
+	for unix, want := range vectors {
+		step := unix / int64(TOTP_STEP.Seconds())
+		if code := totpCode(secret, step); code != want {
+			t.Errorf("Code at %d is %v, want %v", unix, code, want)
+		}
+
+		matched, ok := matchTOTP(secret, want, time.Unix(unix, 0))
+		if !ok || matched != step {
+			t.Errorf("Code %v at %d matched step %d, %v, want %d", want, unix, matched, ok, step)
+		}
+	}
+}
+
+func TestMatchTOTPWindow(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / int64(TOTP_STEP.Seconds())
+
+	for offset := int64(-TOTP_SKEW - 1); offset <= TOTP_SKEW+1; offset++ {
+		step, ok := matchTOTP(secret, totpCode(secret, current+offset), now)
+		accepted := offset >= -TOTP_SKEW && offset <= TOTP_SKEW
+		if ok != accepted || (ok && step != current+offset) {
+			t.Errorf("Code of step %+d matched step %d, %v, want accepted %v", offset, step-current, ok, accepted)
+		}
+	}
+}
+
+// Keeps the TOTP row of userID(7) and its recovery codes in memory, with the conditions of their statements
+func onTwoFactor(db *fakeDB, secret []byte, recoveryCodes ...string) {
+	mutex := new(sync.Mutex)
+	lastStep := int64(0)
+	unused := make(map[string]bool)
+	for _, code := range recoveryCodes {
+		unused[string(hashAccountToken(code))] = true
+	}
+
+	db.on("select secret, enabled is not null, last_step from user_totp", func(args []driver.Value) (fakeResult, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return fakeResult{rows: [][]driver.Value{{secret, int64(1), lastStep}}}, nil
+	})
+	db.on("update user_totp set last_step = ?", func(args []driver.Value) (fakeResult, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if step := args[0].(int64); step > lastStep {
+			lastStep = step
+			return fakeResult{affected: 1}, nil
+		}
+		return fakeResult{}, nil
+	})
+	db.on("update totp_recovery_codes set used = now()", func(args []driver.Value) (fakeResult, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if hash := string(args[1].([]byte)); unused[hash] {
+			delete(unused, hash)
+			return fakeResult{affected: 1}, nil
+		}
+		return fakeResult{}, nil
+	})
+}
+
+func TestTwoFactorCodeReplay(t *testing.T) {
+	db, config := newFakeDB(t)
+	api := newTestAPI(t, config)
+	secret := []byte("12345678901234567890")
+	onTwoFactor(db, secret)
+
+	step := time.Now().Unix() / int64(TOTP_STEP.Seconds())
+	code := totpCode(secret, step)
+	ok, err := api.checkTwoFactorCode(7, code)
+	if err != nil || !ok {
+		t.Fatalf("Current code refused: %v, %v", ok, err)
+	}
+	used := db.executed("update user_totp set last_step = ?")
+	if len(used) != 1 || used[0][0] != step || used[0][1] != int64(7) {
+		t.Errorf("Step of the code not saved for userID(7): %v", used)
+	}
+
+	if ok, _ = api.checkTwoFactorCode(7, code); ok {
+		t.Error("Code accepted twice")
+	}
+	// The previous step is still in the window but older than the accepted code
+	if ok, _ = api.checkTwoFactorCode(7, totpCode(secret, step-1)); ok {
+		t.Error("Code of an earlier step accepted after a later one")
+	}
+	if ok, _ = api.checkTwoFactorCode(7, totpCode(secret, step+1)); !ok {
+		t.Error("Code of the next step refused")
+	}
+}
+
+func TestRecoveryCodeSingleUse(t *testing.T) {
+	db, config := newFakeDB(t)
+	api := newTestAPI(t, config)
+	onTwoFactor(db, []byte("12345678901234567890"), "abcdefgh23")
+
+	if ok, _ := api.checkTwoFactorCode(7, "zzzzz-zzzzz"); ok {
+		t.Error("Unknown recovery code accepted")
+	}
+	if ok, err := api.checkTwoFactorCode(7, "ABCDE-FGH23"); err != nil || !ok {
+		t.Fatalf("Recovery code typed in upper case with its dash refused: %v, %v", ok, err)
+	}
+	if ok, _ := api.checkTwoFactorCode(7, "abcde-fgh23"); ok {
+		t.Error("Recovery code accepted twice")
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// Asks the user named toUsername to take over shortUrl, or all the links of the session's user if shortUrl is empty
+func (api *API) requestTransfer(session *Session, toUsername string, shortUrl string) error {
+	if !session.signedIn || !session.hasScope(SCOPE_ACCOUNT) {
+		Info.Printf("Rejecting unauthorized user with SID(%v)\n", session.sid)
+		return &Unauthorized{}
+	}
+
+	var toUserId int
+	err := api.QueryRow("userId_from_username", []any{toUsername}, &toUserId)
+	if err == sql.ErrNoRows {
+		return &NoSuchUser{}
+	} else if err != nil {
+		Error.Println("Failed to get userID", err)
+		return err
+	}
+
+	if toUserId == session.userId {
+		return &InvalidInput{}
+	}
+
+	var short any // NULL transfers every link
+	if shortUrl != "" {
+		shortUrl = api.normalizeShortUrl(shortUrl)
+
+		var ownerId, workspaceId sql.NullInt64
+		err = api.QueryRow("owner_from_shortUrl", []any{shortUrl}, &ownerId, &workspaceId)
+		if err == sql.ErrNoRows {
+			return &NoSuchLink{}
+		} else if err != nil {
+			Error.Printf("Failed to get owner of shortURL(%v), %v", shortUrl, err)
+			return err
+		}
+
+		// Workspace links belong to the workspace, not to their creator
+		if workspaceId.Valid || !ownerId.Valid || int(ownerId.Int64) != session.userId {
+			Info.Printf("Rejecting transfer of a link not owned by SID(%v)\n", session.sid)
+			return &Unauthorized{}
+		}
+		short = shortUrl
+	}
+
+	_, err = api.ExecRow("add_to_link_transfers", session.userId, toUserId, short)
+	if err != nil {
+		Error.Println("Failed to add transfer request", err)
+		return err
+	}
+
+	Info.Printf("UserID(%d) requested to transfer %v to userID(%d)\n", session.userId, shortUrl, toUserId)
+	return nil
+}
+
+// Moves the links of a transfer request to the recipient, who must be the session's user
+func (api *API) acceptTransfer(session *Session, transferId int) error {
+	if !session.signedIn || !session.hasScope(SCOPE_ACCOUNT) {
+		Info.Printf("Rejecting unauthorized user with SID(%v)\n", session.sid)
+		return &Unauthorized{}
+	}
+
+	var fromUserId, toUserId int
+	var shortUrl sql.NullString
+	err := api.QueryRow("link_transfer_from_id", []any{transferId}, &fromUserId, &toUserId, &shortUrl)
+	if err == sql.ErrNoRows {
+		return &NoSuchTransfer{}
+	} else if err != nil {
+		Error.Println("Failed to get transfer request", err)
+		return err
+	}
+
+	if toUserId != session.userId {
+		Info.Printf("Rejecting transfer acceptance by SID(%v) which isn't the recipient\n", session.sid)
+		return &Unauthorized{}
+	}
+
+	err = api.Transaction(func(tx *sql.Tx) error {
+		var stmt *sql.Stmt
+		var args []any
+		if shortUrl.Valid {
+			stmt, err = api.TxStmt(tx, "transfer_link")
+			args = []any{toUserId, shortUrl.String, fromUserId}
+		} else {
+			stmt, err = api.TxStmt(tx, "transfer_all_links")
+			args = []any{toUserId, fromUserId}
+		}
+		if err != nil {
+			return err
+		}
+
+		res, err := stmt.Exec(args...)
+		if err != nil {
+			return err
+		}
+
+		if affected, _ := res.RowsAffected(); shortUrl.Valid && affected == 0 {
+			return &NoSuchLink{} // The sender deleted the link since the request
+		}
+
+		stmt, err = api.TxStmt(tx, "delete_from_link_transfers")
+		if err != nil {
+			return err
+		}
+
+		_, err = stmt.Exec(transferId)
+		return err
+	})
+	if err != nil {
+		Error.Printf("Failed to accept transfer %d, %v\n", transferId, err)
+		return err
+	}
+
+	Info.Printf("UserID(%d) accepted transfer %d from userID(%d)\n", toUserId, transferId, fromUserId)
+	return nil
+}
+
+// Deletes a transfer request, the sender cancels it and the recipient declines it
+func (api *API) cancelTransfer(session *Session, transferId int) error {
+	if !session.signedIn || !session.hasScope(SCOPE_ACCOUNT) {
+		Info.Printf("Rejecting unauthorized user with SID(%v)\n", session.sid)
+		return &Unauthorized{}
+	}
+
+	var fromUserId, toUserId int
+	var shortUrl sql.NullString
+	err := api.QueryRow("link_transfer_from_id", []any{transferId}, &fromUserId, &toUserId, &shortUrl)
+	if err == sql.ErrNoRows {
+		return &NoSuchTransfer{}
+	} else if err != nil {
+		Error.Println("Failed to get transfer request", err)
+		return err
+	}
+
+	if session.userId != fromUserId && session.userId != toUserId {
+		return &Unauthorized{}
+	}
+
+	_, err = api.ExecRow("delete_from_link_transfers", transferId)
+	return err
+}
+
+// Gets the pending transfer requests sent or received by the session's user
+func (api *API) getTransfers(session *Session) (res []TransferData, err error) {
+	if !session.signedIn || !session.hasScope(SCOPE_ACCOUNT) {
+		return nil, &Unauthorized{}
+	}
+
+	rows, err := api.Query("link_transfers_from_userId", session.userId, session.userId)
+	if err != nil {
+		Error.Println("Failed to get transfer requests", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data TransferData
+		var toUserId int
+		var shortUrl sql.NullString
+		err = rows.Scan(&data.Id, &data.From, &toUserId, &data.To, &shortUrl, &data.Created)
+		if err != nil {
+			break
+		}
+		data.Short = shortUrl.String
+		data.Incoming = toUserId == session.userId
+		res = append(res, data)
+	}
+
+	return
+}
+
+// Returns true if the session's user is listed as an admin in the config
+func (api *API) isAdmin(session *Session) bool {
+	if !session.signedIn || !session.hasScope(SCOPE_ACCOUNT) {
+		return false
+	}
+
+	var username string
+	err := api.QueryRow("username_from_userId", []any{session.userId}, &username)
+	if err != nil {
+		return false
+	}
+
+	for _, admin := range api.config.Admins {
+		if admin == username {
+			return true
+		}
+	}
+	return false
+}
+
+// Moves every link of fromUserId to the user named toUsername without asking anyone, for accounts which are gone
+func (api *API) adminTransfer(session *Session, fromUserId int, toUsername string) (int64, error) {
+	if !api.isAdmin(session) {
+		Info.Printf("Rejecting admin transfer by SID(%v)\n", session.sid)
+		return 0, &Unauthorized{}
+	}
+
+	var toUserId int
+	err := api.QueryRow("userId_from_username", []any{toUsername}, &toUserId)
+	if err == sql.ErrNoRows {
+		return 0, &NoSuchUser{}
+	} else if err != nil {
+		Error.Println("Failed to get userID", err)
+		return 0, err
+	}
+
+	var affected int64
+	err = api.Transaction(func(tx *sql.Tx) error {
+		stmt, err := api.TxStmt(tx, "transfer_all_links")
+		if err != nil {
+			return err
+		}
+
+		res, err := stmt.Exec(toUserId, fromUserId)
+		if err != nil {
+			return err
+		}
+		affected, _ = res.RowsAffected()
+
+		// Pending requests of the old account don't make sense anymore
+		stmt, err = api.TxStmt(tx, "delete_link_transfers_from_userId")
+		if err != nil {
+			return err
+		}
+
+		_, err = stmt.Exec(fromUserId, fromUserId)
+		return err
+	})
+	if err != nil {
+		Error.Printf("Failed to transfer links of userID(%d), %v\n", fromUserId, err)
+		return 0, err
+	}
+
+	Info.Printf("Admin with SID(%v) transferred %d links from userID(%d) to userID(%d)\n", session.sid, affected, fromUserId, toUserId)
+	return affected, nil
+}
+
+func (api *API) handleTransfer(w http.ResponseWriter, r *http.Request, session *Session) {
+	err := r.ParseForm()
+	if err != nil {
+		Warning.Println("Failed to parse form", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = api.requestTransfer(session, r.PostForm.Get("to"), r.PostForm.Get("short"))
+	if err != nil {
+		Warning.Println("Failed to request transfer", err)
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (api *API) handleTransferAccept(w http.ResponseWriter, r *http.Request, session *Session) {
+	transferId, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = api.acceptTransfer(session, transferId)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (api *API) handleTransferCancel(w http.ResponseWriter, r *http.Request, session *Session) {
+	transferId, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = api.cancelTransfer(session, transferId)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (api *API) handleTransfers(w http.ResponseWriter, r *http.Request, session *Session) {
+	res, err := api.getTransfers(session)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	resData, err := json.Marshal(res)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resData)
+}
+
+func (api *API) handleAdminTransfer(w http.ResponseWriter, r *http.Request, session *Session) {
+	err := r.ParseForm()
+	if err != nil {
+		Warning.Println("Failed to parse form", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	fromUserId, err := strconv.Atoi(r.PostForm.Get("from"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	affected, err := api.adminTransfer(session, fromUserId, r.PostForm.Get("to"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	w.Write([]byte(strconv.FormatInt(affected, 10)))
+}
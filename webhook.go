@@ -0,0 +1,618 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	EVENT_LINK_CREATED = "link.created"
+	EVENT_LINK_UPDATED = "link.updated"
+	EVENT_LINK_DELETED = "link.deleted"
+	EVENT_LINK_CLICKED = "link.clicked" // Clicks counted since the last flush, see CLICKS_FLUSH_DELAY
+	EVENT_PING         = "ping"         // Sent by the test button, whatever the subscribed events
+
+	WEBHOOK_SECRET_BYTES      = 32
+	WEBHOOK_URL_MAX_LENGTH    = 1024
+	WEBHOOK_POLL_DELAY        = 5 * time.Second
+	WEBHOOK_BATCH_SIZE        = 20
+	WEBHOOK_LEASE             = time.Minute // A claimed delivery isn't retried by another worker before this
+	WEBHOOK_RETRY_BASE        = 30 * time.Second
+	WEBHOOK_RETRY_MAX         = 6 * time.Hour
+	WEBHOOK_LOG_SIZE          = 50
+	WEBHOOK_LOG_RETENTION     = 30 * 24 * time.Hour
+	WEBHOOK_ERROR_MAX_LENGTH  = 255
+	WEBHOOK_RESPONSE_MAX_READ = 4096
+
+	DELIVERY_PENDING   = "pending"
+	DELIVERY_DELIVERED = "delivered"
+	DELIVERY_FAILED    = "failed"
+)
+
+// Events a webhook can subscribe to
+var webhookEvents = []string{EVENT_LINK_CREATED, EVENT_LINK_UPDATED, EVENT_LINK_DELETED, EVENT_LINK_CLICKED}
+
+// Body of every delivery, the same payload is sent again on retries
+type WebhookEvent struct {
+	Id      string `json:"id"`
+	Event   string `json:"event"`
+	Created string `json:"created"`
+	Data    any    `json:"data"`
+}
+
+// Personal links have a userId, workspace links only a workspaceId
+type linkOwner struct {
+	userId      sql.NullInt64
+	workspaceId sql.NullInt64
+}
+
+func (api *API) linkOwner(shortUrl string) (linkOwner, error) {
+	var owner linkOwner
+	err := api.QueryRow("owner_from_shortUrl", []any{shortUrl}, &owner.userId, &owner.workspaceId)
+	if err == sql.ErrNoRows {
+		return owner, &NoSuchLink{}
+	}
+	if owner.workspaceId.Valid {
+		owner.userId = sql.NullInt64{}
+	}
+	return owner, err
+}
+
+// Returns an http.Client refusing to connect to private networks unless allowPrivate is set, and not following redirects.
+// It never goes through a proxy, the dialer would then only check the proxy's address and not the webhook's
+func NewWebhookClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		// Checked on the resolved address so DNS can't point an allowed host to an internal one
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			return checkWebhookAddress(address)
+		}
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Shared address space of carrier-grade NATs (RFC 6598) and benchmarking networks (RFC 2544), which aren't public
+// but aren't covered by net.IP.IsPrivate either
+var webhookBlockedNets = []*net.IPNet{
+	{IP: net.IP{100, 64, 0, 0}, Mask: net.CIDRMask(10, 32)},
+	{IP: net.IP{198, 18, 0, 0}, Mask: net.CIDRMask(15, 32)},
+}
+
+// Returns an error if the host:port address dialed for a webhook isn't a public one
+func checkWebhookAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("webhook to private address %v refused", host)
+	}
+	for _, network := range webhookBlockedNets {
+		if network.Contains(ip) {
+			return fmt.Errorf("webhook to private address %v refused", host)
+		}
+	}
+	return nil
+}
+
+// Returns nil if the session can manage the webhooks of the workspace, or the personal ones if workspaceId is 0
+func (api *API) checkWebhookAccess(session *Session, workspaceId int) error {
+	if api.webhookClient == nil {
+		return &BadRequest{}
+	}
+	if !session.signedIn || !session.hasScope(SCOPE_ACCOUNT) {
+		Info.Printf("Rejecting unauthorized user with SID(%v)\n", session.sid)
+		return &Unauthorized{}
+	}
+
+	if workspaceId != 0 {
+		role, err := api.workspaceRole(session, workspaceId)
+		if err != nil {
+			return err
+		}
+		if !role.CanManage() {
+			Info.Printf("Rejecting webhook change in workspace %d by SID(%v)\n", workspaceId, session.sid)
+			return &Unauthorized{}
+		}
+	}
+	return nil
+}
+
+// Returns nil if the session can manage the webhook
+func (api *API) checkWebhookOwner(session *Session, webhookId int) error {
+	var userId, workspaceId sql.NullInt64
+	err := api.QueryRow("owner_from_webhookId", []any{webhookId}, &userId, &workspaceId)
+	if err == sql.ErrNoRows {
+		return &BadRequest{}
+	} else if err != nil {
+		Error.Println("Failed to get webhook owner", err)
+		return err
+	}
+
+	if workspaceId.Valid {
+		return api.checkWebhookAccess(session, int(workspaceId.Int64))
+	}
+
+	err = api.checkWebhookAccess(session, 0)
+	if err != nil {
+		return err
+	}
+	if int(userId.Int64) != session.userId {
+		return &BadRequest{} // Same as an unknown webhook
+	}
+	return nil
+}
+
+// Registers a webhook receiving the events of the personal links of the session's user, or of the workspace
+// if workspaceId isn't 0. Returns the secret signing the deliveries, which is only ever shown once
+func (api *API) createWebhook(session *Session, workspaceId int, endpoint string, events []string) (string, error) {
+	err := api.checkWebhookAccess(session, workspaceId)
+	if err != nil {
+		return "", err
+	}
+
+	// Webhooks make the server send requests, new accounts can't use them before proving who they are
+	err = api.requireVerifiedEmail(session)
+	if err != nil {
+		return "", err
+	}
+
+	parsed, err := url.Parse(endpoint)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" ||
+		len(endpoint) > WEBHOOK_URL_MAX_LENGTH || len(events) == 0 {
+		return "", &InvalidInput{}
+	}
+
+	for _, event := range events {
+		valid := false
+		for _, webhookEvent := range webhookEvents {
+			valid = valid || event == webhookEvent
+		}
+		if !valid {
+			return "", &InvalidInput{}
+		}
+	}
+
+	secretBytes := make([]byte, WEBHOOK_SECRET_BYTES)
+	_, err = rand.Read(secretBytes)
+	if err != nil {
+		Error.Println("Failed to generate webhook secret", err)
+		return "", err
+	}
+	secret := hex.EncodeToString(secretBytes)
+
+	var userId, workspace any = session.userId, nil
+	if workspaceId != 0 {
+		userId, workspace = nil, workspaceId
+	}
+
+	_, err = api.ExecRow("add_to_webhooks", userId, workspace, endpoint, secret, strings.Join(events, " "))
+	if err != nil {
+		Error.Println("Failed to save webhook", err)
+		return "", err
+	}
+
+	Info.Printf("UserID(%d) registered webhook %v for %v\n", session.userId, endpoint, events)
+	return secret, nil
+}
+
+// Gets the webhooks of the workspace, or the personal ones if workspaceId is 0
+func (api *API) getWebhooks(session *Session, workspaceId int) (res []WebhookData, err error) {
+	err = api.checkWebhookAccess(session, workspaceId)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows *sql.Rows
+	if workspaceId != 0 {
+		rows, err = api.Query("webhooks_from_workspaceId", workspaceId)
+	} else {
+		rows, err = api.Query("webhooks_from_userId", session.userId)
+	}
+	if err != nil {
+		Error.Println("Failed to get webhooks", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data WebhookData
+		var events string
+		err = rows.Scan(&data.Id, &data.Url, &events, &data.Created)
+		if err != nil {
+			break
+		}
+		data.Events = strings.Fields(events)
+		res = append(res, data)
+	}
+
+	return
+}
+
+// Deletes the webhook and its delivery log, pending deliveries are dropped
+func (api *API) deleteWebhook(session *Session, webhookId int) error {
+	err := api.checkWebhookOwner(session, webhookId)
+	if err != nil {
+		return err
+	}
+
+	err = api.Transaction(func(tx *sql.Tx) error {
+		for _, name := range []string{"delete_webhook_deliveries", "delete_from_webhooks"} {
+			stmt, err := api.TxStmt(tx, name)
+			if err != nil {
+				return err
+			}
+			_, err = stmt.Exec(webhookId)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		Error.Println("Failed to delete webhook", err)
+		return err
+	}
+
+	Info.Printf("UserID(%d) deleted webhook %d\n", session.userId, webhookId)
+	return nil
+}
+
+// Gets the latest deliveries of the webhook, newest first
+func (api *API) getWebhookDeliveries(session *Session, webhookId int) (res []DeliveryData, err error) {
+	err = api.checkWebhookOwner(session, webhookId)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := api.Query("deliveries_from_webhookId", webhookId, WEBHOOK_LOG_SIZE)
+	if err != nil {
+		Error.Println("Failed to get webhook deliveries", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data DeliveryData
+		var responseStatus sql.NullInt64
+		var deliveryError, nextAttempt sql.NullString
+		err = rows.Scan(&data.Id, &data.Event, &data.Status, &data.Attempts, &responseStatus, &deliveryError, &data.Created, &nextAttempt)
+		if err != nil {
+			break
+		}
+		data.ResponseStatus = int(responseStatus.Int64)
+		data.Error = deliveryError.String
+		if data.Status == DELIVERY_PENDING {
+			data.NextAttempt = nextAttempt.String
+		}
+		res = append(res, data)
+	}
+
+	return
+}
+
+// Queues a ping for the webhook and delivers it right away, returns the status answered by the endpoint
+func (api *API) sendTestWebhook(session *Session, webhookId int) (int, error) {
+	err := api.checkWebhookOwner(session, webhookId)
+	if err != nil {
+		return 0, err
+	}
+
+	payload, err := newWebhookPayload(EVENT_PING, map[string]any{"webhook": webhookId})
+	if err != nil {
+		return 0, err
+	}
+
+	// Leased from the start so the background worker leaves it alone
+	deliveryId, err := api.InsertRow("add_to_webhook_deliveries", webhookId, EVENT_PING, payload, int(WEBHOOK_LEASE.Seconds()))
+	if err != nil {
+		Error.Println("Failed to queue test webhook", err)
+		return 0, err
+	}
+
+	return api.attemptDelivery(deliveryId)
+}
+
+func newWebhookPayload(event string, data any) ([]byte, error) {
+	return json.Marshal(WebhookEvent{
+		Id:      uuid.NewString(),
+		Event:   event,
+		Created: time.Now().UTC().Format(time.RFC3339),
+		Data:    data,
+	})
+}
+
+// Queues the event for every webhook of the link's owner subscribed to it. Failures are logged,
+// they never fail the change which caused the event
+func (api *API) emitLinkEvent(event string, owner linkOwner, data any) {
+	if api.webhookClient == nil || (!owner.userId.Valid && !owner.workspaceId.Valid) {
+		return
+	}
+
+	rows, err := api.Query("webhooks_for_owner", owner.workspaceId, owner.userId)
+	if err != nil {
+		Error.Println("Failed to get webhooks of link owner", err)
+		return
+	}
+
+	var webhookIds []int
+	for rows.Next() {
+		var webhookId int
+		var events string
+		err = rows.Scan(&webhookId, &events)
+		if err != nil {
+			Error.Println("Failed to read webhook", err)
+			break
+		}
+		for _, subscribed := range strings.Fields(events) {
+			if subscribed == event {
+				webhookIds = append(webhookIds, webhookId)
+			}
+		}
+	}
+	rows.Close()
+
+	if len(webhookIds) == 0 {
+		return
+	}
+
+	payload, err := newWebhookPayload(event, data)
+	if err != nil {
+		Error.Println("Failed to encode webhook payload", err)
+		return
+	}
+
+	for _, webhookId := range webhookIds {
+		_, err = api.ExecRow("add_to_webhook_deliveries", webhookId, event, payload, 0)
+		if err != nil {
+			Error.Printf("Failed to queue %v for webhook %d, %v\n", event, webhookId, err)
+		}
+	}
+}
+
+// Sends the due deliveries with delay and purges the old delivery log, run in goroutine
+func (api *API) BackgroundDeliverWebhooks(delay time.Duration) {
+	var lastPurge time.Time
+	for ; ; time.Sleep(delay) {
+		if time.Since(lastPurge) > time.Hour {
+			affected, err := api.ExecRow("delete_old_webhook_deliveries", int(WEBHOOK_LOG_RETENTION.Seconds()))
+			if err != nil {
+				Error.Println("Failed to purge webhook deliveries", err)
+			} else if affected > 0 {
+				Info.Printf("Purged %d webhook deliveries\n", affected)
+			}
+			lastPurge = time.Now()
+		}
+
+		rows, err := api.Query("due_webhook_deliveries", WEBHOOK_BATCH_SIZE)
+		if err != nil {
+			Error.Println("Failed to get due webhook deliveries", err)
+			continue
+		}
+
+		var deliveryIds []int64
+		for rows.Next() {
+			var deliveryId int64
+			if rows.Scan(&deliveryId) == nil {
+				deliveryIds = append(deliveryIds, deliveryId)
+			}
+		}
+		rows.Close()
+
+		for _, deliveryId := range deliveryIds {
+			// Another instance may have claimed it in the meantime
+			claimed, err := api.ExecRow("claim_webhook_delivery", int(WEBHOOK_LEASE.Seconds()), deliveryId)
+			if err != nil || claimed == 0 {
+				continue
+			}
+			api.attemptDelivery(deliveryId)
+		}
+	}
+}
+
+// Exponential backoff after the given number of failed attempts
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := WEBHOOK_RETRY_BASE
+	for i := 1; i < attempts && delay < WEBHOOK_RETRY_MAX; i++ {
+		delay *= 2
+	}
+	if delay > WEBHOOK_RETRY_MAX {
+		delay = WEBHOOK_RETRY_MAX
+	}
+	return delay
+}
+
+// Signs the body like "sha256=<hex>" with the timestamp prepended, so a captured delivery can't be replayed later
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Posts a claimed delivery and records the outcome, returns the response status and why the attempt failed
+func (api *API) attemptDelivery(deliveryId int64) (int, error) {
+	var webhookId, attempts int
+	var event, endpoint, secret string
+	var payload []byte
+	err := api.QueryRow("webhook_delivery_from_deliveryId", []any{deliveryId}, &webhookId, &event, &payload, &attempts, &endpoint, &secret)
+	if err != nil {
+		Error.Printf("Failed to get webhook delivery %d, %v\n", deliveryId, err)
+		return 0, err
+	}
+
+	status, deliveryErr := api.postWebhook(deliveryId, event, endpoint, secret, payload)
+	attempts++
+
+	if deliveryErr == nil {
+		_, err = api.ExecRow("update_webhook_delivery_delivered", status, deliveryId)
+	} else {
+		message := deliveryErr.Error()
+		if len(message) > WEBHOOK_ERROR_MAX_LENGTH {
+			message = message[:WEBHOOK_ERROR_MAX_LENGTH]
+		}
+
+		var responseStatus any // NULL when no response was received
+		if status != 0 {
+			responseStatus = status
+		}
+
+		if attempts >= api.config.Webhooks.MaxAttempts {
+			Warning.Printf("Giving up webhook delivery %d to webhook %d after %d attempts, %v\n", deliveryId, webhookId, attempts, deliveryErr)
+			_, err = api.ExecRow("update_webhook_delivery_failed", responseStatus, message, deliveryId)
+		} else {
+			_, err = api.ExecRow("update_webhook_delivery_retry", responseStatus, message, int(webhookRetryDelay(attempts).Seconds()), deliveryId)
+		}
+	}
+	if err != nil {
+		Error.Printf("Failed to record webhook delivery %d, %v\n", deliveryId, err)
+	}
+
+	return status, deliveryErr
+}
+
+func (api *API) postWebhook(deliveryId int64, event string, endpoint string, secret string, payload []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "shr.me-webhooks")
+	req.Header.Set("X-Shr-Event", event)
+	req.Header.Set("X-Shr-Delivery", strconv.FormatInt(deliveryId, 10))
+	req.Header.Set("X-Shr-Timestamp", timestamp)
+	req.Header.Set("X-Shr-Signature", signWebhook(secret, timestamp, payload))
+
+	res, err := api.webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, WEBHOOK_RESPONSE_MAX_READ)) // Lets the connection be reused
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, errors.New(res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+func (api *API) handleWebhookCreate(w http.ResponseWriter, r *http.Request, session *Session) {
+	err := r.ParseForm()
+	if err != nil {
+		Warning.Println("Failed to parse form", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	workspaceId := 0
+	if workspace := r.PostForm.Get("workspace"); workspace != "" {
+		workspaceId, err = strconv.Atoi(workspace)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	secret, err := api.createWebhook(session, workspaceId, r.PostForm.Get("url"), r.PostForm["event"])
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	w.Write([]byte(secret))
+}
+
+func (api *API) handleWebhooks(w http.ResponseWriter, r *http.Request, session *Session) {
+	workspaceId, _ := strconv.Atoi(r.URL.Query().Get("workspace"))
+	res, err := api.getWebhooks(session, workspaceId)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (api *API) handleWebhookDelete(w http.ResponseWriter, r *http.Request, session *Session) {
+	webhookId, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = api.deleteWebhook(session, webhookId)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (api *API) handleWebhookDeliveries(w http.ResponseWriter, r *http.Request, session *Session) {
+	webhookId, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	res, err := api.getWebhookDeliveries(session, webhookId)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (api *API) handleWebhookTest(w http.ResponseWriter, r *http.Request, session *Session) {
+	webhookId, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	status, err := api.sendTestWebhook(session, webhookId)
+	switch err.(type) {
+	case nil:
+		w.Write([]byte(fmt.Sprintf("Delivered, the endpoint answered %d", status)))
+	case *Unauthorized, *BadRequest:
+		writeAPIError(w, err)
+	default:
+		// The endpoint failed rather than this server, the delivery is retried like any other
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("Delivery failed: " + err.Error()))
+	}
+}
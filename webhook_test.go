@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckWebhookAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"93.184.216.34:443", true},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", true},
+		{"100.63.255.255:80", true},
+		{"198.20.0.1:80", true},
+		{"127.0.0.1:80", false},
+		{"[::1]:80", false},
+		{"0.0.0.0:80", false},
+		{"10.1.2.3:80", false},
+		{"172.16.0.1:80", false},
+		{"192.168.1.1:80", false},
+		{"[fd00::1]:80", false},
+		{"[::ffff:10.1.2.3]:80", false},
+		{"169.254.169.254:80", false}, // Metadata services of cloud providers
+		{"[fe80::1]:80", false},
+		{"224.0.0.1:80", false},
+		{"100.64.0.1:80", false},
+		{"100.127.255.254:80", false},
+		{"198.18.0.1:80", false},
+		{"198.19.255.254:80", false},
+		{"localhost:80", false},
+		{"127.0.0.1", false},
+	}
+
+	for _, test := range tests {
+		if err := checkWebhookAddress(test.address); (err == nil) != test.allowed {
+			t.Errorf("Webhook to %v gives %v, want allowed %v", test.address, err, test.allowed)
+		}
+	}
+}
+
+func TestWebhookClientRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://169.254.169.254/", http.StatusFound)
+	}))
+	defer server.Close()
+
+	_, err := NewWebhookClient(time.Second, false).Get(server.URL)
+	if err == nil || !strings.Contains(err.Error(), "private address 127.0.0.1 refused") {
+		t.Errorf("Webhook to %v gives %v", server.URL, err)
+	}
+
+	res, err := NewWebhookClient(time.Second, true).Get(server.URL)
+	if err != nil {
+		t.Fatal("Webhook to a private address refused with AllowPrivateNetworks", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		t.Errorf("Webhook answered %v, the redirect was followed", res.StatusCode)
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	body := []byte(`{"event":"ping"}`)
+	want := "sha256=aa8efe37b751e71157c508c5ac4acb1e9fe5225db98355dfc00f4b680afbc447"
+	if signature := signWebhook("whsec_test", "1700000000", body); signature != want {
+		t.Errorf("Signature %v, want %v", signature, want)
+	}
+	if signWebhook("whsec_test", "1700000001", body) == want {
+		t.Error("Signature doesn't depend on the timestamp, deliveries can be replayed")
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, WEBHOOK_RETRY_BASE},
+		{1, WEBHOOK_RETRY_BASE},
+		{2, 2 * WEBHOOK_RETRY_BASE},
+		{3, 4 * WEBHOOK_RETRY_BASE},
+		{10, 512 * WEBHOOK_RETRY_BASE},
+		{11, WEBHOOK_RETRY_MAX},
+		{1000, WEBHOOK_RETRY_MAX}, // Doubling doesn't overflow
+	}
+
+	for _, test := range tests {
+		if delay := webhookRetryDelay(test.attempts); delay != test.want {
+			t.Errorf("Delay after %d attempts is %v, want %v", test.attempts, delay, test.want)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// Permission level of a user on a link or a workspace, higher roles include the lower ones
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleViewer
+	RoleEditor
+	RoleOwner
+)
+
+var roleNames = map[Role]string{
+	RoleNone:   "none",
+	RoleViewer: "viewer",
+	RoleEditor: "editor",
+	RoleOwner:  "owner",
+}
+
+func ParseRole(name string) (Role, error) {
+	for role, roleName := range roleNames {
+		if role != RoleNone && roleName == name {
+			return role, nil
+		}
+	}
+	return RoleNone, &InvalidInput{}
+}
+
+func (role Role) String() string {
+	return roleNames[role]
+}
+
+func (role Role) MarshalJSON() ([]byte, error) {
+	return json.Marshal(role.String())
+}
+
+func (role Role) CanView() bool {
+	return role >= RoleViewer
+}
+
+func (role Role) CanEdit() bool {
+	return role >= RoleEditor
+}
+
+func (role Role) CanManage() bool {
+	return role >= RoleOwner
+}
+
+// Creates a workspace owned by the session's user, returns its ID
+func (api *API) createWorkspace(session *Session, name string) (int, error) {
+	if !session.signedIn || !session.hasScope(SCOPE_ACCOUNT) {
+		Info.Printf("Rejecting unauthorized user with SID(%v)\n", session.sid)
+		return 0, &Unauthorized{}
+	}
+
+	if name == "" || len(name) > WORKSPACE_NAME_MAX_LENGTH {
+		return 0, &InvalidInput{}
+	}
+
+	err := api.requireVerifiedEmail(session)
+	if err != nil {
+		return 0, err
+	}
+
+	var workspaceId int64
+	err = api.Transaction(func(tx *sql.Tx) error {
+		stmt, err := api.TxStmt(tx, "add_to_workspaces")
+		if err != nil {
+			return err
+		}
+
+		res, err := stmt.Exec(name)
+		if err != nil {
+			return err
+		}
+
+		workspaceId, err = res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		stmt, err = api.TxStmt(tx, "add_to_workspace_members")
+		if err != nil {
+			return err
+		}
+
+		_, err = stmt.Exec(workspaceId, session.userId, RoleOwner.String())
+		return err
+	})
+	if err != nil {
+		Error.Println("Failed to create workspace", err)
+		return 0, err
+	}
+
+	Info.Printf("UserID(%d) created workspace %d\n", session.userId, workspaceId)
+	return int(workspaceId), nil
+}
+
+// Returns the role of the session's user in the workspace, RoleNone if they aren't a member
+func (api *API) workspaceRole(session *Session, workspaceId int) (Role, error) {
+	if !session.signedIn {
+		return RoleNone, nil
+	}
+
+	var roleName string
+	err := api.QueryRow("role_from_workspace_member", []any{workspaceId, session.userId}, &roleName)
+	if err == sql.ErrNoRows {
+		return RoleNone, nil
+	} else if err != nil {
+		Error.Println("Failed to get workspace role", err)
+		return RoleNone, err
+	}
+
+	return ParseRole(roleName)
+}
+
+// Returns the role of the session's user on a link, the creator of a personal link is its owner
+// and workspace links get the role of the user in the workspace
+func (api *API) linkRole(session *Session, shortUrl string) (Role, error) {
+	if !session.signedIn {
+		return RoleNone, nil
+	}
+
+	var userId, workspaceId sql.NullInt64
+	err := api.QueryRow("owner_from_shortUrl", []any{shortUrl}, &userId, &workspaceId)
+	if err == sql.ErrNoRows {
+		return RoleNone, &NoSuchLink{}
+	} else if err != nil {
+		Error.Printf("Failed to get owner of shortURL(%v), %v", shortUrl, err)
+		return RoleNone, err
+	}
+
+	if workspaceId.Valid {
+		return api.workspaceRole(session, int(workspaceId.Int64))
+	}
+
+	if userId.Valid && int(userId.Int64) == session.userId {
+		return RoleOwner, nil
+	}
+	return RoleNone, nil
+}
+
+// Adds the user named username to the workspace or changes their role, only owners can do it
+func (api *API) setWorkspaceMember(session *Session, workspaceId int, username string, role Role) error {
+	if !session.hasScope(SCOPE_ACCOUNT) {
+		return &Unauthorized{}
+	}
+
+	sessionRole, err := api.workspaceRole(session, workspaceId)
+	if err != nil {
+		return err
+	}
+	if !sessionRole.CanManage() {
+		Info.Printf("Rejecting workspace member change by SID(%v)\n", session.sid)
+		return &Unauthorized{}
+	}
+
+	var userId int
+	err = api.QueryRow("userId_from_username", []any{username}, &userId)
+	if err == sql.ErrNoRows {
+		return &NoSuchUser{}
+	} else if err != nil {
+		Error.Println("Failed to get userID", err)
+		return err
+	}
+
+	if userId == session.userId && role != RoleOwner {
+		err = api.checkOtherOwner(workspaceId)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = api.ExecRow("add_to_workspace_members", workspaceId, userId, role.String())
+	if err != nil {
+		Error.Println("Failed to set workspace member", err)
+		return err
+	}
+
+	Info.Printf("UserID(%d) is now %v of workspace %d\n", userId, role, workspaceId)
+	return nil
+}
+
+// Removes the user named username from the workspace, owners can remove anyone and members can leave
+func (api *API) removeWorkspaceMember(session *Session, workspaceId int, username string) error {
+	if !session.hasScope(SCOPE_ACCOUNT) {
+		return &Unauthorized{}
+	}
+
+	sessionRole, err := api.workspaceRole(session, workspaceId)
+	if err != nil {
+		return err
+	}
+	if sessionRole == RoleNone {
+		return &Unauthorized{}
+	}
+
+	var userId int
+	err = api.QueryRow("userId_from_username", []any{username}, &userId)
+	if err == sql.ErrNoRows {
+		return &NoSuchUser{}
+	} else if err != nil {
+		Error.Println("Failed to get userID", err)
+		return err
+	}
+
+	if userId != session.userId && !sessionRole.CanManage() {
+		Info.Printf("Rejecting workspace member removal by SID(%v)\n", session.sid)
+		return &Unauthorized{}
+	}
+
+	if userId == session.userId && sessionRole == RoleOwner {
+		err = api.checkOtherOwner(workspaceId)
+		if err != nil {
+			return err
+		}
+	}
+
+	affected, err := api.ExecRow("delete_from_workspace_members", workspaceId, userId)
+	if err != nil {
+		Error.Println("Failed to remove workspace member", err)
+		return err
+	}
+	if affected == 0 {
+		return &NoSuchUser{}
+	}
+	return nil
+}
+
+// Returns an error if the workspace would be left without owner when one of its owners leaves
+func (api *API) checkOtherOwner(workspaceId int) error {
+	var owners int
+	err := api.QueryRow("count_workspace_owners", []any{workspaceId}, &owners)
+	if err != nil {
+		Error.Println("Failed to count workspace owners", err)
+		return err
+	}
+
+	if owners < 2 {
+		Info.Printf("Rejecting removal of the last owner of workspace %d\n", workspaceId)
+		return &BadRequest{}
+	}
+	return nil
+}
+
+// Gets the workspaces the session's user is a member of
+func (api *API) getWorkspaces(session *Session) (res []WorkspaceData, err error) {
+	if !session.signedIn || !session.hasScope(SCOPE_LINKS_READ) {
+		return nil, &Unauthorized{}
+	}
+
+	rows, err := api.Query("workspaces_from_userId", session.userId)
+	if err != nil {
+		Error.Println("Failed to get workspaces", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data WorkspaceData
+		var roleName string
+		err = rows.Scan(&data.Id, &data.Name, &roleName)
+		if err != nil {
+			break
+		}
+		data.Role, _ = ParseRole(roleName)
+		res = append(res, data)
+	}
+
+	return
+}
+
+// Gets the members of a workspace the session's user is part of
+func (api *API) getWorkspaceMembers(session *Session, workspaceId int) (res []MemberData, err error) {
+	role, err := api.workspaceRole(session, workspaceId)
+	if err != nil {
+		return nil, err
+	}
+	if !role.CanView() {
+		return nil, &Unauthorized{}
+	}
+
+	rows, err := api.Query("members_from_workspaceId", workspaceId)
+	if err != nil {
+		Error.Println("Failed to get workspace members", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data MemberData
+		var roleName string
+		err = rows.Scan(&data.Username, &roleName)
+		if err != nil {
+			break
+		}
+		data.Role, _ = ParseRole(roleName)
+		res = append(res, data)
+	}
+
+	return
+}
+
+func (api *API) handleWorkspaceCreate(w http.ResponseWriter, r *http.Request, session *Session) {
+	err := r.ParseForm()
+	if err != nil {
+		Warning.Println("Failed to parse form", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	workspaceId, err := api.createWorkspace(session, r.PostForm.Get("name"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	w.Write([]byte(strconv.Itoa(workspaceId)))
+}
+
+func (api *API) handleWorkspaces(w http.ResponseWriter, r *http.Request, session *Session) {
+	res, err := api.getWorkspaces(session)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	resData, err := json.Marshal(res)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resData)
+}
+
+func (api *API) handleWorkspaceMembers(w http.ResponseWriter, r *http.Request, session *Session) {
+	workspaceId, err := strconv.Atoi(r.URL.Query().Get("workspace"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	res, err := api.getWorkspaceMembers(session, workspaceId)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	resData, err := json.Marshal(res)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resData)
+}
+
+func (api *API) handleWorkspaceMemberSet(w http.ResponseWriter, r *http.Request, session *Session) {
+	err := r.ParseForm()
+	if err != nil {
+		Warning.Println("Failed to parse form", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	workspaceId, err := strconv.Atoi(r.PostForm.Get("workspace"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	role, err := ParseRole(r.PostForm.Get("role"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	err = api.setWorkspaceMember(session, workspaceId, r.PostForm.Get("username"), role)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (api *API) handleWorkspaceMemberRemove(w http.ResponseWriter, r *http.Request, session *Session) {
+	workspaceId, err := strconv.Atoi(r.URL.Query().Get("workspace"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = api.removeWorkspaceMember(session, workspaceId, r.URL.Query().Get("username"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}